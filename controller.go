@@ -49,9 +49,20 @@
 package goshl
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/eleven-am/goshl/internal/domain"
@@ -75,25 +86,241 @@ type (
 
 	// Coordinator manages the distributed transcoding workflow. It handles job
 	// queuing across worker pools and notifies waiting clients when segments
-	// become available. For single-instance deployments, an in-memory implementation
-	// suffices. For distributed systems, consider Redis or a message queue.
+	// become available. For single-instance deployments, the memory package's
+	// Coordinator suffices. For distributed systems, consider Redis or a
+	// message queue.
 	Coordinator = domain.Coordinator
 
+	// QueueDepther may optionally be implemented by a Coordinator to report
+	// the number of queued jobs; see Controller.QueueDepth. An in-memory
+	// coordinator can return the length of its job channel.
+	QueueDepther = domain.QueueDepther
+
+	// ProgressNotifier may optionally be implemented by a Coordinator to
+	// receive the live progress of running transcoding jobs.
+	ProgressNotifier = domain.ProgressNotifier
+
+	// JobProgress reports the share of a running job's range encoded so far.
+	JobProgress = domain.JobProgress
+
+	// Clock supplies the timer behind SegmentTimeout. Tests can inject one
+	// whose channel they control to exercise timeouts without sleeping.
+	Clock = domain.Clock
+
+	// SourceOpener returns a fresh reader over a "pipe:" source; see
+	// Options.OpenSource.
+	SourceOpener = domain.SourceOpener
+
 	// PathGenerator creates URLs for HLS resources. These URLs are embedded in
 	// playlists and must be routable back to the appropriate Controller methods.
 	PathGenerator = domain.PathGenerator
 
+	// FMP4PathGenerator may optionally be implemented by a PathGenerator to
+	// control init segment (EXT-X-MAP) and .m4s segment URLs for fragmented
+	// MP4 renditions. Without it, URLs are derived from PathGenerator.Segment.
+	FMP4PathGenerator = domain.FMP4PathGenerator
+
+	// VideoCodec is the codec of transcoded video renditions.
+	VideoCodec = domain.VideoCodec
+
+	// AudioTier is one AAC rendition of the audio ladder; see
+	// Options.AudioTiers.
+	AudioTier = domain.AudioTier
+
+	// Accelerator identifies the hardware (or software) video encoder in
+	// use; see Controller.Accelerator.
+	Accelerator = domain.Accelerator
+
+	// HWAccelConfig is the encoder configuration selected for transcodes:
+	// the accelerator, its ffmpeg encoder and the decode and encode flags.
+	HWAccelConfig = domain.HWAccelConfig
+
+	// LadderMode selects how video ladder tiers are sized; see Options.LadderMode.
+	LadderMode = domain.LadderMode
+
+	// RenditionNaming selects how video renditions are named; see
+	// Options.RenditionNaming.
+	RenditionNaming = domain.RenditionNaming
+
+	// Container identifies the segment packaging of a rendition.
+	Container = domain.Container
+
+	// Artifact identifies a kind of response the controller serves; see
+	// Controller.ContentType and Controller.CacheDuration.
+	Artifact = domain.Artifact
+
 	// StreamType identifies the type of media stream (video or audio).
 	StreamType = domain.StreamType
 
+	// Segment is one entry of a rendition's segment layout, with its start,
+	// end and duration in seconds; see Controller.RecomputeSegments.
+	Segment = domain.Segment
+
 	// SegmentData encapsulates information about a specific media segment.
 	SegmentData = domain.SegmentData
 
+	// ThumbnailData identifies a cached single-frame thumbnail.
+	ThumbnailData = domain.ThumbnailData
+
+	// KeyframeStrategy selects how keyframes are detected when probing.
+	KeyframeStrategy = domain.KeyframeStrategy
+
+	// ImageOptions selects the format and quality of extracted images.
+	ImageOptions = domain.ImageOptions
+
+	// ImageFormat is the encoding of extracted images.
+	ImageFormat = domain.ImageFormat
+
+	// SubtitleFormat selects how Subtitle delivers a track.
+	SubtitleFormat = domain.SubtitleFormat
+
+	// SubtitleOptions are per-request settings for SubtitleWith.
+	//
+	//   - Format: SubtitleFormatVTT (the default when empty) or
+	//     SubtitleFormatASS
+	//   - Offset: moves every cue by this many seconds to fix subtitles out of
+	//     sync with the audio; positive values show them later. Cues pushed
+	//     before zero are dropped. The offset is rounded to milliseconds and
+	//     may not exceed the source duration either way; each offset is
+	//     cached separately.
+	SubtitleOptions = domain.SubtitleOptions
+
+	// SubtitleTrack describes one subtitle track of a source; see
+	// Controller.SubtitleTracks.
+	SubtitleTrack = domain.SubtitleTrack
+
+	// Bundle gathers a source's playlists and the URLs of its segments,
+	// subtitles and sprites for offline caching; see Controller.Manifest.
+	Bundle = domain.Bundle
+
+	// BundleVariant is one variant playlist of a Bundle.
+	BundleVariant = domain.BundleVariant
+
+	// BundleSubtitle is one subtitle track of a Bundle.
+	BundleSubtitle = domain.BundleSubtitle
+
+	// Program describes one program (service) of a multi-program MPEG-TS;
+	// see Controller.Programs.
+	Program = domain.Program
+
+	// Metadata is what probing learns about a source: its duration,
+	// keyframe times and streams. See Options.Probe.
+	Metadata = domain.Metadata
+
+	// VideoStream describes the video stream of a source.
+	VideoStream = domain.VideoStream
+
+	// AudioStream describes one audio stream of a source.
+	AudioStream = domain.AudioStream
+
+	// SubtitleStream describes one subtitle stream of a source.
+	SubtitleStream = domain.SubtitleStream
+
+	// SegmentWritePolicy decides whether an existing segment is overwritten.
+	SegmentWritePolicy = domain.SegmentWritePolicy
+
+	// SegmentChecksummer stores segment checksums for VerifySegments.
+	SegmentChecksummer = domain.SegmentChecksummer
+
+	// SegmentSizer reports segment sizes without reading the segments.
+	SegmentSizer = domain.SegmentSizer
+
+	// KeyframeStore supplies precomputed keyframe sidecars.
+	KeyframeStore = domain.KeyframeStore
+
+	// ThumbnailStore caches Thumbnail frames.
+	ThumbnailStore = domain.ThumbnailStore
+
+	// PosterStore caches Poster frames.
+	PosterStore = domain.PosterStore
+
+	// RawProbeStore caches RawProbe output.
+	RawProbeStore = domain.RawProbeStore
+
+	// SegmentFailureStore keeps failure records for MaxSegmentRetries and
+	// GapFailedSegments.
+	SegmentFailureStore = domain.SegmentFailureStore
+
+	// InitSegmentStore holds the init segments of fMP4 renditions.
+	InitSegmentStore = domain.InitSegmentStore
+
+	// SubtitleASSStore caches ASS/SSA subtitle tracks.
+	SubtitleASSStore = domain.SubtitleASSStore
+
 	// SegmentStatus represents the processing state of a segment.
 	SegmentStatus = domain.SegmentStatus
 
 	// Job represents a transcoding task for a range of segments.
 	Job = domain.Job
+
+	// JobStats reports how long a transcoding job took and its encode speed
+	// relative to realtime.
+	JobStats = domain.JobStats
+
+	// VideoRendition describes a single video quality level in the ladder.
+	VideoRendition = domain.VideoRendition
+
+	// AudioRendition describes a single audio track variant.
+	AudioRendition = domain.AudioRendition
+
+	// ClientCapabilities describes what a requesting client can play. It is
+	// used by MasterPlaylistFor to advertise only compatible renditions.
+	//
+	//   - MinHeight: drop video renditions shorter than this (0 = no limit)
+	//   - MaxHeight: drop video renditions taller than this (0 = no limit)
+	//   - MaxBitrate: drop video renditions above this bitrate (0 = no limit)
+	//   - AC3, EAC3: advertise the matching audio passthrough renditions
+	//   - HEVC, VP9: advertise video renditions in those codecs (otherwise
+	//     only H.264 renditions are listed, unless no other codec exists)
+	ClientCapabilities = domain.ClientCapabilities
+
+	// MasterOptions are per-request settings for MasterPlaylistWith.
+	//
+	//   - Capabilities: when set, only renditions the client can play are listed
+	//   - StartOffset: emits EXT-X-START with this TIME-OFFSET in seconds
+	//     (negative values count from the end; 0 omits the tag)
+	//   - NativeOnly: lists a single video rendition at the source resolution
+	//     (the direct-stream one when available) instead of the whole ladder,
+	//     for clients on networks that need no adaptive switching. The other
+	//     renditions remain addressable by name.
+	//   - Muxed: lists each video rendition with the default audio rendition
+	//     muxed into its segments, named like "720p+aac_stereo", and no
+	//     EXT-X-MEDIA audio group, for players that cannot handle separate
+	//     audio. Muxed segments are stored separately from video-only ones.
+	MasterOptions = domain.MasterOptions
+
+	// VariantOptions are per-request settings for VariantPlaylistWith.
+	//
+	//   - StartOffset: emits EXT-X-START with this TIME-OFFSET in seconds
+	//     (negative values count from the end; 0 omits the tag)
+	//   - ProgramDateTime: when non-zero, each segment gets an
+	//     EXT-X-PROGRAM-DATE-TIME of this base time plus the cumulative
+	//     duration of the preceding segments
+	//   - TargetDuration: when non-zero and different from
+	//     Options.TargetDuration, cuts this playlist's segments at this target
+	//     instead. Segment boundaries and indices then differ from the default
+	//     layout, so segment URLs address the rendition as "<name>@<target>"
+	//     (e.g. "720p@2") and those segments are transcoded and stored
+	//     separately. Pass that name back to Segment unchanged. The target
+	//     is rounded to milliseconds and must lie between 1 and 30 seconds.
+	VariantOptions = domain.VariantOptions
+
+	// ValidateOptions enables optional checks in ValidatePlaylistWith.
+	//
+	//   - UniqueSegmentURIs: rejects a media playlist that lists a segment
+	//     URI twice. RFC 8216 allows this, but for goshl's playlists it
+	//     usually means a PathGenerator ignores an argument.
+	ValidateOptions = domain.ValidateOptions
+
+	// AudioGroupPolicy controls how audio renditions are assigned to
+	// EXT-X-MEDIA groups in the master playlist and which rendition is
+	// the default within each group. The zero value places every rendition
+	// in a single "audio" group whose default follows the source's default
+	// audio track, falling back to aac_stereo. Set InlineSingle to list a
+	// source with a single audio rendition as muxed variants instead, for
+	// players (notably some older smart TVs) that fail on a one-track
+	// EXT-X-MEDIA group.
+	AudioGroupPolicy = domain.AudioGroupPolicy
 )
 
 const (
@@ -102,38 +329,264 @@ const (
 
 	// StreamAudio represents an audio stream.
 	StreamAudio = domain.StreamAudio
+
+	// KeyframesFromPackets detects keyframes from packet flags (the default).
+	KeyframesFromPackets = domain.KeyframesFromPackets
+
+	// KeyframesFromFrames detects keyframes by decoding I frames.
+	KeyframesFromFrames = domain.KeyframesFromFrames
+
+	// ImageJPEG encodes images as JPEG (the default).
+	ImageJPEG = domain.ImageJPEG
+
+	// ImageWebP encodes images as WebP. Requires ffmpeg built with libwebp.
+	ImageWebP = domain.ImageWebP
+
+	// SegmentWriteOverwrite replaces an existing segment (the default).
+	SegmentWriteOverwrite = domain.SegmentWriteOverwrite
+
+	// SegmentWriteSkipExisting keeps an existing segment and drops the new one.
+	SegmentWriteSkipExisting = domain.SegmentWriteSkipExisting
+
+	// SubtitleFormatVTT converts a subtitle track to WebVTT.
+	SubtitleFormatVTT = domain.SubtitleFormatVTT
+
+	// SubtitleFormatASS returns an ASS/SSA subtitle track unconverted.
+	SubtitleFormatASS = domain.SubtitleFormatASS
+
+	// LadderByHeight sizes each ladder tier by a fixed height.
+	LadderByHeight = domain.LadderByHeight
+
+	// LadderByPixels sizes each ladder tier by the pixel area of its 16:9
+	// equivalent, fitted to the source aspect ratio.
+	LadderByPixels = domain.LadderByPixels
+
+	// NameByHeight names video renditions by tier, such as "1080p".
+	NameByHeight = domain.NameByHeight
+
+	// NameWithBitrate appends the bitrate, such as "1080p_5000k".
+	NameWithBitrate = domain.NameWithBitrate
+
+	// NameWithCodec appends the output codec, such as "1080p_h264".
+	NameWithCodec = domain.NameWithCodec
+
+	// VideoCodecH264 encodes transcoded renditions as H.264 (the default).
+	VideoCodecH264 = domain.VideoCodecH264
+
+	// VideoCodecVP9 encodes transcoded renditions as VP9 in fragmented MP4.
+	VideoCodecVP9 = domain.VideoCodecVP9
+
+	// VideoCodecHEVC encodes transcoded renditions as HEVC in fragmented
+	// MP4, tagged hvc1.
+	VideoCodecHEVC = domain.VideoCodecHEVC
+
+	// AccelNone is software encoding.
+	AccelNone = domain.AccelNone
+
+	// AccelCUDA is NVIDIA NVENC.
+	AccelCUDA = domain.AccelCUDA
+
+	// AccelVideoToolbox is Apple VideoToolbox.
+	AccelVideoToolbox = domain.AccelVideoToolbox
+
+	// AccelVAAPI is VA-API on Linux (Intel and AMD).
+	AccelVAAPI = domain.AccelVAAPI
+
+	// AccelQSV is Intel Quick Sync Video.
+	AccelQSV = domain.AccelQSV
+
+	// ContainerTS is MPEG-TS segment packaging (".ts"), the default.
+	ContainerTS = domain.ContainerTS
+
+	// ContainerFMP4 is fragmented MP4 packaging (".m4s" plus an init segment).
+	ContainerFMP4 = domain.ContainerFMP4
+
+	// ArtifactMasterPlaylist is the response of MasterPlaylist.
+	ArtifactMasterPlaylist = domain.ArtifactMasterPlaylist
+
+	// ArtifactVariantPlaylist is the response of VariantPlaylist.
+	ArtifactVariantPlaylist = domain.ArtifactVariantPlaylist
+
+	// ArtifactSegment is an MPEG-TS segment from Segment. Container's
+	// SegmentArtifact picks between it and ArtifactFMP4Segment.
+	ArtifactSegment = domain.ArtifactSegment
+
+	// ArtifactFMP4Segment is a fragmented MP4 segment from Segment.
+	ArtifactFMP4Segment = domain.ArtifactFMP4Segment
+
+	// ArtifactInitSegment is the response of InitSegment.
+	ArtifactInitSegment = domain.ArtifactInitSegment
+
+	// ArtifactSubtitleVTT is a WebVTT subtitle track from Subtitle.
+	ArtifactSubtitleVTT = domain.ArtifactSubtitleVTT
+
+	// ArtifactSubtitleASS is an ASS/SSA subtitle track from Subtitle.
+	ArtifactSubtitleASS = domain.ArtifactSubtitleASS
+
+	// ArtifactSpriteVTT is the response of SpriteVTT.
+	ArtifactSpriteVTT = domain.ArtifactSpriteVTT
+
+	// ArtifactSprite is a sprite sheet from Sprite.
+	ArtifactSprite = domain.ArtifactSprite
+
+	// ArtifactThumbnail is the response of Thumbnail.
+	ArtifactThumbnail = domain.ArtifactThumbnail
+
+	// ArtifactPoster is the response of Poster.
+	ArtifactPoster = domain.ArtifactPoster
 )
 
+// ErrRenditionNotFound is returned when a requested rendition name is not part
+// of the ladder generated for the source.
+var ErrRenditionNotFound = errors.New("rendition not found")
+
+// ErrUnknownDuration is returned, wrapped, when a source reports no duration
+// (ffprobe's "N/A") and none can be derived from its streams or keyframes.
+var ErrUnknownDuration = probe.ErrUnknownDuration
+
+// ErrSegmentFailed is returned, wrapped, by Segment once a segment has failed
+// MaxSegmentRetries times.
+var ErrSegmentFailed = errors.New("segment failed")
+
+// ErrSegmentCorrupt is returned, wrapped, by Segment when VerifySegments is
+// set and a stored segment does not match its stored checksum. Delete the
+// segment from storage to have the next request transcode it again.
+var ErrSegmentCorrupt = errors.New("segment checksum mismatch")
+
+// ErrSpriteCancelled is returned by SpriteVTT and Sprite to every caller
+// waiting on a sprite generation stopped with CancelSprite.
+var ErrSpriteCancelled = misc.ErrSpriteCancelled
+
+// ErrQueueDepthUnsupported is returned by QueueDepth when the Coordinator does
+// not implement QueueDepther.
+var ErrQueueDepthUnsupported = errors.New("coordinator does not report queue depth")
+
 // Options configures the Controller behavior and dependencies.
 type Options struct {
 	// Storage is required. Handles persistence of metadata, segments, and assets.
 	Storage Storage
 
 	// Coordinator is required. Manages job distribution and segment notifications.
+	// The Controller owns it: Stop calls Coordinator.Close unless
+	// KeepCoordinatorOpen is set.
 	Coordinator Coordinator
 
+	// KeepCoordinatorOpen leaves the Coordinator open on Stop, for callers
+	// that share it between controllers or close it themselves.
+	// Default: false.
+	KeepCoordinatorOpen bool
+
 	// PathGen is required. Generates URLs for playlists and segments.
 	PathGen PathGenerator
 
+	// BaseURL is prefixed to every URL PathGen returns, so playlists and
+	// sprite VTTs carry absolute URLs while PathGen keeps returning paths.
+	// Exactly one slash is kept at the join, and URLs PathGen already makes
+	// absolute are left alone. Sprite VTTs are cached with their URLs, so
+	// changing BaseURL does not rewrite those already generated. It must
+	// have a scheme and host ("https://cdn.example.com/hls") or start with
+	// "/".
+	// Default: "" (URLs as PathGen returns them).
+	BaseURL string
+
 	// HWAccel enables hardware-accelerated encoding when available.
 	// Automatically detects NVENC (NVIDIA) or VideoToolbox (Apple).
 	// Falls back to software encoding if no hardware support is found.
 	HWAccel bool
 
+	// DetectTimeout bounds the ffmpeg runs NewController makes to detect
+	// hardware encoders and optional encoders such as libfdk_aac, so an
+	// ffmpeg that stalls (for example on a broken GPU driver) cannot hang
+	// startup. On timeout, software encoding is used. Default: 10 seconds.
+	DetectTimeout time.Duration
+
+	// HWEncodeSessions caps how many hardware-encoded jobs run at once.
+	// Consumer NVIDIA GPUs allow only a few simultaneous NVENC sessions
+	// (often 3 to 5) and fail jobs beyond that, so set this at or below
+	// your GPU's limit when VideoPoolSize is higher. Hardware jobs then run
+	// on that many dedicated workers, alongside the VideoPoolSize workers,
+	// which queue up to as many more for them rather than wait, so a few
+	// queued hardware jobs do not hold up direct-stream and software jobs.
+	// Beyond that the workers wait and jobs stay in the Coordinator.
+	// Default: 0 (no cap).
+	HWEncodeSessions int
+
+	// VideoCodec selects the codec of transcoded video renditions.
+	// VideoCodecVP9 encodes with libvpx-vp9 (vp9_qsv with HWAccel on Intel
+	// QSV) and packages segments as fragmented MP4, whose init segments are
+	// served by InitSegment; progressive Stream output is WebM.
+	// VideoCodecHEVC encodes with the accelerator's HEVC encoder, or
+	// libx265, also into fragmented MP4.
+	// Direct-stream renditions are unaffected. Default: VideoCodecH264.
+	VideoCodec VideoCodec
+
+	// TierCodecs overrides VideoCodec for single ladder tiers, keyed by
+	// nominal height, e.g. {480: VideoCodecH264} to keep an H.264 fallback
+	// in an HEVC ladder. The master playlist then mixes codecs, each
+	// variant with its own CODECS attribute.
+	// Default: nil (every tier uses VideoCodec).
+	TierCodecs map[int]VideoCodec
+
 	// SegmentTimeout is the maximum time to wait for a segment to be transcoded.
 	// Default: 30 seconds.
 	SegmentTimeout time.Duration
 
+	// Clock times SegmentTimeout.
+	// Default: the system clock.
+	Clock Clock
+
 	// TargetDuration is the target HLS segment duration in seconds.
-	// Actual duration varies based on keyframe positions.
+	// Actual duration varies based on keyframe positions. Changing it changes
+	// which source range every segment index covers, so cached segments cut
+	// at the old target no longer match new playlists. A single playlist can
+	// use another target via VariantOptions.TargetDuration.
 	// Default: 6.0 seconds.
 	TargetDuration float64
 
+	// AudioTargetDuration gives audio renditions their own segment target,
+	// e.g. 2 seconds for music scrubbing. Audio segments are then cut on a
+	// fixed grid of this length instead of at video keyframes, so they no
+	// longer line up with video segments, and audio-only sources can be
+	// segmented at all. Changing it invalidates cached audio segments like
+	// TargetDuration does for video.
+	// Default: 0 (audio follows TargetDuration and the video keyframes).
+	AudioTargetDuration float64
+
+	// JobTimeout bounds how long a single transcoding job may run. A job that
+	// exceeds it has its ffmpeg process killed and any segments it did not
+	// produce are reported as errors to waiting clients.
+	// Default: 5 minutes.
+	JobTimeout time.Duration
+
+	// UploadConcurrency is how many finished segments a job may write to
+	// Storage at once while ffmpeg keeps encoding, so slow object storage
+	// does not hold up the encoder. Storage must allow concurrent writes.
+	// Default: 4.
+	UploadConcurrency int
+
+	// MaxSegmentSize is a sanity limit in bytes on a single transcoded
+	// segment. A job that produces a larger one (typically a bad bitrate
+	// setting or encoder runaway) is stopped, as soon as the segment it is
+	// writing passes the limit, and its unproduced segments are reported as
+	// errors instead of being stored.
+	// Default: 0 (no limit).
+	MaxSegmentSize int64
+
 	// SegmentsPerJob is the number of segments transcoded per job.
 	// Higher values improve throughput but increase latency for first segment.
 	// Default: 10.
 	SegmentsPerJob int
 
+	// OverlapSegments is how many segments before its range a video job
+	// starts from, discarding their output. A direct stream can only start
+	// at a source keyframe, and the overlap lets it settle before the job's
+	// first segment, so playback crossing a SegmentsPerJob boundary does not
+	// drop or repeat a GOP. Raise it for sources with long or irregular
+	// GOPs; each extra segment costs a little more work per job. Negative
+	// disables the overlap.
+	// Default: 1.
+	OverlapSegments int
+
 	// VideoPoolSize is the number of concurrent video transcoding workers.
 	// Default: 2.
 	VideoPoolSize int
@@ -141,18 +594,303 @@ type Options struct {
 	// AudioPoolSize is the number of concurrent audio transcoding workers.
 	// Default: 4.
 	AudioPoolSize int
+
+	// AccurateSeek places -ss after -i for transcoded renditions so segment
+	// starts are frame accurate. This avoids a few frames of wrong content at
+	// segment boundaries at the cost of decoding from the start of the input,
+	// which makes jobs late in long sources noticeably slower to start.
+	// Direct-stream renditions always seek to the keyframe.
+	// Default: false (fast keyframe seek).
+	AccurateSeek bool
+
+	// SegmentTimeDelta is passed to ffmpeg's segment muxer as
+	// -segment_time_delta. Raise it if segments on some sources split one
+	// frame late. Negative passes 0.
+	// Default: 0.05.
+	SegmentTimeDelta float64
+
+	// MuxDelay sets ffmpeg's -muxdelay in seconds. Default: 0.
+	MuxDelay float64
+
+	// MuxPreload sets ffmpeg's -muxpreload in seconds. When zero, the flag
+	// is omitted and ffmpeg's own default applies.
+	MuxPreload float64
+
+	// HEAAC adds a low-bitrate HE-AAC stereo rendition ("aac_he_stereo",
+	// CODECS mp4a.40.5) for constrained clients. It requires an ffmpeg build
+	// with libfdk_aac; NewController checks for the encoder and leaves the
+	// rendition out if it is unavailable.
+	HEAAC bool
+
+	// AudioTiers replaces the AAC transcode renditions of the audio ladder,
+	// for example with a 64 kbps stereo tier for constrained clients and a
+	// 256 kbps one for quality. Stereo and mono tiers are listed first, in
+	// order, and the first is what players start on; tiers with more than
+	// two channels follow and are only offered for sources with at least
+	// that many channels. Passthrough and HE-AAC renditions are unaffected.
+	// Names must be unique and must not contain "+" or "@". Changing the
+	// tiers changes which names resolve, so use the same tiers on every
+	// replica. Default: nil (128 kbps "aac_stereo", 384 kbps 5.1
+	// "aac_surround" and 512 kbps 7.1 "aac_71").
+	AudioTiers []AudioTier
+
+	// MaxHeight caps the generated video ladder: tiers taller than the cap
+	// are not produced, and a source above it is transcoded down rather than
+	// direct streamed. Master playlists, variants and segments all use the
+	// capped ladder. Default: 0 (no cap).
+	MaxHeight int
+
+	// LadderMode selects how video tiers are sized. LadderByHeight fixes
+	// each tier's height (1080p is 1080 lines tall), which over-produces for
+	// ultrawide sources and under-produces for portrait ones. LadderByPixels
+	// instead gives each tier the pixel area of its 16:9 equivalent, so a
+	// 2.39:1 film's 1080p tier is about 2226x932 and a 9:16 short's is
+	// 1080x1920. Tier names are unchanged. Default: LadderByHeight.
+	LadderMode LadderMode
+
+	// RenditionNaming selects how video renditions are named. Names are
+	// per source, so two sources of the same height both have a "1080p";
+	// NameWithBitrate ("1080p_5000k") or NameWithCodec ("1080p_h264") tell
+	// them apart in logs and analytics. Changing it renames every rendition,
+	// so segments cached under the old names are no longer used.
+	// Default: NameByHeight.
+	RenditionNaming RenditionNaming
+
+	// SkipBlackFrames makes Thumbnail and Poster use the first frame at or
+	// after the chosen time that is not mostly black (ffmpeg's blackframe
+	// filter), falling back to the plain frame if none is found. Sprites are
+	// unaffected. Default: false.
+	SkipBlackFrames bool
+
+	// SpriteImage, ThumbnailImage and PosterImage choose the image format
+	// and quality for sprite sheets, Thumbnail and Poster respectively.
+	// JPEG quality is ffmpeg's qscale, 2 (best) to 31 (smallest); WebP
+	// quality is 0 (smallest) to 100 (best). NewController panics on values
+	// outside those ranges. Default: JPEG at qscale 5 (WebP defaults to 75).
+	SpriteImage    ImageOptions
+	ThumbnailImage ImageOptions
+	PosterImage    ImageOptions
+
+	// ConstantFrameRate outputs every transcoded rendition at a constant
+	// frame rate (ffmpeg -r with -fps_mode cfr), which makes switching
+	// between renditions smoother. The rate is the source's, or MaxFrameRate
+	// if that is lower; NTSC rates are passed exactly (30000/1001, not
+	// 29.970). Forced keyframes are placed on the constant-rate output, so
+	// they still land on segment boundaries. Direct-stream renditions keep
+	// the source timing. Variable frame rate sources always get constant-rate
+	// transcodes. Default: false.
+	ConstantFrameRate bool
+
+	// MaxFrameRate caps the output rate when ConstantFrameRate is set, e.g.
+	// 30 to halve the frame rate of 60fps sources. Default: 0 (no cap).
+	MaxFrameRate float64
+
+	// UpscaleHeights adds the listed ladder tiers (2160, 1080, 720, 480,
+	// 360) even when they are taller than the source, for CDNs or players
+	// that expect a consistent ladder. They are transcoded, marked
+	// VideoRendition.Upscaled, and still subject to MaxHeight. Default: nil
+	// (never upscale).
+	UpscaleHeights []int
+
+	// DisableDirectStream transcodes every video rendition, even one that
+	// matches the source, as an escape hatch for clients that have trouble
+	// with copied segments. Audio passthrough is unaffected. Default: false.
+	DisableDirectStream bool
+
+	// DirectStreamCodecs lists the source video codecs, by ffprobe name, that
+	// may be direct streamed when a rendition matches the source height.
+	// Only list codecs every client can play; HEVC direct streams are
+	// packaged as fragmented MP4, the rest as MPEG-TS. Releases without
+	// TierCodecs packaged HEVC direct streams as MPEG-TS, so delete their
+	// stored indexes and segments when upgrading. Default: h264 only; an
+	// empty non-nil slice disables direct stream.
+	DirectStreamCodecs []string
+
+	// ScaleFlags selects the downscaling algorithm for transcodes, as a
+	// libswscale flag name: "lanczos" and "bicubic" are sharper than the
+	// default at some CPU cost. Software scaling uses it directly, NVENC's
+	// scale_cuda maps neighbor, bilinear, bicubic and lanczos to its own
+	// algorithms, and other hardware scalers ignore it. NewController
+	// panics on unknown names. Default: "" (the scaler's default).
+	ScaleFlags string
+
+	// Denoise and Sharpen add ffmpeg filters to transcodes of low-quality
+	// sources, e.g. "hqdn3d" for a light denoise and "unsharp=5:5:0.5" for
+	// a light sharpen. The chain is denoise, scale, sharpen. Direct-stream
+	// renditions are untouched, and accelerators that keep frames on the
+	// GPU (NVENC, QSV, VAAPI) skip both. Default: "" (off).
+	Denoise string
+	Sharpen string
+
+	// KeyframeInterval adds periodic forced keyframes, in seconds, inside
+	// each segment of a transcode. Keyframes are always forced at segment
+	// starts so boundaries stay aligned across renditions. Default: 0
+	// (segment starts only).
+	KeyframeInterval float64
+
+	// SceneCutKeyframes lets the encoder also place keyframes at scene
+	// changes, which improves quality at the same bitrate. When false,
+	// scene cut detection is switched off for x264 (-sc_threshold 0), x265
+	// (scenecut=0) and NVENC (-no-scenecut 1), so only the forced keyframes
+	// are placed. Other encoders keep their defaults either way.
+	// Default: false.
+	SceneCutKeyframes bool
+
+	// TwoPass encodes transcoded video in two passes (an analysis pass, then
+	// the real encode) for better quality at the same bitrate. It roughly
+	// doubles encode time, so it suits pre-warming a library rather than
+	// on-demand playback. Only software encoding supports it; hardware
+	// accelerated jobs ignore it. Default: false.
+	TwoPass bool
+
+	// FastStart encodes the first job of each video rendition, the one
+	// holding segment 0, with a faster encoder preset and without TwoPass,
+	// so playback starts sooner. Every later job is encoded normally.
+	//
+	// The whole first job is affected, i.e. the first SegmentsPerJob
+	// segments, and those segments are stored like any other: they keep
+	// their lower quality until deleted. Only libx264, libx265 and NVENC
+	// have a faster preset to switch to; VideoToolbox, QSV, VA-API and
+	// libvpx-vp9 already run at their fastest settings, so with them
+	// FastStart only skips TwoPass, which hardware encoders ignore anyway.
+	// Default: false.
+	FastStart bool
+
+	// SegmentWritePolicy decides what happens when overlapping jobs both
+	// produce a segment: SegmentWriteOverwrite replaces it, which requires
+	// Storage.WriteSegment to be atomic; SegmentWriteSkipExisting checks
+	// SegmentExists first and keeps the stored copy, so a segment is never
+	// rewritten while it may be served. Default: SegmentWriteOverwrite.
+	SegmentWritePolicy SegmentWritePolicy
+
+	// GapFailedSegments makes variant playlists tag segments that have
+	// failed MaxSegmentRetries times with EXT-X-GAP, so players skip them
+	// instead of stalling; a segment that can still be retried is listed
+	// normally. It requires MaxSegmentRetries. Failed segments are read
+	// through SegmentFailureStore in one lookup per playlist request;
+	// without it no segment is marked. Default: false.
+	GapFailedSegments bool
+
+	// MaxSegmentRetries bounds how many failed jobs a segment may have before
+	// Segment stops enqueueing work for it and returns ErrSegmentFailed with
+	// the stored error. Clear the record with ResetSegmentError once the
+	// cause is fixed. It has no effect unless Storage implements
+	// SegmentFailureStore. Default: 0 (retry on every request).
+	MaxSegmentRetries int
+
+	// VerifySegments stores a SHA-256 checksum beside every segment and
+	// checks it whenever Segment reads the segment back, returning
+	// ErrSegmentCorrupt on a mismatch. Storage must implement
+	// SegmentChecksummer. Segments stored without a checksum are served
+	// unverified. With SegmentWriteOverwrite, an overlapping job can rewrite
+	// a segment between its checksum and its data, so a read in that window
+	// may fail; SegmentWriteSkipExisting avoids this. Default: false.
+	VerifySegments bool
+
+	// PrewarmFirstSegment makes MasterPlaylist enqueue the first job of the
+	// first listed video rendition and the default audio rendition, so
+	// segment 0 is ready or in progress by the time a player asks for it.
+	// While that job runs, Segment requests in its range wait for it instead
+	// of enqueueing a duplicate. Default: false.
+	PrewarmFirstSegment bool
+
+	// OnSegmentReady is called after a segment has been written to storage
+	// and announced via the Coordinator. It runs in its own goroutine so it
+	// never blocks transcoding; errors and retries are the caller's concern.
+	OnSegmentReady func(info SegmentData)
+
+	// OnJobComplete is called after a transcoding job finishes, whether or
+	// not every segment in its range was produced. Runs in its own goroutine.
+	OnJobComplete func(job Job)
+
+	// OnJobStats is called with the wall time and realtime speed of every
+	// transcoding job that ran to completion, for capacity metrics. A speed
+	// below 1 means transcoding is slower than playback; such jobs are also
+	// logged through Logger. Runs in its own goroutine.
+	OnJobStats func(stats JobStats)
+
+	// Logger receives goshl's diagnostics, such as a hardware detection
+	// timeout, corrections made to probed metadata, hardware encodes
+	// retried in software, jobs slower than realtime and prewarm jobs that
+	// could not be enqueued.
+	// Default: discards everything.
+	Logger *slog.Logger
+
+	// AudioGroups controls audio GROUP-ID assignment and default selection in
+	// the master playlist. For example, grouping by codec lets AAC and AC3
+	// clients each pick a compatible combination. When more than one group is
+	// produced, every video rendition is advertised once per group.
+	// With InlineSingle, a master listing exactly one audio rendition is
+	// written as if MasterOptions.Muxed were set.
+	// Default: a single "audio" group; the default follows the source's
+	// default audio track, falling back to aac_stereo.
+	AudioGroups AudioGroupPolicy
+
+	// ProbeAnalyzeDuration and ProbeSize are passed to ffprobe as
+	// -analyzeduration and -probesize. Raise them for sources whose streams
+	// appear late, such as MPEG-TS captures that otherwise report no audio.
+	// Default: 0 (ffprobe's defaults).
+	ProbeAnalyzeDuration time.Duration
+	ProbeSize            int64
+
+	// KeyframeProbe selects how keyframes are detected when probing.
+	// KeyframesFromPackets reads packet flags without decoding;
+	// KeyframesFromFrames decodes keyframes and keeps I pictures, which is
+	// slower but more reliable for containers with unreliable packet flags.
+	// Default: KeyframesFromPackets.
+	KeyframeProbe KeyframeStrategy
+
+	// Probe supplies a source's metadata in place of ffprobe, for catalogs
+	// that already hold stream information. It must fill Duration (or it is
+	// taken from the last keyframe), Keyframes, Video and Audios; keyframes
+	// are sorted and deduplicated. It is called once per source, and the
+	// result is cached in Storage like probed metadata, where transcode
+	// workers read it. Delete the cached metadata to pick up later changes.
+	// ProbeAnalyzeDuration, ProbeSize and KeyframeProbe then have no effect
+	// except on RawProbe, which always runs ffprobe.
+	// Default: nil (run ffprobe).
+	Probe func(ctx context.Context, sourceURL string) (*Metadata, error)
+
+	// OpenSource supplies the bytes of sources whose URL starts with "pipe:",
+	// such as "pipe:movie-42", for inputs ffmpeg cannot open itself. Every
+	// ffprobe and ffmpeg run opens the source again and reads it through
+	// stdin from the beginning, so seeking is slower than with a file or URL.
+	// The source URL is still the cache key.
+	// Default: nil (pipe sources fail).
+	OpenSource SourceOpener
 }
 
 func (o *Options) setDefaults() {
 	if o.SegmentTimeout == 0 {
 		o.SegmentTimeout = 30 * time.Second
 	}
+	if o.DetectTimeout == 0 {
+		o.DetectTimeout = 10 * time.Second
+	}
+	if o.Clock == nil {
+		o.Clock = domain.SystemClock{}
+	}
+	if o.Logger == nil {
+		o.Logger = slog.New(slog.DiscardHandler)
+	}
 	if o.TargetDuration == 0 {
 		o.TargetDuration = 6.0
 	}
+	if o.JobTimeout == 0 {
+		o.JobTimeout = 5 * time.Minute
+	}
+	if o.SegmentTimeDelta == 0 {
+		o.SegmentTimeDelta = 0.05
+	}
+	if o.UploadConcurrency == 0 {
+		o.UploadConcurrency = 4
+	}
 	if o.SegmentsPerJob == 0 {
 		o.SegmentsPerJob = 10
 	}
+	if o.OverlapSegments == 0 {
+		o.OverlapSegments = 1
+	}
 	if o.VideoPoolSize == 0 {
 		o.VideoPoolSize = 2
 	}
@@ -161,6 +899,21 @@ func (o *Options) setDefaults() {
 	}
 }
 
+// scaleFlagNames are the libswscale scaling algorithms accepted by ScaleFlags.
+var scaleFlagNames = map[string]bool{
+	"fast_bilinear": true,
+	"bilinear":      true,
+	"bicubic":       true,
+	"experimental":  true,
+	"neighbor":      true,
+	"area":          true,
+	"bicublin":      true,
+	"gauss":         true,
+	"sinc":          true,
+	"lanczos":       true,
+	"spline":        true,
+}
+
 func (o *Options) validate() {
 	if o.Storage == nil {
 		panic("service: Storage is required")
@@ -171,6 +924,54 @@ func (o *Options) validate() {
 	if o.PathGen == nil {
 		panic("service: PathGen is required")
 	}
+	if u, err := url.Parse(o.BaseURL); err != nil || u.RawQuery != "" || u.Fragment != "" ||
+		o.BaseURL != "" && !strings.HasPrefix(o.BaseURL, "/") && (!u.IsAbs() || u.Host == "") {
+		panic("service: BaseURL must be an absolute URL or path without a query or fragment: " + strconv.Quote(o.BaseURL))
+	}
+	if err := o.SpriteImage.Validate(); err != nil {
+		panic("service: SpriteImage: " + err.Error())
+	}
+	if err := o.ThumbnailImage.Validate(); err != nil {
+		panic("service: ThumbnailImage: " + err.Error())
+	}
+	if err := o.PosterImage.Validate(); err != nil {
+		panic("service: PosterImage: " + err.Error())
+	}
+	if o.ScaleFlags != "" && !scaleFlagNames[o.ScaleFlags] {
+		panic("service: unsupported ScaleFlags " + o.ScaleFlags)
+	}
+	if _, ok := o.Storage.(domain.SegmentChecksummer); o.VerifySegments && !ok {
+		panic("service: VerifySegments requires Storage to implement SegmentChecksummer")
+	}
+	if o.GapFailedSegments && o.MaxSegmentRetries <= 0 {
+		panic("service: GapFailedSegments requires MaxSegmentRetries")
+	}
+	seenTiers := make(map[string]bool)
+	for _, tier := range o.AudioTiers {
+		if tier.Name == "" || strings.ContainsAny(tier.Name, "+@") || seenTiers[tier.Name] {
+			panic("service: invalid or duplicate AudioTiers name " + strconv.Quote(tier.Name))
+		}
+		if tier.Bitrate <= 0 || tier.Channels <= 0 {
+			panic("service: AudioTiers " + tier.Name + " needs a positive Bitrate and Channels")
+		}
+		seenTiers[tier.Name] = true
+	}
+	if !supportedVideoCodec(o.VideoCodec) {
+		panic("service: unsupported VideoCodec " + string(o.VideoCodec))
+	}
+	for tier, codec := range o.TierCodecs {
+		if codec == "" || !supportedVideoCodec(codec) {
+			panic("service: unsupported TierCodecs codec " + strconv.Quote(string(codec)) + " for tier " + strconv.Itoa(tier))
+		}
+	}
+}
+
+func supportedVideoCodec(codec VideoCodec) bool {
+	switch codec {
+	case "", VideoCodecH264, VideoCodecVP9, VideoCodecHEVC:
+		return true
+	}
+	return false
 }
 
 // Controller is the main entry point for HLS transcoding operations.
@@ -185,6 +986,13 @@ type Controller struct {
 	audioPool *transcode.Pool
 	prober    *probe.Prober
 	miscGen   *misc.Generator
+	ladder    rendition.Options
+	hwConfig  *domain.HWAccelConfig
+
+	prewarmMu  sync.Mutex
+	prewarming map[string]bool
+
+	closeOnce sync.Once
 }
 
 // NewController creates a new Controller with the given options.
@@ -195,16 +1003,103 @@ type Controller struct {
 func NewController(opts Options) *Controller {
 	opts.validate()
 	opts.setDefaults()
+	opts.PathGen = playlist.WithBaseURL(opts.PathGen, opts.BaseURL)
 
-	var hwConfig *domain.HWAccelConfig
-	if opts.HWAccel {
-		hwConfig = hwaccel.DetectBest()
-	} else {
-		hwConfig = hwaccel.NewConfig(domain.AccelNone)
+	detectCtx, cancelDetect := context.WithTimeout(context.Background(), opts.DetectTimeout)
+	defer cancelDetect()
+
+	codecConfig := func(codec domain.VideoCodec) *domain.HWAccelConfig {
+		if opts.HWAccel {
+			return hwaccel.DetectBestForContext(detectCtx, codec)
+		}
+		return hwaccel.NewCodecConfig(domain.AccelNone, codec)
 	}
+
+	hwConfig := codecConfig(opts.VideoCodec)
 	cmdBuilder := ffmpeg.NewCommandBuilder(hwConfig)
+	for _, codec := range opts.TierCodecs {
+		if codec == hwConfig.Codec || cmdBuilder.Codecs[codec] != nil {
+			continue
+		}
+		if cmdBuilder.Codecs == nil {
+			cmdBuilder.Codecs = make(map[domain.VideoCodec]*domain.HWAccelConfig)
+		}
+		cmdBuilder.Codecs[codec] = codecConfig(codec)
+	}
+	if opts.HWAccel && detectCtx.Err() != nil {
+		opts.Logger.Warn("hardware detection timed out, using software encoding", "timeout", opts.DetectTimeout)
+	}
+	if opts.AccurateSeek {
+		cmdBuilder.Seek = ffmpeg.SeekAccurate
+	}
+	cmdBuilder.SegmentTimeDelta = max(opts.SegmentTimeDelta, 0)
+	cmdBuilder.MuxDelay = opts.MuxDelay
+	cmdBuilder.MuxPreload = opts.MuxPreload
+	cmdBuilder.KeyframeInterval = opts.KeyframeInterval
+	cmdBuilder.SceneCut = opts.SceneCutKeyframes
+	cmdBuilder.ScaleFlags = opts.ScaleFlags
+	cmdBuilder.Denoise = opts.Denoise
+	cmdBuilder.Sharpen = opts.Sharpen
+
+	ladder := rendition.Options{
+		HEAAC:     opts.HEAAC && hwaccel.SupportsEncoder(detectCtx, "libfdk_aac"),
+		MaxHeight: opts.MaxHeight,
+		Mode:      opts.LadderMode,
+		Naming:    opts.RenditionNaming,
+
+		ConstantFrameRate: opts.ConstantFrameRate,
+		MaxFrameRate:      opts.MaxFrameRate,
+
+		UpscaleHeights:      opts.UpscaleHeights,
+		VideoCodec:          opts.VideoCodec,
+		TierCodecs:          opts.TierCodecs,
+		DisableDirectStream: opts.DisableDirectStream,
+		DirectStreamCodecs:  opts.DirectStreamCodecs,
+		AudioTiers:          opts.AudioTiers,
+	}
 
-	notifyingStorage := segment.NewNotifyingStorage(opts.Storage, opts.Coordinator)
+	prober := probe.NewProber(opts.Storage)
+	prober.AnalyzeDuration = opts.ProbeAnalyzeDuration
+	prober.ProbeSize = opts.ProbeSize
+	prober.Keyframes = opts.KeyframeProbe
+	prober.OpenSource = opts.OpenSource
+	prober.Logger = opts.Logger
+	if opts.Probe != nil {
+		prober.SetProbeFunc(opts.Probe)
+	}
+
+	miscGen := misc.NewGenerator(opts.Storage)
+	miscGen.SkipBlackFrames = opts.SkipBlackFrames
+	miscGen.SpriteImage = opts.SpriteImage
+	miscGen.ThumbnailImage = opts.ThumbnailImage
+	miscGen.PosterImage = opts.PosterImage
+	miscGen.OpenSource = opts.OpenSource
+
+	notifyingStorage := segment.NewNotifyingStorage(opts.Storage, opts.Coordinator, opts.OnSegmentReady)
+	notifyingStorage.WritePolicy = opts.SegmentWritePolicy
+	if opts.VerifySegments {
+		notifyingStorage.Checksums = opts.Storage.(domain.SegmentChecksummer)
+	}
+	if failures, ok := opts.Storage.(domain.SegmentFailureStore); ok {
+		notifyingStorage.Failures = failures
+	}
+
+	poolOpts := transcode.Options{
+		Ladder:              ladder,
+		JobTimeout:          opts.JobTimeout,
+		OnJobComplete:       opts.OnJobComplete,
+		OnJobStats:          opts.OnJobStats,
+		TwoPass:             opts.TwoPass,
+		TargetDuration:      opts.TargetDuration,
+		AudioTargetDuration: opts.AudioTargetDuration,
+		UploadConcurrency:   opts.UploadConcurrency,
+		MaxSegmentSize:      opts.MaxSegmentSize,
+		OpenSource:          opts.OpenSource,
+		HardwareSessions:    opts.HWEncodeSessions,
+		OverlapSegments:     opts.OverlapSegments,
+		FastStart:           opts.FastStart,
+		Logger:              opts.Logger,
+	}
 
 	videoPool := transcode.NewPool(
 		opts.Coordinator,
@@ -213,6 +1108,7 @@ func NewController(opts Options) *Controller {
 		opts.Storage,
 		cmdBuilder,
 		notifyingStorage,
+		poolOpts,
 	)
 
 	audioPool := transcode.NewPool(
@@ -222,6 +1118,7 @@ func NewController(opts Options) *Controller {
 		opts.Storage,
 		cmdBuilder,
 		notifyingStorage,
+		poolOpts,
 	)
 
 	return &Controller{
@@ -229,11 +1126,38 @@ func NewController(opts Options) *Controller {
 		playlist:  playlist.NewGenerator(opts.PathGen),
 		videoPool: videoPool,
 		audioPool: audioPool,
-		prober:    probe.NewProber(opts.Storage),
-		miscGen:   misc.NewGenerator(opts.Storage),
+		prober:    prober,
+		miscGen:   miscGen,
+		ladder:    ladder,
+		hwConfig:  hwConfig,
+
+		prewarming: make(map[string]bool),
 	}
 }
 
+// Accelerator returns the accelerator transcodes are encoded with: the one
+// detected when HWAccel is set, or AccelNone when it is not set or no
+// hardware encoder works. Jobs that fail on the hardware encoder are still
+// retried in software individually.
+func (c *Controller) Accelerator() Accelerator {
+	return c.hwConfig.Accelerator
+}
+
+// HWAccelConfig returns a copy of the full encoder configuration selected at
+// construction, including the ffmpeg encoder name (e.g. "h264_nvenc" or
+// "libx264") and its flags, for logging and dashboards.
+func (c *Controller) HWAccelConfig() HWAccelConfig {
+	config := *c.hwConfig
+	config.DecodeFlags = slices.Clone(config.DecodeFlags)
+	config.EncodeFlags = slices.Clone(config.EncodeFlags)
+	config.DecodeCodecs = slices.Clone(config.DecodeCodecs)
+	config.HighBitDepthCodecs = slices.Clone(config.HighBitDepthCodecs)
+	config.DeviceFlags = slices.Clone(config.DeviceFlags)
+	config.IDRFlags = slices.Clone(config.IDRFlags)
+	config.FastStartFlags = slices.Clone(config.FastStartFlags)
+	return config
+}
+
 // Start initializes the video and audio transcoding worker pools.
 // It subscribes to the Coordinator for incoming jobs and begins processing.
 //
@@ -252,11 +1176,17 @@ func (c *Controller) Start(ctx context.Context) error {
 }
 
 // Stop gracefully shuts down the transcoding worker pools.
-// It waits for any in-progress transcoding jobs to complete before returning.
+// It waits for any in-progress transcoding jobs to complete before returning,
+// then closes the Coordinator (once, even if Stop is called again) unless
+// KeepCoordinatorOpen is set.
 // Always call Stop when shutting down to prevent resource leaks.
 func (c *Controller) Stop() {
 	c.videoPool.Stop()
 	c.audioPool.Stop()
+
+	if !c.opts.KeepCoordinatorOpen {
+		c.closeOnce.Do(c.opts.Coordinator.Close)
+	}
 }
 
 // MasterPlaylist returns the HLS master playlist for a media source.
@@ -267,18 +1197,203 @@ func (c *Controller) Stop() {
 //
 // The returned string is a complete M3U8 playlist ready to serve to clients.
 func (c *Controller) MasterPlaylist(ctx context.Context, sourceURL string) (string, error) {
+	return c.MasterPlaylistWith(ctx, sourceURL, MasterOptions{})
+}
+
+// MasterPlaylistFor returns a master playlist advertising only the renditions
+// a client with the given capabilities can play.
+//
+// Video renditions outside caps.MinHeight/caps.MaxHeight or above
+// caps.MaxBitrate are omitted (if none fit, the nearest is kept), and
+// AC3/E-AC3 passthrough tracks are only listed when the client declares
+// support for them. HEVC and VP9 renditions are likewise only listed with
+// caps.HEVC or caps.VP9. The variant and segment paths still accept the full
+// ladder, so segments are shared across clients.
+// For example, a mobile data-saver mode can pass MaxHeight: 480 without
+// changing global configuration.
+func (c *Controller) MasterPlaylistFor(ctx context.Context, sourceURL string, caps ClientCapabilities) (string, error) {
+	return c.MasterPlaylistWith(ctx, sourceURL, MasterOptions{Capabilities: &caps})
+}
+
+// MasterPlaylistWith returns the master playlist with per-request options
+// applied, such as capability filtering (see MasterPlaylistFor) or an
+// EXT-X-START default start position for resume or skip-intro.
+func (c *Controller) MasterPlaylistWith(ctx context.Context, sourceURL string, opts MasterOptions) (string, error) {
+	built, err := c.buildMaster(ctx, sourceURL, opts)
+	if err != nil {
+		return "", err
+	}
+	return built.playlist, nil
+}
+
+// builtMaster is a master playlist together with the variants it references
+// and the metadata and ladder it was built from.
+type builtMaster struct {
+	playlist string
+	variants []playlist.Variant
+	meta     *domain.Metadata
+	videos   []VideoRendition
+}
+
+// buildMaster builds the master playlist for MasterPlaylistWith and Manifest,
+// so both list exactly the same variants.
+func (c *Controller) buildMaster(ctx context.Context, sourceURL string, opts MasterOptions) (builtMaster, error) {
 	meta, err := c.getMetadata(ctx, sourceURL)
 	if err != nil {
-		return "", fmt.Errorf("get metadata: %w", err)
+		return builtMaster{}, fmt.Errorf("get metadata: %w", err)
 	}
 
-	videos := rendition.GenerateVideo(meta.Video)
-	var audios []domain.AudioRendition
-	if len(meta.Audios) > 0 {
-		audios = rendition.GenerateAudio(meta.Audios[0])
+	videos, audios := c.renditions(meta)
+	if opts.Capabilities != nil {
+		videos = rendition.FilterVideo(videos, *opts.Capabilities)
+		audios = rendition.FilterAudio(audios, *opts.Capabilities)
+	}
+	if opts.NativeOnly {
+		videos = rendition.Native(videos)
+	}
+	if c.opts.AudioGroups.InlineSingle && len(audios) == 1 {
+		opts.Muxed = true
+	}
+
+	if c.opts.PrewarmFirstSegment {
+		c.prewarm(ctx, sourceURL, videos, audios, opts.Muxed)
+	}
+
+	independent := playlist.IndependentSegments(videos, meta.Keyframes, c.opts.TargetDuration)
+	out, variants := c.playlist.MasterVariants(sourceURL, videos, audios, c.opts.AudioGroups, opts, independent)
+	return builtMaster{playlist: out, variants: variants, meta: meta, videos: videos}, nil
+}
+
+// ValidatePlaylist checks that m3u8 is a well-formed master or media
+// playlist: required tags, EXTINF and URI pairing, a valid
+// EXT-X-MEDIA-SEQUENCE, and a target duration covering every segment. It is
+// meant for tests of integrations, for example one with a custom
+// PathGenerator, and returns an error naming the first bad line.
+func ValidatePlaylist(m3u8 string) error {
+	return playlist.Validate(m3u8)
+}
+
+// ValidatePlaylistWith is ValidatePlaylist with optional stricter checks,
+// such as ValidateOptions.UniqueSegmentURIs.
+func ValidatePlaylistWith(m3u8 string, opts ValidateOptions) error {
+	return playlist.ValidateWith(m3u8, opts)
+}
+
+// RawProbe returns the full ffprobe JSON for a source (format, streams,
+// chapters and programs), for fields goshl does not parse such as side data.
+// It is cached in Storage through WriteRawProbe, separately from the parsed
+// metadata, so the first call runs ffprobe once more even for a source that
+// has already been probed.
+func (c *Controller) RawProbe(ctx context.Context, sourceURL string) ([]byte, error) {
+	return c.prober.RawProbe(ctx, sourceURL)
+}
+
+// ContentType returns the Content-Type to serve an artifact with. Sprites,
+// thumbnails and posters follow the format chosen in SpriteImage,
+// ThumbnailImage and PosterImage. Unknown artifacts are
+// "application/octet-stream".
+func (c *Controller) ContentType(kind Artifact) string {
+	switch kind {
+	case domain.ArtifactMasterPlaylist, domain.ArtifactVariantPlaylist:
+		return "application/vnd.apple.mpegurl"
+	case domain.ArtifactSegment:
+		return "video/MP2T"
+	case domain.ArtifactFMP4Segment:
+		return "video/iso.segment"
+	case domain.ArtifactInitSegment:
+		return "video/mp4"
+	case domain.ArtifactSubtitleVTT, domain.ArtifactSpriteVTT:
+		return "text/vtt"
+	case domain.ArtifactSubtitleASS:
+		return "text/x-ssa"
+	case domain.ArtifactSprite:
+		return c.opts.SpriteImage.Format.ContentType()
+	case domain.ArtifactThumbnail:
+		return c.opts.ThumbnailImage.Format.ContentType()
+	case domain.ArtifactPoster:
+		return c.opts.PosterImage.Format.ContentType()
+	}
+	return "application/octet-stream"
+}
+
+// CacheDuration suggests how long clients and CDNs may cache an artifact,
+// for a Cache-Control max-age. Playlists get a minute: the master follows
+// the options and client capabilities, and with GapFailedSegments a variant
+// changes when a segment fails. Everything else is a day rather than
+// forever, because URLs carry no version and changing TargetDuration or the
+// ladder recuts segments under the same names. Unknown artifacts get zero,
+// meaning do not cache.
+func (c *Controller) CacheDuration(kind Artifact) time.Duration {
+	switch kind {
+	case domain.ArtifactMasterPlaylist, domain.ArtifactVariantPlaylist:
+		return time.Minute
+	case domain.ArtifactSegment, domain.ArtifactFMP4Segment, domain.ArtifactInitSegment,
+		domain.ArtifactSubtitleVTT, domain.ArtifactSubtitleASS, domain.ArtifactSpriteVTT,
+		domain.ArtifactSprite, domain.ArtifactThumbnail, domain.ArtifactPoster:
+		return 24 * time.Hour
+	}
+	return 0
+}
+
+// RecomputeSegments cuts a source's video segments at the current
+// TargetDuration and reports whether the indexes already stored for its
+// renditions still match, for migrating a catalog after changing
+// TargetDuration or AudioTargetDuration.
+//
+// valid is false when any stored video, muxed or audio index has different
+// boundaries. Segments already in Storage were then cut on the old
+// boundaries and must be deleted before the source is served again: an index
+// whose boundaries no longer match the metadata, whatever the cause, is
+// rebuilt on the next VariantPlaylist, but the segments are not. Renditions
+// with no stored index are still valid. Nothing is written.
+func (c *Controller) RecomputeSegments(ctx context.Context, sourceURL string) (segments []Segment, valid bool, err error) {
+	meta, err := c.getMetadata(ctx, sourceURL)
+	if err != nil {
+		return nil, false, fmt.Errorf("get metadata: %w", err)
+	}
+
+	videos, audios := c.renditions(meta)
+	type stored struct {
+		streamType StreamType
+		name       string
+	}
+	var indexes []stored
+	for _, v := range videos {
+		indexes = append(indexes, stored{domain.StreamVideo, v.Name})
+		for _, a := range audios {
+			indexes = append(indexes, stored{domain.StreamVideo, domain.MuxedRendition(v.Name, a.Name)})
+		}
+	}
+	for _, a := range audios {
+		indexes = append(indexes, stored{domain.StreamAudio, a.Name})
+	}
+
+	valid = true
+	for _, idx := range indexes {
+		ok, err := c.storedIndexMatches(ctx, sourceURL, idx.streamType, idx.name, c.segmentLayout(meta, idx.streamType, idx.name))
+		if err != nil {
+			return nil, false, fmt.Errorf("check index %s %s: %w", idx.streamType, idx.name, err)
+		}
+		if !ok {
+			valid = false
+			break
+		}
+	}
+
+	return c.segmentLayout(meta, domain.StreamVideo, ""), valid, nil
+}
+
+// Renditions returns the video and audio renditions available for a source,
+// in the same order they appear in the master playlist. The source is probed
+// on first use, exactly as for MasterPlaylist.
+func (c *Controller) Renditions(ctx context.Context, sourceURL string) ([]VideoRendition, []AudioRendition, error) {
+	meta, err := c.getMetadata(ctx, sourceURL)
+	if err != nil {
+		return nil, nil, fmt.Errorf("get metadata: %w", err)
 	}
 
-	return c.playlist.Master(sourceURL, videos, audios), nil
+	videos, audios := c.renditions(meta)
+	return videos, audios, nil
 }
 
 // VariantPlaylist returns the HLS media playlist for a specific rendition.
@@ -288,20 +1403,125 @@ func (c *Controller) MasterPlaylist(ctx context.Context, sourceURL string) (stri
 //   - streamType: Either StreamVideo or StreamAudio
 //   - renditionName: The rendition identifier (e.g., "1080p", "720p", "aac_stereo")
 //
+// Returns ErrRenditionNotFound if the rendition is not in the source's ladder.
+//
 // The playlist contains segment references with durations calculated from
 // the source keyframe positions. Segment URLs are generated via PathGenerator.
+//
+// The segment layout is persisted as a per-rendition index on first request.
+// Subsequent calls serve from the index without touching source metadata; the
+// index is recomputed if it was built with a different TargetDuration.
 func (c *Controller) VariantPlaylist(ctx context.Context, sourceURL string, streamType StreamType, renditionName string) (string, error) {
-	meta, err := c.getMetadata(ctx, sourceURL)
+	return c.VariantPlaylistWith(ctx, sourceURL, streamType, renditionName, VariantOptions{})
+}
+
+// VariantPlaylistWith returns the media playlist for a rendition with
+// per-request options applied, such as an EXT-X-START default start position
+// or a TargetDuration override.
+func (c *Controller) VariantPlaylistWith(ctx context.Context, sourceURL string, streamType StreamType, renditionName string, opts VariantOptions) (string, error) {
+	if opts.TargetDuration != 0 {
+		target, ok := domain.CanonicalTarget(opts.TargetDuration)
+		if !ok {
+			return "", fmt.Errorf("target duration %v outside %v-%vs", opts.TargetDuration, domain.MinTargetOverride, domain.MaxTargetOverride)
+		}
+		if target != c.targetDuration(streamType, renditionName) {
+			renditionName = domain.TargetRendition(renditionName, target)
+		}
+	}
+
+	index, err := c.getIndex(ctx, sourceURL, streamType, renditionName)
 	if err != nil {
-		return "", fmt.Errorf("get metadata: %w", err)
+		return "", fmt.Errorf("get index: %w", err)
 	}
 
-	segments := playlist.CalculateSegments(meta.Keyframes, meta.Duration, c.opts.TargetDuration)
+	segments := index.Segments
+	if c.opts.GapFailedSegments {
+		segments, err = c.markGaps(ctx, sourceURL, streamType, renditionName, segments)
+		if err != nil {
+			return "", fmt.Errorf("mark gaps: %w", err)
+		}
+	}
 
-	return c.playlist.Variant(sourceURL, renditionName, streamType, segments), nil
+	return c.playlist.Variant(sourceURL, renditionName, streamType, index.Container, segments, opts), nil
 }
 
-// Segment returns a transcoded media segment.
+// SegmentIndexAtTime returns the index of the segment of a rendition that
+// plays at the given time in seconds, from the same layout its variant
+// playlist lists. Times before the start give the first segment and times
+// at or past the end the last. Like VariantPlaylist, the rendition name may
+// carry a target override such as "720p@2".
+func (c *Controller) SegmentIndexAtTime(ctx context.Context, sourceURL string, streamType StreamType, renditionName string, at float64) (int, error) {
+	index, err := c.getIndex(ctx, sourceURL, streamType, renditionName)
+	if err != nil {
+		return 0, fmt.Errorf("get index: %w", err)
+	}
+	i := playlist.SegmentAt(index.Segments, at)
+	if i < 0 {
+		return 0, fmt.Errorf("%s %s has no segments", streamType, renditionName)
+	}
+	return i, nil
+}
+
+// SegmentStartTime returns the time in seconds at which a segment of a
+// rendition starts, from the same layout its variant playlist lists.
+func (c *Controller) SegmentStartTime(ctx context.Context, sourceURL string, streamType StreamType, renditionName string, segmentIndex int) (float64, error) {
+	index, err := c.getIndex(ctx, sourceURL, streamType, renditionName)
+	if err != nil {
+		return 0, fmt.Errorf("get index: %w", err)
+	}
+	if segmentIndex < 0 || segmentIndex >= len(index.Segments) {
+		return 0, fmt.Errorf("segment %d out of range: %s %s has %d segments", segmentIndex, streamType, renditionName, len(index.Segments))
+	}
+	return index.Segments[segmentIndex].Start, nil
+}
+
+// markGaps returns a copy of segments with Gap set on every segment that has
+// failed MaxSegmentRetries times, the point at which Segment stops retrying
+// it, and was not produced by a later job.
+func (c *Controller) markGaps(ctx context.Context, sourceURL string, streamType StreamType, renditionName string, segments []domain.Segment) ([]domain.Segment, error) {
+	failures, ok := c.opts.Storage.(domain.SegmentFailureStore)
+	if !ok {
+		return segments, nil
+	}
+	records, err := failures.ReadSegmentFailures(ctx, sourceURL, renditionName, streamType)
+	if err != nil {
+		return nil, fmt.Errorf("read segment failures: %w", err)
+	}
+	if len(records) == 0 {
+		return segments, nil
+	}
+
+	marked := make([]domain.Segment, len(segments))
+	copy(marked, segments)
+
+	for i := range marked {
+		data, ok := records[marked[i].Index]
+		if !ok {
+			continue
+		}
+		var failure domain.SegmentFailure
+		if err := json.Unmarshal(data, &failure); err != nil {
+			return nil, fmt.Errorf("decode segment failure: %w", err)
+		}
+		if failure.Attempts < c.opts.MaxSegmentRetries {
+			continue
+		}
+		info := domain.SegmentData{
+			SourceURL: sourceURL,
+			Index:     marked[i].Index,
+			Rendition: renditionName,
+			IsVideo:   streamType == domain.StreamVideo,
+		}
+		exists, err := c.opts.Storage.SegmentExists(ctx, info)
+		if err != nil {
+			return nil, err
+		}
+		marked[i].Gap = !exists
+	}
+	return marked, nil
+}
+
+// Segment returns a transcoded media segment.
 //
 // If the segment exists in storage, it returns immediately. Otherwise, it:
 //  1. Subscribes to segment readiness notifications via Coordinator
@@ -316,7 +1536,8 @@ func (c *Controller) VariantPlaylist(ctx context.Context, sourceURL string, stre
 //   - index: Zero-based segment index
 //
 // Returns the raw MPEG-TS segment data, or an error if transcoding fails
-// or times out.
+// or times out. Returns ErrRenditionNotFound without enqueueing any work if
+// the rendition is not in the source's ladder.
 func (c *Controller) Segment(ctx context.Context, sourceURL string, streamType StreamType, renditionName string, index int) ([]byte, error) {
 	info := domain.SegmentData{
 		SourceURL: sourceURL,
@@ -331,29 +1552,233 @@ func (c *Controller) Segment(ctx context.Context, sourceURL string, streamType S
 	}
 
 	if exists {
-		return c.opts.Storage.ReadSegment(ctx, info)
+		return c.readSegment(ctx, info)
+	}
+
+	meta, err := c.getMetadata(ctx, sourceURL)
+	if err != nil {
+		return nil, fmt.Errorf("get metadata: %w", err)
+	}
+	if err := c.validateRendition(meta, streamType, renditionName); err != nil {
+		return nil, err
+	}
+	if err := c.checkRetries(ctx, info); err != nil {
+		return nil, err
 	}
 
-	statusCh, err := c.opts.Coordinator.WaitSegment(ctx, info)
+	// The wait is released through its context on every return path,
+	// including timeouts, so abandoned requests do not pile up waiters.
+	waitCtx, cancelWait := context.WithCancel(ctx)
+	defer cancelWait()
+
+	statusCh, err := c.opts.Coordinator.WaitSegment(waitCtx, info)
 	if err != nil {
 		return nil, fmt.Errorf("wait segment: %w", err)
 	}
 
-	if err := c.enqueueSegment(ctx, sourceURL, streamType, renditionName, index); err != nil {
-		return nil, fmt.Errorf("enqueue: %w", err)
+	if !c.prewarmPending(c.jobFor(sourceURL, streamType, renditionName, index)) {
+		if err := c.enqueueSegment(ctx, sourceURL, streamType, renditionName, index); err != nil {
+			return nil, fmt.Errorf("enqueue: %w", err)
+		}
 	}
 
 	select {
 	case <-ctx.Done():
 		return nil, ctx.Err()
-	case <-time.After(c.opts.SegmentTimeout):
+	case <-c.opts.Clock.After(c.opts.SegmentTimeout):
 		return nil, fmt.Errorf("timeout waiting for segment %d", index)
 	case status := <-statusCh:
 		if status.State == domain.SegmentStateError {
 			return nil, fmt.Errorf("segment error: %s", status.Error)
 		}
-		return c.opts.Storage.ReadSegment(ctx, info)
+		return c.readSegment(ctx, info)
+	}
+}
+
+// readSegment reads a stored segment and, with VerifySegments, checks it
+// against its stored checksum.
+func (c *Controller) readSegment(ctx context.Context, info domain.SegmentData) ([]byte, error) {
+	data, err := c.opts.Storage.ReadSegment(ctx, info)
+	if err != nil || !c.opts.VerifySegments {
+		return data, err
+	}
+
+	want, err := c.opts.Storage.(domain.SegmentChecksummer).ReadSegmentChecksum(ctx, info)
+	if err != nil {
+		return nil, fmt.Errorf("read checksum: %w", err)
+	}
+	if want == nil {
+		return data, nil
+	}
+	if got := sha256.Sum256(data); !bytes.Equal(got[:], want) {
+		return nil, fmt.Errorf("%w: segment %d of %s", ErrSegmentCorrupt, info.Index, info.Rendition)
+	}
+	return data, nil
+}
+
+// checkRetries returns ErrSegmentFailed if the segment's stored failure record
+// has reached MaxSegmentRetries.
+func (c *Controller) checkRetries(ctx context.Context, info domain.SegmentData) error {
+	failures, ok := c.opts.Storage.(domain.SegmentFailureStore)
+	if c.opts.MaxSegmentRetries <= 0 || !ok {
+		return nil
+	}
+
+	exists, err := failures.SegmentFailureExists(ctx, info)
+	if err != nil {
+		return fmt.Errorf("check segment failure: %w", err)
+	}
+	if !exists {
+		return nil
+	}
+	data, err := failures.ReadSegmentFailure(ctx, info)
+	if err != nil {
+		return fmt.Errorf("read segment failure: %w", err)
+	}
+	var failure domain.SegmentFailure
+	if err := json.Unmarshal(data, &failure); err != nil {
+		return fmt.Errorf("decode segment failure: %w", err)
+	}
+	if failure.Attempts < c.opts.MaxSegmentRetries {
+		return nil
+	}
+	return fmt.Errorf("%w: segment %d after %d attempts: %s", ErrSegmentFailed, info.Index, failure.Attempts, failure.Error)
+}
+
+// ResetSegmentError clears the stored failure record of a segment, so the next
+// Segment request transcodes it again even after MaxSegmentRetries failures,
+// and a GapFailedSegments playlist no longer marks it as a gap. It does
+// nothing when Storage does not implement SegmentFailureStore.
+func (c *Controller) ResetSegmentError(ctx context.Context, sourceURL string, streamType StreamType, renditionName string, index int) error {
+	failures, ok := c.opts.Storage.(domain.SegmentFailureStore)
+	if !ok {
+		return nil
+	}
+	info := domain.SegmentData{
+		SourceURL: sourceURL,
+		Index:     index,
+		Rendition: renditionName,
+		IsVideo:   streamType == domain.StreamVideo,
+	}
+	if err := failures.DeleteSegmentFailure(ctx, info); err != nil {
+		return fmt.Errorf("delete segment failure: %w", err)
+	}
+	return nil
+}
+
+// InitSegment returns the initialization segment (the EXT-X-MAP target) of a
+// fragmented MP4 rendition. Jobs save it with the first segment they upload,
+// so if it is missing, segment 0 is requested and waited for. It requires
+// Storage to implement InitSegmentStore.
+func (c *Controller) InitSegment(ctx context.Context, sourceURL string, streamType StreamType, renditionName string) ([]byte, error) {
+	inits, ok := c.opts.Storage.(domain.InitSegmentStore)
+	if !ok {
+		return nil, fmt.Errorf("init segment: Storage does not implement InitSegmentStore")
+	}
+
+	exists, err := inits.InitSegmentExists(ctx, sourceURL, renditionName, streamType)
+	if err != nil {
+		return nil, fmt.Errorf("check init segment: %w", err)
+	}
+	if exists {
+		return inits.ReadInitSegment(ctx, sourceURL, renditionName, streamType)
+	}
+
+	meta, err := c.getMetadata(ctx, sourceURL)
+	if err != nil {
+		return nil, fmt.Errorf("get metadata: %w", err)
+	}
+	container, err := c.renditionContainer(meta, streamType, renditionName)
+	if err != nil {
+		return nil, err
+	}
+	if container != domain.ContainerFMP4 {
+		return nil, fmt.Errorf("rendition %s is not fragmented MP4", renditionName)
+	}
+
+	if _, err := c.Segment(ctx, sourceURL, streamType, renditionName, 0); err != nil {
+		return nil, fmt.Errorf("produce first segment: %w", err)
+	}
+	return inits.ReadInitSegment(ctx, sourceURL, renditionName, streamType)
+}
+
+// SegmentSize returns the stored byte size of a transcoded media segment.
+//
+// Sizes are recorded by the worker when a segment is uploaded (via
+// SegmentData.Size) and read back through SegmentSizer when the Storage
+// implements it; otherwise the segment is read and its length returned.
+// Unlike Segment, this never triggers transcoding; an error is returned if
+// the segment has not been produced yet. Useful for CDN warming and
+// analytics.
+func (c *Controller) SegmentSize(ctx context.Context, sourceURL string, streamType StreamType, renditionName string, index int) (int64, error) {
+	info := domain.SegmentData{
+		SourceURL: sourceURL,
+		Index:     index,
+		Rendition: renditionName,
+		IsVideo:   streamType == domain.StreamVideo,
+	}
+
+	exists, err := c.opts.Storage.SegmentExists(ctx, info)
+	if err != nil {
+		return 0, fmt.Errorf("check segment: %w", err)
+	}
+	if !exists {
+		return 0, fmt.Errorf("segment %d not transcoded", index)
+	}
+
+	if sizer, ok := c.opts.Storage.(domain.SegmentSizer); ok {
+		return sizer.SegmentSize(ctx, info)
+	}
+	data, err := c.opts.Storage.ReadSegment(ctx, info)
+	if err != nil {
+		return 0, fmt.Errorf("read segment: %w", err)
+	}
+	return int64(len(data)), nil
+}
+
+// InspectSegmentCommand returns the ffmpeg arguments that would be run to
+// transcode the job covering the given segment, without executing anything.
+//
+// The arguments are built by the same code path the worker pools use, so they
+// reflect the current Options, hardware acceleration and rendition ladder.
+// Segment output paths are relative, since a real job writes into its own
+// temporary directory. Intended for debugging and bug reports.
+func (c *Controller) InspectSegmentCommand(ctx context.Context, sourceURL string, streamType StreamType, renditionName string, index int) ([]string, error) {
+	if _, err := c.getMetadata(ctx, sourceURL); err != nil {
+		return nil, fmt.Errorf("get metadata: %w", err)
+	}
+
+	pool := c.audioPool
+	if streamType == domain.StreamVideo {
+		pool = c.videoPool
+	}
+
+	return pool.Command(ctx, c.jobFor(sourceURL, streamType, renditionName, index), "")
+}
+
+// Stream returns a single progressive MPEG-TS (WebM for VP9 renditions) of one
+// rendition between start and end seconds, read directly from ffmpeg's
+// stdout. An end of zero means the end of the source.
+//
+// Unlike Segment, nothing is cached and no job is queued; each call runs its
+// own ffmpeg process. This suits previews or clients that cannot play HLS.
+// The caller must Close the reader, which stops ffmpeg if it is still running.
+// Reading to EOF returns an error if ffmpeg exited unsuccessfully.
+func (c *Controller) Stream(ctx context.Context, sourceURL string, streamType StreamType, renditionName string, start, end float64) (io.ReadCloser, error) {
+	meta, err := c.getMetadata(ctx, sourceURL)
+	if err != nil {
+		return nil, fmt.Errorf("get metadata: %w", err)
 	}
+	if err := c.validateRendition(meta, streamType, renditionName); err != nil {
+		return nil, err
+	}
+
+	pool := c.audioPool
+	if streamType == domain.StreamVideo {
+		pool = c.videoPool
+	}
+
+	return pool.Stream(ctx, sourceURL, renditionName, start, end)
 }
 
 // SpriteVTT returns a WebVTT file mapping timestamps to thumbnail sprite images.
@@ -362,7 +1787,9 @@ func (c *Controller) Segment(ctx context.Context, sourceURL string, streamType S
 // with spatial coordinates for each timestamp. This enables video preview
 // thumbnails during seek operations.
 //
-// Sprite sheets and VTT data are generated on first request and cached.
+// Sprite sheets and VTT data are generated on first request and cached. If a
+// generation was interrupted, only the sheets missing from Storage are
+// rendered again.
 func (c *Controller) SpriteVTT(ctx context.Context, sourceURL string) ([]byte, error) {
 	meta, err := c.getMetadata(ctx, sourceURL)
 	if err != nil {
@@ -394,6 +1821,57 @@ func (c *Controller) Sprite(ctx context.Context, sourceURL string, index int) ([
 	return c.miscGen.GetSprite(ctx, sourceURL, meta.Duration, urlPattern, index)
 }
 
+// CancelSprite stops the sprite generation in progress for a source, for
+// example when the viewer navigates away. Concurrent SpriteVTT and Sprite
+// calls share one generation, so all of them return ErrSpriteCancelled. It
+// reports whether a generation was running; sheets already stored are kept
+// and the next request starts over.
+func (c *Controller) CancelSprite(sourceURL string) bool {
+	return c.miscGen.CancelSprites(sourceURL)
+}
+
+// Thumbnail returns a single JPEG frame at the given time in seconds, scaled
+// to width x height. Pass zero for either dimension to keep the source aspect
+// ratio, or both to keep the source size.
+//
+// When the Storage implements ThumbnailStore the result is cached per
+// timestamp (to the millisecond) and size, which makes this a cheap
+// alternative to sprite sheets for one-off images such as social cards. The
+// time must fall before the end of the source.
+func (c *Controller) Thumbnail(ctx context.Context, sourceURL string, at float64, width, height int) ([]byte, error) {
+	meta, err := c.getMetadata(ctx, sourceURL)
+	if err != nil {
+		return nil, fmt.Errorf("get metadata: %w", err)
+	}
+	if at < 0 || at >= meta.Duration {
+		return nil, fmt.Errorf("thumbnail time %.3fs outside 0-%.3fs", at, meta.Duration)
+	}
+
+	info := domain.ThumbnailData{
+		SourceURL: sourceURL,
+		AtMillis:  int64(math.Round(at * 1000)),
+		Width:     width,
+		Height:    height,
+	}
+
+	return c.miscGen.GetThumbnail(ctx, info)
+}
+
+// Poster returns a representative JPEG frame for the source, suitable for
+// grid views. It is taken from about 10% into the video, where intros and
+// logos have usually ended, and ffmpeg's thumbnail filter picks the most
+// typical of the nearby frames so it is rarely black. Generated on first
+// request and cached when the Storage implements PosterStore; otherwise
+// every request extracts it again.
+func (c *Controller) Poster(ctx context.Context, sourceURL string) ([]byte, error) {
+	meta, err := c.getMetadata(ctx, sourceURL)
+	if err != nil {
+		return nil, fmt.Errorf("get metadata: %w", err)
+	}
+
+	return c.miscGen.GetPoster(ctx, sourceURL, meta.Duration)
+}
+
 // SubtitleVTT extracts and returns subtitles in WebVTT format.
 //
 // The lang parameter specifies the subtitle track language code (e.g., "en", "es").
@@ -401,14 +1879,36 @@ func (c *Controller) Sprite(ctx context.Context, sourceURL string, index int) ([
 //
 // Subtitles are extracted from the source on first request and cached.
 func (c *Controller) SubtitleVTT(ctx context.Context, sourceURL string, lang string) ([]byte, error) {
+	return c.Subtitle(ctx, sourceURL, lang, SubtitleFormatVTT)
+}
+
+// Subtitle returns a subtitle track in the requested format. SubtitleFormatVTT
+// converts any text track to WebVTT; SubtitleFormatASS returns an ASS/SSA track
+// byte for byte, keeping positioning, fonts and karaoke effects for players
+// that render it with libass, and fails for tracks in other formats.
+//
+// When several tracks share a language, the first is addressed by the
+// language alone and later ones by the language plus their track index,
+// e.g. "en" and "en_2".
+//
+// Subtitles are extracted from the source on first request and cached.
+func (c *Controller) Subtitle(ctx context.Context, sourceURL string, lang string, format SubtitleFormat) ([]byte, error) {
+	return c.SubtitleWith(ctx, sourceURL, lang, SubtitleOptions{Format: format})
+}
+
+// SubtitleWith returns a subtitle track with per-request options applied,
+// such as a timing offset for subtitles out of sync with the audio. A shifted
+// track is derived from the cached unshifted one and cached under its own
+// key, e.g. "en@+1.5".
+func (c *Controller) SubtitleWith(ctx context.Context, sourceURL string, lang string, opts SubtitleOptions) ([]byte, error) {
 	meta, err := c.getMetadata(ctx, sourceURL)
 	if err != nil {
 		return nil, fmt.Errorf("get metadata: %w", err)
 	}
 
 	streamIndex := -1
-	for i, sub := range meta.Subtitles {
-		if sub.Language == lang {
+	for i, key := range subtitleKeys(meta.Subtitles) {
+		if key == lang {
 			streamIndex = i
 			break
 		}
@@ -417,14 +1917,284 @@ func (c *Controller) SubtitleVTT(ctx context.Context, sourceURL string, lang str
 		return nil, fmt.Errorf("subtitle language %s not found", lang)
 	}
 
-	return c.miscGen.GetSubtitles(ctx, sourceURL, streamIndex, lang)
+	offset := math.Round(opts.Offset*1000) / 1000
+	if math.IsNaN(offset) || math.Abs(offset) > meta.Duration {
+		return nil, fmt.Errorf("subtitle offset %v outside the source duration of %vs", opts.Offset, meta.Duration)
+	}
+
+	switch opts.Format {
+	case "", SubtitleFormatVTT:
+		return c.miscGen.ShiftedSubtitles(ctx, sourceURL, streamIndex, lang, false, offset)
+	case SubtitleFormatASS:
+		if codec := meta.Subtitles[streamIndex].Codec; codec != "ass" && codec != "ssa" {
+			return nil, fmt.Errorf("subtitle %s is %s, not ass", lang, codec)
+		}
+		return c.miscGen.ShiftedSubtitles(ctx, sourceURL, streamIndex, lang, true, offset)
+	default:
+		return nil, fmt.Errorf("unsupported subtitle format %q", opts.Format)
+	}
+}
+
+// ExtractAllSubtitles converts every subtitle track of a source to WebVTT and
+// caches it, so playback never waits on subtitle extraction. Tracks are cached
+// under the keys Subtitle accepts. Tracks that fail, such as image-based
+// subtitles, do not stop the others; their errors are returned joined.
+func (c *Controller) ExtractAllSubtitles(ctx context.Context, sourceURL string) error {
+	meta, err := c.getMetadata(ctx, sourceURL)
+	if err != nil {
+		return fmt.Errorf("get metadata: %w", err)
+	}
+
+	var errs []error
+	for i, key := range subtitleKeys(meta.Subtitles) {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if _, err := c.miscGen.GetSubtitles(ctx, sourceURL, i, key); err != nil {
+			errs = append(errs, fmt.Errorf("subtitle %s (%s): %w", key, meta.Subtitles[i].Codec, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// SubtitleTracks returns the subtitle tracks of a source in stream order,
+// with the key Subtitle accepts for each and its default and forced flags.
+// The source is probed on first use, exactly as for MasterPlaylist.
+func (c *Controller) SubtitleTracks(ctx context.Context, sourceURL string) ([]SubtitleTrack, error) {
+	meta, err := c.getMetadata(ctx, sourceURL)
+	if err != nil {
+		return nil, fmt.Errorf("get metadata: %w", err)
+	}
+
+	return subtitleTracks(meta.Subtitles), nil
+}
+
+func subtitleTracks(subs []domain.SubtitleStream) []SubtitleTrack {
+	keys := subtitleKeys(subs)
+	tracks := make([]SubtitleTrack, len(subs))
+	for i, sub := range subs {
+		tracks[i] = SubtitleTrack{
+			Key:      keys[i],
+			Language: sub.Language,
+			Title:    sub.Title,
+			Codec:    sub.Codec,
+			Forced:   sub.Forced,
+			Default:  sub.Default,
+		}
+	}
+	return tracks
+}
+
+// Manifest returns everything a client needs to download a source for
+// offline playback in one call: the master playlist built with opts, every
+// variant playlist it references with the URLs of their segments, and the
+// URLs of the subtitle tracks and sprite sheets. Pass the same opts as for
+// MasterPlaylistWith, such as Capabilities, to bundle a filtered ladder.
+// Only URLs are gathered: apart from the first segments prewarmed under
+// PrewarmFirstSegment, exactly as for MasterPlaylist, nothing is transcoded
+// or extracted until the client fetches it. The source is probed on first
+// use.
+func (c *Controller) Manifest(ctx context.Context, sourceURL string, opts MasterOptions) (Bundle, error) {
+	built, err := c.buildMaster(ctx, sourceURL, opts)
+	if err != nil {
+		return Bundle{}, err
+	}
+
+	bundle := Bundle{Master: built.playlist}
+	for _, ref := range built.variants {
+		variant, err := c.bundleVariant(ctx, sourceURL, ref.StreamType, ref.Rendition)
+		if err != nil {
+			return Bundle{}, fmt.Errorf("variant %s %s: %w", ref.StreamType, ref.Rendition, err)
+		}
+		bundle.Variants = append(bundle.Variants, variant)
+	}
+
+	meta := built.meta
+	for _, track := range subtitleTracks(meta.Subtitles) {
+		bundle.Subtitles = append(bundle.Subtitles, BundleSubtitle{
+			SubtitleTrack: track,
+			URL:           c.opts.PathGen.SubtitleVTT(sourceURL, track.Key),
+		})
+	}
+
+	if len(built.videos) > 0 {
+		bundle.SpriteVTT = c.opts.PathGen.SpriteVTT(sourceURL)
+		for i := range c.miscGen.SpriteCount(meta.Duration) {
+			bundle.Sprites = append(bundle.Sprites, c.opts.PathGen.Sprite(sourceURL, i))
+		}
+	}
+
+	return bundle, nil
+}
+
+// bundleVariant returns a rendition's variant playlist with the URLs it
+// lists.
+func (c *Controller) bundleVariant(ctx context.Context, sourceURL string, streamType StreamType, renditionName string) (BundleVariant, error) {
+	out, err := c.VariantPlaylist(ctx, sourceURL, streamType, renditionName)
+	if err != nil {
+		return BundleVariant{}, err
+	}
+	index, err := c.getIndex(ctx, sourceURL, streamType, renditionName)
+	if err != nil {
+		return BundleVariant{}, fmt.Errorf("get index: %w", err)
+	}
+
+	variant := BundleVariant{
+		StreamType: streamType,
+		Rendition:  renditionName,
+		URL:        c.opts.PathGen.VariantPlaylist(sourceURL, renditionName, streamType),
+		Playlist:   out,
+		Segments:   make([]string, len(index.Segments)),
+	}
+	if index.Container == domain.ContainerFMP4 {
+		variant.InitSegment = c.playlist.InitSegmentURL(sourceURL, renditionName, streamType)
+	}
+	for i, seg := range index.Segments {
+		variant.Segments[i] = c.playlist.SegmentURL(sourceURL, renditionName, streamType, index.Container, seg.Index)
+	}
+	return variant, nil
+}
+
+// Programs lists the programs of a multi-program source such as a live
+// capture TS, and which of them is served: the first one carrying video.
+// Sources with a single program report no programs and a selection of 0.
+func (c *Controller) Programs(ctx context.Context, sourceURL string) ([]Program, int, error) {
+	meta, err := c.getMetadata(ctx, sourceURL)
+	if err != nil {
+		return nil, 0, fmt.Errorf("get metadata: %w", err)
+	}
+	if len(meta.Programs) < 2 {
+		return nil, 0, nil
+	}
+	return meta.Programs, meta.Program, nil
+}
+
+// subtitleKeys returns the cache key of each subtitle track: its language, or
+// for a repeated language, the language suffixed with the track index.
+func subtitleKeys(subs []domain.SubtitleStream) []string {
+	keys := make([]string, len(subs))
+	seen := make(map[string]bool)
+	for i, sub := range subs {
+		key := sub.Language
+		if seen[key] {
+			key = fmt.Sprintf("%s_%d", sub.Language, i)
+		}
+		seen[sub.Language] = true
+		keys[i] = key
+	}
+	return keys
+}
+
+// QueueDepth returns the number of transcode jobs of a stream type waiting
+// for a worker, as reported by the Coordinator. It returns
+// ErrQueueDepthUnsupported if the Coordinator does not implement QueueDepther.
+func (c *Controller) QueueDepth(ctx context.Context, streamType StreamType) (int, error) {
+	depther, ok := c.opts.Coordinator.(domain.QueueDepther)
+	if !ok {
+		return 0, ErrQueueDepthUnsupported
+	}
+	return depther.QueueDepth(ctx, streamType)
 }
 
 func (c *Controller) enqueueSegment(ctx context.Context, sourceURL string, streamType StreamType, renditionName string, index int) error {
+	return c.opts.Coordinator.Enqueue(ctx, c.jobFor(sourceURL, streamType, renditionName, index))
+}
+
+// prewarm enqueues the first job of the renditions a player starts on: the
+// first video rendition in the master playlist and the default audio
+// rendition. Failures are logged; the segments are then transcoded on demand.
+func (c *Controller) prewarm(ctx context.Context, sourceURL string, videos []VideoRendition, audios []AudioRendition, muxed bool) {
+	audio, hasAudio := playlist.DefaultAudio(audios, c.opts.AudioGroups)
+	if len(videos) > 0 {
+		name := videos[0].Name
+		if muxed && hasAudio {
+			name = domain.MuxedRendition(name, audio.Name)
+		}
+		c.prewarmRendition(ctx, sourceURL, domain.StreamVideo, name)
+	}
+	if hasAudio && !muxed {
+		c.prewarmRendition(ctx, sourceURL, domain.StreamAudio, audio.Name)
+	}
+}
+
+func (c *Controller) prewarmRendition(ctx context.Context, sourceURL string, streamType StreamType, renditionName string) {
+	info := domain.SegmentData{
+		SourceURL: sourceURL,
+		Rendition: renditionName,
+		IsVideo:   streamType == domain.StreamVideo,
+	}
+	exists, err := c.opts.Storage.SegmentExists(ctx, info)
+	if err != nil || exists {
+		return
+	}
+	if c.checkRetries(ctx, info) != nil {
+		return
+	}
+
+	index, err := c.getIndex(ctx, sourceURL, streamType, renditionName)
+	if err != nil || len(index.Segments) == 0 {
+		return
+	}
+
+	job := c.jobFor(sourceURL, streamType, renditionName, 0)
+	key := prewarmKey(job)
+	c.prewarmMu.Lock()
+	if c.prewarming[key] {
+		c.prewarmMu.Unlock()
+		return
+	}
+	c.prewarming[key] = true
+	c.prewarmMu.Unlock()
+
+	// The job is pending until its last segment is announced. The wait
+	// outlives the request, so it is bounded by SegmentTimeout instead.
+	last := info
+	last.Index = min(job.EndIndex, len(index.Segments)-1)
+	waitCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	statusCh, err := c.opts.Coordinator.WaitSegment(waitCtx, last)
+	if err == nil {
+		err = c.opts.Coordinator.Enqueue(ctx, job)
+	}
+	if err != nil {
+		c.opts.Logger.Warn("prewarm failed", "source", sourceURL, "rendition", renditionName, "error", err)
+		cancel()
+		c.endPrewarm(key)
+		return
+	}
+
+	go func() {
+		defer c.endPrewarm(key)
+		defer cancel()
+		select {
+		case <-statusCh:
+		case <-c.opts.Clock.After(c.opts.SegmentTimeout):
+		}
+	}()
+}
+
+// prewarmPending reports whether job's range is already covered by a
+// prewarm job that has not finished.
+func (c *Controller) prewarmPending(job domain.Job) bool {
+	c.prewarmMu.Lock()
+	defer c.prewarmMu.Unlock()
+	return c.prewarming[prewarmKey(job)]
+}
+
+func (c *Controller) endPrewarm(key string) {
+	c.prewarmMu.Lock()
+	delete(c.prewarming, key)
+	c.prewarmMu.Unlock()
+}
+
+func prewarmKey(job domain.Job) string {
+	return fmt.Sprintf("%s|%s|%s|%d", job.SourceURL, job.StreamType, job.Rendition, job.StartIndex)
+}
+
+func (c *Controller) jobFor(sourceURL string, streamType StreamType, renditionName string, index int) domain.Job {
 	startIdx := (index / c.opts.SegmentsPerJob) * c.opts.SegmentsPerJob
 	endIdx := startIdx + c.opts.SegmentsPerJob - 1
 
-	job := domain.Job{
+	return domain.Job{
 		ID:         uuid.New().String(),
 		SourceURL:  sourceURL,
 		Rendition:  renditionName,
@@ -432,8 +2202,6 @@ func (c *Controller) enqueueSegment(ctx context.Context, sourceURL string, strea
 		StartIndex: startIdx,
 		EndIndex:   endIdx,
 	}
-
-	return c.opts.Coordinator.Enqueue(ctx, job)
 }
 
 func (c *Controller) getMetadata(ctx context.Context, sourceURL string) (*domain.Metadata, error) {
@@ -450,8 +2218,171 @@ func (c *Controller) getMetadata(ctx context.Context, sourceURL string) (*domain
 		if err := json.Unmarshal(data, &meta); err != nil {
 			return nil, err
 		}
-		return &meta, nil
+		if !meta.Stale() {
+			return &meta, nil
+		}
 	}
 
 	return c.prober.Probe(ctx, sourceURL)
 }
+
+func (c *Controller) getIndex(ctx context.Context, sourceURL string, streamType StreamType, renditionName string) (*domain.SegmentIndex, error) {
+	meta, err := c.getMetadata(ctx, sourceURL)
+	if err != nil {
+		return nil, fmt.Errorf("get metadata: %w", err)
+	}
+	container, err := c.renditionContainer(meta, streamType, renditionName)
+	if err != nil {
+		return nil, err
+	}
+
+	index := &domain.SegmentIndex{
+		Rendition:      renditionName,
+		StreamType:     streamType,
+		Container:      container,
+		TargetDuration: c.targetDuration(streamType, renditionName),
+		Segments:       c.segmentLayout(meta, streamType, renditionName),
+		Uniform:        c.uniformAudio(streamType),
+	}
+
+	// The stored index is only reused while it still describes the layout
+	// the pools cut from the current metadata and options. A re-probe or a
+	// change of target, codec or ladder rewrites it.
+	exists, err := c.opts.Storage.IndexExists(ctx, sourceURL, renditionName, streamType)
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		data, err := c.opts.Storage.ReadIndex(ctx, sourceURL, renditionName, streamType)
+		if err != nil {
+			return nil, err
+		}
+		var stored domain.SegmentIndex
+		if err := json.Unmarshal(data, &stored); err != nil {
+			return nil, err
+		}
+		if stored.TargetDuration == index.TargetDuration && stored.Uniform == index.Uniform &&
+			stored.Container == index.Container && sameBoundaries(stored.Segments, index.Segments) {
+			return &stored, nil
+		}
+	}
+
+	data, err := json.Marshal(index)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.opts.Storage.WriteIndex(ctx, sourceURL, renditionName, streamType, data); err != nil {
+		return nil, fmt.Errorf("write index: %w", err)
+	}
+
+	return index, nil
+}
+
+// segmentLayout cuts a rendition's segments from the source metadata at the
+// rendition's target duration.
+func (c *Controller) segmentLayout(meta *domain.Metadata, streamType StreamType, renditionName string) []domain.Segment {
+	return playlist.Layout(meta, c.targetDuration(streamType, renditionName), c.uniformAudio(streamType))
+}
+
+// storedIndexMatches reports whether the index stored for a rendition, if
+// any, has the same segment boundaries as segments.
+func (c *Controller) storedIndexMatches(ctx context.Context, sourceURL string, streamType StreamType, renditionName string, segments []domain.Segment) (bool, error) {
+	exists, err := c.opts.Storage.IndexExists(ctx, sourceURL, renditionName, streamType)
+	if err != nil {
+		return false, err
+	}
+	if !exists {
+		return true, nil
+	}
+	data, err := c.opts.Storage.ReadIndex(ctx, sourceURL, renditionName, streamType)
+	if err != nil {
+		return false, err
+	}
+	var index domain.SegmentIndex
+	if err := json.Unmarshal(data, &index); err != nil {
+		return false, err
+	}
+	return sameBoundaries(index.Segments, segments), nil
+}
+
+func sameBoundaries(a, b []domain.Segment) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Index != b[i].Index || a[i].Start != b[i].Start || a[i].End != b[i].End {
+			return false
+		}
+	}
+	return true
+}
+
+// targetDuration returns the segment target of a rendition name, which is
+// Options.TargetDuration (AudioTargetDuration for audio, when set) unless the
+// name carries an override.
+func (c *Controller) targetDuration(streamType StreamType, renditionName string) float64 {
+	if _, target := domain.SplitRendition(renditionName); target > 0 {
+		return target
+	}
+	if c.uniformAudio(streamType) {
+		return c.opts.AudioTargetDuration
+	}
+	return c.opts.TargetDuration
+}
+
+// uniformAudio reports whether streamType is cut on a fixed grid rather than
+// at video keyframes.
+func (c *Controller) uniformAudio(streamType StreamType) bool {
+	return streamType == domain.StreamAudio && c.opts.AudioTargetDuration > 0
+}
+
+func (c *Controller) renditions(meta *domain.Metadata) ([]domain.VideoRendition, []domain.AudioRendition) {
+	videos := rendition.GenerateVideo(meta.Video, c.ladder)
+	var audios []domain.AudioRendition
+	if len(meta.Audios) > 0 {
+		audios = rendition.GenerateAudio(meta.Audios[0], c.ladder)
+	}
+	return videos, audios
+}
+
+func (c *Controller) validateRendition(meta *domain.Metadata, streamType StreamType, renditionName string) error {
+	_, err := c.renditionContainer(meta, streamType, renditionName)
+	return err
+}
+
+// renditionContainer resolves a rendition by name and returns its segment
+// container, or ErrRenditionNotFound.
+func (c *Controller) renditionContainer(meta *domain.Metadata, streamType StreamType, renditionName string) (domain.Container, error) {
+	videos, audios := c.renditions(meta)
+	name, _ := domain.SplitRendition(renditionName)
+	name, muxedAudio := domain.SplitMuxed(name)
+	if muxedAudio != "" && (streamType != domain.StreamVideo || !hasAudioRendition(audios, muxedAudio)) {
+		return "", fmt.Errorf("%w: %s %s", ErrRenditionNotFound, streamType, renditionName)
+	}
+
+	switch streamType {
+	case domain.StreamVideo:
+		for _, v := range videos {
+			if v.Name == name {
+				return v.Container, nil
+			}
+		}
+	case domain.StreamAudio:
+		for _, a := range audios {
+			if a.Name == name {
+				return a.Container, nil
+			}
+		}
+	}
+
+	return "", fmt.Errorf("%w: %s %s", ErrRenditionNotFound, streamType, renditionName)
+}
+
+func hasAudioRendition(audios []domain.AudioRendition, name string) bool {
+	for _, a := range audios {
+		if a.Name == name {
+			return true
+		}
+	}
+	return false
+}
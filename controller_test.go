@@ -1,15 +1,27 @@
 package goshl
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"math"
 	"os"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/eleven-am/goshl/internal/domain"
+	"github.com/eleven-am/goshl/internal/hwaccel"
+	"github.com/eleven-am/goshl/memory"
 )
 
 type stubStorage struct {
@@ -17,8 +29,11 @@ type stubStorage struct {
 	metaExists   bool
 	segments     map[int][]byte
 	segmentCalls int
-	subtitleData []byte
+	subtitles    map[string][]byte
 	spriteVTT    []byte
+	indexes      map[string][]byte
+	failures     map[int][]byte
+	rawProbe     []byte
 }
 
 func (s *stubStorage) MetadataExists(ctx context.Context, sourceURL string) (bool, error) {
@@ -32,6 +47,16 @@ func (s *stubStorage) SetMetadata(ctx context.Context, sourceURL string, data []
 	s.metaExists = true
 	return nil
 }
+func (s *stubStorage) WriteRawProbe(ctx context.Context, sourceURL string, data []byte) error {
+	s.rawProbe = data
+	return nil
+}
+func (s *stubStorage) ReadRawProbe(ctx context.Context, sourceURL string) ([]byte, error) {
+	return s.rawProbe, nil
+}
+func (s *stubStorage) RawProbeExists(ctx context.Context, sourceURL string) (bool, error) {
+	return s.rawProbe != nil, nil
+}
 func (s *stubStorage) WriteSegment(ctx context.Context, info domain.SegmentData, data []byte) error {
 	if s.segments == nil {
 		s.segments = make(map[int][]byte)
@@ -47,6 +72,30 @@ func (s *stubStorage) SegmentExists(ctx context.Context, info domain.SegmentData
 	_, ok := s.segments[info.Index]
 	return ok, nil
 }
+func (s *stubStorage) SegmentSize(ctx context.Context, info domain.SegmentData) (int64, error) {
+	return int64(len(s.segments[info.Index])), nil
+}
+func (s *stubStorage) WriteSegmentFailure(ctx context.Context, info domain.SegmentData, data []byte) error {
+	if s.failures == nil {
+		s.failures = make(map[int][]byte)
+	}
+	s.failures[info.Index] = data
+	return nil
+}
+func (s *stubStorage) ReadSegmentFailure(ctx context.Context, info domain.SegmentData) ([]byte, error) {
+	return s.failures[info.Index], nil
+}
+func (s *stubStorage) SegmentFailureExists(ctx context.Context, info domain.SegmentData) (bool, error) {
+	_, ok := s.failures[info.Index]
+	return ok, nil
+}
+func (s *stubStorage) ReadSegmentFailures(ctx context.Context, sourceURL string, rendition string, streamType domain.StreamType) (map[int][]byte, error) {
+	return s.failures, nil
+}
+func (s *stubStorage) DeleteSegmentFailure(ctx context.Context, info domain.SegmentData) error {
+	delete(s.failures, info.Index)
+	return nil
+}
 func (s *stubStorage) WriteSprite(ctx context.Context, mediaID string, index int, data []byte) error {
 	return nil
 }
@@ -67,20 +116,81 @@ func (s *stubStorage) SpriteVTTExists(ctx context.Context, mediaID string) (bool
 	return s.spriteVTT != nil, nil
 }
 func (s *stubStorage) WriteSubtitleVTT(ctx context.Context, mediaID string, lang string, data []byte) error {
-	s.subtitleData = data
+	if s.subtitles == nil {
+		s.subtitles = make(map[string][]byte)
+	}
+	s.subtitles[lang] = data
 	return nil
 }
 func (s *stubStorage) ReadSubtitleVTT(ctx context.Context, mediaID string, lang string) ([]byte, error) {
-	return s.subtitleData, nil
+	return s.subtitles[lang], nil
 }
 func (s *stubStorage) SubtitleVTTExists(ctx context.Context, mediaID string, lang string) (bool, error) {
-	return s.subtitleData != nil, nil
+	_, ok := s.subtitles[lang]
+	return ok, nil
+}
+func (s *stubStorage) WriteIndex(ctx context.Context, sourceURL string, rendition string, streamType domain.StreamType, data []byte) error {
+	if s.indexes == nil {
+		s.indexes = make(map[string][]byte)
+	}
+	s.indexes[string(streamType)+"/"+rendition] = data
+	return nil
+}
+func (s *stubStorage) ReadIndex(ctx context.Context, sourceURL string, rendition string, streamType domain.StreamType) ([]byte, error) {
+	return s.indexes[string(streamType)+"/"+rendition], nil
+}
+func (s *stubStorage) IndexExists(ctx context.Context, sourceURL string, rendition string, streamType domain.StreamType) (bool, error) {
+	_, ok := s.indexes[string(streamType)+"/"+rendition]
+	return ok, nil
+}
+func (s *stubStorage) ReadKeyframes(ctx context.Context, sourceURL string) ([]byte, error) {
+	return nil, nil
+}
+func (s *stubStorage) KeyframesExists(ctx context.Context, sourceURL string) (bool, error) {
+	return false, nil
+}
+func (s *stubStorage) WriteThumbnail(ctx context.Context, info domain.ThumbnailData, data []byte) error {
+	return nil
+}
+func (s *stubStorage) ReadThumbnail(ctx context.Context, info domain.ThumbnailData) ([]byte, error) {
+	return nil, nil
+}
+func (s *stubStorage) ThumbnailExists(ctx context.Context, info domain.ThumbnailData) (bool, error) {
+	return false, nil
+}
+func (s *stubStorage) WritePoster(ctx context.Context, sourceURL string, data []byte) error {
+	return nil
+}
+func (s *stubStorage) ReadPoster(ctx context.Context, sourceURL string) ([]byte, error) {
+	return nil, nil
+}
+func (s *stubStorage) PosterExists(ctx context.Context, sourceURL string) (bool, error) {
+	return false, nil
+}
+func (s *stubStorage) WriteSubtitleASS(ctx context.Context, sourceURL string, lang string, data []byte) error {
+	return nil
+}
+func (s *stubStorage) ReadSubtitleASS(ctx context.Context, sourceURL string, lang string) ([]byte, error) {
+	return nil, nil
+}
+func (s *stubStorage) SubtitleASSExists(ctx context.Context, sourceURL string, lang string) (bool, error) {
+	return false, nil
+}
+func (s *stubStorage) WriteInitSegment(ctx context.Context, sourceURL string, rendition string, streamType domain.StreamType, data []byte) error {
+	return nil
+}
+func (s *stubStorage) ReadInitSegment(ctx context.Context, sourceURL string, rendition string, streamType domain.StreamType) ([]byte, error) {
+	return nil, nil
+}
+func (s *stubStorage) InitSegmentExists(ctx context.Context, sourceURL string, rendition string, streamType domain.StreamType) (bool, error) {
+	return false, nil
 }
 
 type stubCoordinator struct {
 	enqueued []domain.Job
 	subCh    chan domain.Job
 	waitCh   chan domain.SegmentStatus
+	closed   int
 }
 
 func (c *stubCoordinator) Enqueue(ctx context.Context, job domain.Job) error {
@@ -104,7 +214,16 @@ func (c *stubCoordinator) WaitSegment(ctx context.Context, info domain.SegmentDa
 	}
 	return c.waitCh, nil
 }
-func (c *stubCoordinator) Close() {}
+func (c *stubCoordinator) Close() { c.closed++ }
+
+type depthCoordinator struct {
+	stubCoordinator
+	depths map[domain.StreamType]int
+}
+
+func (c *depthCoordinator) QueueDepth(ctx context.Context, streamType domain.StreamType) (int, error) {
+	return c.depths[streamType], nil
+}
 
 type stubPathGen struct{}
 
@@ -136,14 +255,43 @@ exit 0
 	}
 	orig := os.Getenv("PATH")
 	_ = os.Setenv("PATH", dir+string(os.PathListSeparator)+orig)
-	return func() { _ = os.Setenv("PATH", orig) }
+	hwaccel.ResetCache()
+	return func() {
+		_ = os.Setenv("PATH", orig)
+		hwaccel.ResetCache()
+	}
+}
+
+func TestDetectionTimeoutIsLogged(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "ffmpeg"), []byte("#!/bin/sh\nexec sleep 30\n"), 0755); err != nil {
+		t.Fatalf("write ffmpeg stub: %v", err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	hwaccel.ResetCache()
+	t.Cleanup(hwaccel.ResetCache)
+
+	var logs bytes.Buffer
+	svc := NewController(Options{
+		Storage:       &stubStorage{},
+		Coordinator:   &stubCoordinator{},
+		PathGen:       stubPathGen{},
+		HWAccel:       true,
+		DetectTimeout: 100 * time.Millisecond,
+		Logger:        slog.New(slog.NewTextHandler(&logs, nil)),
+	})
+	defer svc.Stop()
+
+	if !strings.Contains(logs.String(), "hardware detection timed out") || !strings.Contains(logs.String(), "timeout=100ms") {
+		t.Fatalf("expected the detection timeout logged, got %q", logs.String())
+	}
 }
 
 func TestMasterPlaylistUsesCachedMetadata(t *testing.T) {
 	cleanup := installFakeFFmpeg(t)
 	defer cleanup()
 
-	meta := &domain.Metadata{Video: domain.VideoStream{Width: 1920, Height: 1080, Bitrate: 5_000_000}, Audios: []domain.AudioStream{{Codec: "ac3", Channels: 6, Bitrate: 640_000}}}
+	meta := &domain.Metadata{SchemaVersion: domain.MetadataSchemaVersion, Video: domain.VideoStream{Width: 1920, Height: 1080, Bitrate: 5_000_000}, Audios: []domain.AudioStream{{Codec: "ac3", Channels: 6, Bitrate: 640_000}}}
 	metaBytes, _ := json.Marshal(meta)
 	svc := NewController(Options{
 		Storage:     &stubStorage{metaData: metaBytes, metaExists: true},
@@ -160,11 +308,292 @@ func TestMasterPlaylistUsesCachedMetadata(t *testing.T) {
 	}
 }
 
+func TestBaseURLMakesPlaylistURIsAbsolute(t *testing.T) {
+	cleanup := installFakeFFmpeg(t)
+	defer cleanup()
+
+	meta := &domain.Metadata{SchemaVersion: domain.MetadataSchemaVersion, Duration: 12, Keyframes: []float64{0, 6}, Video: domain.VideoStream{Codec: "h264", Width: 1280, Height: 720}, Audios: []domain.AudioStream{{Codec: "aac", Channels: 2}}}
+	metaBytes, _ := json.Marshal(meta)
+	svc := NewController(Options{
+		Storage:     &stubStorage{metaData: metaBytes, metaExists: true},
+		Coordinator: &stubCoordinator{},
+		PathGen:     stubPathGen{},
+		BaseURL:     "https://cdn.example.com/hls/",
+	})
+	ctx := context.Background()
+
+	master, err := svc.MasterPlaylist(ctx, "file:///media")
+	if err != nil {
+		t.Fatalf("master playlist err: %v", err)
+	}
+	if !strings.Contains(master, `URI="https://cdn.example.com/hls/variant"`) || !strings.Contains(master, "\nhttps://cdn.example.com/hls/variant\n") {
+		t.Fatalf("expected absolute variant URIs: %s", master)
+	}
+
+	variant, err := svc.VariantPlaylist(ctx, "file:///media", StreamVideo, "720p")
+	if err != nil {
+		t.Fatalf("variant playlist err: %v", err)
+	}
+	if strings.Count(variant, "https://cdn.example.com/hls/segment\n") != 2 {
+		t.Fatalf("expected absolute segment URIs: %s", variant)
+	}
+
+	for _, base := range []string{"https://cdn.example.com/?token=1", "cdn.example.com", "https://"} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Fatalf("expected panic for BaseURL %q", base)
+				}
+			}()
+			NewController(Options{
+				Storage:     &stubStorage{},
+				Coordinator: &stubCoordinator{},
+				PathGen:     stubPathGen{},
+				BaseURL:     base,
+			})
+		}()
+	}
+}
+
+func TestContentTypeAndCacheDuration(t *testing.T) {
+	cleanup := installFakeFFmpeg(t)
+	defer cleanup()
+
+	svc := NewController(Options{
+		Storage:     &stubStorage{},
+		Coordinator: &stubCoordinator{},
+		PathGen:     stubPathGen{},
+		SpriteImage: ImageOptions{Format: ImageWebP},
+	})
+
+	types := map[Artifact]string{
+		ArtifactMasterPlaylist:          "application/vnd.apple.mpegurl",
+		ArtifactVariantPlaylist:         "application/vnd.apple.mpegurl",
+		ContainerTS.SegmentArtifact():   "video/MP2T",
+		ContainerFMP4.SegmentArtifact(): "video/iso.segment",
+		ArtifactInitSegment:             "video/mp4",
+		ArtifactSubtitleVTT:             "text/vtt",
+		ArtifactSubtitleASS:             "text/x-ssa",
+		ArtifactSpriteVTT:               "text/vtt",
+		ArtifactSprite:                  "image/webp",
+		ArtifactThumbnail:               "image/jpeg",
+		ArtifactPoster:                  "image/jpeg",
+		Artifact("unknown"):             "application/octet-stream",
+	}
+	for kind, want := range types {
+		if got := svc.ContentType(kind); got != want {
+			t.Fatalf("ContentType(%s) = %q, want %q", kind, got, want)
+		}
+	}
+
+	if got := svc.CacheDuration(ArtifactVariantPlaylist); got != time.Minute {
+		t.Fatalf("expected playlists cached briefly, got %v", got)
+	}
+	if svc.CacheDuration(ArtifactSegment) <= svc.CacheDuration(ArtifactMasterPlaylist) {
+		t.Fatalf("segments must be cached longer than playlists")
+	}
+	for kind := range types {
+		if kind != "unknown" && svc.CacheDuration(kind) <= 0 {
+			t.Fatalf("no cache duration for %s", kind)
+		}
+	}
+	if got := svc.CacheDuration("unknown"); got != 0 {
+		t.Fatalf("unknown artifacts must not be cached, got %v", got)
+	}
+}
+
+func TestProbeOptionSuppliesMetadata(t *testing.T) {
+	cleanup := installFakeFFmpeg(t)
+	defer cleanup()
+
+	store := &stubStorage{}
+	var probed []string
+	svc := NewController(Options{
+		Storage:     store,
+		Coordinator: &stubCoordinator{},
+		PathGen:     stubPathGen{},
+		Probe: func(ctx context.Context, sourceURL string) (*Metadata, error) {
+			probed = append(probed, sourceURL)
+			return &Metadata{
+				Duration:  12,
+				Keyframes: []float64{0, 6},
+				Video:     VideoStream{Codec: "h264", Width: 1280, Height: 720, Bitrate: 3_000_000},
+				Audios:    []AudioStream{{Codec: "aac", Channels: 2}},
+			}, nil
+		},
+	})
+	ctx := context.Background()
+
+	master, err := svc.MasterPlaylist(ctx, "catalog://42")
+	if err != nil {
+		t.Fatalf("master playlist err: %v", err)
+	}
+	if !strings.Contains(master, "RESOLUTION=1280x720") {
+		t.Fatalf("expected the supplied video in the master: %s", master)
+	}
+	if !store.metaExists {
+		t.Fatalf("supplied metadata must be cached for the transcode pools")
+	}
+
+	args, err := svc.InspectSegmentCommand(ctx, "catalog://42", StreamVideo, "720p", 1)
+	if err != nil {
+		t.Fatalf("inspect err: %v", err)
+	}
+	if joined := strings.Join(args, " "); !strings.Contains(joined, "-segment_times 6.000000,12.000000") {
+		t.Fatalf("expected the job cut from the supplied keyframes: %s", joined)
+	}
+	if len(probed) != 1 {
+		t.Fatalf("expected one call to Probe, got %v", probed)
+	}
+}
+
+func TestSegmentTimeDeltaCanBeZero(t *testing.T) {
+	cleanup := installFakeFFmpeg(t)
+	defer cleanup()
+
+	for _, tc := range []struct {
+		delta float64
+		want  string
+	}{
+		{0, "-segment_time_delta 0.05 "},
+		{-1, "-segment_time_delta 0 "},
+		{0.1, "-segment_time_delta 0.1 "},
+	} {
+		svc := NewController(Options{
+			Storage:          &stubStorage{},
+			Coordinator:      &stubCoordinator{},
+			PathGen:          stubPathGen{},
+			SegmentTimeDelta: tc.delta,
+			Probe: func(ctx context.Context, sourceURL string) (*Metadata, error) {
+				return &Metadata{
+					Duration:  12,
+					Keyframes: []float64{0, 6},
+					Video:     VideoStream{Codec: "h264", Width: 1280, Height: 720, Bitrate: 3_000_000},
+				}, nil
+			},
+		})
+		args, err := svc.InspectSegmentCommand(context.Background(), "file:///media", StreamVideo, "720p", 0)
+		if err != nil {
+			t.Fatalf("delta %v: inspect err: %v", tc.delta, err)
+		}
+		if joined := strings.Join(args, " "); !strings.Contains(joined, tc.want) {
+			t.Fatalf("delta %v: expected %q in %s", tc.delta, tc.want, joined)
+		}
+	}
+}
+
+func TestMismatchedStreamDurationsKeepPlaylistsAligned(t *testing.T) {
+	cleanup := installFakeFFmpeg(t)
+	defer cleanup()
+
+	keyframes := []float64{0, 6, 12, 18, 24, 30, 36, 42, 48, 54}
+	for _, tc := range []struct {
+		name     string
+		audio    float64
+		duration float64
+		wantPad  bool
+	}{
+		{"audio runs long", 70, 70, false},
+		{"audio ends early", 55, 60, true},
+	} {
+		svc := NewController(Options{
+			Storage:        &stubStorage{},
+			Coordinator:    &stubCoordinator{},
+			PathGen:        stubPathGen{},
+			SegmentsPerJob: 5,
+			Probe: func(ctx context.Context, sourceURL string) (*Metadata, error) {
+				return &Metadata{
+					Duration:  tc.duration,
+					Keyframes: keyframes,
+					Video:     VideoStream{Codec: "h264", Width: 1280, Height: 720, Bitrate: 3_000_000, Duration: 60},
+					Audios:    []AudioStream{{Codec: "ac3", Channels: 6, Bitrate: 448_000, Duration: tc.audio}},
+				}, nil
+			},
+		})
+		ctx := context.Background()
+
+		video, err := svc.VariantPlaylist(ctx, "file:///media", StreamVideo, "720p")
+		if err != nil {
+			t.Fatalf("%s: video playlist err: %v", tc.name, err)
+		}
+		for _, rendition := range []string{"aac_stereo", "ac3_passthrough"} {
+			audio, err := svc.VariantPlaylist(ctx, "file:///media", StreamAudio, rendition)
+			if err != nil {
+				t.Fatalf("%s: %s playlist err: %v", tc.name, rendition, err)
+			}
+			if v, a := strings.Count(video, "#EXTINF"), strings.Count(audio, "#EXTINF"); v != 10 || a != v {
+				t.Fatalf("%s: expected 10 segments in both playlists, got video %d, %s %d", tc.name, v, rendition, a)
+			}
+			for _, out := range []string{video, audio} {
+				last := out[strings.LastIndex(out, "#EXTINF"):]
+				if !strings.HasPrefix(last, "#EXTINF:6.000,") {
+					t.Fatalf("%s: expected the last segment to end with the video, got %s", tc.name, last)
+				}
+			}
+
+			first, err := svc.InspectSegmentCommand(ctx, "file:///media", StreamAudio, rendition, 0)
+			if err != nil {
+				t.Fatalf("%s: inspect err: %v", tc.name, err)
+			}
+			last, err := svc.InspectSegmentCommand(ctx, "file:///media", StreamAudio, rendition, 9)
+			if err != nil {
+				t.Fatalf("%s: inspect err: %v", tc.name, err)
+			}
+			firstArgs, lastArgs := strings.Join(first, " "), strings.Join(last, " ")
+			if strings.Contains(firstArgs, "apad") || strings.Contains(lastArgs, "apad") != tc.wantPad {
+				t.Fatalf("%s: expected only the final %s job padded (%v): %v / %v", tc.name, rendition, tc.wantPad, first, last)
+			}
+			if rendition == "ac3_passthrough" {
+				if !strings.Contains(firstArgs, "-c:a copy") {
+					t.Fatalf("%s: expected the first passthrough job copied: %v", tc.name, first)
+				}
+				if strings.Contains(lastArgs, "-c:a ac3 ") != tc.wantPad {
+					t.Fatalf("%s: expected the padded passthrough tail re-encoded as ac3 (%v): %v", tc.name, tc.wantPad, last)
+				}
+			}
+		}
+	}
+}
+
+func TestMasterPlaylistWithoutVideoDimensions(t *testing.T) {
+	cleanup := installFakeFFmpeg(t)
+	defer cleanup()
+
+	meta := &domain.Metadata{
+		SchemaVersion: domain.MetadataSchemaVersion,
+		Duration:      12,
+		Keyframes:     []float64{0, 6},
+		Video:         domain.VideoStream{Codec: "h264"},
+		Audios:        []domain.AudioStream{{Codec: "aac", Channels: 2}},
+	}
+	metaBytes, _ := json.Marshal(meta)
+	svc := NewController(Options{
+		Storage:        &stubStorage{metaData: metaBytes, metaExists: true},
+		Coordinator:    &stubCoordinator{},
+		PathGen:        stubPathGen{},
+		UpscaleHeights: []int{720},
+	})
+
+	out, err := svc.MasterPlaylist(context.Background(), "file:///media")
+	if err != nil {
+		t.Fatalf("master playlist err: %v", err)
+	}
+	if strings.Contains(out, "RESOLUTION") || strings.Contains(out, "EXT-X-MEDIA") {
+		t.Fatalf("expected an audio-only master without RESOLUTION: %s", out)
+	}
+	if !strings.Contains(out, "#EXT-X-STREAM-INF:BANDWIDTH=128000,CODECS=\"mp4a.40.2\"\n") {
+		t.Fatalf("expected the audio rendition as a variant: %s", out)
+	}
+	if _, err := svc.VariantPlaylist(context.Background(), "file:///media", StreamVideo, "720p"); !errors.Is(err, ErrRenditionNotFound) {
+		t.Fatalf("expected no video renditions, got %v", err)
+	}
+}
+
 func TestSegmentReturnsCachedData(t *testing.T) {
 	cleanup := installFakeFFmpeg(t)
 	defer cleanup()
 
-	meta := &domain.Metadata{Duration: 10, Keyframes: []float64{0, 6, 10}}
+	meta := &domain.Metadata{SchemaVersion: domain.MetadataSchemaVersion, Duration: 10, Keyframes: []float64{0, 6, 10}}
 	metaBytes, _ := json.Marshal(meta)
 	store := &stubStorage{metaData: metaBytes, metaExists: true, segments: map[int][]byte{3: []byte("ok")}}
 	svc := NewController(Options{
@@ -182,14 +611,145 @@ func TestSegmentReturnsCachedData(t *testing.T) {
 	}
 }
 
+type checksumStorage struct {
+	stubStorage
+	sums map[int][]byte
+}
+
+func (s *checksumStorage) WriteSegmentChecksum(ctx context.Context, info domain.SegmentData, sum []byte) error {
+	s.sums[info.Index] = sum
+	return nil
+}
+func (s *checksumStorage) ReadSegmentChecksum(ctx context.Context, info domain.SegmentData) ([]byte, error) {
+	return s.sums[info.Index], nil
+}
+
+func TestSegmentVerifiesChecksums(t *testing.T) {
+	cleanup := installFakeFFmpeg(t)
+	defer cleanup()
+
+	meta := &domain.Metadata{SchemaVersion: domain.MetadataSchemaVersion, Duration: 10, Keyframes: []float64{0, 6, 10}}
+	metaBytes, _ := json.Marshal(meta)
+	good := sha256.Sum256([]byte("ok"))
+	store := &checksumStorage{
+		stubStorage: stubStorage{metaData: metaBytes, metaExists: true, segments: map[int][]byte{
+			0: []byte("ok"), 1: []byte("bitrot"), 2: []byte("legacy"),
+		}},
+		sums: map[int][]byte{0: good[:], 1: good[:]},
+	}
+	svc := NewController(Options{
+		Storage:        store,
+		Coordinator:    &stubCoordinator{},
+		PathGen:        stubPathGen{},
+		VerifySegments: true,
+	})
+
+	if data, err := svc.Segment(context.Background(), "file:///media", domain.StreamVideo, "1080p", 0); err != nil || string(data) != "ok" {
+		t.Fatalf("expected verified segment, got %q, %v", data, err)
+	}
+	if _, err := svc.Segment(context.Background(), "file:///media", domain.StreamVideo, "1080p", 1); !errors.Is(err, ErrSegmentCorrupt) {
+		t.Fatalf("expected ErrSegmentCorrupt, got %v", err)
+	}
+	if data, err := svc.Segment(context.Background(), "file:///media", domain.StreamVideo, "1080p", 2); err != nil || string(data) != "legacy" {
+		t.Fatalf("expected segment without checksum served unverified, got %q, %v", data, err)
+	}
+}
+
+func TestVerifySegmentsRequiresChecksummer(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatalf("expected panic for storage without checksums")
+		}
+	}()
+	NewController(Options{
+		Storage:        &stubStorage{},
+		Coordinator:    &stubCoordinator{},
+		PathGen:        stubPathGen{},
+		VerifySegments: true,
+	})
+}
+
+func TestSegmentSizeReadsStoredSizeWithoutTranscoding(t *testing.T) {
+	cleanup := installFakeFFmpeg(t)
+	defer cleanup()
+
+	store := &stubStorage{segments: map[int][]byte{2: []byte("abcd")}}
+	coord := &stubCoordinator{}
+	svc := NewController(Options{
+		Storage:     store,
+		Coordinator: coord,
+		PathGen:     stubPathGen{},
+	})
+
+	size, err := svc.SegmentSize(context.Background(), "file:///media", domain.StreamVideo, "1080p", 2)
+	if err != nil {
+		t.Fatalf("segment size err: %v", err)
+	}
+	if size != 4 {
+		t.Fatalf("expected size 4, got %d", size)
+	}
+
+	if _, err := svc.SegmentSize(context.Background(), "file:///media", domain.StreamVideo, "1080p", 3); err == nil {
+		t.Fatalf("expected error for missing segment")
+	}
+	if len(coord.enqueued) != 0 {
+		t.Fatalf("segment size should never enqueue work")
+	}
+	if store.segmentCalls != 0 {
+		t.Fatalf("expected the size from SegmentSizer, read the segment %d times", store.segmentCalls)
+	}
+}
+
+// plainStorage hides every optional interface of the Storage it wraps.
+type plainStorage struct{ domain.Storage }
+
+func TestSegmentSizeWithoutSizerReadsSegment(t *testing.T) {
+	cleanup := installFakeFFmpeg(t)
+	defer cleanup()
+
+	store := &stubStorage{segments: map[int][]byte{2: []byte("abcd")}}
+	svc := NewController(Options{
+		Storage:     plainStorage{store},
+		Coordinator: &stubCoordinator{},
+		PathGen:     stubPathGen{},
+	})
+
+	size, err := svc.SegmentSize(context.Background(), "file:///media", domain.StreamVideo, "1080p", 2)
+	if err != nil || size != 4 {
+		t.Fatalf("expected size 4 from the segment, got %d, %v", size, err)
+	}
+	if store.segmentCalls != 1 {
+		t.Fatalf("expected one segment read, got %d", store.segmentCalls)
+	}
+}
+
+func TestThumbnailRejectsTimeAtOrPastTheEnd(t *testing.T) {
+	cleanup := installFakeFFmpeg(t)
+	defer cleanup()
+
+	meta := &domain.Metadata{SchemaVersion: domain.MetadataSchemaVersion, Duration: 12, Keyframes: []float64{0, 6}, Video: domain.VideoStream{Width: 1920, Height: 1080}}
+	metaBytes, _ := json.Marshal(meta)
+	svc := NewController(Options{
+		Storage:     &stubStorage{metaData: metaBytes, metaExists: true},
+		Coordinator: &stubCoordinator{},
+		PathGen:     stubPathGen{},
+	})
+
+	for _, at := range []float64{-1, 12, 13} {
+		if _, err := svc.Thumbnail(context.Background(), "file:///media", at, 0, 0); err == nil || !strings.Contains(err.Error(), "outside") {
+			t.Fatalf("expected time %.0fs to be rejected, got %v", at, err)
+		}
+	}
+}
+
 func TestSegmentEnqueuesWhenMissingAndUsesPubSubReady(t *testing.T) {
 	cleanup := installFakeFFmpeg(t)
 	defer cleanup()
 
-	meta := &domain.Metadata{Duration: 12, Keyframes: []float64{0, 6, 12}, Video: domain.VideoStream{Width: 1920, Height: 1080}}
+	meta := &domain.Metadata{SchemaVersion: domain.MetadataSchemaVersion, Duration: 12, Keyframes: []float64{0, 6, 12}, Video: domain.VideoStream{Width: 1920, Height: 1080}, Audios: []domain.AudioStream{{Codec: "aac", Channels: 2}}}
 	metaBytes, _ := json.Marshal(meta)
 	store := &stubStorage{metaData: metaBytes, metaExists: true, segments: map[int][]byte{0: []byte("seg0")}}
-	coord := &stubCoordinator{}
+	coord := &stubCoordinator{waitCh: make(chan domain.SegmentStatus, 1)}
 	svc := NewController(Options{
 		Storage:     store,
 		Coordinator: coord,
@@ -197,10 +757,7 @@ func TestSegmentEnqueuesWhenMissingAndUsesPubSubReady(t *testing.T) {
 	})
 
 	// simulate worker ready
-	go func() {
-		time.Sleep(10 * time.Millisecond)
-		coord.waitCh <- domain.SegmentStatus{State: domain.SegmentStateReady}
-	}()
+	coord.waitCh <- domain.SegmentStatus{State: domain.SegmentStateReady}
 
 	data, err := svc.Segment(context.Background(), "file:///media", domain.StreamAudio, "aac_stereo", 1)
 	if err != nil {
@@ -219,19 +776,1358 @@ func TestSegmentEnqueuesWhenMissingAndUsesPubSubReady(t *testing.T) {
 	}
 }
 
-func TestSubtitleVTTReturnsErrorWhenLanguageMissing(t *testing.T) {
+func TestSegmentStopsRetryingAfterMaxSegmentRetries(t *testing.T) {
 	cleanup := installFakeFFmpeg(t)
 	defer cleanup()
 
-	meta := &domain.Metadata{Subtitles: []domain.SubtitleStream{{Language: "es"}}}
+	meta := &domain.Metadata{SchemaVersion: domain.MetadataSchemaVersion, Duration: 12, Keyframes: []float64{0, 6, 12}, Audios: []domain.AudioStream{{Codec: "aac", Channels: 2}}}
 	metaBytes, _ := json.Marshal(meta)
+	failure, _ := json.Marshal(domain.SegmentFailure{Attempts: 2, Error: "corrupt packet"})
+	store := &stubStorage{metaData: metaBytes, metaExists: true, failures: map[int][]byte{1: failure}}
+	coord := &stubCoordinator{waitCh: make(chan domain.SegmentStatus, 1)}
 	svc := NewController(Options{
-		Storage:     &stubStorage{metaData: metaBytes, metaExists: true},
-		Coordinator: &stubCoordinator{},
-		PathGen:     stubPathGen{},
+		Storage:           store,
+		Coordinator:       coord,
+		PathGen:           stubPathGen{},
+		MaxSegmentRetries: 2,
 	})
 
-	if _, err := svc.SubtitleVTT(context.Background(), "file:///media", "en"); err == nil {
-		t.Fatalf("expected error for missing language")
+	_, err := svc.Segment(context.Background(), "file:///media", domain.StreamAudio, "aac_stereo", 1)
+	if !errors.Is(err, ErrSegmentFailed) || !strings.Contains(err.Error(), "corrupt packet") {
+		t.Fatalf("expected cached failure, got %v", err)
+	}
+	if len(coord.enqueued) != 0 {
+		t.Fatalf("exhausted segment must not be enqueued, got %d jobs", len(coord.enqueued))
+	}
+
+	if err := svc.ResetSegmentError(context.Background(), "file:///media", domain.StreamAudio, "aac_stereo", 1); err != nil {
+		t.Fatalf("reset err: %v", err)
+	}
+	coord.waitCh <- domain.SegmentStatus{State: domain.SegmentStateReady}
+	if _, err := svc.Segment(context.Background(), "file:///media", domain.StreamAudio, "aac_stereo", 1); err != nil {
+		t.Fatalf("segment after reset err: %v", err)
+	}
+	if len(coord.enqueued) != 1 {
+		t.Fatalf("expected a retry after reset, got %d jobs", len(coord.enqueued))
+	}
+}
+
+func TestStopClosesCoordinatorUnlessKeptOpen(t *testing.T) {
+	coord := &stubCoordinator{}
+	svc := NewController(Options{Storage: &stubStorage{}, Coordinator: coord, PathGen: stubPathGen{}})
+	svc.Stop()
+	svc.Stop()
+	if coord.closed != 1 {
+		t.Fatalf("expected Stop to close the coordinator once, got %d", coord.closed)
+	}
+
+	kept := &stubCoordinator{}
+	svc = NewController(Options{Storage: &stubStorage{}, Coordinator: kept, PathGen: stubPathGen{}, KeepCoordinatorOpen: true})
+	svc.Stop()
+	if kept.closed != 0 {
+		t.Fatalf("KeepCoordinatorOpen must leave the coordinator open")
+	}
+}
+
+type manualClock struct {
+	fire chan time.Time
+}
+
+func (c *manualClock) After(d time.Duration) <-chan time.Time { return c.fire }
+
+func TestSegmentTimesOutOnClock(t *testing.T) {
+	cleanup := installFakeFFmpeg(t)
+	defer cleanup()
+
+	meta := &domain.Metadata{SchemaVersion: domain.MetadataSchemaVersion, Duration: 12, Keyframes: []float64{0, 6, 12}, Audios: []domain.AudioStream{{Codec: "aac", Channels: 2}}}
+	metaBytes, _ := json.Marshal(meta)
+	clock := &manualClock{fire: make(chan time.Time, 1)}
+	clock.fire <- time.Time{}
+	svc := NewController(Options{
+		Storage:        &stubStorage{metaData: metaBytes, metaExists: true},
+		Coordinator:    &stubCoordinator{},
+		PathGen:        stubPathGen{},
+		SegmentTimeout: time.Hour,
+		Clock:          clock,
+	})
+
+	_, err := svc.Segment(context.Background(), "file:///media", domain.StreamAudio, "aac_stereo", 1)
+	if err == nil || !strings.Contains(err.Error(), "timeout waiting for segment 1") {
+		t.Fatalf("expected timeout from injected clock, got %v", err)
+	}
+}
+
+func TestSegmentReleasesWaitOnEveryReturnPath(t *testing.T) {
+	cleanup := installFakeFFmpeg(t)
+	defer cleanup()
+
+	meta := &domain.Metadata{SchemaVersion: domain.MetadataSchemaVersion, Duration: 12, Keyframes: []float64{0, 6, 12}, Audios: []domain.AudioStream{{Codec: "aac", Channels: 2}}}
+	metaBytes, _ := json.Marshal(meta)
+	clock := &manualClock{fire: make(chan time.Time, 1)}
+	coord := memory.NewCoordinator(0)
+	svc := NewController(Options{
+		Storage:        &stubStorage{metaData: metaBytes, metaExists: true},
+		Coordinator:    coord,
+		PathGen:        stubPathGen{},
+		SegmentTimeout: time.Hour,
+		Clock:          clock,
+	})
+
+	for i := 0; i < 20; i++ {
+		clock.fire <- time.Time{}
+		if _, err := svc.Segment(context.Background(), "file:///media", StreamAudio, "aac_stereo", 1); err == nil {
+			t.Fatal("expected a timeout")
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if _, err := svc.Segment(ctx, "file:///media", StreamAudio, "aac_stereo", 1); !errors.Is(err, context.Canceled) {
+			t.Fatalf("expected cancellation, got %v", err)
+		}
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for coord.Waiters() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("abandoned requests leaked %d waiters", coord.Waiters())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSubtitleWithOffsetCachesShiftedTrack(t *testing.T) {
+	cleanup := installFakeFFmpeg(t)
+	defer cleanup()
+
+	meta := &domain.Metadata{SchemaVersion: domain.MetadataSchemaVersion, Duration: 60, Subtitles: []domain.SubtitleStream{{Language: "en", Codec: "subrip"}}}
+	metaBytes, _ := json.Marshal(meta)
+	store := &stubStorage{metaData: metaBytes, metaExists: true, subtitles: map[string][]byte{
+		"en": []byte("WEBVTT\n\n00:00:01.000 --> 00:00:02.000\nHi\n"),
+	}}
+	svc := NewController(Options{
+		Storage:     store,
+		Coordinator: &stubCoordinator{},
+		PathGen:     stubPathGen{},
+	})
+
+	data, err := svc.SubtitleWith(context.Background(), "file:///media", "en", SubtitleOptions{Offset: 1.5})
+	if err != nil {
+		t.Fatalf("subtitle err: %v", err)
+	}
+	if !strings.Contains(string(data), "00:00:02.500 --> 00:00:03.500") {
+		t.Fatalf("expected cues delayed by 1.5s: %q", data)
+	}
+	if string(store.subtitles["en@+1.5"]) != string(data) {
+		t.Fatalf("expected the shifted track cached under its own key, got %v", store.subtitles)
+	}
+	if !strings.Contains(string(store.subtitles["en"]), "00:00:01.000") {
+		t.Fatal("the unshifted track must be left as is")
+	}
+
+	if _, err := svc.SubtitleWith(context.Background(), "file:///media", "en", SubtitleOptions{Offset: 1.5000001}); err != nil {
+		t.Fatalf("subtitle err: %v", err)
+	}
+	if len(store.subtitles) != 2 {
+		t.Fatalf("expected offsets rounded to milliseconds to share a cache entry, got %d entries", len(store.subtitles))
+	}
+	for _, offset := range []float64{math.NaN(), math.Inf(1), math.Inf(-1), 61, -61} {
+		if _, err := svc.SubtitleWith(context.Background(), "file:///media", "en", SubtitleOptions{Offset: offset}); err == nil {
+			t.Fatalf("expected offset %v to be rejected", offset)
+		}
+	}
+}
+
+func TestSubtitleVTTReturnsErrorWhenLanguageMissing(t *testing.T) {
+	cleanup := installFakeFFmpeg(t)
+	defer cleanup()
+
+	meta := &domain.Metadata{SchemaVersion: domain.MetadataSchemaVersion, Subtitles: []domain.SubtitleStream{{Language: "es"}}}
+	metaBytes, _ := json.Marshal(meta)
+	svc := NewController(Options{
+		Storage:     &stubStorage{metaData: metaBytes, metaExists: true},
+		Coordinator: &stubCoordinator{},
+		PathGen:     stubPathGen{},
+	})
+
+	if _, err := svc.SubtitleVTT(context.Background(), "file:///media", "en"); err == nil {
+		t.Fatalf("expected error for missing language")
+	}
+}
+
+func TestExtractAllSubtitlesCachesEachTrackAndJoinsFailures(t *testing.T) {
+	dir := t.TempDir()
+	script := "#!/bin/sh\ncase \"$*\" in *0:s:2*) exit 1;; esac\nprintf \"WEBVTT $*\"\n"
+	if err := os.WriteFile(filepath.Join(dir, "ffmpeg"), []byte(script), 0755); err != nil {
+		t.Fatalf("write ffmpeg stub: %v", err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	meta := &domain.Metadata{SchemaVersion: domain.MetadataSchemaVersion, Subtitles: []domain.SubtitleStream{
+		{Language: "en", Codec: "subrip"},
+		{Language: "en", Codec: "ass"},
+		{Language: "fr", Codec: "hdmv_pgs_subtitle"},
+	}}
+	metaBytes, _ := json.Marshal(meta)
+	store := &stubStorage{metaData: metaBytes, metaExists: true}
+	svc := NewController(Options{
+		Storage:     store,
+		Coordinator: &stubCoordinator{},
+		PathGen:     stubPathGen{},
+	})
+
+	err := svc.ExtractAllSubtitles(context.Background(), "file:///media")
+	if err == nil || !strings.Contains(err.Error(), "subtitle fr (hdmv_pgs_subtitle)") {
+		t.Fatalf("expected failure for the image track, got %v", err)
+	}
+	if !strings.Contains(string(store.subtitles["en"]), "0:s:0") || !strings.Contains(string(store.subtitles["en_1"]), "0:s:1") {
+		t.Fatalf("expected both english tracks cached under distinct keys, got %v", store.subtitles)
+	}
+
+	data, err := svc.SubtitleVTT(context.Background(), "file:///media", "en_1")
+	if err != nil || !strings.Contains(string(data), "0:s:1") {
+		t.Fatalf("expected duplicate-language key to resolve, got %q, %v", data, err)
+	}
+}
+
+func TestSubtitleTracksReportsFlagsAndKeys(t *testing.T) {
+	cleanup := installFakeFFmpeg(t)
+	defer cleanup()
+
+	meta := &domain.Metadata{SchemaVersion: domain.MetadataSchemaVersion, Subtitles: []domain.SubtitleStream{
+		{Language: "en", Codec: "subrip", Default: true},
+		{Language: "en", Codec: "ass", Title: "Signs & Songs", Forced: true},
+	}}
+	metaBytes, _ := json.Marshal(meta)
+	svc := NewController(Options{
+		Storage:     &stubStorage{metaData: metaBytes, metaExists: true},
+		Coordinator: &stubCoordinator{},
+		PathGen:     stubPathGen{},
+	})
+
+	tracks, err := svc.SubtitleTracks(context.Background(), "file:///media")
+	if err != nil {
+		t.Fatalf("subtitle tracks err: %v", err)
+	}
+	want := []SubtitleTrack{
+		{Key: "en", Language: "en", Codec: "subrip", Default: true},
+		{Key: "en_1", Language: "en", Title: "Signs & Songs", Codec: "ass", Forced: true},
+	}
+	if len(tracks) != len(want) {
+		t.Fatalf("expected %d tracks, got %#v", len(want), tracks)
+	}
+	for i := range want {
+		if tracks[i] != want[i] {
+			t.Fatalf("track %d: want %#v, got %#v", i, want[i], tracks[i])
+		}
+	}
+}
+
+func TestProgramsReportsSelection(t *testing.T) {
+	cleanup := installFakeFFmpeg(t)
+	defer cleanup()
+
+	meta := &domain.Metadata{SchemaVersion: domain.MetadataSchemaVersion, Program: 2, Programs: []domain.Program{
+		{ID: 1, Name: "Radio", Streams: []int{0}},
+		{ID: 2, Name: "News HD", Streams: []int{1, 2}},
+	}}
+	metaBytes, _ := json.Marshal(meta)
+	svc := NewController(Options{
+		Storage:     &stubStorage{metaData: metaBytes, metaExists: true},
+		Coordinator: &stubCoordinator{},
+		PathGen:     stubPathGen{},
+	})
+
+	programs, selected, err := svc.Programs(context.Background(), "file:///capture.ts")
+	if err != nil {
+		t.Fatalf("programs err: %v", err)
+	}
+	if selected != 2 || len(programs) != 2 || programs[1].Name != "News HD" {
+		t.Fatalf("unexpected programs %#v, selected %d", programs, selected)
+	}
+}
+
+func TestSubtitleASSRejectsNonASSTracks(t *testing.T) {
+	cleanup := installFakeFFmpeg(t)
+	defer cleanup()
+
+	meta := &domain.Metadata{SchemaVersion: domain.MetadataSchemaVersion, Subtitles: []domain.SubtitleStream{{Language: "en", Codec: "subrip"}}}
+	metaBytes, _ := json.Marshal(meta)
+	svc := NewController(Options{
+		Storage:     &stubStorage{metaData: metaBytes, metaExists: true},
+		Coordinator: &stubCoordinator{},
+		PathGen:     stubPathGen{},
+	})
+
+	if _, err := svc.Subtitle(context.Background(), "file:///media", "en", SubtitleFormatASS); err == nil || !strings.Contains(err.Error(), "not ass") {
+		t.Fatalf("expected error for subrip track, got %v", err)
+	}
+	if _, err := svc.Subtitle(context.Background(), "file:///media", "en", "srt"); err == nil {
+		t.Fatalf("expected error for unsupported format")
+	}
+}
+
+func TestVariantPlaylistPersistsAndReusesIndex(t *testing.T) {
+	cleanup := installFakeFFmpeg(t)
+	defer cleanup()
+
+	meta := &domain.Metadata{SchemaVersion: domain.MetadataSchemaVersion, Duration: 12, Keyframes: []float64{0, 6, 12}, Video: domain.VideoStream{Width: 1920, Height: 1080}}
+	metaBytes, _ := json.Marshal(meta)
+	store := &stubStorage{metaData: metaBytes, metaExists: true}
+	svc := NewController(Options{
+		Storage:     store,
+		Coordinator: &stubCoordinator{},
+		PathGen:     stubPathGen{},
+	})
+
+	first, err := svc.VariantPlaylist(context.Background(), "file:///media", domain.StreamVideo, "1080p")
+	if err != nil {
+		t.Fatalf("variant playlist err: %v", err)
+	}
+	if _, ok := store.indexes["video/1080p"]; !ok {
+		t.Fatalf("expected index to be persisted on first request")
+	}
+
+	// A stored index that still matches the metadata is reused as is.
+	var stored domain.SegmentIndex
+	if err := json.Unmarshal(store.indexes["video/1080p"], &stored); err != nil {
+		t.Fatalf("decode index: %v", err)
+	}
+	stored.Segments[0].Duration = 5.5
+	store.indexes["video/1080p"], _ = json.Marshal(stored)
+
+	second, err := svc.VariantPlaylist(context.Background(), "file:///media", domain.StreamVideo, "1080p")
+	if err != nil {
+		t.Fatalf("variant playlist from index err: %v", err)
+	}
+	if first == second || !strings.Contains(second, "#EXTINF:5.500") {
+		t.Fatalf("expected the stored index to be reused:\n%s", second)
+	}
+
+	// After a re-probe that moves the keyframes, the index is rebuilt to
+	// the layout the pool now cuts.
+	meta.Keyframes = []float64{0, 4, 8}
+	store.metaData, _ = json.Marshal(meta)
+	third, err := svc.VariantPlaylist(context.Background(), "file:///media", domain.StreamVideo, "1080p")
+	if err != nil {
+		t.Fatalf("variant playlist after re-probe err: %v", err)
+	}
+	if strings.Contains(third, "#EXTINF:5.500") || !strings.Contains(third, "#EXTINF:8.000,\n/segment\n#EXTINF:4.000") {
+		t.Fatalf("expected the index rebuilt from the new keyframes:\n%s", third)
+	}
+	if err := json.Unmarshal(store.indexes["video/1080p"], &stored); err != nil || len(stored.Segments) != 2 || stored.Segments[0].End != 8 {
+		t.Fatalf("expected the rebuilt index stored, got %+v (%v)", stored, err)
+	}
+}
+
+func TestVariantPlaylistTargetDurationOverride(t *testing.T) {
+	cleanup := installFakeFFmpeg(t)
+	defer cleanup()
+
+	keyframes := make([]float64, 0, 30)
+	for i := 0; i < 30; i++ {
+		keyframes = append(keyframes, float64(i*2))
+	}
+	meta := &domain.Metadata{SchemaVersion: domain.MetadataSchemaVersion, Duration: 60, Keyframes: keyframes, Audios: []domain.AudioStream{{Codec: "aac", Channels: 2}}}
+	metaBytes, _ := json.Marshal(meta)
+	store := &stubStorage{metaData: metaBytes, metaExists: true}
+	svc := NewController(Options{
+		Storage:     store,
+		Coordinator: &stubCoordinator{},
+		PathGen:     stubPathGen{},
+	})
+
+	playlist, err := svc.VariantPlaylistWith(context.Background(), "file:///media", domain.StreamAudio, "aac_stereo", VariantOptions{TargetDuration: 2})
+	if err != nil {
+		t.Fatalf("variant playlist err: %v", err)
+	}
+	if got := strings.Count(playlist, "#EXTINF"); got != 30 {
+		t.Fatalf("expected 30 two-second segments, got %d:\n%s", got, playlist)
+	}
+	if _, ok := store.indexes["audio/aac_stereo@2"]; !ok {
+		t.Fatalf("expected override index stored apart from the default one")
+	}
+	if _, ok := store.indexes["audio/aac_stereo"]; ok {
+		t.Fatalf("override must not replace the default index")
+	}
+
+	args, err := svc.InspectSegmentCommand(context.Background(), "file:///media", domain.StreamAudio, "aac_stereo@2", 12)
+	if err != nil {
+		t.Fatalf("inspect err: %v", err)
+	}
+	if joined := strings.Join(args, " "); !strings.Contains(joined, "-ss 20.000000 -i file:///media") {
+		t.Fatalf("expected job cut at the overridden target: %s", joined)
+	}
+}
+
+func TestTargetDurationOverrideIsBoundedAndCanonical(t *testing.T) {
+	cleanup := installFakeFFmpeg(t)
+	defer cleanup()
+
+	meta := &domain.Metadata{SchemaVersion: domain.MetadataSchemaVersion, Duration: 60, Keyframes: []float64{0, 2, 4}, Audios: []domain.AudioStream{{Codec: "aac", Channels: 2}}}
+	metaBytes, _ := json.Marshal(meta)
+	store := &stubStorage{metaData: metaBytes, metaExists: true}
+	svc := NewController(Options{
+		Storage:     store,
+		Coordinator: &stubCoordinator{},
+		PathGen:     stubPathGen{},
+	})
+	ctx := context.Background()
+
+	for _, target := range []float64{math.NaN(), math.Inf(1), 0.0001, 1e9, -2} {
+		if _, err := svc.VariantPlaylistWith(ctx, "file:///media", domain.StreamAudio, "aac_stereo", VariantOptions{TargetDuration: target}); err == nil {
+			t.Fatalf("expected target %v to be rejected", target)
+		}
+	}
+	for _, name := range []string{"aac_stereo@2.0", "aac_stereo@NaN", "aac_stereo@+Inf", "aac_stereo@0.0001", "aac_stereo@1e9"} {
+		if _, err := svc.VariantPlaylist(ctx, "file:///media", domain.StreamAudio, name); !errors.Is(err, ErrRenditionNotFound) {
+			t.Fatalf("expected %s to match no rendition, got %v", name, err)
+		}
+	}
+
+	if _, err := svc.VariantPlaylistWith(ctx, "file:///media", domain.StreamAudio, "aac_stereo", VariantOptions{TargetDuration: 2.0004}); err != nil {
+		t.Fatalf("variant playlist err: %v", err)
+	}
+	if _, ok := store.indexes["audio/aac_stereo@2"]; !ok || len(store.indexes) != 1 {
+		t.Fatalf("expected the target rounded to one canonical index, got %v", slices.Collect(maps.Keys(store.indexes)))
+	}
+}
+
+func TestRecomputeSegmentsReportsStaleIndexes(t *testing.T) {
+	cleanup := installFakeFFmpeg(t)
+	defer cleanup()
+
+	keyframes := make([]float64, 0, 12)
+	for i := 0; i < 12; i++ {
+		keyframes = append(keyframes, float64(i*2))
+	}
+	meta := &domain.Metadata{SchemaVersion: domain.MetadataSchemaVersion, Duration: 24, Keyframes: keyframes, Video: domain.VideoStream{Codec: "h264", Width: 1280, Height: 720}, Audios: []domain.AudioStream{{Codec: "aac", Channels: 2}}}
+	metaBytes, _ := json.Marshal(meta)
+	store := &stubStorage{metaData: metaBytes, metaExists: true}
+	ctx := context.Background()
+
+	old := NewController(Options{Storage: store, Coordinator: &stubCoordinator{}, PathGen: stubPathGen{}})
+	segments, valid, err := old.RecomputeSegments(ctx, "file:///media")
+	if err != nil || !valid || len(segments) != 4 {
+		t.Fatalf("expected four valid segments before any index exists, got %d %v %v", len(segments), valid, err)
+	}
+	if _, err := old.VariantPlaylist(ctx, "file:///media", StreamAudio, "aac_stereo"); err != nil {
+		t.Fatalf("variant playlist err: %v", err)
+	}
+	if _, valid, err := old.RecomputeSegments(ctx, "file:///media"); err != nil || !valid {
+		t.Fatalf("an index built at the same target must stay valid: %v %v", valid, err)
+	}
+
+	recut := NewController(Options{Storage: store, Coordinator: &stubCoordinator{}, PathGen: stubPathGen{}, TargetDuration: 2})
+	segments, valid, err = recut.RecomputeSegments(ctx, "file:///media")
+	if err != nil {
+		t.Fatalf("recompute err: %v", err)
+	}
+	if valid {
+		t.Fatalf("an index cut at 6s must be invalid at a 2s target")
+	}
+	if len(segments) != 12 || segments[1].Start != 2 || segments[11].End != 24 {
+		t.Fatalf("expected twelve 2s segments, got %#v", segments)
+	}
+
+	var index domain.SegmentIndex
+	if err := json.Unmarshal(store.indexes["audio/aac_stereo"], &index); err != nil || index.TargetDuration != 6 {
+		t.Fatalf("recompute must not rewrite stored indexes: %#v %v", index, err)
+	}
+
+	uniform := NewController(Options{Storage: store, Coordinator: &stubCoordinator{}, PathGen: stubPathGen{}, AudioTargetDuration: 4})
+	if _, valid, err := uniform.RecomputeSegments(ctx, "file:///media"); err != nil || valid {
+		t.Fatalf("moving audio to its own grid must invalidate the keyframe-cut index: %v %v", valid, err)
+	}
+}
+
+func TestSegmentTimeHelpersFollowThePlaylistLayout(t *testing.T) {
+	cleanup := installFakeFFmpeg(t)
+	defer cleanup()
+
+	meta := &domain.Metadata{SchemaVersion: domain.MetadataSchemaVersion, Duration: 20, Keyframes: []float64{0, 2, 4, 6.5, 8, 10, 13, 16, 18}, Video: domain.VideoStream{Codec: "h264", Width: 1280, Height: 720}, Audios: []domain.AudioStream{{Codec: "aac", Channels: 2}}}
+	metaBytes, _ := json.Marshal(meta)
+	svc := NewController(Options{
+		Storage:             &stubStorage{metaData: metaBytes, metaExists: true},
+		Coordinator:         &stubCoordinator{},
+		PathGen:             stubPathGen{},
+		AudioTargetDuration: 4,
+	})
+	ctx := context.Background()
+
+	// Video is cut at the keyframes at 0, 6.5 and 13.
+	for at, want := range map[float64]int{0: 0, 6.4: 0, 6.5: 1, 12.99: 1, 13: 2, 19.9: 2, 25: 2} {
+		got, err := svc.SegmentIndexAtTime(ctx, "file:///media", StreamVideo, "720p", at)
+		if err != nil || got != want {
+			t.Fatalf("video at %v: got %d, %v; want %d", at, got, err, want)
+		}
+	}
+	for index, want := range map[int]float64{0: 0, 1: 6.5, 2: 13} {
+		got, err := svc.SegmentStartTime(ctx, "file:///media", StreamVideo, "720p", index)
+		if err != nil || got != want {
+			t.Fatalf("video segment %d: got %v, %v; want %v", index, got, err, want)
+		}
+	}
+
+	if got, err := svc.SegmentIndexAtTime(ctx, "file:///media", StreamAudio, "aac_stereo", 13); err != nil || got != 3 {
+		t.Fatalf("audio follows its own 4s grid: got %d, %v", got, err)
+	}
+	if got, err := svc.SegmentStartTime(ctx, "file:///media", StreamVideo, "720p@2", 3); err != nil || got != 6.5 {
+		t.Fatalf("target overrides use their own layout: got %v, %v", got, err)
+	}
+
+	if _, err := svc.SegmentStartTime(ctx, "file:///media", StreamVideo, "720p", 3); err == nil || !strings.Contains(err.Error(), "out of range") {
+		t.Fatalf("expected an out of range error, got %v", err)
+	}
+	if _, err := svc.SegmentIndexAtTime(ctx, "file:///media", StreamVideo, "4320p", 1); !errors.Is(err, ErrRenditionNotFound) {
+		t.Fatalf("expected ErrRenditionNotFound, got %v", err)
+	}
+}
+
+func TestAudioTargetDurationCutsAudioOnItsOwnGrid(t *testing.T) {
+	cleanup := installFakeFFmpeg(t)
+	defer cleanup()
+
+	meta := &domain.Metadata{SchemaVersion: domain.MetadataSchemaVersion, Duration: 13, Keyframes: []float64{0, 6.5}, Video: domain.VideoStream{Codec: "h264", Width: 1280, Height: 720}, Audios: []domain.AudioStream{{Codec: "aac", Channels: 2}}}
+	metaBytes, _ := json.Marshal(meta)
+	svc := NewController(Options{
+		Storage:             &stubStorage{metaData: metaBytes, metaExists: true},
+		Coordinator:         &stubCoordinator{},
+		PathGen:             stubPathGen{},
+		AudioTargetDuration: 2,
+	})
+	ctx := context.Background()
+
+	audio, err := svc.VariantPlaylist(ctx, "file:///media", StreamAudio, "aac_stereo")
+	if err != nil {
+		t.Fatalf("audio playlist err: %v", err)
+	}
+	if got := strings.Count(audio, "#EXTINF"); got != 7 || !strings.Contains(audio, "#EXT-X-TARGETDURATION:2") {
+		t.Fatalf("expected seven audio segments on a 2s grid:\n%s", audio)
+	}
+
+	video, err := svc.VariantPlaylist(ctx, "file:///media", StreamVideo, "720p")
+	if err != nil {
+		t.Fatalf("video playlist err: %v", err)
+	}
+	if got := strings.Count(video, "#EXTINF"); got != 2 {
+		t.Fatalf("video must keep following keyframes at TargetDuration:\n%s", video)
+	}
+
+	args, err := svc.InspectSegmentCommand(ctx, "file:///media", StreamAudio, "aac_stereo", 5)
+	if err != nil {
+		t.Fatalf("inspect err: %v", err)
+	}
+	if joined := strings.Join(args, " "); !strings.Contains(joined, "-segment_times 2.000000,4.000000,6.000000,8.000000") {
+		t.Fatalf("expected the audio job cut on the same grid: %s", joined)
+	}
+}
+
+func TestVariantPlaylistMarksFailedSegmentsAsGaps(t *testing.T) {
+	cleanup := installFakeFFmpeg(t)
+	defer cleanup()
+
+	meta := &domain.Metadata{SchemaVersion: domain.MetadataSchemaVersion, Duration: 18, Keyframes: []float64{0, 6, 12}, Audios: []domain.AudioStream{{Codec: "aac", Channels: 2}}}
+	metaBytes, _ := json.Marshal(meta)
+	store := &stubStorage{
+		metaData:   metaBytes,
+		metaExists: true,
+		failures: map[int][]byte{
+			0: []byte(`{"Attempts":1,"Error":"timeout"}`),
+			1: []byte(`{"Attempts":2,"Error":"boom"}`),
+			2: []byte(`{"Attempts":2,"Error":"boom"}`),
+		},
+		segments: map[int][]byte{2: []byte("retried")},
+	}
+	svc := NewController(Options{
+		Storage:           store,
+		Coordinator:       &stubCoordinator{},
+		PathGen:           stubPathGen{},
+		GapFailedSegments: true,
+		MaxSegmentRetries: 2,
+	})
+
+	playlist, err := svc.VariantPlaylist(context.Background(), "file:///media", domain.StreamAudio, "aac_stereo")
+	if err != nil {
+		t.Fatalf("variant playlist err: %v", err)
+	}
+	if got := strings.Count(playlist, "#EXT-X-GAP"); got != 1 {
+		t.Fatalf("expected only the exhausted, unrecovered failure to be a gap, got %d:\n%s", got, playlist)
+	}
+
+	var index domain.SegmentIndex
+	if err := json.Unmarshal(store.indexes["audio/aac_stereo"], &index); err != nil {
+		t.Fatalf("decode index: %v", err)
+	}
+	for _, seg := range index.Segments {
+		if seg.Gap {
+			t.Fatalf("gaps must not be persisted in the index: %#v", seg)
+		}
+	}
+}
+
+func TestInspectSegmentCommandBuildsArgsForCoveringJob(t *testing.T) {
+	cleanup := installFakeFFmpeg(t)
+	defer cleanup()
+
+	keyframes := make([]float64, 0, 30)
+	for i := 0; i < 30; i++ {
+		keyframes = append(keyframes, float64(i*6))
+	}
+	meta := &domain.Metadata{SchemaVersion: domain.MetadataSchemaVersion, Duration: 180, Keyframes: keyframes, Audios: []domain.AudioStream{{Codec: "aac", Channels: 2}}}
+	metaBytes, _ := json.Marshal(meta)
+	coord := &stubCoordinator{}
+	svc := NewController(Options{
+		Storage:     &stubStorage{metaData: metaBytes, metaExists: true},
+		Coordinator: coord,
+		PathGen:     stubPathGen{},
+	})
+
+	args, err := svc.InspectSegmentCommand(context.Background(), "file:///media", domain.StreamAudio, "aac_stereo", 12)
+	if err != nil {
+		t.Fatalf("inspect err: %v", err)
+	}
+
+	joined := strings.Join(args, " ")
+	if !strings.Contains(joined, "-ss 60.000000 -i file:///media") {
+		t.Fatalf("expected seek to start of covering job: %s", joined)
+	}
+	if !strings.Contains(joined, "-segment_start_number 10") {
+		t.Fatalf("expected job to start at segment 10: %s", joined)
+	}
+	if len(coord.enqueued) != 0 {
+		t.Fatalf("inspect must not enqueue work")
+	}
+
+	if _, err := svc.InspectSegmentCommand(context.Background(), "file:///media", domain.StreamAudio, "missing", 0); err == nil {
+		t.Fatalf("expected error for unknown rendition")
+	}
+}
+
+func TestUnknownRenditionFailsFastWithoutEnqueue(t *testing.T) {
+	cleanup := installFakeFFmpeg(t)
+	defer cleanup()
+
+	meta := &domain.Metadata{SchemaVersion: domain.MetadataSchemaVersion, Duration: 12, Keyframes: []float64{0, 6, 12}, Video: domain.VideoStream{Width: 1280, Height: 720}}
+	metaBytes, _ := json.Marshal(meta)
+	coord := &stubCoordinator{}
+	svc := NewController(Options{
+		Storage:     &stubStorage{metaData: metaBytes, metaExists: true},
+		Coordinator: coord,
+		PathGen:     stubPathGen{},
+	})
+
+	if _, err := svc.Segment(context.Background(), "file:///media", domain.StreamVideo, "1080p", 0); !errors.Is(err, ErrRenditionNotFound) {
+		t.Fatalf("expected ErrRenditionNotFound from Segment, got %v", err)
+	}
+	if len(coord.enqueued) != 0 {
+		t.Fatalf("unknown rendition must not enqueue a job")
+	}
+
+	if _, err := svc.VariantPlaylist(context.Background(), "file:///media", domain.StreamAudio, "aac_stereo"); !errors.Is(err, ErrRenditionNotFound) {
+		t.Fatalf("expected ErrRenditionNotFound from VariantPlaylist, got %v", err)
+	}
+}
+
+func TestMasterPlaylistForFiltersByCapabilities(t *testing.T) {
+	cleanup := installFakeFFmpeg(t)
+	defer cleanup()
+
+	meta := &domain.Metadata{SchemaVersion: domain.MetadataSchemaVersion, Video: domain.VideoStream{Width: 1920, Height: 1080, Bitrate: 5_000_000}, Audios: []domain.AudioStream{{Codec: "ac3", Channels: 6, Bitrate: 640_000}}}
+	metaBytes, _ := json.Marshal(meta)
+	svc := NewController(Options{
+		Storage:     &stubStorage{metaData: metaBytes, metaExists: true},
+		Coordinator: &stubCoordinator{},
+		PathGen:     stubPathGen{},
+	})
+
+	out, err := svc.MasterPlaylistFor(context.Background(), "file:///media", ClientCapabilities{MaxHeight: 720})
+	if err != nil {
+		t.Fatalf("master playlist err: %v", err)
+	}
+	if strings.Contains(out, "x1080") {
+		t.Fatalf("1080p should be filtered out: %s", out)
+	}
+	if strings.Contains(out, "ac3_passthrough") {
+		t.Fatalf("ac3 passthrough should be filtered without AC3 support: %s", out)
+	}
+	if !strings.Contains(out, "x720") {
+		t.Fatalf("expected 720p to remain: %s", out)
+	}
+}
+
+func TestMasterPlaylistNativeOnlyListsSourceRendition(t *testing.T) {
+	cleanup := installFakeFFmpeg(t)
+	defer cleanup()
+
+	meta := &domain.Metadata{SchemaVersion: domain.MetadataSchemaVersion, Duration: 12, Keyframes: []float64{0, 6}, Video: domain.VideoStream{Codec: "h264", Width: 1920, Height: 1080, Bitrate: 5_000_000}, Audios: []domain.AudioStream{{Codec: "aac", Channels: 2}}}
+	metaBytes, _ := json.Marshal(meta)
+	svc := NewController(Options{
+		Storage:     &stubStorage{metaData: metaBytes, metaExists: true},
+		Coordinator: &stubCoordinator{},
+		PathGen:     stubPathGen{},
+	})
+
+	out, err := svc.MasterPlaylistWith(context.Background(), "file:///media", MasterOptions{NativeOnly: true})
+	if err != nil {
+		t.Fatalf("master playlist err: %v", err)
+	}
+	if strings.Count(out, "#EXT-X-STREAM-INF") != 1 || !strings.Contains(out, "RESOLUTION=1920x1080") {
+		t.Fatalf("expected only the 1080p rendition: %s", out)
+	}
+
+	if _, err := svc.VariantPlaylist(context.Background(), "file:///media", StreamVideo, "480p"); err != nil {
+		t.Fatalf("unlisted renditions must stay addressable: %v", err)
+	}
+}
+
+type namedPathGen struct{ stubPathGen }
+
+func (namedPathGen) VariantPlaylist(sourceURL string, rendition string, streamType domain.StreamType) string {
+	return "/" + string(streamType) + "/" + rendition + ".m3u8"
+}
+
+func TestMasterPlaylistMuxedListsVideoWithAudio(t *testing.T) {
+	cleanup := installFakeFFmpeg(t)
+	defer cleanup()
+
+	meta := &domain.Metadata{SchemaVersion: domain.MetadataSchemaVersion, Duration: 12, Keyframes: []float64{0, 6}, Video: domain.VideoStream{Codec: "h264", Width: 1280, Height: 720, Bitrate: 3_000_000}, Audios: []domain.AudioStream{{Codec: "aac", Channels: 2}}}
+	metaBytes, _ := json.Marshal(meta)
+	svc := NewController(Options{
+		Storage:     &stubStorage{metaData: metaBytes, metaExists: true},
+		Coordinator: &stubCoordinator{},
+		PathGen:     namedPathGen{},
+	})
+	ctx := context.Background()
+
+	out, err := svc.MasterPlaylistWith(ctx, "file:///media", MasterOptions{Muxed: true})
+	if err != nil {
+		t.Fatalf("master playlist err: %v", err)
+	}
+	if strings.Contains(out, "#EXT-X-MEDIA") || strings.Contains(out, "AUDIO=") {
+		t.Fatalf("muxed master must not list a separate audio group: %s", out)
+	}
+	if !strings.Contains(out, "/video/720p+aac_stereo.m3u8") {
+		t.Fatalf("expected muxed variant URI: %s", out)
+	}
+
+	if _, err := svc.VariantPlaylist(ctx, "file:///media", StreamVideo, "720p+aac_stereo"); err != nil {
+		t.Fatalf("muxed rendition must be addressable: %v", err)
+	}
+	if _, err := svc.VariantPlaylist(ctx, "file:///media", StreamVideo, "720p+opus"); !errors.Is(err, ErrRenditionNotFound) {
+		t.Fatalf("expected ErrRenditionNotFound for unknown muxed audio, got %v", err)
+	}
+
+	args, err := svc.InspectSegmentCommand(ctx, "file:///media", StreamVideo, "720p+aac_stereo", 0)
+	if err != nil {
+		t.Fatalf("inspect err: %v", err)
+	}
+	if joined := strings.Join(args, " "); !strings.Contains(joined, "-map 0:V:0") || !strings.Contains(joined, "-map 0:a:0 -c:a aac") {
+		t.Fatalf("expected video and audio mapped into one segment: %s", joined)
+	}
+}
+
+func TestAudioGroupsInlineSingleMuxesOnlyLoneAudio(t *testing.T) {
+	cleanup := installFakeFFmpeg(t)
+	defer cleanup()
+
+	master := func(audio domain.AudioStream, policy AudioGroupPolicy) string {
+		meta := &domain.Metadata{SchemaVersion: domain.MetadataSchemaVersion, Duration: 12, Keyframes: []float64{0, 6}, Video: domain.VideoStream{Codec: "h264", Width: 1280, Height: 720, Bitrate: 3_000_000}, Audios: []domain.AudioStream{audio}}
+		metaBytes, _ := json.Marshal(meta)
+		svc := NewController(Options{
+			Storage:     &stubStorage{metaData: metaBytes, metaExists: true},
+			Coordinator: &stubCoordinator{},
+			PathGen:     namedPathGen{},
+			AudioGroups: policy,
+		})
+		out, err := svc.MasterPlaylist(context.Background(), "file:///media")
+		if err != nil {
+			t.Fatalf("master playlist err: %v", err)
+		}
+		return out
+	}
+	stereo := domain.AudioStream{Codec: "aac", Channels: 2}
+
+	if out := master(stereo, AudioGroupPolicy{}); !strings.Contains(out, "#EXT-X-MEDIA:TYPE=AUDIO") {
+		t.Fatalf("a single track must keep its AUDIO group by default: %s", out)
+	}
+
+	inline := master(stereo, AudioGroupPolicy{InlineSingle: true})
+	if strings.Contains(inline, "#EXT-X-MEDIA") || strings.Contains(inline, "AUDIO=") || !strings.Contains(inline, "/video/720p+aac_stereo.m3u8") {
+		t.Fatalf("expected the lone audio muxed into the variants: %s", inline)
+	}
+	if !strings.Contains(inline, `CODECS="avc1.64001f,mp4a.40.2"`) {
+		t.Fatalf("expected the audio declared in CODECS: %s", inline)
+	}
+
+	surround := master(domain.AudioStream{Codec: "ac3", Channels: 6}, AudioGroupPolicy{InlineSingle: true})
+	if strings.Count(surround, "#EXT-X-MEDIA:TYPE=AUDIO") < 2 || strings.Contains(surround, "+aac_stereo") {
+		t.Fatalf("several audio renditions must stay in a group: %s", surround)
+	}
+}
+
+// segmentCoordinator hands out one status channel per segment so tests can
+// complete specific segments.
+type segmentCoordinator struct {
+	stubCoordinator
+	mu    sync.Mutex
+	waits map[domain.SegmentData]chan domain.SegmentStatus
+}
+
+func (c *segmentCoordinator) WaitSegment(ctx context.Context, info domain.SegmentData) (<-chan domain.SegmentStatus, error) {
+	return c.wait(info), nil
+}
+
+func (c *segmentCoordinator) wait(info domain.SegmentData) chan domain.SegmentStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.waits == nil {
+		c.waits = make(map[domain.SegmentData]chan domain.SegmentStatus)
+	}
+	ch, ok := c.waits[info]
+	if !ok {
+		ch = make(chan domain.SegmentStatus, 1)
+		c.waits[info] = ch
+	}
+	return ch
+}
+
+func TestMasterPlaylistPrewarmsFirstSegment(t *testing.T) {
+	cleanup := installFakeFFmpeg(t)
+	defer cleanup()
+
+	meta := &domain.Metadata{SchemaVersion: domain.MetadataSchemaVersion, Duration: 12, Keyframes: []float64{0, 6, 12}, Video: domain.VideoStream{Codec: "h264", Width: 1920, Height: 1080, Bitrate: 5_000_000}, Audios: []domain.AudioStream{{Codec: "aac", Channels: 2}}}
+	metaBytes, _ := json.Marshal(meta)
+	coord := &segmentCoordinator{}
+	svc := NewController(Options{
+		Storage:             &stubStorage{metaData: metaBytes, metaExists: true},
+		Coordinator:         coord,
+		PathGen:             stubPathGen{},
+		PrewarmFirstSegment: true,
+	})
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		if _, err := svc.MasterPlaylist(ctx, "file:///media"); err != nil {
+			t.Fatalf("master playlist err: %v", err)
+		}
+	}
+	if len(coord.enqueued) != 2 {
+		t.Fatalf("expected one prewarm job per stream, got %#v", coord.enqueued)
+	}
+	if job := coord.enqueued[0]; job.StreamType != StreamVideo || job.Rendition != "1080p" || job.StartIndex != 0 {
+		t.Fatalf("unexpected video prewarm job: %#v", job)
+	}
+	if job := coord.enqueued[1]; job.StreamType != StreamAudio || job.Rendition != "aac_stereo" || job.StartIndex != 0 {
+		t.Fatalf("unexpected audio prewarm job: %#v", job)
+	}
+
+	first := domain.SegmentData{SourceURL: "file:///media", Rendition: "1080p", IsVideo: true}
+	coord.wait(first) <- domain.SegmentStatus{State: domain.SegmentStateReady}
+	if _, err := svc.Segment(ctx, "file:///media", StreamVideo, "1080p", 0); err != nil {
+		t.Fatalf("segment err: %v", err)
+	}
+	if len(coord.enqueued) != 2 {
+		t.Fatalf("segment 0 must wait for the prewarm job, got %d jobs", len(coord.enqueued))
+	}
+
+	last := first
+	last.Index = 1
+	coord.wait(last) <- domain.SegmentStatus{State: domain.SegmentStateReady}
+	job := svc.jobFor("file:///media", StreamVideo, "1080p", 0)
+	deadline := time.Now().Add(time.Second)
+	for svc.prewarmPending(job) {
+		if time.Now().After(deadline) {
+			t.Fatal("prewarm still pending after its last segment was announced")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	coord.wait(first) <- domain.SegmentStatus{State: domain.SegmentStateReady}
+	if _, err := svc.Segment(ctx, "file:///media", StreamVideo, "1080p", 0); err != nil {
+		t.Fatalf("segment err: %v", err)
+	}
+	if len(coord.enqueued) != 3 {
+		t.Fatalf("expected an on-demand job once the prewarm finished, got %d jobs", len(coord.enqueued))
+	}
+}
+
+// failingEnqueueCoordinator rejects every job.
+type failingEnqueueCoordinator struct{ stubCoordinator }
+
+func (c *failingEnqueueCoordinator) Enqueue(ctx context.Context, job domain.Job) error {
+	return errors.New("queue unavailable")
+}
+
+func TestPrewarmErrorsAreLogged(t *testing.T) {
+	cleanup := installFakeFFmpeg(t)
+	defer cleanup()
+
+	meta := &domain.Metadata{SchemaVersion: domain.MetadataSchemaVersion, Duration: 12, Keyframes: []float64{0, 6, 12}, Video: domain.VideoStream{Codec: "h264", Width: 1920, Height: 1080, Bitrate: 5_000_000}, Audios: []domain.AudioStream{{Codec: "aac", Channels: 2}}}
+	metaBytes, _ := json.Marshal(meta)
+	var logs bytes.Buffer
+	svc := NewController(Options{
+		Storage:             &stubStorage{metaData: metaBytes, metaExists: true},
+		Coordinator:         &failingEnqueueCoordinator{},
+		PathGen:             stubPathGen{},
+		PrewarmFirstSegment: true,
+		Logger:              slog.New(slog.NewTextHandler(&logs, nil)),
+	})
+
+	if _, err := svc.MasterPlaylist(context.Background(), "file:///media"); err != nil {
+		t.Fatalf("a failed prewarm must not fail the playlist: %v", err)
+	}
+	if !strings.Contains(logs.String(), "prewarm failed") || !strings.Contains(logs.String(), "rendition=1080p") || !strings.Contains(logs.String(), "queue unavailable") {
+		t.Fatalf("expected the prewarm error logged, got %q", logs.String())
+	}
+}
+
+func TestRenditionNamingIsSharedByPlaylistsAndJobs(t *testing.T) {
+	cleanup := installFakeFFmpeg(t)
+	defer cleanup()
+
+	meta := &domain.Metadata{SchemaVersion: domain.MetadataSchemaVersion, Duration: 12, Keyframes: []float64{0, 6}, Video: domain.VideoStream{Codec: "h264", Width: 1280, Height: 720, Bitrate: 3_000_000}, Audios: []domain.AudioStream{{Codec: "aac", Channels: 2}}}
+	metaBytes, _ := json.Marshal(meta)
+	svc := NewController(Options{
+		Storage:         &stubStorage{metaData: metaBytes, metaExists: true},
+		Coordinator:     &stubCoordinator{},
+		PathGen:         stubPathGen{},
+		RenditionNaming: NameWithBitrate,
+	})
+	ctx := context.Background()
+
+	videos, _, err := svc.Renditions(ctx, "file:///media")
+	if err != nil {
+		t.Fatalf("renditions err: %v", err)
+	}
+	if videos[0].Name != "720p_3000k" {
+		t.Fatalf("expected bitrate in the name, got %q", videos[0].Name)
+	}
+	if _, err := svc.VariantPlaylist(ctx, "file:///media", StreamVideo, "720p"); !errors.Is(err, ErrRenditionNotFound) {
+		t.Fatalf("height-only name must not resolve, got %v", err)
+	}
+	if _, err := svc.InspectSegmentCommand(ctx, "file:///media", StreamVideo, videos[0].Name, 0); err != nil {
+		t.Fatalf("pool must resolve the same name: %v", err)
+	}
+}
+
+func TestRenditionsReturnsGeneratedLadders(t *testing.T) {
+	cleanup := installFakeFFmpeg(t)
+	defer cleanup()
+
+	meta := &domain.Metadata{SchemaVersion: domain.MetadataSchemaVersion, Video: domain.VideoStream{Codec: "h264", Width: 1280, Height: 720, Bitrate: 3_000_000}, Audios: []domain.AudioStream{{Codec: "ac3", Language: "fra", Channels: 6, Bitrate: 640_000}}}
+	metaBytes, _ := json.Marshal(meta)
+	svc := NewController(Options{
+		Storage:     &stubStorage{metaData: metaBytes, metaExists: true},
+		Coordinator: &stubCoordinator{},
+		PathGen:     stubPathGen{},
+	})
+
+	videos, audios, err := svc.Renditions(context.Background(), "file:///media")
+	if err != nil {
+		t.Fatalf("renditions err: %v", err)
+	}
+	if len(videos) == 0 || videos[0].Name != "720p" || videos[0].Height != 720 {
+		t.Fatalf("unexpected video ladder: %#v", videos)
+	}
+	if len(audios) != 3 {
+		t.Fatalf("expected stereo, surround and passthrough, got %#v", audios)
+	}
+	for _, a := range audios {
+		if a.Language != "fra" {
+			t.Fatalf("expected audio language from source track, got %#v", a)
+		}
+	}
+}
+
+func TestMaxHeightCapsMasterAndVariants(t *testing.T) {
+	cleanup := installFakeFFmpeg(t)
+	defer cleanup()
+
+	meta := &domain.Metadata{SchemaVersion: domain.MetadataSchemaVersion, Duration: 12, Keyframes: []float64{0, 6, 12}, Video: domain.VideoStream{Codec: "h264", Width: 3840, Height: 2160, Bitrate: 20_000_000}}
+	metaBytes, _ := json.Marshal(meta)
+	svc := NewController(Options{
+		Storage:     &stubStorage{metaData: metaBytes, metaExists: true},
+		Coordinator: &stubCoordinator{},
+		PathGen:     stubPathGen{},
+		MaxHeight:   1080,
+	})
+
+	out, err := svc.MasterPlaylist(context.Background(), "file:///media")
+	if err != nil {
+		t.Fatalf("master playlist err: %v", err)
+	}
+	if strings.Contains(out, "x2160") || !strings.Contains(out, "x1080") {
+		t.Fatalf("expected ladder capped at 1080p: %s", out)
+	}
+
+	if _, err := svc.VariantPlaylist(context.Background(), "file:///media", StreamVideo, "2160p"); !errors.Is(err, ErrRenditionNotFound) {
+		t.Fatalf("expected capped rendition to be unknown, got %v", err)
+	}
+}
+
+func TestStreamRejectsUnknownRendition(t *testing.T) {
+	cleanup := installFakeFFmpeg(t)
+	defer cleanup()
+
+	meta := &domain.Metadata{SchemaVersion: domain.MetadataSchemaVersion, Duration: 12, Video: domain.VideoStream{Codec: "h264", Width: 1280, Height: 720}}
+	metaBytes, _ := json.Marshal(meta)
+	svc := NewController(Options{
+		Storage:     &stubStorage{metaData: metaBytes, metaExists: true},
+		Coordinator: &stubCoordinator{},
+		PathGen:     stubPathGen{},
+	})
+
+	if _, err := svc.Stream(context.Background(), "file:///media", StreamVideo, "1080p", 0, 0); !errors.Is(err, ErrRenditionNotFound) {
+		t.Fatalf("expected ErrRenditionNotFound, got %v", err)
+	}
+
+	rc, err := svc.Stream(context.Background(), "file:///media", StreamVideo, "720p", 0, 0)
+	if err != nil {
+		t.Fatalf("stream err: %v", err)
+	}
+	if err := rc.Close(); err != nil {
+		t.Fatalf("close err: %v", err)
+	}
+}
+
+func TestPerRequestLadderCapKeepsFullLadderForVariants(t *testing.T) {
+	cleanup := installFakeFFmpeg(t)
+	defer cleanup()
+
+	meta := &domain.Metadata{SchemaVersion: domain.MetadataSchemaVersion, Duration: 12, Keyframes: []float64{0, 6, 12}, Video: domain.VideoStream{Width: 1920, Height: 1080, Bitrate: 5_000_000}}
+	metaBytes, _ := json.Marshal(meta)
+	svc := NewController(Options{
+		Storage:     &stubStorage{metaData: metaBytes, metaExists: true},
+		Coordinator: &stubCoordinator{},
+		PathGen:     stubPathGen{},
+	})
+
+	out, err := svc.MasterPlaylistFor(context.Background(), "file:///media", ClientCapabilities{MaxHeight: 480})
+	if err != nil {
+		t.Fatalf("master playlist err: %v", err)
+	}
+	if strings.Contains(out, "x720") || strings.Contains(out, "x1080") {
+		t.Fatalf("data-saver master should stop at 480p: %s", out)
+	}
+
+	if _, err := svc.VariantPlaylist(context.Background(), "file:///media", domain.StreamVideo, "1080p"); err != nil {
+		t.Fatalf("variant path must still accept the full ladder: %v", err)
+	}
+}
+
+func TestQueueDepthUsesOptionalCoordinatorInterface(t *testing.T) {
+	cleanup := installFakeFFmpeg(t)
+	defer cleanup()
+
+	svc := NewController(Options{
+		Storage:     &stubStorage{},
+		Coordinator: &stubCoordinator{},
+		PathGen:     stubPathGen{},
+	})
+	if _, err := svc.QueueDepth(context.Background(), StreamVideo); !errors.Is(err, ErrQueueDepthUnsupported) {
+		t.Fatalf("expected ErrQueueDepthUnsupported, got %v", err)
+	}
+
+	svc = NewController(Options{
+		Storage:     &stubStorage{},
+		Coordinator: &depthCoordinator{depths: map[domain.StreamType]int{StreamVideo: 7, StreamAudio: 2}},
+		PathGen:     stubPathGen{},
+	})
+	video, err := svc.QueueDepth(context.Background(), StreamVideo)
+	if err != nil || video != 7 {
+		t.Fatalf("expected video depth 7, got %d, %v", video, err)
+	}
+	if audio, _ := svc.QueueDepth(context.Background(), StreamAudio); audio != 2 {
+		t.Fatalf("expected audio depth 2, got %d", audio)
+	}
+}
+
+func TestInitSegmentRequiresFragmentedRendition(t *testing.T) {
+	cleanup := installFakeFFmpeg(t)
+	defer cleanup()
+
+	meta := &domain.Metadata{SchemaVersion: domain.MetadataSchemaVersion, Duration: 12, Keyframes: []float64{0, 6}, Video: domain.VideoStream{Codec: "h264", Width: 1920, Height: 1080}}
+	metaBytes, _ := json.Marshal(meta)
+	svc := NewController(Options{
+		Storage:     &stubStorage{metaData: metaBytes, metaExists: true},
+		Coordinator: &stubCoordinator{},
+		PathGen:     stubPathGen{},
+	})
+
+	if _, err := svc.InitSegment(context.Background(), "file:///media", StreamVideo, "720p"); err == nil || !strings.Contains(err.Error(), "not fragmented MP4") {
+		t.Fatalf("expected error for TS rendition, got %v", err)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Fatalf("expected panic for unknown codec")
+		}
+	}()
+	NewController(Options{
+		Storage:     &stubStorage{},
+		Coordinator: &stubCoordinator{},
+		PathGen:     stubPathGen{},
+		VideoCodec:  "theora",
+	})
+}
+
+func TestControllerReportsAccelerator(t *testing.T) {
+	cleanup := installFakeFFmpeg(t)
+	defer cleanup()
+
+	svc := NewController(Options{
+		Storage:     &stubStorage{},
+		Coordinator: &stubCoordinator{},
+		PathGen:     stubPathGen{},
+	})
+
+	if got := svc.Accelerator(); got != AccelNone {
+		t.Fatalf("expected software encoding without HWAccel, got %s", got)
+	}
+	config := svc.HWAccelConfig()
+	if config.Encoder != "libx264" {
+		t.Fatalf("expected libx264 encoder, got %q", config.Encoder)
+	}
+	config.EncodeFlags[0] = "changed"
+	if svc.HWAccelConfig().EncodeFlags[0] == "changed" {
+		t.Fatalf("HWAccelConfig must return a copy")
+	}
+}
+
+func TestTierCodecsMixCodecsInOneLadder(t *testing.T) {
+	cleanup := installFakeFFmpeg(t)
+	defer cleanup()
+
+	meta := &domain.Metadata{SchemaVersion: domain.MetadataSchemaVersion, Duration: 12, Keyframes: []float64{0, 6}, Video: domain.VideoStream{Codec: "h264", Width: 1920, Height: 1080, FrameRate: 30, Bitrate: 5_000_000}}
+	metaBytes, _ := json.Marshal(meta)
+	svc := NewController(Options{
+		Storage:             &stubStorage{metaData: metaBytes, metaExists: true},
+		Coordinator:         &stubCoordinator{},
+		PathGen:             stubPathGen{},
+		VideoCodec:          VideoCodecHEVC,
+		TierCodecs:          map[int]VideoCodec{480: VideoCodecH264},
+		DisableDirectStream: true,
+	})
+
+	out, err := svc.MasterPlaylist(context.Background(), "file:///media")
+	if err != nil {
+		t.Fatalf("master playlist err: %v", err)
+	}
+	if !strings.Contains(out, "CODECS=\"hvc1.1.6.L120.B0") || !strings.Contains(out, "CODECS=\"avc1.") {
+		t.Fatalf("expected hevc and h264 variants in one master: %s", out)
+	}
+
+	for rendition, encoder := range map[string]string{"720p": "libx265", "480p": "libx264"} {
+		args, err := svc.InspectSegmentCommand(context.Background(), "file:///media", StreamVideo, rendition, 0)
+		if err != nil {
+			t.Fatalf("inspect %s: %v", rendition, err)
+		}
+		if joined := strings.Join(args, " "); !strings.Contains(joined, "-c:v "+encoder) {
+			t.Fatalf("expected %s to encode with %s: %s", rendition, encoder, joined)
+		}
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Fatalf("expected panic for unknown tier codec")
+		}
+	}()
+	NewController(Options{Storage: &stubStorage{}, Coordinator: &stubCoordinator{}, PathGen: stubPathGen{}, TierCodecs: map[int]VideoCodec{480: "theora"}})
+}
+
+func TestAudioTiersResolveAndValidate(t *testing.T) {
+	cleanup := installFakeFFmpeg(t)
+	defer cleanup()
+
+	meta := &domain.Metadata{SchemaVersion: domain.MetadataSchemaVersion, Duration: 12, Keyframes: []float64{0, 6}, Audios: []domain.AudioStream{{Codec: "aac", Channels: 2}}}
+	metaBytes, _ := json.Marshal(meta)
+	svc := NewController(Options{
+		Storage:     &stubStorage{metaData: metaBytes, metaExists: true},
+		Coordinator: &stubCoordinator{},
+		PathGen:     stubPathGen{},
+		AudioTiers:  []AudioTier{{Name: "aac_stereo_64k", Bitrate: 64000, Channels: 2}},
+	})
+
+	if _, err := svc.VariantPlaylist(context.Background(), "file:///media", StreamAudio, "aac_stereo_64k"); err != nil {
+		t.Fatalf("custom tier must resolve: %v", err)
+	}
+	if _, err := svc.VariantPlaylist(context.Background(), "file:///media", StreamAudio, "aac_stereo"); !errors.Is(err, ErrRenditionNotFound) {
+		t.Fatalf("default tier must be replaced, got %v", err)
+	}
+
+	for _, tiers := range [][]AudioTier{
+		{{Name: "a+b", Bitrate: 64000, Channels: 2}},
+		{{Name: "low", Bitrate: 64000, Channels: 2}, {Name: "low", Bitrate: 96000, Channels: 2}},
+		{{Name: "silent", Channels: 2}},
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Fatalf("expected panic for tiers %#v", tiers)
+				}
+			}()
+			NewController(Options{Storage: &stubStorage{}, Coordinator: &stubCoordinator{}, PathGen: stubPathGen{}, AudioTiers: tiers})
+		}()
+	}
+}
+
+type indexedPathGen struct{ namedPathGen }
+
+func (indexedPathGen) Segment(sourceURL string, rendition string, streamType domain.StreamType, index int) string {
+	return "/" + string(streamType) + "/" + rendition + "/" + strconv.Itoa(index) + ".ts"
+}
+
+func TestValidatePlaylistChecksServedPlaylists(t *testing.T) {
+	cleanup := installFakeFFmpeg(t)
+	defer cleanup()
+
+	meta := &domain.Metadata{SchemaVersion: domain.MetadataSchemaVersion, Duration: 14, Keyframes: []float64{0, 6, 12}, Video: domain.VideoStream{Codec: "h264", Width: 1920, Height: 1080}, Audios: []domain.AudioStream{{Codec: "aac", Channels: 2}}}
+	metaBytes, _ := json.Marshal(meta)
+	svc := NewController(Options{
+		Storage:     &stubStorage{metaData: metaBytes, metaExists: true},
+		Coordinator: &stubCoordinator{},
+		PathGen:     indexedPathGen{},
+	})
+
+	master, err := svc.MasterPlaylist(context.Background(), "file:///media")
+	if err != nil {
+		t.Fatalf("master playlist err: %v", err)
+	}
+	variant, err := svc.VariantPlaylist(context.Background(), "file:///media", StreamVideo, "720p")
+	if err != nil {
+		t.Fatalf("variant playlist err: %v", err)
+	}
+	for _, out := range []string{master, variant} {
+		if err := ValidatePlaylist(out); err != nil {
+			t.Fatalf("expected a valid playlist: %v\n%s", err, out)
+		}
+	}
+	if err := ValidatePlaylist(strings.Replace(variant, "#EXT-X-ENDLIST\n", "", 1)); err == nil {
+		t.Fatalf("expected a VOD playlist without EXT-X-ENDLIST to fail")
+	}
+
+	// stubPathGen gives every segment the same URI.
+	svc = NewController(Options{
+		Storage:     &stubStorage{metaData: metaBytes, metaExists: true},
+		Coordinator: &stubCoordinator{},
+		PathGen:     stubPathGen{},
+	})
+	variant, err = svc.VariantPlaylist(context.Background(), "file:///media", StreamVideo, "720p")
+	if err != nil {
+		t.Fatalf("variant playlist err: %v", err)
+	}
+	if err := ValidatePlaylist(variant); err != nil {
+		t.Fatalf("repeated segment URIs are only checked on request, got %v", err)
+	}
+	if err := ValidatePlaylistWith(variant, ValidateOptions{UniqueSegmentURIs: true}); err == nil || !strings.Contains(err.Error(), "repeats") {
+		t.Fatalf("expected repeated segment URIs to be reported, got %v", err)
+	}
+}
+
+type bundlePathGen struct{ namedPathGen }
+
+func (bundlePathGen) Segment(sourceURL string, rendition string, streamType domain.StreamType, index int) string {
+	return fmt.Sprintf("/%s/%s/%d.ts", streamType, rendition, index)
+}
+func (bundlePathGen) Sprite(sourceURL string, index int) string {
+	return fmt.Sprintf("/sprites/%d.jpg", index)
+}
+func (bundlePathGen) SubtitleVTT(sourceURL string, lang string) string {
+	return "/subs/" + lang + ".vtt"
+}
+
+func TestManifestBundlesEveryPlaylistAndReference(t *testing.T) {
+	cleanup := installFakeFFmpeg(t)
+	defer cleanup()
+
+	var keyframes []float64
+	for kf := 0.0; kf < 600; kf += 6 {
+		keyframes = append(keyframes, kf)
+	}
+	meta := &domain.Metadata{
+		SchemaVersion: domain.MetadataSchemaVersion,
+		Duration:      600,
+		Keyframes:     keyframes,
+		Video:         domain.VideoStream{Codec: "h264", Width: 1280, Height: 720, Bitrate: 3_000_000},
+		Audios:        []domain.AudioStream{{Codec: "aac", Channels: 2}},
+		Subtitles:     []domain.SubtitleStream{{Codec: "subrip", Language: "eng"}, {Codec: "subrip", Language: "eng", Forced: true}},
+	}
+	metaBytes, _ := json.Marshal(meta)
+
+	for _, inline := range []bool{false, true} {
+		svc := NewController(Options{
+			Storage:     &stubStorage{metaData: metaBytes, metaExists: true},
+			Coordinator: &stubCoordinator{},
+			PathGen:     bundlePathGen{},
+			AudioGroups: AudioGroupPolicy{InlineSingle: inline},
+		})
+		bundle, err := svc.Manifest(context.Background(), "file:///media", MasterOptions{})
+		if err != nil {
+			t.Fatalf("inline %v: manifest err: %v", inline, err)
+		}
+
+		master, err := svc.MasterPlaylist(context.Background(), "file:///media")
+		if err != nil || bundle.Master != master {
+			t.Fatalf("inline %v: expected the master playlist (%v), got %s", inline, err, bundle.Master)
+		}
+		var listed int
+		for _, line := range strings.Split(master, "\n") {
+			if strings.HasSuffix(line, ".m3u8") || strings.Contains(line, `URI="`) {
+				listed++
+			}
+		}
+		if len(bundle.Variants) != listed {
+			t.Fatalf("inline %v: expected %d variants, got %+v", inline, listed, bundle.Variants)
+		}
+		for _, v := range bundle.Variants {
+			if !strings.Contains(master, v.URL) {
+				t.Fatalf("inline %v: variant %s is not in the master: %s", inline, v.URL, master)
+			}
+			if inline && (v.StreamType != StreamVideo || !strings.Contains(v.Rendition, "aac_stereo")) {
+				t.Fatalf("inline %v: expected only muxed video variants, got %s %s", inline, v.StreamType, v.Rendition)
+			}
+			if len(v.Segments) != 100 || strings.Count(v.Playlist, "#EXTINF") != 100 {
+				t.Fatalf("inline %v: expected 100 segments for %s, got %d", inline, v.Rendition, len(v.Segments))
+			}
+			for _, seg := range v.Segments {
+				if !strings.Contains(v.Playlist, seg+"\n") {
+					t.Fatalf("inline %v: segment %s is not in the %s playlist", inline, seg, v.Rendition)
+				}
+			}
+		}
+	}
+
+	svc := NewController(Options{
+		Storage:     &stubStorage{metaData: metaBytes, metaExists: true},
+		Coordinator: &stubCoordinator{},
+		PathGen:     bundlePathGen{},
+	})
+	bundle, err := svc.Manifest(context.Background(), "file:///media", MasterOptions{})
+	if err != nil {
+		t.Fatalf("manifest err: %v", err)
+	}
+	if len(bundle.Subtitles) != 2 || bundle.Subtitles[1].Key != "eng_1" || bundle.Subtitles[1].URL != "/subs/eng_1.vtt" || !bundle.Subtitles[1].Forced {
+		t.Fatalf("expected both subtitle tracks with their URLs, got %+v", bundle.Subtitles)
+	}
+	if bundle.SpriteVTT != "/sprites.vtt" || !slices.Equal(bundle.Sprites, []string{"/sprites/0.jpg", "/sprites/1.jpg"}) {
+		t.Fatalf("expected the sprite VTT and two sheets, got %s %v", bundle.SpriteVTT, bundle.Sprites)
+	}
+
+	caps := ClientCapabilities{MaxHeight: 480}
+	filtered, err := svc.Manifest(context.Background(), "file:///media", MasterOptions{Capabilities: &caps})
+	if err != nil {
+		t.Fatalf("filtered manifest err: %v", err)
+	}
+	master, err := svc.MasterPlaylistFor(context.Background(), "file:///media", caps)
+	if err != nil || filtered.Master != master {
+		t.Fatalf("expected the capability-filtered master (%v), got %s", err, filtered.Master)
+	}
+	if len(filtered.Variants) == 0 || len(filtered.Variants) >= len(bundle.Variants) {
+		t.Fatalf("expected fewer variants than the full ladder's %d, got %+v", len(bundle.Variants), filtered.Variants)
+	}
+	for _, v := range filtered.Variants {
+		if !strings.Contains(master, v.URL) {
+			t.Fatalf("variant %s is not in the filtered master: %s", v.URL, master)
+		}
 	}
 }
@@ -0,0 +1,16 @@
+package domain
+
+import "time"
+
+// Clock supplies the timers behind request timeouts, so tests can fire them
+// deterministically instead of sleeping.
+type Clock interface {
+	After(d time.Duration) <-chan time.Time
+}
+
+// SystemClock is the Clock backed by the time package.
+type SystemClock struct{}
+
+func (SystemClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
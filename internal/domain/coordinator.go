@@ -7,8 +7,31 @@ type Coordinator interface {
 	Subscribe(ctx context.Context, streamType StreamType) (<-chan Job, error)
 	Ack(ctx context.Context, jobID string) error
 
+	// NotifySegment must deliver status to every current waiter of the
+	// segment, not just one: many clients may wait on the same segment.
 	NotifySegment(ctx context.Context, info SegmentData, status SegmentStatus) error
+
+	// WaitSegment must not miss a ready notification sent shortly before
+	// it is called, since a segment can finish between the Controller's
+	// storage check and its subscription; otherwise such a request waits
+	// for SegmentTimeout. The wait ends when ctx is done: implementations
+	// must then release whatever backs it (a subscription, a map entry).
+	// The Controller cancels ctx as soon as it stops waiting, whether the
+	// status arrived, the request was abandoned or SegmentTimeout passed.
 	WaitSegment(ctx context.Context, info SegmentData) (<-chan SegmentStatus, error)
 
 	Close()
 }
+
+// QueueDepther is optionally implemented by a Coordinator to report how many
+// jobs are waiting for a worker, e.g. for scaling replicas on backlog.
+type QueueDepther interface {
+	QueueDepth(ctx context.Context, streamType StreamType) (int, error)
+}
+
+// ProgressNotifier is optionally implemented by a Coordinator to receive the
+// live progress of running jobs, about twice a second per job. It is called
+// from the job's ffmpeg output reader, so it should return quickly.
+type ProgressNotifier interface {
+	NotifyProgress(ctx context.Context, progress JobProgress) error
+}
@@ -1,5 +1,7 @@
 package domain
 
+import "slices"
+
 type Accelerator string
 
 const (
@@ -10,11 +12,72 @@ const (
 	AccelQSV          Accelerator = "qsv"
 )
 
+// VideoCodec is the codec transcoded video renditions are encoded with.
+type VideoCodec string
+
+const (
+	VideoCodecH264 VideoCodec = "h264"
+	// VideoCodecVP9 needs fragmented MP4 segments, since VP9 in MPEG-TS is
+	// not standard.
+	VideoCodecVP9 VideoCodec = "vp9"
+	// VideoCodecHEVC is packaged as fragmented MP4 too: Apple players only
+	// accept HEVC in fMP4 segments, tagged hvc1.
+	VideoCodecHEVC VideoCodec = "hevc"
+)
+
+// NeedsFMP4 reports whether renditions in c must be packaged as fragmented
+// MP4 rather than MPEG-TS.
+func (c VideoCodec) NeedsFMP4() bool {
+	return c == VideoCodecVP9 || c == VideoCodecHEVC
+}
+
 type HWAccelConfig struct {
 	Accelerator  Accelerator
+	Codec        VideoCodec
 	DecodeFlags  []string
 	EncodeFlags  []string
 	Encoder      string
 	KeyframeFlag string
 	ScaleFilter  string
+
+	// DecodeCodecs lists the source codecs (ffprobe names) the accelerator
+	// can decode. Other sources are decoded in software and only encoded in
+	// hardware. Nil means every codec.
+	DecodeCodecs []string
+
+	// HighBitDepthCodecs lists the codecs in DecodeCodecs the accelerator
+	// also decodes deeper than 8 bits, such as 10-bit HEVC. Deeper sources
+	// in other codecs, such as H.264 High 10, are decoded in software.
+	HighBitDepthCodecs []string
+
+	// DeviceFlags replace DecodeFlags when decoding in software, for
+	// encoders that still need a device opened (e.g. -vaapi_device).
+	DeviceFlags []string
+
+	// UploadFilter ends the software filter chain when decoding in
+	// software, for encoders that only take frames in device memory.
+	UploadFilter string
+
+	// IDRFlags are encoder options that turn the keyframes forced with
+	// KeyframeFlag into IDR frames, so each segment decodes on its own.
+	// Empty for encoders that already do so.
+	IDRFlags []string
+
+	// FastStartFlags are encoder options appended after EncodeFlags for a
+	// fast-start job, overriding its preset with a faster one. Empty for
+	// encoders already configured for their fastest preset.
+	FastStartFlags []string
+}
+
+// Decodes reports whether the accelerator can decode a source in codec with
+// the given ffprobe pixel format. An unknown codec is assumed to be
+// supported, and an unknown pixel format to be 8-bit.
+func (c *HWAccelConfig) Decodes(codec, pixelFormat string) bool {
+	if c.DecodeCodecs == nil || codec == "" {
+		return true
+	}
+	if !slices.Contains(c.DecodeCodecs, codec) {
+		return false
+	}
+	return BitDepth(pixelFormat) <= 8 || slices.Contains(c.HighBitDepthCodecs, codec)
 }
@@ -1,10 +1,30 @@
 package domain
 
+import (
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
 type Segment struct {
 	Index    int
 	Start    float64
 	End      float64
 	Duration float64
+
+	// Gap marks a segment that failed to transcode; playlists tag it with
+	// EXT-X-GAP so players skip it.
+	Gap bool
+}
+
+// ThumbnailData identifies a single cached JPEG frame. At is in whole
+// milliseconds; a zero Width or Height keeps the source aspect ratio.
+type ThumbnailData struct {
+	SourceURL string
+	AtMillis  int64
+	Width     int
+	Height    int
 }
 
 type SegmentData struct {
@@ -15,6 +35,7 @@ type SegmentData struct {
 	Duration  float64
 	Rendition string
 	IsVideo   bool
+	Size      int64
 }
 
 type MasterPlaylist struct {
@@ -29,6 +50,119 @@ type VariantPlaylist struct {
 	Segments       []Segment
 }
 
+type MasterOptions struct {
+	Capabilities *ClientCapabilities
+	StartOffset  float64
+	NativeOnly   bool
+
+	// Muxed lists each video rendition with the default audio rendition
+	// muxed into its segments (see MuxedRendition) and no separate audio
+	// group, for players that cannot handle EXT-X-MEDIA audio.
+	Muxed bool
+}
+
+type VariantOptions struct {
+	StartOffset     float64
+	ProgramDateTime time.Time
+	TargetDuration  float64
+}
+
+type ValidateOptions struct {
+	// UniqueSegmentURIs rejects a media playlist listing the same segment
+	// URI twice. RFC 8216 allows it, but in a playlist built from a
+	// PathGenerator it usually means the generator ignores an argument.
+	UniqueSegmentURIs bool
+}
+
+// MinTargetOverride and MaxTargetOverride bound the per-request target
+// durations a rendition name may carry, in seconds. Each distinct target is
+// transcoded and stored apart, so the range and millisecond precision keep
+// clients from growing storage without limit.
+const (
+	MinTargetOverride = 1.0
+	MaxTargetOverride = 30.0
+)
+
+// CanonicalTarget rounds a target duration override to milliseconds and
+// reports whether it lies within MinTargetOverride and MaxTargetOverride.
+func CanonicalTarget(target float64) (float64, bool) {
+	target = math.Round(target*1000) / 1000
+	return target, target >= MinTargetOverride && target <= MaxTargetOverride
+}
+
+// TargetRendition returns the name under which a rendition cut at a
+// non-default target duration is addressed, such as "720p@2". Changing the
+// target changes segment boundaries and indices, so such segments are stored
+// apart from those of the plain rendition. target should be canonical, as
+// returned by CanonicalTarget.
+func TargetRendition(name string, target float64) string {
+	return name + "@" + strconv.FormatFloat(target, 'f', -1, 64)
+}
+
+// SplitRendition splits a name built by TargetRendition into the ladder
+// rendition name and its target duration. A plain name has a zero target, and
+// so does a suffix that is out of range or not in canonical form ("720p@2.0"
+// rather than "720p@2"); such a name matches no rendition.
+func SplitRendition(key string) (string, float64) {
+	i := strings.LastIndex(key, "@")
+	if i < 0 {
+		return key, 0
+	}
+	target, err := strconv.ParseFloat(key[i+1:], 64)
+	if err != nil {
+		return key, 0
+	}
+	canonical, ok := CanonicalTarget(target)
+	if !ok || strconv.FormatFloat(canonical, 'f', -1, 64) != key[i+1:] {
+		return key, 0
+	}
+	return key[:i], canonical
+}
+
+// MuxedRendition returns the name under which a video rendition carrying an
+// audio rendition in the same segments is addressed, such as
+// "720p+aac_stereo". Muxed segments are stored apart from the video-only
+// segments of the plain rendition.
+func MuxedRendition(video, audio string) string {
+	return video + "+" + audio
+}
+
+// SplitMuxed splits a name built by MuxedRendition, with any target suffix
+// already removed by SplitRendition, into the video and audio rendition
+// names. A plain name has no audio.
+func SplitMuxed(name string) (string, string) {
+	video, audio, _ := strings.Cut(name, "+")
+	return video, audio
+}
+
+type SegmentIndex struct {
+	Rendition      string
+	StreamType     StreamType
+	Container      Container
+	TargetDuration float64
+	Segments       []Segment
+
+	// Uniform marks an audio index cut on a fixed grid rather than at video
+	// keyframes (see AudioTargetDuration).
+	Uniform bool
+}
+
+type Container string
+
+const (
+	ContainerTS   Container = "ts"
+	ContainerFMP4 Container = "fmp4"
+)
+
+// Extension returns the media segment file extension for the container,
+// including the leading dot. The zero value is treated as MPEG-TS.
+func (c Container) Extension() string {
+	if c == ContainerFMP4 {
+		return ".m4s"
+	}
+	return ".ts"
+}
+
 type StreamType string
 
 const (
@@ -45,3 +179,42 @@ type PathGenerator interface {
 	Sprite(sourceURL string, index int) string
 	SubtitleVTT(sourceURL string, lang string) string
 }
+
+// FMP4PathGenerator is optionally implemented by a PathGenerator to provide
+// first-class URLs for fragmented MP4 renditions. When it is not implemented,
+// fMP4 URLs are derived from PathGenerator.Segment by swapping the ".ts"
+// extension for ".m4s", and the init segment is "init.mp4" alongside them.
+type FMP4PathGenerator interface {
+	InitSegment(sourceURL string, rendition string, streamType StreamType) string
+	FMP4Segment(sourceURL string, rendition string, streamType StreamType, index int) string
+}
+
+// Artifact identifies a kind of response the controller serves, for choosing
+// its HTTP headers.
+type Artifact string
+
+const (
+	ArtifactMasterPlaylist  Artifact = "master_playlist"
+	ArtifactVariantPlaylist Artifact = "variant_playlist"
+	// ArtifactSegment is an MPEG-TS media segment.
+	ArtifactSegment Artifact = "segment"
+	// ArtifactFMP4Segment is a fragmented MP4 media segment.
+	ArtifactFMP4Segment Artifact = "fmp4_segment"
+	// ArtifactInitSegment is the EXT-X-MAP initialization segment of a
+	// fragmented MP4 rendition.
+	ArtifactInitSegment Artifact = "init_segment"
+	ArtifactSubtitleVTT Artifact = "subtitle_vtt"
+	ArtifactSubtitleASS Artifact = "subtitle_ass"
+	ArtifactSpriteVTT   Artifact = "sprite_vtt"
+	ArtifactSprite      Artifact = "sprite"
+	ArtifactThumbnail   Artifact = "thumbnail"
+	ArtifactPoster      Artifact = "poster"
+)
+
+// SegmentArtifact returns the artifact of a media segment in the container.
+func (c Container) SegmentArtifact() Artifact {
+	if c == ContainerFMP4 {
+		return ArtifactFMP4Segment
+	}
+	return ArtifactSegment
+}
@@ -8,18 +8,108 @@ const (
 	Transcode    PlaybackMethod = "transcode"
 )
 
-type VideoRendition struct {
-	Name    string
-	Width   int
-	Height  int
+// LadderMode selects how video ladder tiers are sized.
+type LadderMode int
+
+const (
+	// LadderByHeight fixes each tier's height and derives width from the
+	// source aspect ratio.
+	LadderByHeight LadderMode = iota
+
+	// LadderByPixels gives each tier the pixel budget of its 16:9
+	// equivalent and fits the source aspect ratio into that budget.
+	LadderByPixels
+)
+
+// RenditionNaming selects how video renditions are named. Names appear in
+// playlist and segment URLs and in storage keys.
+type RenditionNaming int
+
+const (
+	// NameByHeight names renditions by tier alone, such as "1080p".
+	NameByHeight RenditionNaming = iota
+
+	// NameWithBitrate appends the bitrate in kbit/s, such as "1080p_5000k".
+	NameWithBitrate
+
+	// NameWithCodec appends the output codec, such as "1080p_h264". Direct
+	// streams carry the source codec's ffprobe name, such as "1080p_hevc".
+	NameWithCodec
+)
+
+// AudioTier is one AAC transcode rendition of the audio ladder.
+type AudioTier struct {
+	// Name addresses the rendition in URLs and storage keys, such as
+	// "aac_stereo_64k". It must not contain "+" or "@".
+	Name string
+
+	// Bitrate is the target bitrate in bits per second.
 	Bitrate int
-	Method  PlaybackMethod
+
+	// Channels is the output channel count. Tiers with more than two
+	// channels are only offered for sources with at least that many.
+	Channels int
+}
+
+type VideoRendition struct {
+	Name      string
+	Width     int
+	Height    int
+	Bitrate   int
+	FrameRate float64
+	Method    PlaybackMethod
+	Container Container
+
+	// Codec is the output codec. Empty means h264. Direct-stream
+	// renditions carry the source codec, set here when it is HEVC.
+	Codec VideoCodec
+
+	// BitDepth is the output bit depth when above 8: a direct stream keeps
+	// the source's, while transcodes are always 8-bit. Zero means 8.
+	BitDepth int
+
+	// Upscaled marks a rendition taller than its source.
+	Upscaled bool
+
+	// ConstantFrameRate makes transcodes emit FrameRate as a constant rate.
+	ConstantFrameRate bool
 }
 
 type AudioRendition struct {
-	Name     string
-	Codec    string
-	Bitrate  int
-	Channels int
-	Method   PlaybackMethod
+	Name      string
+	Codec     string
+	Language  string
+	Profile   string
+	Bitrate   int
+	Channels  int
+	Method    PlaybackMethod
+	Container Container
+	Default   bool
+
+	// ChannelLayout is the output layout: the source's for passthrough,
+	// the downmix target for transcodes.
+	ChannelLayout string
+}
+
+type ClientCapabilities struct {
+	MinHeight  int
+	MaxHeight  int
+	MaxBitrate int
+	AC3        bool
+	EAC3       bool
+
+	// HEVC and VP9 declare support for video renditions in those codecs.
+	// Without them only H.264 renditions are listed.
+	HEVC bool
+	VP9  bool
+}
+
+type AudioGroupPolicy struct {
+	GroupID   func(audio AudioRendition) string
+	IsDefault func(audio AudioRendition) bool
+
+	// InlineSingle muxes the audio into the video variants, as
+	// MasterOptions.Muxed does, when exactly one audio rendition is listed,
+	// rather than declaring an AUDIO group with a single track.
+	InlineSingle bool
 }
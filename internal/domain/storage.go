@@ -7,6 +7,9 @@ type Storage interface {
 	GetMetadata(ctx context.Context, sourceURL string) ([]byte, error)
 	SetMetadata(ctx context.Context, sourceURL string, data []byte) error
 
+	// WriteSegment may be called more than once for the same segment when
+	// jobs overlap. It must be idempotent, and atomic unless the
+	// SegmentWriteSkipExisting policy is used.
 	WriteSegment(ctx context.Context, info SegmentData, data []byte) error
 	ReadSegment(ctx context.Context, info SegmentData) ([]byte, error)
 	SegmentExists(ctx context.Context, info SegmentData) (bool, error)
@@ -22,4 +25,101 @@ type Storage interface {
 	WriteSubtitleVTT(ctx context.Context, sourceURL string, lang string, data []byte) error
 	ReadSubtitleVTT(ctx context.Context, sourceURL string, lang string) ([]byte, error)
 	SubtitleVTTExists(ctx context.Context, sourceURL string, lang string) (bool, error)
+
+	WriteIndex(ctx context.Context, sourceURL string, rendition string, streamType StreamType, data []byte) error
+	ReadIndex(ctx context.Context, sourceURL string, rendition string, streamType StreamType) ([]byte, error)
+	IndexExists(ctx context.Context, sourceURL string, rendition string, streamType StreamType) (bool, error)
+}
+
+// SegmentChecksummer is implemented by a Storage that can keep a checksum
+// beside each segment, for caches that may corrupt data at rest. It is
+// required by the VerifySegments option.
+type SegmentChecksummer interface {
+	// WriteSegmentChecksum stores the SHA-256 of a segment. It is called
+	// before the segment itself is written.
+	WriteSegmentChecksum(ctx context.Context, info SegmentData, sum []byte) error
+
+	// ReadSegmentChecksum returns the stored SHA-256 of a segment, or nil
+	// if there is none (for example, a segment stored before checksums
+	// were enabled).
+	ReadSegmentChecksum(ctx context.Context, info SegmentData) ([]byte, error)
+}
+
+// SegmentSizer is implemented by a Storage that can report a segment's size
+// without reading it, such as from object metadata. Without it
+// Controller.SegmentSize reads the whole segment.
+type SegmentSizer interface {
+	SegmentSize(ctx context.Context, info SegmentData) (int64, error)
+}
+
+// KeyframeStore is implemented by a Storage that can supply a precomputed
+// keyframe sidecar: a JSON array of keyframe timestamps in seconds. When one
+// exists it is used instead of scanning packets with ffprobe.
+type KeyframeStore interface {
+	ReadKeyframes(ctx context.Context, sourceURL string) ([]byte, error)
+	KeyframesExists(ctx context.Context, sourceURL string) (bool, error)
+}
+
+// ThumbnailStore is implemented by a Storage that can cache the frames
+// returned by Controller.Thumbnail, per timestamp and size. Without it each
+// request extracts its frame from the source.
+type ThumbnailStore interface {
+	WriteThumbnail(ctx context.Context, info ThumbnailData, data []byte) error
+	ReadThumbnail(ctx context.Context, info ThumbnailData) ([]byte, error)
+	ThumbnailExists(ctx context.Context, info ThumbnailData) (bool, error)
+}
+
+// PosterStore is implemented by a Storage that can cache the frame returned
+// by Controller.Poster. Without it each request extracts the poster from the
+// source.
+type PosterStore interface {
+	WritePoster(ctx context.Context, sourceURL string, data []byte) error
+	ReadPoster(ctx context.Context, sourceURL string) ([]byte, error)
+	PosterExists(ctx context.Context, sourceURL string) (bool, error)
+}
+
+// RawProbeStore is implemented by a Storage that can cache the unparsed
+// ffprobe JSON of a source, kept apart from its parsed metadata. Without it
+// RawProbe runs ffprobe on every call.
+type RawProbeStore interface {
+	WriteRawProbe(ctx context.Context, sourceURL string, data []byte) error
+	ReadRawProbe(ctx context.Context, sourceURL string) ([]byte, error)
+	RawProbeExists(ctx context.Context, sourceURL string) (bool, error)
+}
+
+// SegmentFailureStore is implemented by a Storage that can keep the JSON
+// failure record of a segment whose transcode failed. It is required by the
+// MaxSegmentRetries and GapFailedSegments options.
+type SegmentFailureStore interface {
+	WriteSegmentFailure(ctx context.Context, info SegmentData, data []byte) error
+	ReadSegmentFailure(ctx context.Context, info SegmentData) ([]byte, error)
+	SegmentFailureExists(ctx context.Context, info SegmentData) (bool, error)
+
+	// ReadSegmentFailures returns every failure record of a rendition keyed
+	// by segment index, so a variant playlist costs one lookup rather than
+	// one per segment.
+	ReadSegmentFailures(ctx context.Context, sourceURL string, rendition string, streamType StreamType) (map[int][]byte, error)
+
+	// DeleteSegmentFailure removes the record and must not fail if there
+	// is none.
+	DeleteSegmentFailure(ctx context.Context, info SegmentData) error
+}
+
+// InitSegmentStore is implemented by a Storage that can hold the EXT-X-MAP
+// initialization segment of a fragmented MP4 rendition. It is required by
+// any configuration that produces fMP4 renditions (VP9 or HEVC output, or
+// HEVC direct streams).
+type InitSegmentStore interface {
+	WriteInitSegment(ctx context.Context, sourceURL string, rendition string, streamType StreamType, data []byte) error
+	ReadInitSegment(ctx context.Context, sourceURL string, rendition string, streamType StreamType) ([]byte, error)
+	InitSegmentExists(ctx context.Context, sourceURL string, rendition string, streamType StreamType) (bool, error)
+}
+
+// SubtitleASSStore is implemented by a Storage that can cache ASS/SSA
+// subtitle tracks copied from the source without conversion. Without it
+// ASS tracks are extracted from the source on every request.
+type SubtitleASSStore interface {
+	WriteSubtitleASS(ctx context.Context, sourceURL string, lang string, data []byte) error
+	ReadSubtitleASS(ctx context.Context, sourceURL string, lang string) ([]byte, error)
+	SubtitleASSExists(ctx context.Context, sourceURL string, lang string) (bool, error)
 }
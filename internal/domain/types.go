@@ -1,5 +1,14 @@
 package domain
 
+import (
+	"context"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"time"
+)
+
 type Job struct {
 	ID         string
 	SourceURL  string
@@ -9,6 +18,36 @@ type Job struct {
 	EndIndex   int
 }
 
+// JobProgress reports how far a running transcoding job has got.
+type JobProgress struct {
+	Job Job
+
+	// Fraction is the share of the job's source range encoded so far,
+	// from 0 to 1.
+	Fraction float64
+
+	// Position is the source position reached, in seconds.
+	Position float64
+
+	// Frame counts the video frames encoded so far; zero for audio.
+	Frame int64
+
+	// Speed is the encode speed relative to realtime, zero until known.
+	Speed float64
+}
+
+// JobStats describes how a finished transcoding job performed.
+type JobStats struct {
+	Job Job
+
+	// Elapsed is the wall time of the job's ffmpeg run.
+	Elapsed time.Duration
+
+	// Speed is ffmpeg's encode speed relative to realtime: 0.8 means a
+	// 10 second range took 12.5 seconds. Zero if ffmpeg did not report it.
+	Speed float64
+}
+
 type SegmentState int
 
 const (
@@ -16,17 +55,74 @@ const (
 	SegmentStateError
 )
 
+// SegmentWritePolicy decides what happens when a job finishes a segment that
+// another, overlapping job has already stored.
+type SegmentWritePolicy int
+
+const (
+	// SegmentWriteOverwrite replaces the stored segment. Storage.WriteSegment
+	// must then be atomic, e.g. write to a temporary key and rename, so a
+	// reader never sees a half-written segment.
+	SegmentWriteOverwrite SegmentWritePolicy = iota
+	// SegmentWriteSkipExisting keeps the stored segment and drops the new one.
+	SegmentWriteSkipExisting
+)
+
 type SegmentStatus struct {
 	State SegmentState
 	Error string
 }
 
+// SegmentFailure is the stored record of a segment whose transcode failed.
+type SegmentFailure struct {
+	// Attempts counts the failed jobs that covered the segment.
+	Attempts int
+	// Error is the reason given by the latest failure.
+	Error string
+}
+
+// MetadataSchemaVersion is the current Metadata layout. It is bumped whenever
+// probing starts filling new fields, so that metadata cached by an older
+// release is re-probed instead of being read back with those fields empty.
+// Version 2 normalizes keyframes to a sorted list without duplicates; version
+// 3 adds subtitle titles and default flags; version 4 adds programs; version
+// 5 adds stream durations; version 6 adds the video pixel format.
+const MetadataSchemaVersion = 6
+
 type Metadata struct {
+	// SchemaVersion is the MetadataSchemaVersion the metadata was probed with.
+	SchemaVersion int
+
 	Duration  float64
 	Keyframes []float64
 	Video     VideoStream
 	Audios    []AudioStream
 	Subtitles []SubtitleStream
+
+	// Programs lists the source's programs, such as the services of a
+	// broadcast MPEG-TS capture. Empty for most files.
+	Programs []Program
+
+	// Program is the ID of the program Video and Audios were chosen from
+	// when the source has more than one, and zero otherwise.
+	Program int
+}
+
+// Stale reports whether the metadata was probed by an older release and must
+// be probed again.
+func (m *Metadata) Stale() bool {
+	return m.SchemaVersion < MetadataSchemaVersion
+}
+
+// Program is one program (service) of a multi-program source.
+type Program struct {
+	ID int
+
+	// Name is the program's service_name tag, if any.
+	Name string
+
+	// Streams holds the ffprobe indices of the program's streams.
+	Streams []int
 }
 
 type VideoStream struct {
@@ -36,6 +132,31 @@ type VideoStream struct {
 	Height    int
 	Bitrate   int
 	FrameRate float64
+	VFR       bool
+
+	// PixelFormat is ffprobe's pixel format name, e.g. "yuv420p" or
+	// "yuv420p10le". Empty when the source does not declare one.
+	PixelFormat string
+
+	// Duration is the stream's own length in seconds, which may differ from
+	// the container's. Zero when the source does not report it.
+	Duration float64
+}
+
+// highBitDepth matches the component depth in ffprobe pixel format names
+// above 8 bits: planar formats such as "yuv420p10le" and "gbrp12le", and
+// semi-planar ones such as "p010le".
+var highBitDepth = regexp.MustCompile(`(?:p|^p[024]|^gray)(\d{2})(?:le|be)?$`)
+
+// BitDepth returns the bit depth of an ffprobe pixel format, such as 10 for
+// "yuv420p10le". 8-bit, unrecognised and empty formats return 8.
+func BitDepth(pixelFormat string) int {
+	if m := highBitDepth.FindStringSubmatch(pixelFormat); m != nil {
+		if depth, err := strconv.Atoi(m[1]); err == nil && depth > 8 {
+			return depth
+		}
+	}
+	return 8
 }
 
 type AudioStream struct {
@@ -44,11 +165,149 @@ type AudioStream struct {
 	Language string
 	Channels int
 	Bitrate  int
+	Default  bool
+
+	// ChannelLayout is ffprobe's layout name, e.g. "stereo", "5.1" or
+	// "5.1(side)". Empty when the source does not declare one.
+	ChannelLayout string
+
+	// Duration is the stream's own length in seconds, which may differ from
+	// the container's. Zero when the source does not report it.
+	Duration float64
+}
+
+// KeyframeStrategy selects how keyframe timestamps are read from a source.
+type KeyframeStrategy int
+
+const (
+	// KeyframesFromPackets scans packet flags. It is fast because nothing is
+	// decoded, but some containers flag packets poorly.
+	KeyframesFromPackets KeyframeStrategy = iota
+
+	// KeyframesFromFrames decodes keyframes only and keeps I pictures, in
+	// presentation order. Slower, but reliable where packet flags are not.
+	KeyframesFromFrames
+)
+
+type ImageFormat string
+
+const (
+	ImageJPEG ImageFormat = "jpeg"
+	ImageWebP ImageFormat = "webp"
+)
+
+// ContentType returns the MIME type of images in the format. The zero value
+// is JPEG.
+func (f ImageFormat) ContentType() string {
+	if f == ImageWebP {
+		return "image/webp"
+	}
+	return "image/jpeg"
+}
+
+// ImageOptions selects the encoder for extracted images. Quality follows the
+// encoder's own scale: for JPEG it is ffmpeg's qscale, 2 (best) to 31
+// (smallest); for WebP it is 0 (smallest) to 100 (best). Zero selects the
+// default for the format.
+type ImageOptions struct {
+	Format  ImageFormat
+	Quality int
+}
+
+// Validate reports an unknown format or a quality outside the format's range.
+func (o ImageOptions) Validate() error {
+	switch o.Format {
+	case "", ImageJPEG:
+		if o.Quality != 0 && (o.Quality < 2 || o.Quality > 31) {
+			return fmt.Errorf("jpeg quality %d outside 2-31", o.Quality)
+		}
+	case ImageWebP:
+		if o.Quality < 0 || o.Quality > 100 {
+			return fmt.Errorf("webp quality %d outside 0-100", o.Quality)
+		}
+	default:
+		return fmt.Errorf("unknown image format %q", o.Format)
+	}
+	return nil
 }
 
 type SubtitleStream struct {
 	Index    int
 	Codec    string
 	Language string
+	Title    string
 	Forced   bool
+	Default  bool
+}
+
+// SubtitleTrack describes a subtitle track for building a track selector.
+type SubtitleTrack struct {
+	// Key addresses the track in Subtitle: its language, or for a repeated
+	// language the language plus the track index, e.g. "en_2".
+	Key      string
+	Language string
+	Title    string
+	Codec    string
+	Forced   bool
+	Default  bool
+}
+
+// Bundle is everything a client needs to cache a source for offline
+// playback, gathered in one call.
+type Bundle struct {
+	// Master is the master playlist.
+	Master string
+
+	// Variants are the variant playlists Master references.
+	Variants []BundleVariant
+
+	// Subtitles are the source's subtitle tracks, in stream order.
+	Subtitles []BundleSubtitle
+
+	// SpriteVTT is the URL of the seek-preview VTT and Sprites those of the
+	// sheets it points into. Both are empty for a source without video.
+	SpriteVTT string
+	Sprites   []string
+}
+
+// BundleVariant is one variant playlist of a Bundle with the URLs of the
+// segments it lists.
+type BundleVariant struct {
+	StreamType StreamType
+	Rendition  string
+
+	// URL is the variant playlist's URL as Master lists it.
+	URL      string
+	Playlist string
+
+	// InitSegment is the URL of the initialization segment of an fMP4
+	// rendition, and empty for MPEG-TS.
+	InitSegment string
+	Segments    []string
 }
+
+// BundleSubtitle is a subtitle track of a Bundle and the URL of its WebVTT.
+type BundleSubtitle struct {
+	SubtitleTrack
+	URL string
+}
+
+// SubtitleFormat selects how a subtitle track is delivered.
+type SubtitleFormat string
+
+const (
+	// SubtitleFormatVTT converts the track to WebVTT.
+	SubtitleFormatVTT SubtitleFormat = "vtt"
+	// SubtitleFormatASS copies an ASS/SSA track unchanged, keeping its styling.
+	SubtitleFormatASS SubtitleFormat = "ass"
+)
+
+type SubtitleOptions struct {
+	Format SubtitleFormat
+	Offset float64
+}
+
+// SourceOpener returns the bytes of a "pipe:" source, for inputs ffmpeg
+// cannot open itself such as blobs decrypted in process. It is called once
+// per ffmpeg or ffprobe run, and each call must start from the beginning.
+type SourceOpener func(ctx context.Context, sourceURL string) (io.ReadCloser, error)
@@ -2,7 +2,10 @@ package ffmpeg
 
 import (
 	"fmt"
+	"math"
+	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 
 	"github.com/eleven-am/goshl/internal/domain"
@@ -13,12 +16,28 @@ type StreamParams struct {
 	StreamIndex int
 	StartTime   float64
 	EndTime     float64
+
+	// Program restricts stream selection to one program of a multi-program
+	// source, such as an MPEG-TS capture. Zero selects from the whole input.
+	Program int
 }
 
 type VideoStreamParams struct {
 	StreamParams
 	Rendition     domain.VideoRendition
 	KeyframeTimes []float64
+
+	// SourceCodec is the source video codec. When the accelerator cannot
+	// decode it, decoding falls back to software.
+	SourceCodec string
+
+	// SourcePixelFormat is the source's ffprobe pixel format. A source
+	// deeper than 8 bits is decoded in software when the accelerator cannot
+	// decode that depth, and transcodes of it are converted to 8-bit.
+	SourcePixelFormat string
+
+	// Audio, when set, is muxed into the stream alongside the video.
+	Audio *domain.AudioRendition
 }
 
 type AudioStreamParams struct {
@@ -26,12 +45,99 @@ type AudioStreamParams struct {
 	Rendition domain.AudioRendition
 }
 
+// SeekMode controls where -ss is placed relative to -i.
+type SeekMode int
+
+const (
+	// SeekFast places -ss before -i. ffmpeg jumps straight to the nearest
+	// keyframe, which is quick but may decode a few frames of content from
+	// before the requested start on transcoded renditions.
+	SeekFast SeekMode = iota
+
+	// SeekAccurate places -ss after -i. ffmpeg decodes from the start of the
+	// input and discards frames until the exact start time, which is frame
+	// accurate but adds latency proportional to the seek position. Only
+	// applied to transcoded renditions; stream copies always seek fast.
+	SeekAccurate
+)
+
+const defaultSegmentTimeDelta = 0.05
+
+// boundaryMargin is how far before its end boundary a video job stops
+// reading. Keyframe times are probed to the microsecond, so the frame on the
+// boundary, which the next job starts with, could compare either side of an
+// exact -to. Stopping a millisecond early keeps it out of this job whatever
+// the rounding, and no frame interval is that short.
+const boundaryMargin = 0.001
+
 type CommandBuilder struct {
 	HWAccel *domain.HWAccelConfig
+	Seek    SeekMode
+
+	// Codecs holds the configurations of output codecs other than
+	// HWAccel.Codec, for ladders that mix codecs. Renditions in a codec
+	// missing here are encoded with HWAccel.
+	Codecs map[domain.VideoCodec]*domain.HWAccelConfig
+
+	// SegmentTimeDelta is passed as -segment_time_delta to the segment muxer.
+	SegmentTimeDelta float64
+
+	// MuxDelay is passed as -muxdelay.
+	MuxDelay float64
+
+	// MuxPreload is passed as -muxpreload when non-zero.
+	MuxPreload float64
+
+	// KeyframeInterval adds forced keyframes every interval seconds inside
+	// each segment, on top of the ones at segment starts. Zero forces
+	// keyframes at segment starts only.
+	KeyframeInterval float64
+
+	// SceneCut keeps the encoder's scene-change keyframes. When false they
+	// are switched off where the encoder has a switch for them (x264/x265
+	// and NVENC). Segment-start keyframes are forced either way, so
+	// boundaries stay aligned across renditions.
+	SceneCut bool
+
+	// ScaleFlags selects the scaling algorithm, as a libswscale flag name
+	// (e.g. "lanczos", "bicubic"). It is appended as flags= to software
+	// scale filters and mapped to interp_algo for scale_cuda; scalers
+	// without an equivalent ignore it. Empty keeps the scaler's default.
+	ScaleFlags string
+
+	// Denoise and Sharpen are ffmpeg filters (e.g. "hqdn3d", "unsharp")
+	// run before and after scaling on transcodes. They need frames in
+	// system memory, so they are skipped when the accelerator scales on
+	// the GPU.
+	Denoise string
+	Sharpen string
+}
+
+// cudaInterpAlgos maps libswscale flag names to scale_cuda interp_algo values.
+var cudaInterpAlgos = map[string]string{
+	"neighbor": "nearest",
+	"bilinear": "bilinear",
+	"bicubic":  "bicubic",
+	"lanczos":  "lanczos",
 }
 
 func NewCommandBuilder(hwAccel *domain.HWAccelConfig) *CommandBuilder {
-	return &CommandBuilder{HWAccel: hwAccel}
+	return &CommandBuilder{
+		HWAccel:          hwAccel,
+		SegmentTimeDelta: defaultSegmentTimeDelta,
+	}
+}
+
+// Config returns the configuration renditions in codec are encoded with.
+// Empty means h264.
+func (b *CommandBuilder) Config(codec domain.VideoCodec) *domain.HWAccelConfig {
+	if codec == "" {
+		codec = domain.VideoCodecH264
+	}
+	if hw, ok := b.Codecs[codec]; ok {
+		return hw
+	}
+	return b.HWAccel
 }
 
 type VideoParams struct {
@@ -41,6 +147,36 @@ type VideoParams struct {
 	Segments           []domain.Segment
 	OutputDir          string
 	ActualSeekKeyframe float64
+
+	// SourceCodec is the source video codec. When the accelerator cannot
+	// decode it, decoding falls back to software.
+	SourceCodec string
+
+	// SourcePixelFormat is the source's ffprobe pixel format. A source
+	// deeper than 8 bits is decoded in software when the accelerator cannot
+	// decode that depth, and transcodes of it are converted to 8-bit.
+	SourcePixelFormat string
+
+	// PassLogFile, when set on a transcoded rendition, makes Video the
+	// second pass of a two-pass encode reading stats from this file.
+	// VideoFirstPass writes them.
+	PassLogFile string
+
+	// Audio, when set, is muxed into the video segments, taken from the
+	// source's first audio stream.
+	Audio *domain.AudioRendition
+
+	// PadAudio pads a muxed Audio with silence, for sources whose audio
+	// ends before their video, as AudioParams.Pad does.
+	PadAudio bool
+
+	// Program restricts stream selection to one program of a multi-program
+	// source. Zero selects from the whole input.
+	Program int
+
+	// FastStart adds the encoder's FastStartFlags to a transcode, trading
+	// quality for a quicker first segment.
+	FastStart bool
 }
 
 type AudioParams struct {
@@ -49,6 +185,25 @@ type AudioParams struct {
 	Rendition   domain.AudioRendition
 	Segments    []domain.Segment
 	OutputDir   string
+
+	// Program restricts stream selection to one program of a multi-program
+	// source. Zero selects from the whole input.
+	Program int
+
+	// Pad fills the audio with silence up to the end of its last segment,
+	// for sources whose audio ends before their video. A passthrough
+	// rendition is then re-encoded in its own codec, since a stream copy
+	// cannot be padded.
+	Pad bool
+}
+
+// streamMap returns the -map specifier for the index-th stream of kind ("V"
+// or "a"), within program when it is non-zero.
+func streamMap(program int, kind string, index int) string {
+	if program != 0 {
+		return fmt.Sprintf("0:p:%d:%s:%d", program, kind, index)
+	}
+	return fmt.Sprintf("0:%s:%d", kind, index)
 }
 
 func (b *CommandBuilder) Video(p VideoParams) []string {
@@ -61,41 +216,31 @@ func (b *CommandBuilder) Video(p VideoParams) []string {
 
 	args := []string{
 		"-nostats", "-hide_banner", "-loglevel", "warning",
+		// Key=value progress, including speed, for the worker to parse.
+		"-progress", "pipe:2",
 	}
 
 	if p.Rendition.Method != domain.DirectStream {
-		args = append(args, b.HWAccel.DecodeFlags...)
+		args = append(args, b.decodeFlags(b.Config(p.Rendition.Codec), p.SourceCodec, p.SourcePixelFormat)...)
 	}
 
-	args = append(args,
-		"-ss", fmt.Sprintf("%.6f", startSeg.Start),
-		"-i", p.InputURL,
-		"-to", fmt.Sprintf("%.6f", endSeg.End),
-		"-copyts",
-		"-start_at_zero",
-		"-muxdelay", "0",
-	)
+	args = append(args, b.inputArgs(p.InputURL, startSeg.Start, endSeg.End-boundaryMargin, p.Rendition.Method)...)
 
-	args = append(args, "-map", fmt.Sprintf("0:V:%d", p.StreamIndex))
+	args = append(args, "-map", streamMap(p.Program, "V", p.StreamIndex))
 
 	args = append(args, b.videoEncodeArgs(p)...)
+	args = append(args, codecTagArgs(p.Rendition)...)
+	args = append(args, passArgs(p, 2)...)
+	args = append(args, muxedAudioArgs(p.Program, p.Audio, p.PadAudio)...)
 
-	var segmentTimes string
+	offset := startSeg.Start
 	if p.Rendition.Method == domain.DirectStream && p.ActualSeekKeyframe > 0 {
-		segmentTimes = formatSegmentTimesWithOffset(p.Segments, p.ActualSeekKeyframe)
-	} else {
-		segmentTimes = formatSegmentTimes(p.Segments)
+		offset = p.ActualSeekKeyframe
 	}
-	outputPattern := filepath.Join(p.OutputDir, "segment-%05d.ts")
+	segmentTimes := formatVideoSegmentTimes(p.Segments, offset)
+	outputPattern := filepath.Join(p.OutputDir, "segment-%05d"+p.Rendition.Container.Extension())
 
-	args = append(args,
-		"-f", "segment",
-		"-segment_time_delta", "0.05",
-		"-segment_format", "mpegts",
-		"-segment_list_type", "flat",
-		"-segment_list", "pipe:1",
-		"-segment_start_number", fmt.Sprintf("%d", startSeg.Index),
-	)
+	args = append(args, b.segmentArgs(startSeg.Index, p.Rendition.Container)...)
 
 	if segmentTimes != "" {
 		args = append(args, "-segment_times", segmentTimes)
@@ -106,30 +251,220 @@ func (b *CommandBuilder) Video(p VideoParams) []string {
 	return args
 }
 
+// VideoFirstPass returns the analysis pass of a two-pass encode for p. It
+// encodes the same range with the same settings as Video, writes rate
+// control stats to p.PassLogFile and discards the output. It returns nil for
+// direct-stream renditions or when no PassLogFile is set.
+func (b *CommandBuilder) VideoFirstPass(p VideoParams) []string {
+	if len(p.Segments) == 0 || p.PassLogFile == "" || p.Rendition.Method == domain.DirectStream {
+		return nil
+	}
+
+	startSeg := p.Segments[0]
+	endSeg := p.Segments[len(p.Segments)-1]
+
+	args := []string{
+		"-nostats", "-hide_banner", "-loglevel", "warning",
+	}
+	args = append(args, b.decodeFlags(b.Config(p.Rendition.Codec), p.SourceCodec, p.SourcePixelFormat)...)
+	args = append(args, b.inputArgs(p.InputURL, startSeg.Start, endSeg.End-boundaryMargin, p.Rendition.Method)...)
+	args = append(args, "-map", streamMap(p.Program, "V", p.StreamIndex))
+	args = append(args, b.videoEncodeArgs(p)...)
+	args = append(args, passArgs(p, 1)...)
+	args = append(args, "-an", "-f", "null", os.DevNull)
+
+	return args
+}
+
+// decodeFlags returns the input flags for decoding a source in codec and
+// pixelFormat: hw's decode flags, or only its device flags when it cannot
+// decode the codec at that bit depth and frames are decoded in software.
+func (b *CommandBuilder) decodeFlags(hw *domain.HWAccelConfig, codec, pixelFormat string) []string {
+	if hw.Decodes(codec, pixelFormat) {
+		return hw.DecodeFlags
+	}
+	return hw.DeviceFlags
+}
+
+// codecTagArgs tags HEVC in fragmented MP4 as hvc1, the sample entry Apple
+// players require; ffmpeg writes hev1 by default.
+func codecTagArgs(r domain.VideoRendition) []string {
+	if r.Codec == domain.VideoCodecHEVC && r.Container == domain.ContainerFMP4 {
+		return []string{"-tag:v", "hvc1"}
+	}
+	return nil
+}
+
+func passArgs(p VideoParams, pass int) []string {
+	if p.PassLogFile == "" || p.Rendition.Method == domain.DirectStream {
+		return nil
+	}
+	return []string{"-pass", strconv.Itoa(pass), "-passlogfile", p.PassLogFile}
+}
+
+func (b *CommandBuilder) inputArgs(inputURL string, start, end float64, method domain.PlaybackMethod) []string {
+	ss := []string{"-ss", fmt.Sprintf("%.6f", start)}
+
+	var args []string
+	if b.Seek == SeekAccurate && method != domain.DirectStream {
+		args = append(args, "-i", inputURL)
+		args = append(args, ss...)
+	} else {
+		args = append(args, ss...)
+		args = append(args, "-i", inputURL)
+	}
+
+	args = append(args,
+		"-to", fmt.Sprintf("%.6f", end),
+		"-copyts",
+		"-start_at_zero",
+		"-muxdelay", formatFloat(b.MuxDelay),
+	)
+
+	if b.MuxPreload != 0 {
+		args = append(args, "-muxpreload", formatFloat(b.MuxPreload))
+	}
+
+	return args
+}
+
+// segmentArgs configures the segment muxer. Fragmented MP4 segments are
+// written self-initializing (each starts with its own moov); the worker
+// splits the initialization section off before upload.
+func (b *CommandBuilder) segmentArgs(startIndex int, container domain.Container) []string {
+	args := []string{
+		"-f", "segment",
+		"-segment_time_delta", formatFloat(b.SegmentTimeDelta),
+	}
+
+	if container == domain.ContainerFMP4 {
+		args = append(args,
+			"-segment_format", "mp4",
+			"-segment_format_options", "movflags=+frag_keyframe+empty_moov+default_base_moof",
+		)
+	} else {
+		args = append(args, "-segment_format", "mpegts")
+	}
+
+	return append(args,
+		"-segment_list_type", "flat",
+		"-segment_list", "pipe:1",
+		"-segment_start_number", fmt.Sprintf("%d", startIndex),
+	)
+}
+
 func (b *CommandBuilder) videoEncodeArgs(p VideoParams) []string {
 	if p.Rendition.Method == domain.DirectStream {
 		return []string{"-c:v", "copy"}
 	}
 
-	segmentTimes := formatKeyframeTimes(p.Segments)
+	segmentTimes := formatKeyframeTimes(p.Segments, b.KeyframeInterval)
+	hw := b.Config(p.Rendition.Codec)
 
-	args := b.HWAccel.EncodeFlags
+	args := make([]string, len(hw.EncodeFlags))
+	copy(args, hw.EncodeFlags)
+	if p.FastStart {
+		args = append(args, hw.FastStartFlags...)
+	}
 
 	args = append(args,
-		"-vf", fmt.Sprintf(b.HWAccel.ScaleFilter, p.Rendition.Width, p.Rendition.Height),
+		"-vf", b.videoFilter(hw, p.Rendition.Width, p.Rendition.Height, p.SourceCodec, p.SourcePixelFormat),
 		"-b:v", fmt.Sprintf("%d", p.Rendition.Bitrate),
 		"-maxrate", fmt.Sprintf("%d", int(float64(p.Rendition.Bitrate)*1.5)),
 		"-bufsize", fmt.Sprintf("%d", p.Rendition.Bitrate*5),
-		b.HWAccel.KeyframeFlag, segmentTimes,
 	)
-
-	if b.HWAccel.Accelerator == domain.AccelCUDA {
-		args = append(args, "-forced-idr", "1")
+	args = append(args, frameRateArgs(p.Rendition)...)
+	args = append(args, hw.KeyframeFlag, segmentTimes)
+	if !b.SceneCut {
+		args = disableSceneCut(args, hw.Encoder)
 	}
 
+	args = append(args, hw.IDRFlags...)
+
 	return args
 }
 
+// videoFilter builds the -vf chain for a transcode: denoise, then scale, then
+// sharpen, so noise is removed at full resolution and sharpening works on the
+// output pixels. A source hw cannot decode is scaled in software and then
+// handed to the encoder through hw's upload filter. A high bit depth source
+// scaled in system memory is converted to 8-bit yuv420p, which the hardware
+// scalers and upload filters already produce as nv12, so that every
+// transcode matches the 8-bit profile its CODECS attribute advertises.
+func (b *CommandBuilder) videoFilter(hw *domain.HWAccelConfig, width, height int, sourceCodec, pixelFormat string) string {
+	hwDecode := hw.Decodes(sourceCodec, pixelFormat)
+	scaleFormat := hw.ScaleFilter
+	if !hwDecode {
+		scaleFormat = softwareScaleFilter
+	}
+
+	scale := b.scaleFilter(scaleFormat, width, height)
+	if !strings.HasPrefix(scale, "scale=") {
+		return scale
+	}
+
+	var filters []string
+	if b.Denoise != "" {
+		filters = append(filters, b.Denoise)
+	}
+	filters = append(filters, scale)
+	if b.Sharpen != "" {
+		filters = append(filters, b.Sharpen)
+	}
+	upload := !hwDecode && hw.UploadFilter != ""
+	if !upload && domain.BitDepth(pixelFormat) > 8 {
+		filters = append(filters, "format=yuv420p")
+	}
+	if upload {
+		filters = append(filters, hw.UploadFilter)
+	}
+	return strings.Join(filters, ",")
+}
+
+// softwareScaleFilter scales frames decoded into system memory.
+const softwareScaleFilter = "scale=%d:%d"
+
+// scaleFilter renders a scale filter format for the given size with
+// ScaleFlags applied where the scaler supports it.
+func (b *CommandBuilder) scaleFilter(format string, width, height int) string {
+	filter := fmt.Sprintf(format, width, height)
+	if b.ScaleFlags == "" {
+		return filter
+	}
+
+	switch {
+	case strings.HasPrefix(filter, "scale="):
+		return filter + ":flags=" + b.ScaleFlags
+	case strings.HasPrefix(filter, "scale_cuda="):
+		if algo, ok := cudaInterpAlgos[b.ScaleFlags]; ok {
+			return filter + ":interp_algo=" + algo
+		}
+	}
+	return filter
+}
+
+// frameRateArgs forces a constant output rate for renditions that ask for it.
+func frameRateArgs(r domain.VideoRendition) []string {
+	if !r.ConstantFrameRate || r.FrameRate <= 0 {
+		return nil
+	}
+	return []string{"-r", frameRate(r.FrameRate), "-fps_mode", "cfr"}
+}
+
+// frameRate formats rate for ffmpeg's -r. Whole rates and NTSC rates
+// (N*1000/1001, such as 29.97) are written as exact rationals, since a
+// rounded decimal drifts from the source's frame timing over a long
+// encode. Other rates are written as decimals.
+func frameRate(rate float64) string {
+	if whole := math.Round(rate); math.Abs(rate-whole) < 1e-3 {
+		return strconv.Itoa(int(whole))
+	}
+	if ntsc := math.Round(rate * 1.001); math.Abs(rate*1.001-ntsc) < 1e-3 {
+		return fmt.Sprintf("%d/1001", int(ntsc)*1000)
+	}
+	return strconv.FormatFloat(rate, 'f', -1, 64)
+}
+
 func (b *CommandBuilder) Audio(p AudioParams) []string {
 	if len(p.Segments) == 0 {
 		return nil
@@ -140,29 +475,19 @@ func (b *CommandBuilder) Audio(p AudioParams) []string {
 
 	args := []string{
 		"-nostats", "-hide_banner", "-loglevel", "warning",
-		"-ss", fmt.Sprintf("%.6f", startSeg.Start),
-		"-i", p.InputURL,
-		"-to", fmt.Sprintf("%.6f", endSeg.End),
-		"-copyts",
-		"-start_at_zero",
-		"-muxdelay", "0",
+		"-progress", "pipe:2",
 	}
 
-	args = append(args, "-map", fmt.Sprintf("0:a:%d", p.StreamIndex))
+	args = append(args, b.inputArgs(p.InputURL, startSeg.Start, endSeg.End, p.Rendition.Method)...)
+
+	args = append(args, "-map", streamMap(p.Program, "a", p.StreamIndex))
 
 	args = append(args, b.audioEncodeArgs(p)...)
 
 	segmentTimes := formatSegmentTimes(p.Segments)
-	outputPattern := filepath.Join(p.OutputDir, "segment-%05d.ts")
+	outputPattern := filepath.Join(p.OutputDir, "segment-%05d"+p.Rendition.Container.Extension())
 
-	args = append(args,
-		"-f", "segment",
-		"-segment_time_delta", "0.05",
-		"-segment_format", "mpegts",
-		"-segment_list_type", "flat",
-		"-segment_list", "pipe:1",
-		"-segment_start_number", fmt.Sprintf("%d", startSeg.Index),
-	)
+	args = append(args, b.segmentArgs(startSeg.Index, p.Rendition.Container)...)
 
 	if segmentTimes != "" {
 		args = append(args, "-segment_times", segmentTimes)
@@ -173,16 +498,70 @@ func (b *CommandBuilder) Audio(p AudioParams) []string {
 	return args
 }
 
+// muxedAudioArgs maps and encodes the first audio stream next to the video,
+// or returns nothing when no audio is muxed.
+func muxedAudioArgs(program int, audio *domain.AudioRendition, pad bool) []string {
+	if audio == nil {
+		return nil
+	}
+	return append([]string{"-map", streamMap(program, "a", 0)}, audioCodecArgs(*audio, pad)...)
+}
+
 func (b *CommandBuilder) audioEncodeArgs(p AudioParams) []string {
-	if p.Rendition.Method == domain.DirectStream {
-		return []string{"-c:a", "copy"}
+	return audioCodecArgs(p.Rendition, p.Pad)
+}
+
+// audioCodecArgs encodes r. With pad, the audio continues as silence once the
+// source's runs out; the -to of the input arguments still ends the output.
+// Passthrough is copied, except when padded: it is then encoded with the
+// encoder of its own codec (ac3, eac3), so its segments stay compatible.
+func audioCodecArgs(r domain.AudioRendition, pad bool) []string {
+	if r.Method == domain.DirectStream {
+		if !pad {
+			return []string{"-c:a", "copy"}
+		}
+		args := []string{"-c:a", r.Codec, "-ac", fmt.Sprintf("%d", r.Channels)}
+		if r.Bitrate > 0 {
+			args = append(args, "-b:a", fmt.Sprintf("%d", r.Bitrate))
+		}
+		return append(args, audioFilterArgs([]string{"apad"})...)
+	}
+
+	var filters []string
+	if pad {
+		filters = append(filters, "apad")
 	}
 
-	return []string{
+	if r.Profile == "aac_he" {
+		args := []string{
+			"-c:a", "libfdk_aac",
+			"-profile:a", r.Profile,
+			"-ac", fmt.Sprintf("%d", r.Channels),
+			"-b:a", fmt.Sprintf("%d", r.Bitrate),
+		}
+		return append(args, audioFilterArgs(filters)...)
+	}
+
+	args := []string{
 		"-c:a", "aac",
-		"-ac", fmt.Sprintf("%d", p.Rendition.Channels),
-		"-b:a", fmt.Sprintf("%d", p.Rendition.Bitrate),
+		"-ac", fmt.Sprintf("%d", r.Channels),
+	}
+	if r.Channels > 2 && r.ChannelLayout != "" {
+		filters = append([]string{"aformat=channel_layouts=" + r.ChannelLayout}, filters...)
+	}
+	args = append(args, audioFilterArgs(filters)...)
+	return append(args, "-b:a", fmt.Sprintf("%d", r.Bitrate))
+}
+
+func audioFilterArgs(filters []string) []string {
+	if len(filters) == 0 {
+		return nil
 	}
+	return []string{"-af", strings.Join(filters, ",")}
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
 }
 
 func formatSegmentTimes(segments []domain.Segment) string {
@@ -198,19 +577,29 @@ func formatSegmentTimes(segments []domain.Segment) string {
 	return strings.Join(times, ",")
 }
 
-func formatSegmentTimesWithOffset(segments []domain.Segment, actualKeyframe float64) string {
-	if len(segments) <= 1 {
-		return ""
-	}
-
-	times := make([]string, 0, len(segments)-1)
+// formatVideoSegmentTimes lists the cuts of a video job relative to offset,
+// where its output starts: the start of every segment after the first, and
+// the end of the last. A stream copy stops on decode timestamps, so the
+// keyframe on the end boundary and the packets decoded with it get past -to;
+// the final cut moves them into a segment beyond the job's range, which the
+// worker discards, instead of leaving a repeated frame at the end of the
+// last segment.
+func formatVideoSegmentTimes(segments []domain.Segment, offset float64) string {
+	times := make([]string, 0, len(segments))
 	for i := 1; i < len(segments); i++ {
-		times = append(times, fmt.Sprintf("%.6f", segments[i].Start-actualKeyframe))
+		times = append(times, fmt.Sprintf("%.6f", segments[i].Start-offset))
+	}
+	if len(segments) > 0 {
+		times = append(times, fmt.Sprintf("%.6f", segments[len(segments)-1].End-offset))
 	}
 	return strings.Join(times, ",")
 }
 
-func formatKeyframeTimes(segments []domain.Segment) string {
+// formatKeyframeTimes lists the forced keyframe times relative to the first
+// segment: every segment start and, with a positive interval, periodic times
+// inside each segment. Periodic keyframes closer than half an interval to the
+// next segment start are skipped to avoid tiny GOPs.
+func formatKeyframeTimes(segments []domain.Segment, interval float64) string {
 	if len(segments) == 0 {
 		return ""
 	}
@@ -219,33 +608,59 @@ func formatKeyframeTimes(segments []domain.Segment) string {
 	times := make([]string, 0, len(segments))
 	for _, seg := range segments {
 		times = append(times, fmt.Sprintf("%.6f", seg.Start-seekOffset))
+		if interval <= 0 {
+			continue
+		}
+		for t := seg.Start + interval; t < seg.End-interval/2; t += interval {
+			times = append(times, fmt.Sprintf("%.6f", t-seekOffset))
+		}
 	}
 	return strings.Join(times, ",")
 }
 
+// disableSceneCut turns off the scene-change keyframes of encoders that add
+// them by default, so the forced keyframes are the only ones. x265 takes the
+// switch inside its -x265-params value, which is extended if args already
+// set one.
+func disableSceneCut(args []string, encoder string) []string {
+	switch encoder {
+	case "libx264":
+		return append(args, "-sc_threshold", "0")
+	case "libx265":
+		for i := 0; i+1 < len(args); i++ {
+			if args[i] == "-x265-params" {
+				args[i+1] += ":scenecut=0"
+				return args
+			}
+		}
+		return append(args, "-x265-params", "scenecut=0")
+	case "h264_nvenc", "hevc_nvenc":
+		return append(args, "-no-scenecut", "1")
+	}
+	return args
+}
+
 func (b *CommandBuilder) VideoStream(p VideoStreamParams) []string {
 	args := []string{
 		"-nostats", "-hide_banner", "-loglevel", "warning",
 	}
 
 	if p.Rendition.Method != domain.DirectStream {
-		args = append(args, b.HWAccel.DecodeFlags...)
+		args = append(args, b.decodeFlags(b.Config(p.Rendition.Codec), p.SourceCodec, p.SourcePixelFormat)...)
 	}
 
-	args = append(args,
-		"-ss", fmt.Sprintf("%.6f", p.StartTime),
-		"-i", p.InputURL,
-		"-to", fmt.Sprintf("%.6f", p.EndTime),
-		"-copyts",
-		"-start_at_zero",
-		"-muxdelay", "0",
-	)
+	args = append(args, b.inputArgs(p.InputURL, p.StartTime, p.EndTime, p.Rendition.Method)...)
 
-	args = append(args, "-map", fmt.Sprintf("0:V:%d", p.StreamIndex))
+	args = append(args, "-map", streamMap(p.Program, "V", p.StreamIndex))
 
 	args = append(args, b.videoStreamEncodeArgs(p)...)
+	args = append(args, muxedAudioArgs(p.Program, p.Audio, false)...)
 
-	args = append(args, "-f", "mpegts", "pipe:1")
+	format := "mpegts"
+	if p.Rendition.Codec == domain.VideoCodecVP9 {
+		format = "webm"
+	}
+	args = append(args, "-f", format, "pipe:1")
 
 	return args
 }
@@ -255,27 +670,27 @@ func (b *CommandBuilder) videoStreamEncodeArgs(p VideoStreamParams) []string {
 		return []string{"-c:v", "copy"}
 	}
 
-	args := make([]string, len(b.HWAccel.EncodeFlags))
-	copy(args, b.HWAccel.EncodeFlags)
+	hw := b.Config(p.Rendition.Codec)
+	args := make([]string, len(hw.EncodeFlags))
+	copy(args, hw.EncodeFlags)
 
 	args = append(args,
-		"-vf", fmt.Sprintf(b.HWAccel.ScaleFilter, p.Rendition.Width, p.Rendition.Height),
+		"-vf", b.videoFilter(hw, p.Rendition.Width, p.Rendition.Height, p.SourceCodec, p.SourcePixelFormat),
 		"-b:v", fmt.Sprintf("%d", p.Rendition.Bitrate),
 		"-maxrate", fmt.Sprintf("%d", int(float64(p.Rendition.Bitrate)*1.5)),
 		"-bufsize", fmt.Sprintf("%d", p.Rendition.Bitrate*5),
 	)
+	args = append(args, frameRateArgs(p.Rendition)...)
 
 	if len(p.KeyframeTimes) > 0 {
 		times := make([]string, len(p.KeyframeTimes))
 		for i, t := range p.KeyframeTimes {
 			times[i] = fmt.Sprintf("%.6f", t)
 		}
-		args = append(args, b.HWAccel.KeyframeFlag, strings.Join(times, ","))
+		args = append(args, hw.KeyframeFlag, strings.Join(times, ","))
 	}
 
-	if b.HWAccel.Accelerator == domain.AccelCUDA {
-		args = append(args, "-forced-idr", "1")
-	}
+	args = append(args, hw.IDRFlags...)
 
 	return args
 }
@@ -283,15 +698,11 @@ func (b *CommandBuilder) videoStreamEncodeArgs(p VideoStreamParams) []string {
 func (b *CommandBuilder) AudioStream(p AudioStreamParams) []string {
 	args := []string{
 		"-nostats", "-hide_banner", "-loglevel", "warning",
-		"-ss", fmt.Sprintf("%.6f", p.StartTime),
-		"-i", p.InputURL,
-		"-to", fmt.Sprintf("%.6f", p.EndTime),
-		"-copyts",
-		"-start_at_zero",
-		"-muxdelay", "0",
 	}
 
-	args = append(args, "-map", fmt.Sprintf("0:a:%d", p.StreamIndex))
+	args = append(args, b.inputArgs(p.InputURL, p.StartTime, p.EndTime, p.Rendition.Method)...)
+
+	args = append(args, "-map", streamMap(p.Program, "a", p.StreamIndex))
 
 	args = append(args, b.audioStreamEncodeArgs(p)...)
 
@@ -301,13 +712,5 @@ func (b *CommandBuilder) AudioStream(p AudioStreamParams) []string {
 }
 
 func (b *CommandBuilder) audioStreamEncodeArgs(p AudioStreamParams) []string {
-	if p.Rendition.Method == domain.DirectStream {
-		return []string{"-c:a", "copy"}
-	}
-
-	return []string{
-		"-c:a", "aac",
-		"-ac", fmt.Sprintf("%d", p.Rendition.Channels),
-		"-b:a", fmt.Sprintf("%d", p.Rendition.Bitrate),
-	}
+	return audioCodecArgs(p.Rendition, false)
 }
@@ -6,6 +6,7 @@ import (
 	"testing"
 
 	"github.com/eleven-am/goshl/internal/domain"
+	"github.com/eleven-am/goshl/internal/hwaccel"
 )
 
 var testHW = &domain.HWAccelConfig{
@@ -89,6 +90,19 @@ func TestAudioCommand_TranscodeAndCopy(t *testing.T) {
 	if !strings.Contains(joined, "-segment_times 5.000000") {
 		t.Fatalf("audio segment times missing: %s", joined)
 	}
+	if strings.Contains(joined, "aformat") {
+		t.Fatalf("stereo downmix needs no layout filter: %s", joined)
+	}
+
+	surround := strings.Join(builder.Audio(AudioParams{
+		InputURL:  "in.mkv",
+		Rendition: domain.AudioRendition{Method: domain.Transcode, Channels: 6, Bitrate: 384000, ChannelLayout: "5.1"},
+		Segments:  segments,
+		OutputDir: "/tmp/a",
+	}), " ")
+	if !strings.Contains(surround, "-ac 6 -af aformat=channel_layouts=5.1") {
+		t.Fatalf("surround transcode must target the 5.1 layout: %s", surround)
+	}
 
 	copyArgs := builder.Audio(AudioParams{
 		InputURL:    "in.mkv",
@@ -105,6 +119,111 @@ func TestAudioCommand_TranscodeAndCopy(t *testing.T) {
 	}
 }
 
+func TestAudioCommand_HEAACUsesProfile(t *testing.T) {
+	builder := NewCommandBuilder(testHW)
+	segments := []domain.Segment{{Index: 0, Start: 0, End: 5}}
+
+	args := builder.Audio(AudioParams{
+		InputURL:  "in.mkv",
+		Rendition: domain.AudioRendition{Method: domain.Transcode, Codec: "aac", Profile: "aac_he", Channels: 2, Bitrate: 48000},
+		Segments:  segments,
+		OutputDir: "/tmp/a",
+	})
+
+	joined := strings.Join(args, " ")
+	if !strings.Contains(joined, "-c:a libfdk_aac -profile:a aac_he") || !strings.Contains(joined, "-b:a 48000") {
+		t.Fatalf("HE-AAC args missing: %s", joined)
+	}
+}
+
+func TestAudioCommand_PadsShortAudioWithSilence(t *testing.T) {
+	builder := NewCommandBuilder(testHW)
+	params := AudioParams{
+		InputURL:  "in.mkv",
+		Rendition: domain.AudioRendition{Method: domain.Transcode, Channels: 6, Bitrate: 384000, ChannelLayout: "5.1"},
+		Segments:  []domain.Segment{{Index: 8, Start: 48, End: 54}, {Index: 9, Start: 54, End: 60}},
+		OutputDir: "/tmp/a",
+		Pad:       true,
+	}
+
+	joined := strings.Join(builder.Audio(params), " ")
+	if !strings.Contains(joined, "-af aformat=channel_layouts=5.1,apad") || !strings.Contains(joined, "-to 60.000000") {
+		t.Fatalf("expected padding in the one filter chain, bounded by -to: %s", joined)
+	}
+
+	params.Rendition = domain.AudioRendition{Method: domain.Transcode, Profile: "aac_he", Channels: 2, Bitrate: 48000}
+	if he := strings.Join(builder.Audio(params), " "); !strings.Contains(he, "-af apad") {
+		t.Fatalf("expected HE-AAC padded too: %s", he)
+	}
+
+	params.Rendition = domain.AudioRendition{Method: domain.DirectStream, Codec: "eac3", Channels: 6, Bitrate: 640000}
+	if passthrough := strings.Join(builder.Audio(params), " "); !strings.Contains(passthrough, "-c:a eac3 -ac 6 -b:a 640000 -af apad") {
+		t.Fatalf("expected padded passthrough re-encoded in its own codec: %s", passthrough)
+	}
+
+	params.Pad = false
+	if copied := strings.Join(builder.Audio(params), " "); !strings.Contains(copied, "-c:a copy") || strings.Contains(copied, "apad") {
+		t.Fatalf("expected unpadded passthrough copied: %s", copied)
+	}
+}
+
+func TestVideoCommand_SeekModeControlsSSPlacement(t *testing.T) {
+	segments := []domain.Segment{{Index: 0, Start: 12.0, End: 18.0}}
+	transcode := VideoParams{
+		InputURL:  "input.mp4",
+		Rendition: domain.VideoRendition{Method: domain.Transcode, Width: 1280, Height: 720, Bitrate: 2_000_000},
+		Segments:  segments,
+		OutputDir: "/tmp/out",
+	}
+
+	fast := strings.Join(NewCommandBuilder(testHW).Video(transcode), " ")
+	if !strings.Contains(fast, "-ss 12.000000 -i input.mp4") {
+		t.Fatalf("fast seek should place -ss before -i: %s", fast)
+	}
+
+	accurate := NewCommandBuilder(testHW)
+	accurate.Seek = SeekAccurate
+	joined := strings.Join(accurate.Video(transcode), " ")
+	if !strings.Contains(joined, "-i input.mp4 -ss 12.000000") {
+		t.Fatalf("accurate seek should place -ss after -i: %s", joined)
+	}
+
+	direct := transcode
+	direct.Rendition.Method = domain.DirectStream
+	joined = strings.Join(accurate.Video(direct), " ")
+	if !strings.Contains(joined, "-ss 12.000000 -i input.mp4") {
+		t.Fatalf("direct stream should always seek fast: %s", joined)
+	}
+}
+
+func TestSegmentMuxerTuningAppliesToVideoAndAudio(t *testing.T) {
+	segments := []domain.Segment{{Index: 0, Start: 0, End: 6}, {Index: 1, Start: 6, End: 12}}
+
+	defaults := NewCommandBuilder(testHW)
+	joined := strings.Join(defaults.Audio(AudioParams{InputURL: "in", Rendition: domain.AudioRendition{Method: domain.Transcode, Channels: 2, Bitrate: 128000}, Segments: segments, OutputDir: "/tmp"}), " ")
+	if !strings.Contains(joined, "-segment_time_delta 0.05") || !strings.Contains(joined, "-muxdelay 0") {
+		t.Fatalf("expected default muxer tuning: %s", joined)
+	}
+	if strings.Contains(joined, "-muxpreload") {
+		t.Fatalf("muxpreload should be omitted by default: %s", joined)
+	}
+
+	tuned := NewCommandBuilder(testHW)
+	tuned.SegmentTimeDelta = 0.1
+	tuned.MuxDelay = 0.2
+	tuned.MuxPreload = 0.3
+
+	for name, args := range map[string][]string{
+		"video": tuned.Video(VideoParams{InputURL: "in", Rendition: domain.VideoRendition{Method: domain.Transcode, Width: 640, Height: 360, Bitrate: 600_000}, Segments: segments, OutputDir: "/tmp"}),
+		"audio": tuned.Audio(AudioParams{InputURL: "in", Rendition: domain.AudioRendition{Method: domain.Transcode, Channels: 2, Bitrate: 128000}, Segments: segments, OutputDir: "/tmp"}),
+	} {
+		joined := strings.Join(args, " ")
+		if !strings.Contains(joined, "-segment_time_delta 0.1") || !strings.Contains(joined, "-muxdelay 0.2") || !strings.Contains(joined, "-muxpreload 0.3") {
+			t.Fatalf("%s: expected tuned muxer args: %s", name, joined)
+		}
+	}
+}
+
 func TestVideoStreamArgsIncludeKeyframesAndForcedIDRForCUDA(t *testing.T) {
 	builder := NewCommandBuilder(&domain.HWAccelConfig{
 		Accelerator:  domain.AccelCUDA,
@@ -113,6 +232,7 @@ func TestVideoStreamArgsIncludeKeyframesAndForcedIDRForCUDA(t *testing.T) {
 		Encoder:      "h264_nvenc",
 		KeyframeFlag: "-force_idr",
 		ScaleFilter:  "scale_cuda=%d:%d:format=nv12",
+		IDRFlags:     []string{"-forced-idr", "1"},
 	})
 
 	args := builder.VideoStream(VideoStreamParams{
@@ -125,6 +245,9 @@ func TestVideoStreamArgsIncludeKeyframesAndForcedIDRForCUDA(t *testing.T) {
 	if !strings.Contains(joined, "-force_idr 0.000000,2.500000,5.000000") {
 		t.Fatalf("cuda keyframes missing: %s", joined)
 	}
+	if !strings.Contains(joined, "-forced-idr 1") {
+		t.Fatalf("cuda IDR flags missing: %s", joined)
+	}
 	if !strings.Contains(joined, "-vf scale_cuda=640:360:format=nv12") {
 		t.Fatalf("cuda scale missing: %s", joined)
 	}
@@ -134,11 +257,439 @@ func TestHelpersHandleEdgeCases(t *testing.T) {
 	if got := formatSegmentTimes(nil); got != "" {
 		t.Fatalf("expected empty for nil segments, got %q", got)
 	}
-	if got := formatKeyframeTimes(nil); got != "" {
+	if got := formatKeyframeTimes(nil, 0); got != "" {
 		t.Fatalf("expected empty for no segments, got %q", got)
 	}
-	segs := []domain.Segment{{Start: 5}, {Start: 8}, {Start: 11}}
-	if got := formatSegmentTimesWithOffset(segs, 4); got != "4.000000,7.000000" {
+	segs := []domain.Segment{{Start: 5, End: 8}, {Start: 8, End: 11}, {Start: 11, End: 14}}
+	if got := formatVideoSegmentTimes(segs, 4); got != "4.000000,7.000000,10.000000" {
 		t.Fatalf("unexpected offset times %q", got)
 	}
 }
+
+func TestVideoCommand_ConstantFrameRateForcesRate(t *testing.T) {
+	builder := NewCommandBuilder(testHW)
+	segments := []domain.Segment{{Index: 0, Start: 0, End: 6}, {Index: 1, Start: 6, End: 12}}
+
+	args := strings.Join(builder.Video(VideoParams{
+		InputURL:  "input.mp4",
+		Rendition: domain.VideoRendition{Method: domain.Transcode, Width: 1280, Height: 720, Bitrate: 2_000_000, FrameRate: 29.97, ConstantFrameRate: true},
+		Segments:  segments,
+		OutputDir: "/tmp/out",
+	}), " ")
+	if !strings.Contains(args, "-r 30000/1001 -fps_mode cfr -force_key_frames 0.000000,6.000000") {
+		t.Fatalf("expected constant rate ahead of forced keyframes, got %s", args)
+	}
+
+	plain := strings.Join(builder.Video(VideoParams{
+		InputURL:  "input.mp4",
+		Rendition: domain.VideoRendition{Method: domain.Transcode, Width: 1280, Height: 720, Bitrate: 2_000_000, FrameRate: 29.97},
+		Segments:  segments,
+		OutputDir: "/tmp/out",
+	}), " ")
+	if strings.Contains(plain, "-fps_mode") {
+		t.Fatalf("constant rate should be opt-in per rendition, got %s", plain)
+	}
+}
+
+func TestFrameRateIsExactForWholeAndNTSCRates(t *testing.T) {
+	tests := []struct {
+		rate float64
+		want string
+	}{
+		{24000.0 / 1001, "24000/1001"},
+		{23.976, "24000/1001"},
+		{29.97, "30000/1001"},
+		{59.94, "60000/1001"},
+		{25, "25"},
+		{30, "30"},
+		{12.5, "12.5"},
+	}
+	for _, tc := range tests {
+		if got := frameRate(tc.rate); got != tc.want {
+			t.Errorf("frameRate(%v) = %q, want %q", tc.rate, got, tc.want)
+		}
+	}
+}
+
+func TestVideoCommand_PeriodicAndSceneCutKeyframes(t *testing.T) {
+	builder := NewCommandBuilder(testHW)
+	builder.KeyframeInterval = 2
+	builder.SceneCut = true
+	segments := []domain.Segment{{Index: 0, Start: 10, End: 16.5}, {Index: 1, Start: 16.5, End: 21}}
+
+	args := strings.Join(builder.Video(VideoParams{
+		InputURL:  "input.mp4",
+		Rendition: domain.VideoRendition{Method: domain.Transcode, Width: 1280, Height: 720, Bitrate: 2_000_000},
+		Segments:  segments,
+		OutputDir: "/tmp/out",
+	}), " ")
+
+	if !strings.Contains(args, "-force_key_frames 0.000000,2.000000,4.000000,6.500000,8.500000 ") {
+		t.Fatalf("expected segment starts plus periodic keyframes, got %s", args)
+	}
+	if !strings.Contains(args, "-segment_times 6.500000") {
+		t.Fatalf("segment boundaries must be unchanged, got %s", args)
+	}
+	if strings.Contains(args, "-sc_threshold") {
+		t.Fatalf("expected libx264's own scene cut detection, got %s", args)
+	}
+}
+
+func TestVideoCommand_SceneCutOffDisablesEncoderDetection(t *testing.T) {
+	tests := []struct {
+		name     string
+		builder  *CommandBuilder
+		disabled string
+	}{
+		{"libx264", NewCommandBuilder(hwaccel.NewConfig(domain.AccelNone)), "-sc_threshold 0"},
+		{"libx265", NewCommandBuilder(hwaccel.NewCodecConfig(domain.AccelNone, domain.VideoCodecHEVC)), "-x265-params log-level=error:scenecut=0"},
+		{"nvenc", NewCommandBuilder(hwaccel.NewConfig(domain.AccelCUDA)), "-no-scenecut 1"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			params := VideoParams{
+				InputURL:  "input.mp4",
+				Rendition: domain.VideoRendition{Method: domain.Transcode, Width: 1280, Height: 720, Bitrate: 2_000_000, Codec: tc.builder.HWAccel.Codec},
+				Segments:  []domain.Segment{{Index: 0, Start: 0, End: 6}},
+				OutputDir: "/tmp/out",
+			}
+			off := strings.Join(tc.builder.Video(params), " ")
+			tc.builder.SceneCut = true
+			on := strings.Join(tc.builder.Video(params), " ")
+
+			if off == on {
+				t.Fatalf("expected the scene cut option to change the command, got %s", on)
+			}
+			if !strings.Contains(off, tc.disabled) {
+				t.Fatalf("expected %q with scene cuts off, got %s", tc.disabled, off)
+			}
+			if strings.Contains(on, "scenecut") || strings.Contains(on, "-sc_threshold") {
+				t.Fatalf("expected encoder defaults with scene cuts on, got %s", on)
+			}
+		})
+	}
+}
+
+func TestVideoCommand_TwoPassSharesPassLog(t *testing.T) {
+	builder := NewCommandBuilder(testHW)
+	params := VideoParams{
+		InputURL:    "input.mp4",
+		Rendition:   domain.VideoRendition{Method: domain.Transcode, Width: 1280, Height: 720, Bitrate: 2_000_000},
+		Segments:    []domain.Segment{{Index: 0, Start: 0, End: 6}, {Index: 1, Start: 6, End: 12}},
+		OutputDir:   "/tmp/out",
+		PassLogFile: "/tmp/out/passlog",
+	}
+
+	first := strings.Join(builder.VideoFirstPass(params), " ")
+	if !strings.Contains(first, "-pass 1 -passlogfile /tmp/out/passlog") || !strings.HasSuffix(first, "-an -f null /dev/null") {
+		t.Fatalf("unexpected first pass: %s", first)
+	}
+	if !strings.Contains(first, "-force_key_frames 0.000000,6.000000") {
+		t.Fatalf("first pass must use the same keyframes: %s", first)
+	}
+
+	second := strings.Join(builder.Video(params), " ")
+	if !strings.Contains(second, "-pass 2 -passlogfile /tmp/out/passlog") || !strings.Contains(second, "-f segment") {
+		t.Fatalf("unexpected second pass: %s", second)
+	}
+
+	params.Rendition.Method = domain.DirectStream
+	if builder.VideoFirstPass(params) != nil || strings.Contains(strings.Join(builder.Video(params), " "), "-pass") {
+		t.Fatalf("direct stream must not be two-pass")
+	}
+}
+
+func TestVideoCommand_VP9UsesFragmentedMP4AndWebM(t *testing.T) {
+	builder := NewCommandBuilder(testHW)
+	rendition := domain.VideoRendition{
+		Method:    domain.Transcode,
+		Width:     1280,
+		Height:    720,
+		Bitrate:   2_000_000,
+		Codec:     domain.VideoCodecVP9,
+		Container: domain.ContainerFMP4,
+	}
+
+	args := strings.Join(builder.Video(VideoParams{
+		InputURL:  "input.mp4",
+		Rendition: rendition,
+		Segments:  []domain.Segment{{Index: 3, Start: 18, End: 24}},
+		OutputDir: "/tmp/out",
+	}), " ")
+	if !strings.Contains(args, "-segment_format mp4 -segment_format_options movflags=+frag_keyframe+empty_moov+default_base_moof") {
+		t.Fatalf("expected fragmented mp4 segments: %s", args)
+	}
+	if !strings.HasSuffix(args, "/tmp/out/segment-%05d.m4s") {
+		t.Fatalf("expected .m4s output pattern: %s", args)
+	}
+
+	stream := strings.Join(builder.VideoStream(VideoStreamParams{
+		StreamParams: StreamParams{InputURL: "input.mp4", EndTime: 10},
+		Rendition:    rendition,
+	}), " ")
+	if !strings.HasSuffix(stream, "-f webm pipe:1") {
+		t.Fatalf("expected webm progressive output: %s", stream)
+	}
+}
+
+func TestScaleFilterAppliesFlagsWhereSupported(t *testing.T) {
+	cases := []struct {
+		scale string
+		flags string
+		want  string
+	}{
+		{"scale=%d:%d", "", "scale=1280:720"},
+		{"scale=%d:%d", "lanczos", "scale=1280:720:flags=lanczos"},
+		{"scale_cuda=%d:%d:format=nv12", "bicubic", "scale_cuda=1280:720:format=nv12:interp_algo=bicubic"},
+		{"scale_cuda=%d:%d:format=nv12", "area", "scale_cuda=1280:720:format=nv12"},
+		{"scale_vaapi=%d:%d:format=nv12", "lanczos", "scale_vaapi=1280:720:format=nv12"},
+		{"scale_qsv=%d:%d:format=nv12", "lanczos", "scale_qsv=1280:720:format=nv12"},
+	}
+	for _, tc := range cases {
+		hw := *testHW
+		hw.ScaleFilter = tc.scale
+		builder := NewCommandBuilder(&hw)
+		builder.ScaleFlags = tc.flags
+		if got := builder.scaleFilter(hw.ScaleFilter, 1280, 720); got != tc.want {
+			t.Fatalf("%s with %q: expected %s, got %s", tc.scale, tc.flags, tc.want, got)
+		}
+	}
+
+	builder := NewCommandBuilder(testHW)
+	builder.ScaleFlags = "lanczos"
+	args := strings.Join(builder.Video(VideoParams{
+		InputURL:  "input.mp4",
+		Rendition: domain.VideoRendition{Method: domain.Transcode, Width: 640, Height: 360, Bitrate: 600_000},
+		Segments:  []domain.Segment{{Index: 0, Start: 0, End: 6}},
+		OutputDir: "/tmp/out",
+	}), " ")
+	if !strings.Contains(args, "-vf scale=640:360:flags=lanczos") {
+		t.Fatalf("expected scale flags in video args: %s", args)
+	}
+}
+
+func TestVideoFilterOrdersDenoiseScaleSharpen(t *testing.T) {
+	builder := NewCommandBuilder(testHW)
+	builder.Denoise = "hqdn3d"
+	builder.Sharpen = "unsharp=5:5:0.5"
+	builder.ScaleFlags = "lanczos"
+
+	if got := builder.videoFilter(builder.HWAccel, 640, 360, "", ""); got != "hqdn3d,scale=640:360:flags=lanczos,unsharp=5:5:0.5" {
+		t.Fatalf("unexpected filter chain: %s", got)
+	}
+	if got := builder.videoFilter(builder.HWAccel, 640, 360, "", "yuv420p10le"); got != "hqdn3d,scale=640:360:flags=lanczos,unsharp=5:5:0.5,format=yuv420p" {
+		t.Fatalf("expected a 10-bit source converted to 8-bit: %s", got)
+	}
+
+	cuda := *testHW
+	cuda.ScaleFilter = "scale_cuda=%d:%d:format=nv12"
+	builder.HWAccel = &cuda
+	if got := builder.videoFilter(builder.HWAccel, 640, 360, "", "yuv420p10le"); got != "scale_cuda=640:360:format=nv12:interp_algo=lanczos" {
+		t.Fatalf("gpu scaling must skip software filters: %s", got)
+	}
+
+	builder.HWAccel = testHW
+	direct := strings.Join(builder.Video(VideoParams{
+		InputURL:  "input.mp4",
+		Rendition: domain.VideoRendition{Method: domain.DirectStream},
+		Segments:  []domain.Segment{{Index: 0, Start: 0, End: 6}},
+		OutputDir: "/tmp/out",
+	}), " ")
+	if strings.Contains(direct, "hqdn3d") || strings.Contains(direct, "-vf") {
+		t.Fatalf("direct stream must not be filtered: %s", direct)
+	}
+}
+
+func TestVideoFallsBackToSoftwareDecodeForUnsupportedCodec(t *testing.T) {
+	vaapi := &domain.HWAccelConfig{
+		Accelerator:  domain.AccelVAAPI,
+		DecodeFlags:  []string{"-hwaccel", "vaapi", "-vaapi_device", "/dev/dri/renderD128"},
+		EncodeFlags:  []string{"-c:v", "h264_vaapi"},
+		Encoder:      "h264_vaapi",
+		KeyframeFlag: "-force_key_frames",
+		ScaleFilter:  "scale_vaapi=%d:%d:format=nv12",
+		DecodeCodecs: []string{"h264", "hevc"},
+		DeviceFlags:  []string{"-vaapi_device", "/dev/dri/renderD128"},
+		UploadFilter: "format=nv12,hwupload",
+	}
+	builder := NewCommandBuilder(vaapi)
+	params := VideoParams{
+		InputURL:    "input.mkv",
+		Rendition:   domain.VideoRendition{Method: domain.Transcode, Width: 1280, Height: 720, Bitrate: 2_000_000},
+		Segments:    []domain.Segment{{Index: 0, Start: 0, End: 6}},
+		OutputDir:   "/tmp/out",
+		SourceCodec: "vc1",
+	}
+
+	args := strings.Join(builder.Video(params), " ")
+	if strings.Contains(args, "-hwaccel") {
+		t.Fatalf("unsupported codec must be decoded in software: %s", args)
+	}
+	if !strings.Contains(args, "-vaapi_device /dev/dri/renderD128 -ss") {
+		t.Fatalf("expected the encoder device to stay open: %s", args)
+	}
+	if !strings.Contains(args, "-c:v h264_vaapi -vf scale=1280:720,format=nv12,hwupload ") {
+		t.Fatalf("expected software scaling then upload to the hardware encoder: %s", args)
+	}
+
+	params.SourceCodec = "hevc"
+	args = strings.Join(builder.Video(params), " ")
+	if !strings.Contains(args, "-hwaccel vaapi") || !strings.Contains(args, "-vf scale_vaapi=1280:720:format=nv12 ") {
+		t.Fatalf("supported codec should keep hardware decode: %s", args)
+	}
+
+	params.SourceCodec = "h264"
+	params.SourcePixelFormat = "yuv420p10le"
+	args = strings.Join(builder.Video(params), " ")
+	if strings.Contains(args, "-hwaccel") || !strings.Contains(args, "-vf scale=1280:720,format=nv12,hwupload ") {
+		t.Fatalf("a bit depth the decoder lacks must be decoded in software: %s", args)
+	}
+}
+
+func TestCommandsMapStreamsWithinProgram(t *testing.T) {
+	builder := NewCommandBuilder(testHW)
+	segments := []domain.Segment{{Index: 0, Start: 0, End: 6}}
+
+	video := strings.Join(builder.Video(VideoParams{
+		InputURL:  "capture.ts",
+		Rendition: domain.VideoRendition{Method: domain.Transcode, Width: 1280, Height: 720, Bitrate: 2_000_000},
+		Segments:  segments,
+		OutputDir: "/tmp/out",
+		Program:   2,
+	}), " ")
+	if !strings.Contains(video, "-map 0:p:2:V:0") {
+		t.Fatalf("expected video mapped from program 2: %s", video)
+	}
+
+	audio := strings.Join(builder.Audio(AudioParams{
+		InputURL:  "capture.ts",
+		Rendition: domain.AudioRendition{Method: domain.Transcode, Channels: 2, Bitrate: 128000},
+		Segments:  segments,
+		OutputDir: "/tmp/out",
+	}), " ")
+	if !strings.Contains(audio, "-map 0:a:0") {
+		t.Fatalf("expected plain audio map without a program: %s", audio)
+	}
+}
+
+func TestVideoCommand_MuxesAudio(t *testing.T) {
+	builder := NewCommandBuilder(testHW)
+	audio := domain.AudioRendition{Method: domain.Transcode, Channels: 2, Bitrate: 128000}
+
+	args := strings.Join(builder.Video(VideoParams{
+		InputURL:  "in.mkv",
+		Rendition: domain.VideoRendition{Method: domain.DirectStream, Width: 1920, Height: 1080},
+		Segments:  []domain.Segment{{Index: 0, Start: 0, End: 6}},
+		OutputDir: "/tmp/out",
+		Audio:     &audio,
+	}), " ")
+	if !strings.Contains(args, "-map 0:V:0 -c:v copy -map 0:a:0 -c:a aac -ac 2 -b:a 128000") {
+		t.Fatalf("expected audio mapped and encoded next to the video: %s", args)
+	}
+
+	stream := strings.Join(builder.VideoStream(VideoStreamParams{
+		StreamParams: StreamParams{InputURL: "in.mkv", EndTime: 6},
+		Rendition:    domain.VideoRendition{Method: domain.DirectStream},
+		Audio:        &audio,
+	}), " ")
+	if !strings.Contains(stream, "-map 0:a:0 -c:a aac") {
+		t.Fatalf("expected audio muxed into the progressive stream: %s", stream)
+	}
+}
+
+func TestVideoCommand_ForcesIDRKeyframesPerAccelerator(t *testing.T) {
+	cases := []struct {
+		accel domain.Accelerator
+		idr   string
+	}{
+		{domain.AccelNone, ""},
+		{domain.AccelCUDA, "-forced-idr 1"},
+		{domain.AccelQSV, "-forced_idr 1"},
+		{domain.AccelVAAPI, ""},
+		{domain.AccelVideoToolbox, ""},
+	}
+	segments := []domain.Segment{{Index: 0, Start: 0, End: 6}, {Index: 1, Start: 6, End: 12}}
+
+	for _, tc := range cases {
+		builder := NewCommandBuilder(hwaccel.NewConfig(tc.accel))
+		params := VideoParams{
+			InputURL:  "in.mkv",
+			Rendition: domain.VideoRendition{Method: domain.Transcode, Width: 1280, Height: 720, Bitrate: 2_000_000},
+			Segments:  segments,
+			OutputDir: "/tmp/out",
+		}
+		for _, args := range [][]string{
+			builder.Video(params),
+			builder.VideoStream(VideoStreamParams{
+				StreamParams:  StreamParams{InputURL: "in.mkv", EndTime: 12},
+				Rendition:     params.Rendition,
+				KeyframeTimes: []float64{0, 6},
+			}),
+		} {
+			joined := strings.Join(args, " ")
+			if !strings.Contains(joined, "-force_key_frames 0.000000,6.000000") {
+				t.Fatalf("%s: expected keyframes forced at segment starts: %s", tc.accel, joined)
+			}
+			for _, flag := range []string{"-forced-idr", "-forced_idr"} {
+				if want := strings.HasPrefix(tc.idr, flag); strings.Contains(joined, flag+" ") != want {
+					t.Fatalf("%s: expected IDR flags %q: %s", tc.accel, tc.idr, joined)
+				}
+			}
+		}
+	}
+}
+
+func TestVideoCommand_EncodesEachRenditionInItsCodec(t *testing.T) {
+	builder := NewCommandBuilder(hwaccel.NewCodecConfig(domain.AccelCUDA, domain.VideoCodecHEVC))
+	builder.Codecs = map[domain.VideoCodec]*domain.HWAccelConfig{
+		domain.VideoCodecH264: hwaccel.NewConfig(domain.AccelNone),
+	}
+	segments := []domain.Segment{{Index: 0, Start: 0, End: 6}}
+
+	hevc := strings.Join(builder.Video(VideoParams{
+		InputURL:  "in.mkv",
+		Rendition: domain.VideoRendition{Method: domain.Transcode, Width: 1920, Height: 1080, Bitrate: 4_000_000, Codec: domain.VideoCodecHEVC, Container: domain.ContainerFMP4},
+		Segments:  segments,
+		OutputDir: "/tmp/out",
+	}), " ")
+	if !strings.Contains(hevc, "-hwaccel cuda") || !strings.Contains(hevc, "-c:v hevc_nvenc") || !strings.Contains(hevc, "-tag:v hvc1") {
+		t.Fatalf("expected hvc1-tagged hevc_nvenc encode: %s", hevc)
+	}
+
+	h264 := strings.Join(builder.Video(VideoParams{
+		InputURL:  "in.mkv",
+		Rendition: domain.VideoRendition{Method: domain.Transcode, Width: 854, Height: 480, Bitrate: 1_000_000},
+		Segments:  segments,
+		OutputDir: "/tmp/out",
+	}), " ")
+	if strings.Contains(h264, "-hwaccel") || !strings.Contains(h264, "-c:v libx264") || strings.Contains(h264, "-tag:v") {
+		t.Fatalf("expected software h264 encode for the fallback rendition: %s", h264)
+	}
+	if !strings.HasSuffix(h264, "segment-%05d.ts") {
+		t.Fatalf("expected MPEG-TS segments for h264: %s", h264)
+	}
+}
+
+func TestVideoCommand_FastStartAppendsEncoderFlags(t *testing.T) {
+	builder := NewCommandBuilder(hwaccel.NewConfig(domain.AccelNone))
+	params := VideoParams{
+		InputURL:  "input.mp4",
+		Rendition: domain.VideoRendition{Method: domain.Transcode, Width: 1280, Height: 720, Bitrate: 2_000_000},
+		Segments:  []domain.Segment{{Index: 0, Start: 0, End: 6}, {Index: 1, Start: 6, End: 12}},
+		OutputDir: "/tmp/out",
+	}
+
+	if normal := strings.Join(builder.Video(params), " "); strings.Contains(normal, "zerolatency") {
+		t.Fatalf("fast-start flags without FastStart: %s", normal)
+	}
+
+	params.FastStart = true
+	if fast := strings.Join(builder.Video(params), " "); !strings.Contains(fast, "-c:v libx264 -preset ultrafast -tune zerolatency -vf") {
+		t.Fatalf("expected fast-start flags after the encoder's own, got %s", fast)
+	}
+
+	params.Rendition.Method = domain.DirectStream
+	if copied := strings.Join(builder.Video(params), " "); strings.Contains(copied, "zerolatency") {
+		t.Fatalf("stream copy must ignore FastStart: %s", copied)
+	}
+}
@@ -5,6 +5,8 @@ import (
 	"context"
 	"os/exec"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/eleven-am/goshl/internal/domain"
 )
@@ -54,67 +56,334 @@ func Select(available []domain.Accelerator) domain.Accelerator {
 	return domain.AccelNone
 }
 
+// DetectBest returns the configuration of the best available accelerator, or
+// the software one. ffmpeg is only run by the first detection in a process;
+// see ResetCache.
 func DetectBest() *domain.HWAccelConfig {
-	available, err := Detect(context.Background())
+	return DetectBestContext(context.Background())
+}
+
+// DetectBestContext is DetectBest bounded by ctx. If ctx ends before ffmpeg
+// answers, ffmpeg is killed and the software configuration is returned.
+func DetectBestContext(ctx context.Context) *domain.HWAccelConfig {
+	available, err := Detect(ctx)
 	if err != nil {
 		return NewConfig(domain.AccelNone)
 	}
 	return NewConfig(Select(available))
 }
 
+// DetectBestFor returns the best available configuration for codec. VP9 is
+// hardware encoded only through QSV and falls back to libvpx-vp9; HEVC uses
+// the selected accelerator's HEVC encoder when ffmpeg lists it and libx265
+// otherwise.
+func DetectBestFor(codec domain.VideoCodec) *domain.HWAccelConfig {
+	return DetectBestForContext(context.Background(), codec)
+}
+
+// DetectBestForContext is DetectBestFor bounded by ctx, falling back to the
+// software configuration when ctx ends first.
+func DetectBestForContext(ctx context.Context, codec domain.VideoCodec) *domain.HWAccelConfig {
+	if codec != domain.VideoCodecVP9 && codec != domain.VideoCodecHEVC {
+		return DetectBestContext(ctx)
+	}
+
+	available, err := Detect(ctx)
+	if err != nil {
+		return NewCodecConfig(domain.AccelNone, codec)
+	}
+	cfg := NewCodecConfig(Select(available), codec)
+	if cfg.Accelerator != domain.AccelNone && SupportsEncoder(ctx, cfg.Encoder) {
+		return cfg
+	}
+	return NewCodecConfig(domain.AccelNone, codec)
+}
+
+// NewCodecConfig returns the configuration for accel encoding codec. For VP9,
+// accelerators without a VP9 encoder get the software configuration.
+func NewCodecConfig(accel domain.Accelerator, codec domain.VideoCodec) *domain.HWAccelConfig {
+	switch codec {
+	case domain.VideoCodecVP9:
+		return newVP9Config(accel)
+	case domain.VideoCodecHEVC:
+		return newHEVCConfig(accel)
+	}
+	return NewConfig(accel)
+}
+
+// newVP9Config returns the vp9_qsv configuration for QSV and the libvpx-vp9
+// one for every other accelerator.
+func newVP9Config(accel domain.Accelerator) *domain.HWAccelConfig {
+	if accel == domain.AccelQSV {
+		return &domain.HWAccelConfig{
+			Accelerator:  domain.AccelQSV,
+			Codec:        domain.VideoCodecVP9,
+			DecodeFlags:  []string{"-hwaccel", "qsv", "-hwaccel_output_format", "qsv"},
+			EncodeFlags:  []string{"-c:v", "vp9_qsv", "-preset", "veryfast"},
+			Encoder:      "vp9_qsv",
+			KeyframeFlag: "-force_key_frames",
+			ScaleFilter:  "scale_qsv=%d:%d:format=nv12",
+			DecodeCodecs: qsvDecodeCodecs,
+			UploadFilter: "format=nv12",
+
+			HighBitDepthCodecs: gpuHighBitDepthCodecs,
+		}
+	}
+
+	return &domain.HWAccelConfig{
+		Accelerator:  domain.AccelNone,
+		Codec:        domain.VideoCodecVP9,
+		DecodeFlags:  []string{},
+		EncodeFlags:  []string{"-c:v", "libvpx-vp9", "-deadline", "realtime", "-cpu-used", "8", "-row-mt", "1"},
+		Encoder:      "libvpx-vp9",
+		KeyframeFlag: "-force_key_frames",
+		ScaleFilter:  "scale=%d:%d",
+	}
+}
+
+// newHEVCConfig returns the H.264 configuration of accel with its encoder
+// swapped for the HEVC one. Decoding and scaling are unchanged.
+func newHEVCConfig(accel domain.Accelerator) *domain.HWAccelConfig {
+	cfg := NewConfig(accel)
+	cfg.Codec = domain.VideoCodecHEVC
+
+	switch cfg.Accelerator {
+	case domain.AccelCUDA:
+		cfg.EncodeFlags = []string{"-c:v", "hevc_nvenc", "-preset", "p4", "-tune", "ll"}
+		cfg.Encoder = "hevc_nvenc"
+		cfg.FastStartFlags = []string{"-preset", "p1", "-tune", "ull"}
+	case domain.AccelVideoToolbox:
+		cfg.EncodeFlags = []string{"-c:v", "hevc_videotoolbox", "-realtime", "true", "-prio_speed", "true"}
+		cfg.Encoder = "hevc_videotoolbox"
+	case domain.AccelVAAPI:
+		cfg.EncodeFlags = []string{"-c:v", "hevc_vaapi"}
+		cfg.Encoder = "hevc_vaapi"
+	case domain.AccelQSV:
+		cfg.EncodeFlags = []string{"-c:v", "hevc_qsv", "-preset", "veryfast"}
+		cfg.Encoder = "hevc_qsv"
+	default:
+		cfg.EncodeFlags = []string{"-c:v", "libx265", "-preset", "ultrafast", "-x265-params", "log-level=error"}
+		cfg.Encoder = "libx265"
+		cfg.FastStartFlags = []string{"-tune", "zerolatency"}
+		// Unlike libx264, libx265 encodes forced keyframes as open-GOP
+		// I frames unless asked for IDR.
+		cfg.IDRFlags = []string{"-forced-idr", "1"}
+	}
+	return cfg
+}
+
+// Hardware decoders cover fewer codecs than software ones; VC-1, for one, is
+// missing from most. Sources in other codecs are decoded in software and
+// still encoded on the GPU.
+var (
+	cudaDecodeCodecs         = []string{"h264", "hevc", "vp8", "vp9", "av1", "mpeg1video", "mpeg2video", "mpeg4", "mjpeg"}
+	qsvDecodeCodecs          = []string{"h264", "hevc", "vp9", "av1", "mpeg2video", "mjpeg"}
+	vaapiDecodeCodecs        = []string{"h264", "hevc", "vp8", "vp9", "av1", "mpeg2video"}
+	videoToolboxDecodeCodecs = []string{"h264", "hevc", "mpeg2video", "prores"}
+)
+
+// Of those, only the codecs below are decoded in hardware deeper than 8
+// bits. None of the decoders handles H.264 High 10, so 10-bit H.264 sources
+// are decoded in software.
+var (
+	gpuHighBitDepthCodecs          = []string{"hevc", "vp9", "av1"}
+	videoToolboxHighBitDepthCodecs = []string{"hevc", "prores"}
+)
+
+const vaapiDevice = "/dev/dri/renderD128"
+
 func NewConfig(accel domain.Accelerator) *domain.HWAccelConfig {
 	switch accel {
 	case domain.AccelCUDA:
 		return &domain.HWAccelConfig{
 			Accelerator:  domain.AccelCUDA,
+			Codec:        domain.VideoCodecH264,
 			DecodeFlags:  []string{"-hwaccel", "cuda", "-hwaccel_output_format", "cuda"},
 			EncodeFlags:  []string{"-c:v", "h264_nvenc", "-preset", "p4", "-tune", "ll"},
 			Encoder:      "h264_nvenc",
-			KeyframeFlag: "-force_idr",
+			KeyframeFlag: "-force_key_frames",
 			ScaleFilter:  "scale_cuda=%d:%d:format=nv12",
+			DecodeCodecs: cudaDecodeCodecs,
+			// NVENC encodes forced keyframes as plain I frames unless told
+			// otherwise.
+			IDRFlags:       []string{"-forced-idr", "1"},
+			FastStartFlags: []string{"-preset", "p1", "-tune", "ull"},
+
+			HighBitDepthCodecs: gpuHighBitDepthCodecs,
 		}
 	case domain.AccelVideoToolbox:
 		return &domain.HWAccelConfig{
 			Accelerator:  domain.AccelVideoToolbox,
+			Codec:        domain.VideoCodecH264,
 			DecodeFlags:  []string{"-hwaccel", "videotoolbox"},
 			EncodeFlags:  []string{"-c:v", "h264_videotoolbox", "-realtime", "true", "-prio_speed", "true"},
 			Encoder:      "h264_videotoolbox",
 			KeyframeFlag: "-force_key_frames",
 			ScaleFilter:  "scale=%d:%d",
+			DecodeCodecs: videoToolboxDecodeCodecs,
+
+			HighBitDepthCodecs: videoToolboxHighBitDepthCodecs,
 		}
 	case domain.AccelVAAPI:
 		return &domain.HWAccelConfig{
 			Accelerator:  domain.AccelVAAPI,
-			DecodeFlags:  []string{"-hwaccel", "vaapi", "-vaapi_device", "/dev/dri/renderD128"},
+			Codec:        domain.VideoCodecH264,
+			DecodeFlags:  []string{"-hwaccel", "vaapi", "-vaapi_device", vaapiDevice},
 			EncodeFlags:  []string{"-c:v", "h264_vaapi"},
 			Encoder:      "h264_vaapi",
 			KeyframeFlag: "-force_key_frames",
 			ScaleFilter:  "scale_vaapi=%d:%d:format=nv12",
+			DecodeCodecs: vaapiDecodeCodecs,
+			DeviceFlags:  []string{"-vaapi_device", vaapiDevice},
+			UploadFilter: "format=nv12,hwupload",
+			// h264_vaapi, like libx264 and VideoToolbox, starts a new IDR
+			// at every forced keyframe without extra options.
+
+			HighBitDepthCodecs: gpuHighBitDepthCodecs,
 		}
 	case domain.AccelQSV:
 		return &domain.HWAccelConfig{
 			Accelerator:  domain.AccelQSV,
+			Codec:        domain.VideoCodecH264,
 			DecodeFlags:  []string{"-hwaccel", "qsv", "-hwaccel_output_format", "qsv"},
 			EncodeFlags:  []string{"-c:v", "h264_qsv", "-preset", "veryfast"},
 			Encoder:      "h264_qsv",
 			KeyframeFlag: "-force_key_frames",
 			ScaleFilter:  "scale_qsv=%d:%d:format=nv12",
+			DecodeCodecs: qsvDecodeCodecs,
+			UploadFilter: "format=nv12",
+			// Like NVENC, QSV only makes forced keyframes IDR on request.
+			IDRFlags: []string{"-forced_idr", "1"},
+
+			HighBitDepthCodecs: gpuHighBitDepthCodecs,
 		}
 	default:
 		return &domain.HWAccelConfig{
 			Accelerator:  domain.AccelNone,
+			Codec:        domain.VideoCodecH264,
 			DecodeFlags:  []string{},
 			EncodeFlags:  []string{"-c:v", "libx264", "-preset", "ultrafast"},
 			Encoder:      "libx264",
 			KeyframeFlag: "-force_key_frames",
 			ScaleFilter:  "scale=%d:%d",
+			// Already at ultrafast; zerolatency also drops the lookahead
+			// and B-frames that delay the first output.
+			FastStartFlags: []string{"-tune", "zerolatency"},
 		}
 	}
 }
 
-func detectHWAccels(ctx context.Context) (map[string]bool, error) {
-	cmd := exec.CommandContext(ctx, "ffmpeg", "-hwaccels")
+// SupportsEncoder reports whether the local ffmpeg build lists the named
+// encoder (e.g. "libfdk_aac"). Any error running ffmpeg is treated as absent.
+// The encoder listing is cached like the one DetectBest reads.
+func SupportsEncoder(ctx context.Context, name string) bool {
+	output, err := ffmpegListing(ctx, "-encoders")
+	if err != nil {
+		return false
+	}
+
+	scanner := bufio.NewScanner(strings.NewReader(string(output)))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[1] == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ffmpeg's -hwaccels and -encoders listings, by flag. They only change when
+// ffmpeg is replaced, so each is read once per process. listingCalls holds
+// the runs still in progress.
+var (
+	listingsMu   sync.Mutex
+	listings     = make(map[string][]byte)
+	listingCalls = make(map[string]*listingCall)
+)
+
+// listingCall is a single in-flight ffmpeg listing run shared by concurrent
+// callers for the same flag. waiters counts the callers still waiting on it.
+type listingCall struct {
+	done    chan struct{}
+	cancel  context.CancelFunc
+	waiters int
+	output  []byte
+	err     error
+}
+
+// ffmpegListing returns the output of "ffmpeg flag", running ffmpeg only the
+// first time. Concurrent callers share that run, each waiting only as long
+// as its own ctx allows; the run is cancelled once all of them have given
+// up. Failures are not cached, so a missing ffmpeg is looked for again on
+// the next call.
+func ffmpegListing(ctx context.Context, flag string) ([]byte, error) {
+	listingsMu.Lock()
+	if output, ok := listings[flag]; ok {
+		listingsMu.Unlock()
+		return output, nil
+	}
+	call, ok := listingCalls[flag]
+	if !ok {
+		runCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+		call = &listingCall{done: make(chan struct{}), cancel: cancel}
+		listingCalls[flag] = call
+		go runListing(runCtx, flag, call)
+	}
+	call.waiters++
+	listingsMu.Unlock()
+
+	select {
+	case <-call.done:
+		return call.output, call.err
+	case <-ctx.Done():
+		listingsMu.Lock()
+		call.waiters--
+		if call.waiters == 0 {
+			call.cancel()
+			if listingCalls[flag] == call {
+				delete(listingCalls, flag)
+			}
+		}
+		listingsMu.Unlock()
+		return nil, ctx.Err()
+	}
+}
+
+// runListing runs the ffmpeg listing every caller of call waits on, caching
+// its output unless the run was abandoned or the cache reset meanwhile.
+func runListing(ctx context.Context, flag string, call *listingCall) {
+	cmd := exec.CommandContext(ctx, "ffmpeg", flag)
+	// Stop waiting for output held open by ffmpeg's children once it has
+	// been killed.
+	cmd.WaitDelay = time.Second
 	output, err := cmd.Output()
+	call.cancel()
+
+	listingsMu.Lock()
+	if listingCalls[flag] == call {
+		delete(listingCalls, flag)
+		if err == nil {
+			listings[flag] = output
+		}
+	}
+	call.output, call.err = output, err
+	listingsMu.Unlock()
+	close(call.done)
+}
+
+// ResetCache forgets the cached ffmpeg listings, so the next detection runs
+// ffmpeg again, for example after ffmpeg has been upgraded or in tests that
+// swap the ffmpeg binary.
+func ResetCache() {
+	listingsMu.Lock()
+	defer listingsMu.Unlock()
+	clear(listings)
+	clear(listingCalls)
+}
+
+func detectHWAccels(ctx context.Context) (map[string]bool, error) {
+	output, err := ffmpegListing(ctx, "-hwaccels")
 	if err != nil {
 		return nil, err
 	}
@@ -132,8 +401,7 @@ func detectHWAccels(ctx context.Context) (map[string]bool, error) {
 }
 
 func detectEncoders(ctx context.Context) (map[string]bool, error) {
-	cmd := exec.CommandContext(ctx, "ffmpeg", "-encoders")
-	output, err := cmd.Output()
+	output, err := ffmpegListing(ctx, "-encoders")
 	if err != nil {
 		return nil, err
 	}
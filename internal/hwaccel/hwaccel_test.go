@@ -5,7 +5,9 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/eleven-am/goshl/internal/domain"
 )
@@ -20,6 +22,8 @@ func TestDetectParsesFakeFFmpegOutput(t *testing.T) {
 	origPath := os.Getenv("PATH")
 	t.Cleanup(func() { _ = os.Setenv("PATH", origPath) })
 	_ = os.Setenv("PATH", tmp+string(os.PathListSeparator)+origPath)
+	ResetCache()
+	t.Cleanup(ResetCache)
 
 	accels, err := Detect(context.Background())
 	if err != nil {
@@ -64,6 +68,27 @@ func TestNewConfigReturnsExpectedFlags(t *testing.T) {
 	}
 }
 
+func TestSupportsEncoderMatchesEncoderName(t *testing.T) {
+	tmp := t.TempDir()
+	script := filepath.Join(tmp, "ffmpeg")
+	if err := os.WriteFile(script, []byte(fakeFFmpegDetectScript), 0755); err != nil {
+		t.Fatalf("write script: %v", err)
+	}
+
+	origPath := os.Getenv("PATH")
+	t.Cleanup(func() { _ = os.Setenv("PATH", origPath) })
+	_ = os.Setenv("PATH", tmp+string(os.PathListSeparator)+origPath)
+	ResetCache()
+	t.Cleanup(ResetCache)
+
+	if !SupportsEncoder(context.Background(), "h264_nvenc") {
+		t.Fatalf("expected h264_nvenc to be reported")
+	}
+	if SupportsEncoder(context.Background(), "libfdk_aac") {
+		t.Fatalf("libfdk_aac is not listed and should not be reported")
+	}
+}
+
 const fakeFFmpegDetectScript = `#!/bin/sh
 if [ "$1" = "-hwaccels" ]; then
 cat <<'EOF'
@@ -85,3 +110,169 @@ fi
 
 exit 1
 `
+
+func TestNewCodecConfigVP9FallsBackToSoftware(t *testing.T) {
+	qsv := NewCodecConfig(domain.AccelQSV, domain.VideoCodecVP9)
+	if qsv.Encoder != "vp9_qsv" || qsv.Codec != domain.VideoCodecVP9 {
+		t.Fatalf("expected vp9_qsv for qsv, got %#v", qsv)
+	}
+
+	for _, accel := range []domain.Accelerator{domain.AccelCUDA, domain.AccelVideoToolbox, domain.AccelNone} {
+		cfg := NewCodecConfig(accel, domain.VideoCodecVP9)
+		if cfg.Encoder != "libvpx-vp9" || cfg.Accelerator != domain.AccelNone || len(cfg.DecodeFlags) != 0 {
+			t.Fatalf("expected software vp9 for %s, got %#v", accel, cfg)
+		}
+	}
+
+	if cfg := NewCodecConfig(domain.AccelCUDA, domain.VideoCodecH264); cfg.Encoder != "h264_nvenc" {
+		t.Fatalf("expected h264 config unchanged, got %s", cfg.Encoder)
+	}
+}
+
+func TestNewCodecConfigHEVCSwapsEncoder(t *testing.T) {
+	want := map[domain.Accelerator]string{
+		domain.AccelCUDA:         "hevc_nvenc",
+		domain.AccelVideoToolbox: "hevc_videotoolbox",
+		domain.AccelVAAPI:        "hevc_vaapi",
+		domain.AccelQSV:          "hevc_qsv",
+		domain.AccelNone:         "libx265",
+	}
+	for accel, encoder := range want {
+		cfg := NewCodecConfig(accel, domain.VideoCodecHEVC)
+		if cfg.Encoder != encoder || cfg.EncodeFlags[1] != encoder || cfg.Codec != domain.VideoCodecHEVC || cfg.Accelerator != accel {
+			t.Fatalf("expected %s for %s, got %#v", encoder, accel, cfg)
+		}
+		if h264 := NewConfig(accel); cfg.ScaleFilter != h264.ScaleFilter || len(cfg.DecodeFlags) != len(h264.DecodeFlags) {
+			t.Fatalf("expected %s hevc to decode and scale like h264, got %#v", accel, cfg)
+		}
+	}
+	if cfg := NewCodecConfig(domain.AccelNone, domain.VideoCodecHEVC); strings.Join(cfg.IDRFlags, " ") != "-forced-idr 1" {
+		t.Fatalf("expected libx265 to force IDR keyframes, got %v", cfg.IDRFlags)
+	}
+}
+
+func TestDetectBestForHEVCNeedsListedEncoder(t *testing.T) {
+	tmp := t.TempDir()
+	if err := os.WriteFile(filepath.Join(tmp, "ffmpeg"), []byte(fakeFFmpegDetectScript), 0755); err != nil {
+		t.Fatalf("write script: %v", err)
+	}
+	t.Setenv("PATH", tmp+string(os.PathListSeparator)+os.Getenv("PATH"))
+	ResetCache()
+	t.Cleanup(ResetCache)
+
+	// The fake build has CUDA but only lists h264_nvenc.
+	if cfg := DetectBestFor(domain.VideoCodecHEVC); cfg.Encoder != "libx265" || cfg.Accelerator != domain.AccelNone {
+		t.Fatalf("expected libx265 without hevc_nvenc, got %#v", cfg)
+	}
+	if cfg := DetectBestFor(domain.VideoCodecH264); cfg.Encoder != "h264_nvenc" {
+		t.Fatalf("expected h264_nvenc, got %s", cfg.Encoder)
+	}
+}
+
+func TestNewConfigDecodesCommonCodecsOnly(t *testing.T) {
+	cuda := NewConfig(domain.AccelCUDA)
+	if !cuda.Decodes("hevc", "") || cuda.Decodes("vc1", "") {
+		t.Fatalf("cuda should decode hevc but not vc1: %v", cuda.DecodeCodecs)
+	}
+	if !cuda.Decodes("hevc", "yuv420p10le") || cuda.Decodes("h264", "yuv420p10le") || !cuda.Decodes("h264", "yuv420p") {
+		t.Fatalf("cuda should decode 10-bit hevc but not h264 high 10: %v", cuda.HighBitDepthCodecs)
+	}
+	if qsv := NewCodecConfig(domain.AccelQSV, domain.VideoCodecHEVC); qsv.Decodes("h264", "yuv420p10le") {
+		t.Fatal("qsv should decode h264 high 10 in software")
+	}
+	if sw := NewConfig(domain.AccelNone); !sw.Decodes("vc1", "yuv420p10le") {
+		t.Fatal("software decoding supports every codec")
+	}
+	if vaapi := NewConfig(domain.AccelVAAPI); len(vaapi.DeviceFlags) == 0 || vaapi.UploadFilter == "" {
+		t.Fatalf("vaapi needs its device and an upload when decoding in software: %#v", vaapi)
+	}
+}
+
+func TestDetectionRunsFFmpegOnce(t *testing.T) {
+	tmp := t.TempDir()
+	calls := filepath.Join(tmp, "calls")
+	script := "#!/bin/sh\necho \"$1\" >> " + calls + "\n" + strings.TrimPrefix(fakeFFmpegDetectScript, "#!/bin/sh\n")
+	if err := os.WriteFile(filepath.Join(tmp, "ffmpeg"), []byte(script), 0755); err != nil {
+		t.Fatalf("write script: %v", err)
+	}
+	t.Setenv("PATH", tmp+string(os.PathListSeparator)+os.Getenv("PATH"))
+	ResetCache()
+	t.Cleanup(ResetCache)
+
+	countCalls := func() int {
+		data, _ := os.ReadFile(calls)
+		return strings.Count(string(data), "\n")
+	}
+
+	if cfg := DetectBest(); cfg.Accelerator != domain.AccelCUDA {
+		t.Fatalf("expected cuda, got %s", cfg.Accelerator)
+	}
+	DetectBest()
+	SupportsEncoder(context.Background(), "libfdk_aac")
+	if got := countCalls(); got != 2 {
+		t.Fatalf("expected -hwaccels and -encoders to run once each, got %d runs", got)
+	}
+
+	ResetCache()
+	DetectBest()
+	if got := countCalls(); got != 4 {
+		t.Fatalf("expected detection to run again after ResetCache, got %d runs", got)
+	}
+}
+
+func TestDetectBestContextGivesUpOnHungFFmpeg(t *testing.T) {
+	tmp := t.TempDir()
+	if err := os.WriteFile(filepath.Join(tmp, "ffmpeg"), []byte("#!/bin/sh\nexec sleep 30\n"), 0755); err != nil {
+		t.Fatalf("write script: %v", err)
+	}
+	t.Setenv("PATH", tmp+string(os.PathListSeparator)+os.Getenv("PATH"))
+	ResetCache()
+	t.Cleanup(ResetCache)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	cfg := DetectBestContext(ctx)
+	if cfg.Accelerator != domain.AccelNone {
+		t.Fatalf("expected software fallback, got %s", cfg.Accelerator)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("detection did not honour the context: took %s", elapsed)
+	}
+}
+
+func TestListingWaiterGivesUpWithoutBlockingOthers(t *testing.T) {
+	tmp := t.TempDir()
+	release := filepath.Join(tmp, "release")
+	if err := syscall.Mkfifo(release, 0600); err != nil {
+		t.Fatalf("mkfifo: %v", err)
+	}
+	script := "#!/bin/sh\nread x < " + release + "\necho ' V..... libx264              H.264'\n"
+	if err := os.WriteFile(filepath.Join(tmp, "ffmpeg"), []byte(script), 0755); err != nil {
+		t.Fatalf("write script: %v", err)
+	}
+	t.Setenv("PATH", tmp+string(os.PathListSeparator)+os.Getenv("PATH"))
+	ResetCache()
+	t.Cleanup(ResetCache)
+
+	patient := make(chan bool, 1)
+	go func() { patient <- SupportsEncoder(context.Background(), "libx264") }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if SupportsEncoder(ctx, "libx264") {
+		t.Fatal("expected the impatient caller to give up before the listing")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("the impatient caller waited on the other's run: took %s", elapsed)
+	}
+
+	if err := os.WriteFile(release, []byte("go\n"), 0600); err != nil {
+		t.Fatalf("release ffmpeg: %v", err)
+	}
+	if !<-patient {
+		t.Fatal("expected the waiting caller to get the listing")
+	}
+}
@@ -3,16 +3,33 @@ package misc
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"math"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 
 	"github.com/eleven-am/goshl/internal/domain"
+	"github.com/eleven-am/goshl/internal/source"
 )
 
 const (
+	// posterPosition is the fraction of the duration the poster is taken from.
+	posterPosition = 0.1
+
+	// blackFrameFilter drops frames that are at least 90% black. blackframe
+	// with amount=0 tags every frame with its black percentage, and metadata
+	// keeps only those below the limit.
+	blackFrameFilter = "blackframe=amount=0:threshold=32,metadata=select:key=lavfi.blackframe.pblack:value=90:function=less"
+
+	// posterCandidates is the number of frames the thumbnail filter compares
+	// when choosing a poster; it favors typical frames over black or faded ones.
+	posterCandidates = 100
+
 	defaultThumbWidth  = 160
 	defaultThumbHeight = 90
 	defaultInterval    = 5.0
@@ -20,7 +37,24 @@ const (
 	defaultRows        = 10
 )
 
+// ErrSpriteCancelled is returned to every caller waiting on a sprite
+// generation that was stopped with CancelSprites.
+var ErrSpriteCancelled = errors.New("sprite generation cancelled")
+
 type Generator struct {
+	// SkipBlackFrames makes thumbnails and posters use the first non-black
+	// frame at or after the requested time.
+	SkipBlackFrames bool
+
+	// SpriteImage, ThumbnailImage and PosterImage choose the encoder and
+	// quality for each kind of image. The zero value is JPEG at qscale 5.
+	SpriteImage    domain.ImageOptions
+	ThumbnailImage domain.ImageOptions
+	PosterImage    domain.ImageOptions
+
+	// OpenSource supplies the bytes of "pipe:" sources. Nil rejects them.
+	OpenSource domain.SourceOpener
+
 	storage domain.Storage
 
 	thumbWidth  int
@@ -28,11 +62,28 @@ type Generator struct {
 	interval    float64
 	cols        int
 	rows        int
+
+	mu      sync.Mutex
+	sprites map[string]*spriteCall
+
+	// waiting, when set, is called each time a caller starts waiting on a
+	// sprite generation. Tests use it to know every caller has joined.
+	waiting func(sourceURL string)
+}
+
+// spriteCall is a single in-flight sprite generation shared by concurrent
+// callers for the same source.
+type spriteCall struct {
+	done      chan struct{}
+	cancel    context.CancelFunc
+	cancelled bool
+	err       error
 }
 
 func NewGenerator(storage domain.Storage) *Generator {
 	return &Generator{
 		storage:     storage,
+		sprites:     make(map[string]*spriteCall),
 		thumbWidth:  defaultThumbWidth,
 		thumbHeight: defaultThumbHeight,
 		interval:    defaultInterval,
@@ -71,34 +122,145 @@ func (g *Generator) GetSprite(ctx context.Context, sourceURL string, duration fl
 	return g.storage.ReadSprite(ctx, sourceURL, index)
 }
 
+// CancelSprites stops an in-progress sprite generation for sourceURL. Every
+// caller waiting on it gets ErrSpriteCancelled. It reports whether a
+// generation was running.
+func (g *Generator) CancelSprites(sourceURL string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	call, ok := g.sprites[sourceURL]
+	if !ok {
+		return false
+	}
+	call.cancelled = true
+	call.cancel()
+	return true
+}
+
+// generateSprites produces and stores the sprite sheets and VTT for a source.
+// Concurrent calls for the same source share one ffmpeg run. The run is
+// detached from the caller that started it: a caller whose ctx ends stops
+// waiting, but only CancelSprites stops the run.
 func (g *Generator) generateSprites(ctx context.Context, sourceURL string, duration float64, urlPattern string) error {
-	thumbsPerSprite := g.cols * g.rows
+	g.mu.Lock()
+	call, ok := g.sprites[sourceURL]
+	if !ok {
+		runCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+		call = &spriteCall{done: make(chan struct{}), cancel: cancel}
+		g.sprites[sourceURL] = call
+		go g.shareSprites(runCtx, sourceURL, duration, urlPattern, call)
+	}
+	g.mu.Unlock()
+
+	if g.waiting != nil {
+		g.waiting(sourceURL)
+	}
+	select {
+	case <-call.done:
+		return call.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// shareSprites runs the sprite generation every caller of call waits on.
+func (g *Generator) shareSprites(ctx context.Context, sourceURL string, duration float64, urlPattern string, call *spriteCall) {
+	err := g.renderSprites(ctx, sourceURL, duration, urlPattern)
+	call.cancel()
+
+	g.mu.Lock()
+	delete(g.sprites, sourceURL)
+	if call.cancelled {
+		err = ErrSpriteCancelled
+	}
+	call.err = err
+	g.mu.Unlock()
+	close(call.done)
+}
+
+// SpriteCount returns how many sprite sheets a source of duration seconds
+// is split into.
+func (g *Generator) SpriteCount(duration float64) int {
 	totalThumbs := int(math.Ceil(duration / g.interval))
-	numSprites := int(math.Ceil(float64(totalThumbs) / float64(thumbsPerSprite)))
+	return int(math.Ceil(float64(totalThumbs) / float64(g.cols*g.rows)))
+}
+
+// renderSprites stores whichever sprite sheets and VTT are missing, so a
+// generation interrupted part way resumes instead of starting over. When no
+// sheet exists yet a single ffmpeg pass renders them all; otherwise each
+// missing sheet is rendered from its own slice of the source.
+func (g *Generator) renderSprites(ctx context.Context, sourceURL string, duration float64, urlPattern string) error {
+	numSprites := g.SpriteCount(duration)
+
+	var missing []int
+	for i := 0; i < numSprites; i++ {
+		exists, err := g.storage.SpriteExists(ctx, sourceURL, i)
+		if err != nil {
+			return fmt.Errorf("check sprite %d: %w", i, err)
+		}
+		if !exists {
+			missing = append(missing, i)
+		}
+	}
+
+	if len(missing) > 0 {
+		if err := g.renderSheets(ctx, sourceURL, missing, numSprites); err != nil {
+			return err
+		}
+	}
+
+	exists, err := g.storage.SpriteVTTExists(ctx, sourceURL)
+	if err != nil {
+		return fmt.Errorf("check sprite vtt: %w", err)
+	}
+	if exists {
+		return nil
+	}
 
+	vtt := g.generateVTT(duration, numSprites, urlPattern)
+	if err := g.storage.WriteSpriteVTT(ctx, sourceURL, vtt); err != nil {
+		return fmt.Errorf("write sprite vtt: %w", err)
+	}
+
+	return nil
+}
+
+// renderSheets renders and stores the sprite sheets listed in missing.
+func (g *Generator) renderSheets(ctx context.Context, sourceURL string, missing []int, numSprites int) error {
 	tmpDir, err := os.MkdirTemp("", "sprites-*")
 	if err != nil {
 		return fmt.Errorf("create temp dir: %w", err)
 	}
 	defer os.RemoveAll(tmpDir)
 
-	outputPattern := filepath.Join(tmpDir, "sprite-%d.jpg")
-
-	args := []string{
-		"-i", sourceURL,
-		"-vf", fmt.Sprintf("fps=1/%g,scale=%d:%d,tile=%dx%d", g.interval, g.thumbWidth, g.thumbHeight, g.cols, g.rows),
-		"-q:v", "5",
-		outputPattern,
+	ext := imageExtension(g.SpriteImage)
+	sheetPath := func(i int) string {
+		return filepath.Join(tmpDir, fmt.Sprintf("sprite-%d%s", i+1, ext))
 	}
 
-	cmd := exec.CommandContext(ctx, "ffmpeg", args...)
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("ffmpeg sprite generation: %w", err)
+	if len(missing) == numSprites {
+		args := g.spriteArgs([]string{"-i", sourceURL}, filepath.Join(tmpDir, "sprite-%d"+ext))
+		if _, err := g.ffmpeg(ctx, sourceURL, args); err != nil {
+			return fmt.Errorf("ffmpeg sprite generation: %w", err)
+		}
+	} else {
+		span := float64(g.cols*g.rows) * g.interval
+		for _, i := range missing {
+			input := []string{
+				"-ss", fmt.Sprintf("%f", float64(i)*span),
+				"-t", fmt.Sprintf("%f", span),
+				"-i", sourceURL,
+			}
+			args := g.spriteArgs(input, "-frames:v", "1", sheetPath(i))
+			if _, err := g.ffmpeg(ctx, sourceURL, args); err != nil {
+				return fmt.Errorf("ffmpeg sprite %d generation: %w", i, err)
+			}
+		}
 	}
 
-	for i := 0; i < numSprites; i++ {
-		spritePath := filepath.Join(tmpDir, fmt.Sprintf("sprite-%d.jpg", i+1))
-		data, err := os.ReadFile(spritePath)
+	for _, i := range missing {
+		data, err := os.ReadFile(sheetPath(i))
 		if err != nil {
 			return fmt.Errorf("read sprite %d: %w", i, err)
 		}
@@ -108,14 +270,19 @@ func (g *Generator) generateSprites(ctx context.Context, sourceURL string, durat
 		}
 	}
 
-	vtt := g.generateVTT(duration, numSprites, urlPattern)
-	if err := g.storage.WriteSpriteVTT(ctx, sourceURL, vtt); err != nil {
-		return fmt.Errorf("write sprite vtt: %w", err)
-	}
-
 	return nil
 }
 
+// spriteArgs returns the ffmpeg arguments that tile thumbnails from input
+// into sprite sheets, followed by output (extra output options and the path).
+func (g *Generator) spriteArgs(input []string, output ...string) []string {
+	args := append(input,
+		"-vf", fmt.Sprintf("fps=1/%g,scale=%d:%d,tile=%dx%d", g.interval, g.thumbWidth, g.thumbHeight, g.cols, g.rows),
+	)
+	args = append(args, imageEncodeArgs(g.SpriteImage)...)
+	return append(args, output...)
+}
+
 func (g *Generator) generateVTT(duration float64, numSprites int, urlPattern string) []byte {
 	var buf bytes.Buffer
 	buf.WriteString("WEBVTT\n\n")
@@ -151,6 +318,152 @@ func (g *Generator) generateVTT(duration float64, numSprites int, urlPattern str
 	return buf.Bytes()
 }
 
+// GetThumbnail returns the frame described by info, cached when storage
+// implements ThumbnailStore and extracted on every call otherwise.
+func (g *Generator) GetThumbnail(ctx context.Context, info domain.ThumbnailData) ([]byte, error) {
+	cache, cached := g.storage.(domain.ThumbnailStore)
+	if cached {
+		exists, err := cache.ThumbnailExists(ctx, info)
+		if err != nil {
+			return nil, fmt.Errorf("check thumbnail: %w", err)
+		}
+		if exists {
+			return cache.ReadThumbnail(ctx, info)
+		}
+	}
+
+	data, err := g.extractFrame(ctx, info.SourceURL, float64(info.AtMillis)/1000, g.ThumbnailImage, scaleFilter(info.Width, info.Height))
+	if err != nil {
+		return nil, err
+	}
+
+	if cached {
+		if err := cache.WriteThumbnail(ctx, info, data); err != nil {
+			return nil, fmt.Errorf("write thumbnail: %w", err)
+		}
+	}
+
+	return data, nil
+}
+
+// GetPoster returns a representative frame for the source, extracted from
+// around posterPosition into the video. It is cached on first use when
+// storage implements PosterStore and extracted on every call otherwise.
+func (g *Generator) GetPoster(ctx context.Context, sourceURL string, duration float64) ([]byte, error) {
+	cache, cached := g.storage.(domain.PosterStore)
+	if cached {
+		exists, err := cache.PosterExists(ctx, sourceURL)
+		if err != nil {
+			return nil, fmt.Errorf("check poster: %w", err)
+		}
+		if exists {
+			return cache.ReadPoster(ctx, sourceURL)
+		}
+	}
+
+	data, err := g.extractFrame(ctx, sourceURL, duration*posterPosition, g.PosterImage, fmt.Sprintf("thumbnail=%d", posterCandidates))
+	if err != nil {
+		return nil, err
+	}
+
+	if cached {
+		if err := cache.WritePoster(ctx, sourceURL, data); err != nil {
+			return nil, fmt.Errorf("write poster: %w", err)
+		}
+	}
+
+	return data, nil
+}
+
+// extractFrame decodes one frame at or after the given time, passed through
+// filters, and returns it encoded per img. With SkipBlackFrames it first looks for a
+// non-black frame and falls back to the plain frame if the rest is black.
+func (g *Generator) extractFrame(ctx context.Context, sourceURL string, at float64, img domain.ImageOptions, filters ...string) ([]byte, error) {
+	if g.SkipBlackFrames {
+		data, err := g.runFrame(ctx, sourceURL, frameArgs(sourceURL, at, img, append([]string{blackFrameFilter}, filters...)))
+		if err != nil || len(data) > 0 {
+			return data, err
+		}
+	}
+
+	data, err := g.runFrame(ctx, sourceURL, frameArgs(sourceURL, at, img, filters))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, fmt.Errorf("ffmpeg frame extraction: no frame at %.3fs", at)
+	}
+	return data, nil
+}
+
+func (g *Generator) runFrame(ctx context.Context, sourceURL string, args []string) ([]byte, error) {
+	output, err := g.ffmpeg(ctx, sourceURL, args)
+	if err != nil {
+		return nil, fmt.Errorf("ffmpeg frame extraction: %w", err)
+	}
+	return output, nil
+}
+
+func frameArgs(sourceURL string, at float64, img domain.ImageOptions, filters []string) []string {
+	args := []string{
+		"-ss", fmt.Sprintf("%.3f", at),
+		"-i", sourceURL,
+	}
+
+	var chain []string
+	for _, f := range filters {
+		if f != "" {
+			chain = append(chain, f)
+		}
+	}
+	if len(chain) > 0 {
+		args = append(args, "-vf", strings.Join(chain, ","))
+	}
+
+	args = append(args, "-frames:v", "1")
+	args = append(args, imageEncodeArgs(img)...)
+	args = append(args, "-f", "image2pipe", "pipe:1")
+	return args
+}
+
+func imageEncodeArgs(img domain.ImageOptions) []string {
+	if img.Format == domain.ImageWebP {
+		quality := img.Quality
+		if quality == 0 {
+			quality = 75
+		}
+		return []string{"-c:v", "libwebp", "-quality", strconv.Itoa(quality)}
+	}
+
+	quality := img.Quality
+	if quality == 0 {
+		quality = 5
+	}
+	return []string{"-c:v", "mjpeg", "-q:v", strconv.Itoa(quality)}
+}
+
+func imageExtension(img domain.ImageOptions) string {
+	if img.Format == domain.ImageWebP {
+		return ".webp"
+	}
+	return ".jpg"
+}
+
+// scaleFilter returns a scale filter for the given size, keeping the aspect
+// ratio for a zero dimension, or "" when both are zero.
+func scaleFilter(width, height int) string {
+	if width <= 0 && height <= 0 {
+		return ""
+	}
+	if width <= 0 {
+		width = -2
+	}
+	if height <= 0 {
+		height = -2
+	}
+	return fmt.Sprintf("scale=%d:%d", width, height)
+}
+
 func (g *Generator) GetSubtitles(ctx context.Context, sourceURL string, streamIndex int, lang string) ([]byte, error) {
 	exists, err := g.storage.SubtitleVTTExists(ctx, sourceURL, lang)
 	if err != nil {
@@ -167,25 +480,72 @@ func (g *Generator) GetSubtitles(ctx context.Context, sourceURL string, streamIn
 }
 
 func (g *Generator) extractSubtitles(ctx context.Context, sourceURL string, streamIndex int, lang string) error {
+	output, err := g.extractSubtitleStream(ctx, sourceURL, streamIndex, "webvtt", "webvtt")
+	if err != nil {
+		return err
+	}
+
+	if err := g.storage.WriteSubtitleVTT(ctx, sourceURL, lang, output); err != nil {
+		return fmt.Errorf("write subtitle vtt: %w", err)
+	}
+
+	return nil
+}
+
+// GetSubtitlesASS returns an ASS/SSA subtitle track copied from the source
+// without conversion, so players with libass keep its full styling. It is
+// cached only when storage implements SubtitleASSStore.
+func (g *Generator) GetSubtitlesASS(ctx context.Context, sourceURL string, streamIndex int, lang string) ([]byte, error) {
+	cache, ok := g.storage.(domain.SubtitleASSStore)
+	if !ok {
+		return g.extractSubtitleStream(ctx, sourceURL, streamIndex, "copy", "ass")
+	}
+
+	exists, err := cache.SubtitleASSExists(ctx, sourceURL, lang)
+	if err != nil {
+		return nil, fmt.Errorf("check subtitle ass: %w", err)
+	}
+
+	if !exists {
+		output, err := g.extractSubtitleStream(ctx, sourceURL, streamIndex, "copy", "ass")
+		if err != nil {
+			return nil, err
+		}
+		if err := cache.WriteSubtitleASS(ctx, sourceURL, lang, output); err != nil {
+			return nil, fmt.Errorf("write subtitle ass: %w", err)
+		}
+		return output, nil
+	}
+
+	return cache.ReadSubtitleASS(ctx, sourceURL, lang)
+}
+
+func (g *Generator) extractSubtitleStream(ctx context.Context, sourceURL string, streamIndex int, codec string, format string) ([]byte, error) {
 	args := []string{
 		"-i", sourceURL,
 		"-map", fmt.Sprintf("0:s:%d", streamIndex),
-		"-c:s", "webvtt",
-		"-f", "webvtt",
+		"-c:s", codec,
+		"-f", format,
 		"pipe:1",
 	}
 
-	cmd := exec.CommandContext(ctx, "ffmpeg", args...)
-	output, err := cmd.Output()
+	output, err := g.ffmpeg(ctx, sourceURL, args)
 	if err != nil {
-		return fmt.Errorf("ffmpeg subtitle extraction: %w", err)
+		return nil, fmt.Errorf("ffmpeg subtitle extraction: %w", err)
 	}
+	return output, nil
+}
 
-	if err := g.storage.WriteSubtitleVTT(ctx, sourceURL, lang, output); err != nil {
-		return fmt.Errorf("write subtitle vtt: %w", err)
+// ffmpeg runs ffmpeg with args, which read from sourceURL, and returns its
+// standard output.
+func (g *Generator) ffmpeg(ctx context.Context, sourceURL string, args []string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, "ffmpeg", args...)
+	input, err := source.Attach(ctx, cmd, g.OpenSource, sourceURL)
+	if err != nil {
+		return nil, err
 	}
-
-	return nil
+	defer input.Close()
+	return cmd.Output()
 }
 
 func formatVTTTime(seconds float64) string {
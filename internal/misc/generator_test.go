@@ -3,8 +3,12 @@ package misc
 import (
 	"context"
 	"errors"
+	"os"
+	"path/filepath"
 	"strings"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/eleven-am/goshl/internal/domain"
 )
@@ -12,15 +16,21 @@ import (
 type stubStorage struct {
 	spriteVTTExists bool
 	spriteExists    bool
+	sprites         map[int]bool
 	subtitleExists  bool
 
 	existsErr error
 
 	wroteSprites   int
+	wroteSheets    []int
 	wroteSpriteVTT int
 	wroteSubtitle  int
 
 	spriteVTTData []byte
+
+	thumbnails map[domain.ThumbnailData][]byte
+	poster     []byte
+	ass        map[string][]byte
 }
 
 func (s *stubStorage) MetadataExists(ctx context.Context, sourceURL string) (bool, error) {
@@ -32,6 +42,15 @@ func (s *stubStorage) GetMetadata(ctx context.Context, sourceURL string) ([]byte
 func (s *stubStorage) SetMetadata(ctx context.Context, sourceURL string, data []byte) error {
 	return nil
 }
+func (s *stubStorage) WriteRawProbe(ctx context.Context, sourceURL string, data []byte) error {
+	return nil
+}
+func (s *stubStorage) ReadRawProbe(ctx context.Context, sourceURL string) ([]byte, error) {
+	return nil, nil
+}
+func (s *stubStorage) RawProbeExists(ctx context.Context, sourceURL string) (bool, error) {
+	return false, nil
+}
 func (s *stubStorage) WriteSegment(ctx context.Context, info domain.SegmentData, data []byte) error {
 	return nil
 }
@@ -41,9 +60,25 @@ func (s *stubStorage) ReadSegment(ctx context.Context, info domain.SegmentData)
 func (s *stubStorage) SegmentExists(ctx context.Context, info domain.SegmentData) (bool, error) {
 	return false, nil
 }
+func (s *stubStorage) SegmentSize(ctx context.Context, info domain.SegmentData) (int64, error) {
+	return 0, nil
+}
+func (s *stubStorage) WriteSegmentFailure(ctx context.Context, info domain.SegmentData, data []byte) error {
+	return nil
+}
+func (s *stubStorage) ReadSegmentFailure(ctx context.Context, info domain.SegmentData) ([]byte, error) {
+	return nil, nil
+}
+func (s *stubStorage) SegmentFailureExists(ctx context.Context, info domain.SegmentData) (bool, error) {
+	return false, nil
+}
+func (s *stubStorage) DeleteSegmentFailure(ctx context.Context, info domain.SegmentData) error {
+	return nil
+}
 
 func (s *stubStorage) WriteSprite(ctx context.Context, mediaID string, index int, data []byte) error {
 	s.wroteSprites++
+	s.wroteSheets = append(s.wroteSheets, index)
 	return nil
 }
 func (s *stubStorage) ReadSprite(ctx context.Context, mediaID string, index int) ([]byte, error) {
@@ -53,7 +88,7 @@ func (s *stubStorage) SpriteExists(ctx context.Context, mediaID string, index in
 	if s.existsErr != nil {
 		return false, s.existsErr
 	}
-	return s.spriteExists, nil
+	return s.spriteExists || s.sprites[index], nil
 }
 
 func (s *stubStorage) WriteSpriteVTT(ctx context.Context, mediaID string, data []byte) error {
@@ -84,6 +119,68 @@ func (s *stubStorage) SubtitleVTTExists(ctx context.Context, mediaID string, lan
 	}
 	return s.subtitleExists, nil
 }
+func (s *stubStorage) WriteIndex(ctx context.Context, sourceURL string, rendition string, streamType domain.StreamType, data []byte) error {
+	return nil
+}
+func (s *stubStorage) ReadIndex(ctx context.Context, sourceURL string, rendition string, streamType domain.StreamType) ([]byte, error) {
+	return nil, nil
+}
+func (s *stubStorage) IndexExists(ctx context.Context, sourceURL string, rendition string, streamType domain.StreamType) (bool, error) {
+	return false, nil
+}
+func (s *stubStorage) ReadKeyframes(ctx context.Context, sourceURL string) ([]byte, error) {
+	return nil, nil
+}
+func (s *stubStorage) KeyframesExists(ctx context.Context, sourceURL string) (bool, error) {
+	return false, nil
+}
+func (s *stubStorage) WriteThumbnail(ctx context.Context, info domain.ThumbnailData, data []byte) error {
+	if s.thumbnails == nil {
+		s.thumbnails = make(map[domain.ThumbnailData][]byte)
+	}
+	s.thumbnails[info] = data
+	return nil
+}
+func (s *stubStorage) ReadThumbnail(ctx context.Context, info domain.ThumbnailData) ([]byte, error) {
+	return s.thumbnails[info], nil
+}
+func (s *stubStorage) ThumbnailExists(ctx context.Context, info domain.ThumbnailData) (bool, error) {
+	_, ok := s.thumbnails[info]
+	return ok, nil
+}
+func (s *stubStorage) WritePoster(ctx context.Context, sourceURL string, data []byte) error {
+	s.poster = data
+	return nil
+}
+func (s *stubStorage) ReadPoster(ctx context.Context, sourceURL string) ([]byte, error) {
+	return s.poster, nil
+}
+func (s *stubStorage) PosterExists(ctx context.Context, sourceURL string) (bool, error) {
+	return s.poster != nil, nil
+}
+func (s *stubStorage) WriteSubtitleASS(ctx context.Context, sourceURL string, lang string, data []byte) error {
+	if s.ass == nil {
+		s.ass = make(map[string][]byte)
+	}
+	s.ass[lang] = data
+	return nil
+}
+func (s *stubStorage) ReadSubtitleASS(ctx context.Context, sourceURL string, lang string) ([]byte, error) {
+	return s.ass[lang], nil
+}
+func (s *stubStorage) SubtitleASSExists(ctx context.Context, sourceURL string, lang string) (bool, error) {
+	_, ok := s.ass[lang]
+	return ok, nil
+}
+func (s *stubStorage) WriteInitSegment(ctx context.Context, sourceURL string, rendition string, streamType domain.StreamType, data []byte) error {
+	return nil
+}
+func (s *stubStorage) ReadInitSegment(ctx context.Context, sourceURL string, rendition string, streamType domain.StreamType) ([]byte, error) {
+	return nil, nil
+}
+func (s *stubStorage) InitSegmentExists(ctx context.Context, sourceURL string, rendition string, streamType domain.StreamType) (bool, error) {
+	return false, nil
+}
 
 func TestGenerateVTTProducesContinuousEntries(t *testing.T) {
 	g := &Generator{thumbWidth: 10, thumbHeight: 10, interval: 1, cols: 2, rows: 2}
@@ -117,6 +214,118 @@ func TestGetSpriteVTTUsesCacheWhenPresent(t *testing.T) {
 	}
 }
 
+func TestCancelSpritesStopsSharedGeneration(t *testing.T) {
+	tmp := t.TempDir()
+	counter := filepath.Join(tmp, "runs")
+	started := filepath.Join(tmp, "started")
+	if err := syscall.Mkfifo(started, 0600); err != nil {
+		t.Fatalf("mkfifo: %v", err)
+	}
+	script := "#!/bin/sh\necho run >> " + counter + "\necho started > " + started + "\nexec sleep 30\n"
+	if err := os.WriteFile(filepath.Join(tmp, "ffmpeg"), []byte(script), 0755); err != nil {
+		t.Fatalf("write ffmpeg stub: %v", err)
+	}
+	t.Setenv("PATH", tmp+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	g := NewGenerator(&stubStorage{})
+	if g.CancelSprites("file:///media") {
+		t.Fatalf("nothing should be cancelled before generation starts")
+	}
+
+	const callers = 3
+	joined := make(chan struct{}, callers)
+	g.waiting = func(string) { joined <- struct{}{} }
+
+	// The first caller's context ends early; that must not stop the run
+	// the others share.
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, callers)
+	for i := 0; i < callers; i++ {
+		go func() {
+			callCtx := context.Background()
+			if i == 0 {
+				callCtx = ctx
+			}
+			_, err := g.GetSpriteVTT(callCtx, "file:///media", 30, "http://sprites/%d.jpg")
+			errs <- err
+		}()
+		<-joined
+	}
+	// Opening the FIFO waits for ffmpeg to write to it.
+	if _, err := os.ReadFile(started); err != nil {
+		t.Fatalf("wait for ffmpeg: %v", err)
+	}
+	cancel()
+	if err := <-errs; !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the first caller to give up with its context, got %v", err)
+	}
+
+	if !g.CancelSprites("file:///media") {
+		t.Fatalf("expected a running generation to cancel")
+	}
+
+	for i := 1; i < callers; i++ {
+		select {
+		case err := <-errs:
+			if !errors.Is(err, ErrSpriteCancelled) {
+				t.Fatalf("caller %d: expected ErrSpriteCancelled, got %v", i, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("caller %d still waiting after cancel", i)
+		}
+	}
+
+	runs, _ := os.ReadFile(counter)
+	if got := strings.Count(string(runs), "run"); got != 1 {
+		t.Fatalf("expected callers to share one ffmpeg run, got %d", got)
+	}
+}
+
+func TestGetSpriteVTTRendersOnlyMissingSheets(t *testing.T) {
+	tmp := t.TempDir()
+	log := filepath.Join(tmp, "args")
+	script := "#!/bin/sh\necho \"$@\" >> " + log + "\nfor last; do :; done\nprintf sheet > \"$last\"\n"
+	if err := os.WriteFile(filepath.Join(tmp, "ffmpeg"), []byte(script), 0755); err != nil {
+		t.Fatalf("write ffmpeg stub: %v", err)
+	}
+	t.Setenv("PATH", tmp+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	// 1500s at one thumbnail per 5s and 100 per sheet is 3 sheets; the
+	// interrupted run stored sheets 0 and 2 but not sheet 1 or the VTT.
+	storage := &stubStorage{sprites: map[int]bool{0: true, 2: true}}
+	g := NewGenerator(storage)
+
+	if _, err := g.GetSpriteVTT(context.Background(), "file:///media", 1500, "http://sprites/%d.jpg"); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	if len(storage.wroteSheets) != 1 || storage.wroteSheets[0] != 1 {
+		t.Fatalf("expected only sheet 1 to be rendered, wrote %v", storage.wroteSheets)
+	}
+	if storage.wroteSpriteVTT != 1 {
+		t.Fatalf("expected the VTT to be written once, got %d", storage.wroteSpriteVTT)
+	}
+	runs, _ := os.ReadFile(log)
+	if strings.Count(string(runs), "\n") != 1 || !strings.Contains(string(runs), "-ss 500.000000 -t 500.000000 -i file:///media") {
+		t.Fatalf("expected one ffmpeg run seeking to sheet 1, got %q", runs)
+	}
+}
+
+func TestGetSpriteVTTWritesOnlyVTTWhenSheetsExist(t *testing.T) {
+	t.Setenv("PATH", t.TempDir())
+
+	storage := &stubStorage{spriteExists: true}
+	g := NewGenerator(storage)
+
+	data, err := g.GetSpriteVTT(context.Background(), "file:///media", 30, "http://sprites/%d.jpg")
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if storage.wroteSprites != 0 || storage.wroteSpriteVTT != 1 || !strings.HasPrefix(string(data), "WEBVTT") {
+		t.Fatalf("expected only the VTT to be written, got %d sheets, %d VTTs", storage.wroteSprites, storage.wroteSpriteVTT)
+	}
+}
+
 func TestGetSpriteVTTPropagatesExistenceError(t *testing.T) {
 	storage := &stubStorage{existsErr: errors.New("boom")}
 	g := NewGenerator(storage)
@@ -132,3 +341,206 @@ func TestFormatVTTTime(t *testing.T) {
 		t.Fatalf("unexpected time format: %s", got)
 	}
 }
+
+func TestFrameArgsScalesAndKeepsAspect(t *testing.T) {
+	args := strings.Join(frameArgs("file:///in", 12.5, domain.ImageOptions{}, []string{scaleFilter(640, 0)}), " ")
+	if !strings.HasPrefix(args, "-ss 12.500 -i file:///in") || !strings.Contains(args, "-frames:v 1") {
+		t.Fatalf("expected input seek and single frame, got %q", args)
+	}
+	if !strings.Contains(args, "-vf scale=640:-2") {
+		t.Fatalf("expected aspect-preserving scale, got %q", args)
+	}
+	if args := strings.Join(frameArgs("file:///in", 0, domain.ImageOptions{}, []string{scaleFilter(0, 0)}), " "); strings.Contains(args, "-vf") {
+		t.Fatalf("expected no filter without dimensions, got %q", args)
+	}
+}
+
+func TestExtractFrameSkipsBlackFramesWithFallback(t *testing.T) {
+	tmp := t.TempDir()
+	argsFile := filepath.Join(tmp, "args")
+	// Emulate a source that is black to the end: the black-frame filtered run
+	// produces nothing, the plain run produces a frame.
+	script := "#!/bin/sh\necho \"$@\" >> " + argsFile + "\ncase \"$*\" in *blackframe*) exit 0;; esac\nprintf frame\n"
+	if err := os.WriteFile(filepath.Join(tmp, "ffmpeg"), []byte(script), 0755); err != nil {
+		t.Fatalf("write ffmpeg stub: %v", err)
+	}
+	t.Setenv("PATH", tmp+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	g := NewGenerator(&stubStorage{})
+	g.SkipBlackFrames = true
+
+	data, err := g.extractFrame(context.Background(), "file:///in", 3, domain.ImageOptions{}, scaleFilter(320, 0))
+	if err != nil || string(data) != "frame" {
+		t.Fatalf("unexpected frame %q, %v", data, err)
+	}
+
+	recorded, _ := os.ReadFile(argsFile)
+	calls := strings.Split(strings.TrimSpace(string(recorded)), "\n")
+	if len(calls) != 2 {
+		t.Fatalf("expected a filtered attempt and a fallback, got %q", calls)
+	}
+	if !strings.Contains(calls[0], "-vf blackframe=amount=0") || !strings.Contains(calls[0], ",scale=320:-2") {
+		t.Fatalf("expected black-frame filter ahead of scale, got %q", calls[0])
+	}
+	if strings.Contains(calls[1], "blackframe") {
+		t.Fatalf("fallback should not filter black frames, got %q", calls[1])
+	}
+}
+
+func TestGetThumbnailCachesPerTimestamp(t *testing.T) {
+	tmp := t.TempDir()
+	counter := filepath.Join(tmp, "runs")
+	script := "#!/bin/sh\necho run >> " + counter + "\nprintf jpeg\n"
+	if err := os.WriteFile(filepath.Join(tmp, "ffmpeg"), []byte(script), 0755); err != nil {
+		t.Fatalf("write ffmpeg stub: %v", err)
+	}
+	t.Setenv("PATH", tmp+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	storage := &stubStorage{}
+	g := NewGenerator(storage)
+	info := domain.ThumbnailData{SourceURL: "file:///in", AtMillis: 12500, Width: 640}
+
+	for i := 0; i < 2; i++ {
+		data, err := g.GetThumbnail(context.Background(), info)
+		if err != nil || string(data) != "jpeg" {
+			t.Fatalf("unexpected thumbnail %q, %v", data, err)
+		}
+	}
+
+	runs, _ := os.ReadFile(counter)
+	if got := strings.Count(string(runs), "run"); got != 1 {
+		t.Fatalf("expected one ffmpeg run for a cached timestamp, got %d", got)
+	}
+}
+
+func TestGetThumbnailWithoutStoreExtractsEachTime(t *testing.T) {
+	tmp := t.TempDir()
+	counter := filepath.Join(tmp, "runs")
+	script := "#!/bin/sh\necho run >> " + counter + "\nprintf jpeg\n"
+	if err := os.WriteFile(filepath.Join(tmp, "ffmpeg"), []byte(script), 0755); err != nil {
+		t.Fatalf("write ffmpeg stub: %v", err)
+	}
+	t.Setenv("PATH", tmp+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	g := NewGenerator(struct{ domain.Storage }{&stubStorage{}})
+	info := domain.ThumbnailData{SourceURL: "file:///in", AtMillis: 12500, Width: 640}
+
+	for i := 0; i < 2; i++ {
+		data, err := g.GetThumbnail(context.Background(), info)
+		if err != nil || string(data) != "jpeg" {
+			t.Fatalf("unexpected thumbnail %q, %v", data, err)
+		}
+	}
+
+	runs, _ := os.ReadFile(counter)
+	if got := strings.Count(string(runs), "run"); got != 2 {
+		t.Fatalf("expected an ffmpeg run per request without a store, got %d", got)
+	}
+}
+
+func TestGetPosterSeeksIntoVideoAndCaches(t *testing.T) {
+	tmp := t.TempDir()
+	argsFile := filepath.Join(tmp, "args")
+	script := "#!/bin/sh\necho \"$@\" >> " + argsFile + "\nprintf poster\n"
+	if err := os.WriteFile(filepath.Join(tmp, "ffmpeg"), []byte(script), 0755); err != nil {
+		t.Fatalf("write ffmpeg stub: %v", err)
+	}
+	t.Setenv("PATH", tmp+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	storage := &stubStorage{}
+	g := NewGenerator(storage)
+
+	for i := 0; i < 2; i++ {
+		data, err := g.GetPoster(context.Background(), "file:///in", 600)
+		if err != nil || string(data) != "poster" {
+			t.Fatalf("unexpected poster %q, %v", data, err)
+		}
+	}
+
+	recorded, _ := os.ReadFile(argsFile)
+	calls := strings.Split(strings.TrimSpace(string(recorded)), "\n")
+	if len(calls) != 1 {
+		t.Fatalf("expected poster to be extracted once, got %d runs", len(calls))
+	}
+	if !strings.Contains(calls[0], "-ss 60.000") || !strings.Contains(calls[0], "thumbnail=") {
+		t.Fatalf("expected seek to 10%% with thumbnail filter, got %q", calls[0])
+	}
+}
+
+func TestGetPosterWithoutStoreExtractsEachTime(t *testing.T) {
+	tmp := t.TempDir()
+	counter := filepath.Join(tmp, "runs")
+	script := "#!/bin/sh\necho run >> " + counter + "\nprintf poster\n"
+	if err := os.WriteFile(filepath.Join(tmp, "ffmpeg"), []byte(script), 0755); err != nil {
+		t.Fatalf("write ffmpeg stub: %v", err)
+	}
+	t.Setenv("PATH", tmp+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	g := NewGenerator(struct{ domain.Storage }{&stubStorage{}})
+	for i := 0; i < 2; i++ {
+		data, err := g.GetPoster(context.Background(), "file:///in", 600)
+		if err != nil || string(data) != "poster" {
+			t.Fatalf("unexpected poster %q, %v", data, err)
+		}
+	}
+
+	runs, _ := os.ReadFile(counter)
+	if got := strings.Count(string(runs), "run"); got != 2 {
+		t.Fatalf("expected an ffmpeg run per request without a store, got %d", got)
+	}
+}
+
+func TestImageEncodeArgsPerFormat(t *testing.T) {
+	if got := strings.Join(imageEncodeArgs(domain.ImageOptions{}), " "); got != "-c:v mjpeg -q:v 5" {
+		t.Fatalf("unexpected default jpeg args: %q", got)
+	}
+	if got := strings.Join(imageEncodeArgs(domain.ImageOptions{Quality: 2}), " "); got != "-c:v mjpeg -q:v 2" {
+		t.Fatalf("unexpected jpeg args: %q", got)
+	}
+	if got := strings.Join(imageEncodeArgs(domain.ImageOptions{Format: domain.ImageWebP, Quality: 90}), " "); got != "-c:v libwebp -quality 90" {
+		t.Fatalf("unexpected webp args: %q", got)
+	}
+
+	for _, bad := range []domain.ImageOptions{
+		{Quality: 1},
+		{Quality: 40},
+		{Format: domain.ImageWebP, Quality: 101},
+		{Format: "gif"},
+	} {
+		if err := bad.Validate(); err == nil {
+			t.Fatalf("expected %#v to be rejected", bad)
+		}
+	}
+	if err := (domain.ImageOptions{Format: domain.ImageWebP, Quality: 60}).Validate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestGetSubtitlesASSCopiesTrackAndCaches(t *testing.T) {
+	tmp := t.TempDir()
+	argsFile := filepath.Join(tmp, "args")
+	script := "#!/bin/sh\necho \"$@\" >> " + argsFile + "\nprintf '[Script Info]'\n"
+	if err := os.WriteFile(filepath.Join(tmp, "ffmpeg"), []byte(script), 0755); err != nil {
+		t.Fatalf("write ffmpeg stub: %v", err)
+	}
+	t.Setenv("PATH", tmp+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	storage := &stubStorage{}
+	g := NewGenerator(storage)
+
+	for i := 0; i < 2; i++ {
+		data, err := g.GetSubtitlesASS(context.Background(), "file:///in", 1, "jpn")
+		if err != nil || string(data) != "[Script Info]" {
+			t.Fatalf("unexpected subtitle %q, %v", data, err)
+		}
+	}
+
+	recorded, _ := os.ReadFile(argsFile)
+	calls := strings.Split(strings.TrimSpace(string(recorded)), "\n")
+	if len(calls) != 1 {
+		t.Fatalf("expected one extraction, got %d", len(calls))
+	}
+	if !strings.Contains(calls[0], "-map 0:s:1 -c:s copy -f ass") {
+		t.Fatalf("expected stream copy to ass, got %q", calls[0])
+	}
+}
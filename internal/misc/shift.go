@@ -0,0 +1,171 @@
+package misc
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/eleven-am/goshl/internal/domain"
+)
+
+// vttTiming matches a WebVTT cue timing line. Hours are optional.
+var vttTiming = regexp.MustCompile(`^((?:\d+:)?\d{2}:\d{2}\.\d{3}) --> ((?:\d+:)?\d{2}:\d{2}\.\d{3})(.*)$`)
+
+// ShiftedSubtitles returns subtitle track lang converted to WebVTT, or copied
+// as ASS when ass is set, with every cue moved by offset seconds. The shifted
+// track is derived from the cached unshifted one and cached under its own key,
+// so different offsets do not collide; a shifted ASS track is only cached when
+// storage implements SubtitleASSStore. A zero offset returns the track as is.
+func (g *Generator) ShiftedSubtitles(ctx context.Context, sourceURL string, streamIndex int, lang string, ass bool, offset float64) ([]byte, error) {
+	if offset == 0 {
+		if ass {
+			return g.GetSubtitlesASS(ctx, sourceURL, streamIndex, lang)
+		}
+		return g.GetSubtitles(ctx, sourceURL, streamIndex, lang)
+	}
+
+	key := shiftedKey(lang, offset)
+	exists := g.storage.SubtitleVTTExists
+	read := g.storage.ReadSubtitleVTT
+	write := g.storage.WriteSubtitleVTT
+	if ass {
+		if cache, ok := g.storage.(domain.SubtitleASSStore); ok {
+			exists = cache.SubtitleASSExists
+			read = cache.ReadSubtitleASS
+			write = cache.WriteSubtitleASS
+		} else {
+			exists, write = nil, nil
+		}
+	}
+
+	if exists != nil {
+		ok, err := exists(ctx, sourceURL, key)
+		if err != nil {
+			return nil, fmt.Errorf("check shifted subtitle: %w", err)
+		}
+		if ok {
+			return read(ctx, sourceURL, key)
+		}
+	}
+
+	var shifted []byte
+	if ass {
+		base, err := g.GetSubtitlesASS(ctx, sourceURL, streamIndex, lang)
+		if err != nil {
+			return nil, err
+		}
+		shifted = shiftASS(base, offset)
+	} else {
+		base, err := g.GetSubtitles(ctx, sourceURL, streamIndex, lang)
+		if err != nil {
+			return nil, err
+		}
+		shifted = shiftVTT(base, offset)
+	}
+
+	if write == nil {
+		return shifted, nil
+	}
+	if err := write(ctx, sourceURL, key, shifted); err != nil {
+		return nil, fmt.Errorf("write shifted subtitle: %w", err)
+	}
+	return shifted, nil
+}
+
+// shiftedKey returns the cache key of track lang shifted by offset seconds,
+// e.g. "en@+1.5" or "en@-0.25".
+func shiftedKey(lang string, offset float64) string {
+	sign := "+"
+	if offset < 0 {
+		sign = ""
+	}
+	return lang + "@" + sign + strconv.FormatFloat(offset, 'f', -1, 64)
+}
+
+// shiftVTT moves every cue of a WebVTT document by offset seconds. Cues that
+// end up entirely before zero are dropped; cues straddling zero start at zero.
+func shiftVTT(data []byte, offset float64) []byte {
+	blocks := strings.Split(strings.ReplaceAll(string(data), "\r\n", "\n"), "\n\n")
+
+	kept := blocks[:0]
+	for _, block := range blocks {
+		lines := strings.Split(block, "\n")
+		drop := false
+		for i, line := range lines {
+			m := vttTiming.FindStringSubmatch(line)
+			if m == nil {
+				continue
+			}
+			start, end := parseCueTime(m[1])+offset, parseCueTime(m[2])+offset
+			if end <= 0 {
+				drop = true
+				break
+			}
+			lines[i] = formatCueTime(math.Max(start, 0), vttClock) + " --> " + formatCueTime(end, vttClock) + m[3]
+			break
+		}
+		if !drop {
+			kept = append(kept, strings.Join(lines, "\n"))
+		}
+	}
+	return []byte(strings.Join(kept, "\n\n"))
+}
+
+// shiftASS moves every Dialogue event of an ASS/SSA script by offset seconds,
+// dropping events that end before zero.
+func shiftASS(data []byte, offset float64) []byte {
+	lines := strings.Split(strings.ReplaceAll(string(data), "\r\n", "\n"), "\n")
+
+	kept := lines[:0]
+	for _, line := range lines {
+		if !strings.HasPrefix(line, "Dialogue:") {
+			kept = append(kept, line)
+			continue
+		}
+		fields := strings.SplitN(line, ",", 4)
+		if len(fields) < 4 {
+			kept = append(kept, line)
+			continue
+		}
+		start, end := parseCueTime(fields[1])+offset, parseCueTime(fields[2])+offset
+		if end <= 0 {
+			continue
+		}
+		fields[1] = formatCueTime(math.Max(start, 0), assClock)
+		fields[2] = formatCueTime(end, assClock)
+		kept = append(kept, strings.Join(fields, ","))
+	}
+	return []byte(strings.Join(kept, "\n"))
+}
+
+// parseCueTime parses a WebVTT ("hh:mm:ss.ttt" or "mm:ss.ttt") or ASS
+// ("h:mm:ss.cc") timestamp into seconds.
+func parseCueTime(ts string) float64 {
+	var seconds float64
+	for _, part := range strings.Split(strings.TrimSpace(ts), ":") {
+		v, _ := strconv.ParseFloat(part, 64)
+		seconds = seconds*60 + v
+	}
+	return seconds
+}
+
+type cueClock int
+
+const (
+	vttClock cueClock = iota
+	assClock
+)
+
+// formatCueTime renders seconds as a WebVTT "hh:mm:ss.ttt" or ASS
+// "h:mm:ss.cc" timestamp, rounding to the format's precision.
+func formatCueTime(seconds float64, clock cueClock) string {
+	if clock == assClock {
+		cs := int64(math.Round(seconds * 100))
+		return fmt.Sprintf("%d:%02d:%02d.%02d", cs/360000, cs/6000%60, cs/100%60, cs%100)
+	}
+	ms := int64(math.Round(seconds * 1000))
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
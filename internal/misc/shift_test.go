@@ -0,0 +1,46 @@
+package misc
+
+import (
+	"strings"
+	"testing"
+)
+
+const shiftFixtureVTT = "WEBVTT\n\n00:00:00.500 --> 00:00:01.200\nToo early\n\n1\n00:00:01.000 --> 00:00:03.000 align:start\nStraddles zero\n\n01:00.250 --> 01:02.000\nLater\n"
+
+func TestShiftVTTMovesAndDropsCues(t *testing.T) {
+	got := string(shiftVTT([]byte(shiftFixtureVTT), -1.5))
+	want := "WEBVTT\n\n1\n00:00:00.000 --> 00:00:01.500 align:start\nStraddles zero\n\n00:00:58.750 --> 00:01:00.500\nLater\n"
+	if got != want {
+		t.Fatalf("unexpected shifted vtt:\n%q\nwant\n%q", got, want)
+	}
+
+	later := string(shiftVTT([]byte(shiftFixtureVTT), 2))
+	if !strings.Contains(later, "00:00:02.500 --> 00:00:03.200\nToo early") || !strings.Contains(later, "00:01:02.250 --> 00:01:04.000") {
+		t.Fatalf("expected every cue delayed by 2s: %q", later)
+	}
+}
+
+func TestShiftASSMovesDialogue(t *testing.T) {
+	script := "[Events]\nFormat: Layer, Start, End, Style, Name, MarginL, MarginR, MarginV, Effect, Text\n" +
+		"Dialogue: 0,0:00:00.50,0:00:00.60,Default,,0,0,0,,Gone\n" +
+		"Dialogue: 0,0:00:10.00,0:00:12.25,Default,,0,0,0,,Hello, world\n"
+	got := string(shiftASS([]byte(script), -0.75))
+	if strings.Contains(got, "Gone") {
+		t.Fatalf("event ending before zero should be dropped: %q", got)
+	}
+	if !strings.Contains(got, "Dialogue: 0,0:00:09.25,0:00:11.50,Default,,0,0,0,,Hello, world\n") {
+		t.Fatalf("expected the dialogue shifted with text intact: %q", got)
+	}
+	if !strings.HasPrefix(got, "[Events]\nFormat:") {
+		t.Fatalf("non-dialogue lines must be kept: %q", got)
+	}
+}
+
+func TestShiftedKeyIncludesSign(t *testing.T) {
+	if got := shiftedKey("en", 1.5); got != "en@+1.5" {
+		t.Fatalf("expected en@+1.5, got %s", got)
+	}
+	if got := shiftedKey("en_2", -0.25); got != "en_2@-0.25" {
+		t.Fatalf("expected en_2@-0.25, got %s", got)
+	}
+}
@@ -0,0 +1,77 @@
+package playlist
+
+import (
+	"net/url"
+	"strings"
+
+	"github.com/eleven-am/goshl/internal/domain"
+)
+
+// WithBaseURL returns a PathGenerator that prefixes base to every URL
+// pathGen returns. If pathGen implements FMP4PathGenerator, so does the
+// result. An empty base returns pathGen unchanged.
+func WithBaseURL(pathGen domain.PathGenerator, base string) domain.PathGenerator {
+	if base == "" {
+		return pathGen
+	}
+	b := baseURLPathGen{pathGen: pathGen, base: base}
+	if fmp4, ok := pathGen.(domain.FMP4PathGenerator); ok {
+		return baseURLFMP4PathGen{baseURLPathGen: b, fmp4: fmp4}
+	}
+	return b
+}
+
+// JoinURL prefixes base to ref with exactly one slash between them. A ref
+// that is already absolute, starting with a scheme or with "//", is returned
+// as is; a URL embedded further along a path or query does not count.
+func JoinURL(base, ref string) string {
+	if base == "" || strings.HasPrefix(ref, "//") {
+		return ref
+	}
+	if u, err := url.Parse(ref); err == nil && u.IsAbs() {
+		return ref
+	}
+	return strings.TrimRight(base, "/") + "/" + strings.TrimLeft(ref, "/")
+}
+
+type baseURLPathGen struct {
+	pathGen domain.PathGenerator
+	base    string
+}
+
+func (g baseURLPathGen) MasterPlaylist(sourceURL string) string {
+	return JoinURL(g.base, g.pathGen.MasterPlaylist(sourceURL))
+}
+
+func (g baseURLPathGen) VariantPlaylist(sourceURL string, rendition string, streamType domain.StreamType) string {
+	return JoinURL(g.base, g.pathGen.VariantPlaylist(sourceURL, rendition, streamType))
+}
+
+func (g baseURLPathGen) Segment(sourceURL string, rendition string, streamType domain.StreamType, index int) string {
+	return JoinURL(g.base, g.pathGen.Segment(sourceURL, rendition, streamType, index))
+}
+
+func (g baseURLPathGen) SpriteVTT(sourceURL string) string {
+	return JoinURL(g.base, g.pathGen.SpriteVTT(sourceURL))
+}
+
+func (g baseURLPathGen) Sprite(sourceURL string, index int) string {
+	return JoinURL(g.base, g.pathGen.Sprite(sourceURL, index))
+}
+
+func (g baseURLPathGen) SubtitleVTT(sourceURL string, lang string) string {
+	return JoinURL(g.base, g.pathGen.SubtitleVTT(sourceURL, lang))
+}
+
+type baseURLFMP4PathGen struct {
+	baseURLPathGen
+	fmp4 domain.FMP4PathGenerator
+}
+
+func (g baseURLFMP4PathGen) InitSegment(sourceURL string, rendition string, streamType domain.StreamType) string {
+	return JoinURL(g.base, g.fmp4.InitSegment(sourceURL, rendition, streamType))
+}
+
+func (g baseURLFMP4PathGen) FMP4Segment(sourceURL string, rendition string, streamType domain.StreamType, index int) string {
+	return JoinURL(g.base, g.fmp4.FMP4Segment(sourceURL, rendition, streamType, index))
+}
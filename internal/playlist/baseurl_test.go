@@ -0,0 +1,54 @@
+package playlist
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/eleven-am/goshl/internal/domain"
+)
+
+func TestJoinURL(t *testing.T) {
+	cases := []struct{ base, ref, want string }{
+		{"https://cdn.example.com", "/media/master.m3u8", "https://cdn.example.com/media/master.m3u8"},
+		{"https://cdn.example.com/", "/media/master.m3u8", "https://cdn.example.com/media/master.m3u8"},
+		{"https://cdn.example.com/hls/", "media/master.m3u8", "https://cdn.example.com/hls/media/master.m3u8"},
+		{"https://cdn.example.com/hls", "media/seg.ts?token=a", "https://cdn.example.com/hls/media/seg.ts?token=a"},
+		{"https://cdn.example.com", "https://other.example.com/seg.ts", "https://other.example.com/seg.ts"},
+		{"https://cdn.example.com", "//other.example.com/seg.ts", "//other.example.com/seg.ts"},
+		{"", "/media/master.m3u8", "/media/master.m3u8"},
+		{"https://cdn.example.com", "/hls/file:///movies/a.mkv/720p.m3u8", "https://cdn.example.com/hls/file:///movies/a.mkv/720p.m3u8"},
+		{"https://cdn.example.com", "/hls/seg.ts?src=https://origin.example.com/a.mkv", "https://cdn.example.com/hls/seg.ts?src=https://origin.example.com/a.mkv"},
+	}
+	for _, tc := range cases {
+		if got := JoinURL(tc.base, tc.ref); got != tc.want {
+			t.Fatalf("JoinURL(%q, %q) = %q, want %q", tc.base, tc.ref, got, tc.want)
+		}
+	}
+}
+
+func TestWithBaseURLPrefixesPlaylistURIs(t *testing.T) {
+	const base = "https://cdn.example.com/"
+
+	if _, ok := WithBaseURL(staticPathGen{}, base).(domain.FMP4PathGenerator); ok {
+		t.Fatalf("wrapper must not claim FMP4PathGenerator when the wrapped generator does not")
+	}
+
+	gen := NewGenerator(WithBaseURL(fmp4PathGen{}, base))
+	videos := []domain.VideoRendition{{Name: "720p", Width: 1280, Height: 720, Bitrate: 2_500_000, Container: domain.ContainerFMP4}}
+	audios := []domain.AudioRendition{{Name: "aac_stereo", Codec: "aac", Bitrate: 128_000}}
+
+	master := gen.Master("media", videos, audios, domain.AudioGroupPolicy{}, domain.MasterOptions{}, false)
+	if !strings.Contains(master, `URI="https://cdn.example.com/media/audio/aac_stereo/playlist.m3u8"`) ||
+		!strings.Contains(master, "\nhttps://cdn.example.com/media/video/720p/playlist.m3u8\n") {
+		t.Fatalf("expected absolute variant URIs: %s", master)
+	}
+
+	variant := gen.Variant("media", "720p", domain.StreamVideo, domain.ContainerFMP4, []domain.Segment{{Index: 0, Duration: 6}}, domain.VariantOptions{})
+	if !strings.Contains(variant, `#EXT-X-MAP:URI="https://cdn.example.com/media/720p/init.mp4"`) ||
+		!strings.Contains(variant, "\nhttps://cdn.example.com/media/720p/0.m4s\n") {
+		t.Fatalf("expected absolute init and segment URIs: %s", variant)
+	}
+	if err := Validate(variant); err != nil {
+		t.Fatalf("invalid variant: %v", err)
+	}
+}
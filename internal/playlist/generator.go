@@ -3,11 +3,15 @@ package playlist
 import (
 	"fmt"
 	"math"
+	"slices"
 	"strings"
+	"time"
 
 	"github.com/eleven-am/goshl/internal/domain"
 )
 
+const programDateTimeLayout = "2006-01-02T15:04:05.000Z07:00"
+
 type Generator struct {
 	pathGen domain.PathGenerator
 }
@@ -16,65 +20,258 @@ func NewGenerator(pathGen domain.PathGenerator) *Generator {
 	return &Generator{pathGen: pathGen}
 }
 
-func (g *Generator) Master(sourceURL string, videos []domain.VideoRendition, audios []domain.AudioRendition) string {
-	var b strings.Builder
+// Master builds the master playlist. independent declares
+// EXT-X-INDEPENDENT-SEGMENTS; callers must only set it when every segment of
+// every listed rendition starts with a keyframe decodable on its own.
+func (g *Generator) Master(sourceURL string, videos []domain.VideoRendition, audios []domain.AudioRendition, policy domain.AudioGroupPolicy, opts domain.MasterOptions, independent bool) string {
+	out, _ := g.MasterVariants(sourceURL, videos, audios, policy, opts, independent)
+	return out
+}
+
+// Variant identifies a variant playlist referenced by a master playlist.
+type Variant struct {
+	StreamType domain.StreamType
+	Rendition  string
+}
+
+// MasterVariants builds the same master playlist as Master and also returns
+// every variant playlist it references, once each, in the order they appear.
+func (g *Generator) MasterVariants(sourceURL string, videos []domain.VideoRendition, audios []domain.AudioRendition, policy domain.AudioGroupPolicy, opts domain.MasterOptions, independent bool) (string, []Variant) {
+	w := &masterWriter{g: g, sourceURL: sourceURL}
+	b := &w.b
 
 	b.WriteString("#EXTM3U\n")
-	b.WriteString("#EXT-X-VERSION:4\n")
+	b.WriteString(fmt.Sprintf("#EXT-X-VERSION:%d\n", masterFeatures(videos, audios).version()))
+	if independent {
+		b.WriteString("#EXT-X-INDEPENDENT-SEGMENTS\n")
+	}
+	writeStart(b, opts.StartOffset)
 	b.WriteString("\n")
 
-	audioGroupID := "audio"
-	for _, audio := range audios {
-		b.WriteString(fmt.Sprintf(
-			"#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID=\"%s\",NAME=\"%s\",DEFAULT=%s,AUTOSELECT=YES,URI=\"%s\"\n",
-			audioGroupID,
-			audio.Name,
-			defaultFlag(audio.Name == "aac_stereo"),
-			g.pathGen.VariantPlaylist(sourceURL, audio.Name, domain.StreamAudio),
-		))
+	if len(videos) == 0 {
+		w.writeAudioOnly(audios)
+		return b.String(), w.variants
+	}
+
+	if audio, ok := DefaultAudio(audios, policy); ok && opts.Muxed {
+		w.writeMuxed(videos, audio)
+		return b.String(), w.variants
 	}
 
-	if len(audios) > 0 {
+	groups := groupAudios(audios, policy)
+	for _, group := range groups {
+		for i, audio := range group.audios {
+			b.WriteString(fmt.Sprintf(
+				"#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID=\"%s\",NAME=\"%s\",DEFAULT=%s,AUTOSELECT=YES,%s%sURI=\"%s\"\n",
+				group.id,
+				audio.Name,
+				defaultFlag(i == group.defaultIdx),
+				languageAttr(audio),
+				channelsAttr(audio),
+				w.uri(audio.Name, domain.StreamAudio),
+			))
+		}
+	}
+
+	if len(groups) > 0 {
 		b.WriteString("\n")
 	}
 
 	for _, video := range videos {
-		codecs := fmt.Sprintf("%s,%s", videoCodecString(video), audioCodecString())
+		if len(groups) == 0 {
+			streamInf := fmt.Sprintf(
+				"#EXT-X-STREAM-INF:BANDWIDTH=%d,%sCODECS=\"%s\"",
+				video.Bitrate,
+				resolutionAttr(video),
+				videoCodecString(video),
+			)
+			b.WriteString(streamInf + "\n")
+			b.WriteString(w.uri(video.Name, domain.StreamVideo) + "\n")
+			continue
+		}
+
+		for _, group := range groups {
+			codecs := fmt.Sprintf("%s,%s", videoCodecString(video), group.codecs())
+			streamInf := fmt.Sprintf(
+				"#EXT-X-STREAM-INF:BANDWIDTH=%d,%sCODECS=\"%s\",AUDIO=\"%s\"",
+				video.Bitrate,
+				resolutionAttr(video),
+				codecs,
+				group.id,
+			)
+			b.WriteString(streamInf + "\n")
+			b.WriteString(w.uri(video.Name, domain.StreamVideo) + "\n")
+		}
+	}
+
+	return b.String(), w.variants
+}
+
+// masterWriter accumulates a master playlist and the variants it references.
+type masterWriter struct {
+	g         *Generator
+	sourceURL string
+	b         strings.Builder
+	variants  []Variant
+}
+
+// uri returns the variant playlist URI for a rendition and records the
+// variant the first time it is referenced.
+func (w *masterWriter) uri(rendition string, streamType domain.StreamType) string {
+	variant := Variant{StreamType: streamType, Rendition: rendition}
+	if !slices.Contains(w.variants, variant) {
+		w.variants = append(w.variants, variant)
+	}
+	return w.g.pathGen.VariantPlaylist(w.sourceURL, rendition, streamType)
+}
+
+// writeMuxed lists every video rendition with audio muxed into its segments.
+// The audio travels in the same stream, so it counts toward BANDWIDTH.
+func (w *masterWriter) writeMuxed(videos []domain.VideoRendition, audio domain.AudioRendition) {
+	for _, video := range videos {
 		streamInf := fmt.Sprintf(
-			"#EXT-X-STREAM-INF:BANDWIDTH=%d,RESOLUTION=%dx%d,CODECS=\"%s\",AUDIO=\"%s\"",
-			video.Bitrate,
-			video.Width,
-			video.Height,
-			codecs,
-			audioGroupID,
+			"#EXT-X-STREAM-INF:BANDWIDTH=%d,%sCODECS=\"%s,%s\"",
+			video.Bitrate+audio.Bitrate,
+			resolutionAttr(video),
+			videoCodecString(video),
+			audioCodecString(audio),
 		)
-		b.WriteString(streamInf + "\n")
-		b.WriteString(g.pathGen.VariantPlaylist(sourceURL, video.Name, domain.StreamVideo) + "\n")
+		w.b.WriteString(streamInf + "\n")
+		w.b.WriteString(w.uri(domain.MuxedRendition(video.Name, audio.Name), domain.StreamVideo) + "\n")
 	}
+}
 
-	return b.String()
+// writeAudioOnly lists each audio rendition as a variant of its own, for
+// sources without a usable video stream. EXT-X-MEDIA renditions need a
+// variant to attach to, so none are written.
+func (w *masterWriter) writeAudioOnly(audios []domain.AudioRendition) {
+	for _, audio := range audios {
+		bandwidth := audio.Bitrate
+		if bandwidth <= 0 {
+			bandwidth = unknownAudioBandwidth
+		}
+		w.b.WriteString(fmt.Sprintf("#EXT-X-STREAM-INF:BANDWIDTH=%d,CODECS=\"%s\"\n", bandwidth, audioCodecString(audio)))
+		w.b.WriteString(w.uri(audio.Name, domain.StreamAudio) + "\n")
+	}
+}
+
+// unknownAudioBandwidth stands in for a passthrough track whose source did
+// not declare a bitrate; BANDWIDTH is mandatory. It is the usual AC-3 rate.
+const unknownAudioBandwidth = 640000
+
+type audioGroup struct {
+	id         string
+	audios     []domain.AudioRendition
+	defaultIdx int
+}
+
+// codecs returns the de-duplicated audio CODECS entries for every rendition
+// in the group, since a variant must declare all formats it may be paired with.
+func (g *audioGroup) codecs() string {
+	seen := make(map[string]bool)
+	var codecs []string
+	for _, audio := range g.audios {
+		codec := audioCodecString(audio)
+		if !seen[codec] {
+			seen[codec] = true
+			codecs = append(codecs, codec)
+		}
+	}
+	return strings.Join(codecs, ",")
+}
+
+// groupAudios partitions audio renditions into EXT-X-MEDIA groups according to
+// policy, preserving first-seen order. Without a GroupID func every rendition
+// lands in a single "audio" group; without an IsDefault func the first
+// rendition of the source's default track is the default. A group with no
+// default falls back to aac_stereo, then to its first rendition.
+func groupAudios(audios []domain.AudioRendition, policy domain.AudioGroupPolicy) []*audioGroup {
+	groupID := policy.GroupID
+	if groupID == nil {
+		groupID = func(domain.AudioRendition) string { return "audio" }
+	}
+	isDefault := policy.IsDefault
+	if isDefault == nil {
+		isDefault = func(audio domain.AudioRendition) bool { return audio.Default }
+	}
+
+	var groups []*audioGroup
+	byID := make(map[string]*audioGroup)
+	for _, audio := range audios {
+		id := groupID(audio)
+		group, ok := byID[id]
+		if !ok {
+			group = &audioGroup{id: id, defaultIdx: -1}
+			byID[id] = group
+			groups = append(groups, group)
+		}
+		if group.defaultIdx == -1 && isDefault(audio) {
+			group.defaultIdx = len(group.audios)
+		}
+		group.audios = append(group.audios, audio)
+	}
+
+	for _, group := range groups {
+		if group.defaultIdx != -1 {
+			continue
+		}
+		group.defaultIdx = 0
+		for i, audio := range group.audios {
+			if audio.Name == "aac_stereo" {
+				group.defaultIdx = i
+				break
+			}
+		}
+	}
+
+	return groups
 }
 
-func (g *Generator) Variant(sourceURL string, rendition string, streamType domain.StreamType, segments []domain.Segment) string {
+// DefaultAudio returns the audio rendition marked DEFAULT=YES in the first
+// group of the master playlist, the one a player starts on.
+func DefaultAudio(audios []domain.AudioRendition, policy domain.AudioGroupPolicy) (domain.AudioRendition, bool) {
+	groups := groupAudios(audios, policy)
+	if len(groups) == 0 {
+		return domain.AudioRendition{}, false
+	}
+	return groups[0].audios[groups[0].defaultIdx], true
+}
+
+func (g *Generator) Variant(sourceURL string, rendition string, streamType domain.StreamType, container domain.Container, segments []domain.Segment, opts domain.VariantOptions) string {
 	var b strings.Builder
 
 	var maxDuration float64
+	used := features{fmp4: container == domain.ContainerFMP4}
 	for _, seg := range segments {
 		if seg.Duration > maxDuration {
 			maxDuration = seg.Duration
 		}
+		used.gap = used.gap || seg.Gap
 	}
 
 	b.WriteString("#EXTM3U\n")
-	b.WriteString("#EXT-X-VERSION:4\n")
+	b.WriteString(fmt.Sprintf("#EXT-X-VERSION:%d\n", used.version()))
 	b.WriteString(fmt.Sprintf("#EXT-X-TARGETDURATION:%d\n", int(math.Ceil(maxDuration))))
 	b.WriteString("#EXT-X-PLAYLIST-TYPE:VOD\n")
 	b.WriteString("#EXT-X-MEDIA-SEQUENCE:0\n")
+	writeStart(&b, opts.StartOffset)
+	if container == domain.ContainerFMP4 {
+		b.WriteString(fmt.Sprintf("#EXT-X-MAP:URI=\"%s\"\n", g.InitSegmentURL(sourceURL, rendition, streamType)))
+	}
 	b.WriteString("\n")
 
+	var elapsed float64
 	for _, seg := range segments {
+		if !opts.ProgramDateTime.IsZero() {
+			at := opts.ProgramDateTime.Add(time.Duration(elapsed * float64(time.Second)))
+			b.WriteString("#EXT-X-PROGRAM-DATE-TIME:" + at.Format(programDateTimeLayout) + "\n")
+			elapsed += seg.Duration
+		}
+		if seg.Gap {
+			b.WriteString("#EXT-X-GAP\n")
+		}
 		b.WriteString(fmt.Sprintf("#EXTINF:%.3f,\n", seg.Duration))
-		b.WriteString(g.pathGen.Segment(sourceURL, rendition, streamType, seg.Index) + "\n")
+		b.WriteString(g.SegmentURL(sourceURL, rendition, streamType, container, seg.Index) + "\n")
 	}
 
 	b.WriteString("#EXT-X-ENDLIST\n")
@@ -82,6 +279,64 @@ func (g *Generator) Variant(sourceURL string, rendition string, streamType domai
 	return b.String()
 }
 
+// SegmentURL returns the URL a variant playlist lists for a segment.
+func (g *Generator) SegmentURL(sourceURL string, rendition string, streamType domain.StreamType, container domain.Container, index int) string {
+	if container != domain.ContainerFMP4 {
+		return g.pathGen.Segment(sourceURL, rendition, streamType, index)
+	}
+	if fmp4, ok := g.pathGen.(domain.FMP4PathGenerator); ok {
+		return fmp4.FMP4Segment(sourceURL, rendition, streamType, index)
+	}
+	url := g.pathGen.Segment(sourceURL, rendition, streamType, index)
+	return strings.TrimSuffix(url, domain.ContainerTS.Extension()) + domain.ContainerFMP4.Extension()
+}
+
+// InitSegmentURL returns the URL of an fMP4 rendition's initialization
+// segment, as its variant playlist's EXT-X-MAP gives it.
+func (g *Generator) InitSegmentURL(sourceURL string, rendition string, streamType domain.StreamType) string {
+	if fmp4, ok := g.pathGen.(domain.FMP4PathGenerator); ok {
+		return fmp4.InitSegment(sourceURL, rendition, streamType)
+	}
+	url := g.pathGen.Segment(sourceURL, rendition, streamType, 0)
+	return url[:strings.LastIndex(url, "/")+1] + "init.mp4"
+}
+
+// writeStart emits EXT-X-START when a non-zero offset is requested. Negative
+// offsets are measured from the end of the playlist.
+func writeStart(b *strings.Builder, offset float64) {
+	if offset == 0 {
+		return
+	}
+	b.WriteString(fmt.Sprintf("#EXT-X-START:TIME-OFFSET=%.3f\n", offset))
+}
+
+// resolutionAttr returns the EXT-X-STREAM-INF RESOLUTION attribute, with a
+// trailing comma, or nothing when either dimension is unknown.
+func resolutionAttr(video domain.VideoRendition) string {
+	if video.Width <= 0 || video.Height <= 0 {
+		return ""
+	}
+	return fmt.Sprintf("RESOLUTION=%dx%d,", video.Width, video.Height)
+}
+
+// languageAttr returns the EXT-X-MEDIA LANGUAGE attribute, with a trailing
+// comma, or nothing when the track's language is unknown.
+func languageAttr(audio domain.AudioRendition) string {
+	if audio.Language == "" {
+		return ""
+	}
+	return fmt.Sprintf("LANGUAGE=\"%s\",", audio.Language)
+}
+
+// channelsAttr returns the EXT-X-MEDIA CHANNELS attribute, with a trailing
+// comma, or nothing when the channel count is unknown.
+func channelsAttr(audio domain.AudioRendition) string {
+	if audio.Channels <= 0 {
+		return ""
+	}
+	return fmt.Sprintf("CHANNELS=\"%d\",", audio.Channels)
+}
+
 func defaultFlag(isDefault bool) string {
 	if isDefault {
 		return "YES"
@@ -89,21 +344,172 @@ func defaultFlag(isDefault bool) string {
 	return "NO"
 }
 
+// h264Levels lists H.264 levels with their macroblock-per-second and
+// macroblocks-per-frame limits, lowest first.
+var h264Levels = []struct {
+	idc  int
+	mbps int
+	fs   int
+}{
+	{0x15, 19800, 792},
+	{0x16, 20250, 1620},
+	{0x1e, 40500, 1620},
+	{0x1f, 108000, 3600},
+	{0x20, 216000, 5120},
+	{0x28, 245760, 8192},
+	{0x2a, 522240, 8704},
+	{0x32, 589824, 22080},
+	{0x33, 983040, 36864},
+	{0x34, 2073600, 36864},
+	{0x3c, 4177920, 139264},
+}
+
+// vp9Levels lists VP9 levels with their luma picture size and luma sample
+// rate limits, lowest first.
+var vp9Levels = []struct {
+	level   int
+	picture int
+	rate    int
+}{
+	{10, 36864, 829440},
+	{11, 73728, 2764800},
+	{20, 122880, 4608000},
+	{21, 245760, 9216000},
+	{30, 552960, 20736000},
+	{31, 983040, 36864000},
+	{40, 2228224, 83558400},
+	{41, 2228224, 160432128},
+	{50, 8912896, 311951360},
+	{51, 8912896, 588251136},
+	{52, 8912896, 1176502272},
+	{60, 35651584, 1176502272},
+}
+
 func videoCodecString(video domain.VideoRendition) string {
+	switch video.Codec {
+	case domain.VideoCodecVP9:
+		return fmt.Sprintf("vp09.00.%02d.08", vp9Level(video.Width, video.Height, video.FrameRate))
+	case domain.VideoCodecHEVC:
+		// Main tier, in the Main profile or, for a direct-streamed 10-bit
+		// source, Main 10.
+		if video.BitDepth > 8 {
+			return fmt.Sprintf("hvc1.2.4.L%d.B0", hevcLevel(video.Width, video.Height, video.FrameRate))
+		}
+		return fmt.Sprintf("hvc1.1.6.L%d.B0", hevcLevel(video.Width, video.Height, video.FrameRate))
+	}
+
+	// High profile, or High 10 for a direct-streamed 10-bit source.
+	profile := 0x64
+	if video.BitDepth > 8 {
+		profile = 0x6e
+	}
+
+	if video.FrameRate > 0 && video.Width > 0 && video.Height > 0 {
+		return fmt.Sprintf("avc1.%02x00%02x", profile, h264Level(video.Width, video.Height, video.FrameRate))
+	}
+
 	switch video.Height {
 	case 2160:
-		return "avc1.640033"
+		return fmt.Sprintf("avc1.%02x0033", profile)
 	case 1080:
-		return "avc1.640028"
+		return fmt.Sprintf("avc1.%02x0028", profile)
 	case 720:
-		return "avc1.64001f"
+		return fmt.Sprintf("avc1.%02x001f", profile)
 	case 480:
-		return "avc1.64001e"
+		return fmt.Sprintf("avc1.%02x001e", profile)
 	default:
-		return "avc1.640015"
+		return fmt.Sprintf("avc1.%02x0015", profile)
+	}
+}
+
+// h264Level returns the lowest level whose frame size and macroblock rate
+// limits fit the given dimensions and frame rate.
+func h264Level(width, height int, frameRate float64) int {
+	frameSize := ((width + 15) / 16) * ((height + 15) / 16)
+	rate := int(math.Ceil(float64(frameSize) * frameRate))
+
+	for _, level := range h264Levels {
+		if frameSize <= level.fs && rate <= level.mbps {
+			return level.idc
+		}
 	}
+	return h264Levels[len(h264Levels)-1].idc
 }
 
-func audioCodecString() string {
-	return "mp4a.40.2"
+// vp9Level returns the lowest profile 0 level that fits the picture size and
+// sample rate. An unknown frame rate is taken as 30fps.
+func vp9Level(width, height int, frameRate float64) int {
+	if frameRate <= 0 {
+		frameRate = 30
+	}
+	picture := width * height
+	rate := int(math.Ceil(float64(picture) * frameRate))
+
+	for _, level := range vp9Levels {
+		if picture <= level.picture && rate <= level.rate {
+			return level.level
+		}
+	}
+	return vp9Levels[len(vp9Levels)-1].level
+}
+
+// hevcLevels lists HEVC Main tier levels, as general_level_idc (30 times
+// the level number), with their luma picture size and luma sample rate
+// limits, lowest first.
+var hevcLevels = []struct {
+	idc     int
+	picture int
+	rate    int
+}{
+	{30, 36864, 552960},
+	{60, 122880, 3686400},
+	{63, 245760, 7372800},
+	{90, 552960, 16588800},
+	{93, 983040, 33177600},
+	{120, 2228224, 66846720},
+	{123, 2228224, 133693440},
+	{150, 8912896, 267386880},
+	{153, 8912896, 534773760},
+	{156, 8912896, 1069547520},
+	{180, 35651584, 1069547520},
+	{183, 35651584, 2139095040},
+	{186, 35651584, 4278190080},
+}
+
+// hevcLevel returns the lowest Main tier level that fits the picture size
+// and sample rate. An unknown frame rate is taken as 30fps.
+func hevcLevel(width, height int, frameRate float64) int {
+	if frameRate <= 0 {
+		frameRate = 30
+	}
+	picture := width * height
+	rate := int(math.Ceil(float64(picture) * frameRate))
+
+	for _, level := range hevcLevels {
+		if picture <= level.picture && rate <= level.rate {
+			return level.idc
+		}
+	}
+	return hevcLevels[len(hevcLevels)-1].idc
+}
+
+// audioCodecTags maps AudioRendition.Codec to its HLS CODECS entry. Apple
+// players reject Dolby passthrough declared as AAC.
+var audioCodecTags = map[string]string{
+	"aac":  "mp4a.40.2",
+	"ac3":  "ac-3",
+	"eac3": "ec-3",
+	"opus": "opus",
+}
+
+// audioCodecString returns the CODECS entry for an audio rendition. HE-AAC
+// has its own object type; unknown codecs are declared as AAC-LC.
+func audioCodecString(audio domain.AudioRendition) string {
+	if audio.Profile == "aac_he" {
+		return "mp4a.40.5"
+	}
+	if tag, ok := audioCodecTags[audio.Codec]; ok {
+		return tag
+	}
+	return audioCodecTags["aac"]
 }
@@ -1,9 +1,11 @@
 package playlist
 
 import (
+	"slices"
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/eleven-am/goshl/internal/domain"
 )
@@ -40,10 +42,20 @@ func TestGenerator_MasterIncludesAudioGroupsAndVariants(t *testing.T) {
 
 	audios := []domain.AudioRendition{
 		{Name: "aac_stereo", Codec: "aac"},
-		{Name: "ac3_passthrough", Codec: "ac3"},
+		{Name: "ac3_passthrough", Codec: "ac3", Language: "eng", Channels: 6},
 	}
 
-	out := gen.Master("media", videos, audios)
+	out := gen.Master("media", videos, audios, domain.AudioGroupPolicy{}, domain.MasterOptions{}, false)
+
+	if !strings.Contains(out, "NAME=\"ac3_passthrough\",DEFAULT=NO,AUTOSELECT=YES,LANGUAGE=\"eng\",CHANNELS=\"6\",URI=") {
+		t.Fatalf("expected LANGUAGE and CHANNELS on the surround track: %s", out)
+	}
+	if strings.Count(out, "CHANNELS=") != 1 {
+		t.Fatalf("CHANNELS must be omitted when the count is unknown: %s", out)
+	}
+	if strings.Count(out, "LANGUAGE=") != 1 {
+		t.Fatalf("LANGUAGE must be omitted when the language is unknown: %s", out)
+	}
 
 	if !strings.Contains(out, "#EXTM3U") || !strings.Contains(out, "#EXT-X-VERSION:4") {
 		t.Fatalf("missing mandatory headers: %s", out)
@@ -57,8 +69,8 @@ func TestGenerator_MasterIncludesAudioGroupsAndVariants(t *testing.T) {
 		t.Fatalf("expected additional audio track to be non-default: %s", out)
 	}
 
-	if !strings.Contains(out, "CODECS=\"avc1.640028,mp4a.40.2\"") {
-		t.Fatalf("expected 1080p codec string: %s", out)
+	if !strings.Contains(out, "CODECS=\"avc1.640028,mp4a.40.2,ac-3\"") {
+		t.Fatalf("expected 1080p codec string covering grouped audio: %s", out)
 	}
 
 	if !strings.Contains(out, "/media/video/1080p/playlist.m3u8") || !strings.Contains(out, "/media/video/480p/playlist.m3u8") {
@@ -76,7 +88,7 @@ func TestGenerator_VariantUsesCeilTargetDurationAndAppendsEndlist(t *testing.T)
 		{Index: 1, Duration: 6.2},
 	}
 
-	out := gen.Variant(mediaID, rendition, domain.StreamVideo, segments)
+	out := gen.Variant(mediaID, rendition, domain.StreamVideo, domain.ContainerTS, segments, domain.VariantOptions{})
 
 	if !strings.Contains(out, "#EXT-X-TARGETDURATION:7") {
 		t.Fatalf("target duration should ceil max segment: %s", out)
@@ -95,3 +107,394 @@ func TestGenerator_VariantUsesCeilTargetDurationAndAppendsEndlist(t *testing.T)
 		}
 	}
 }
+
+func TestGenerator_VariantMarksGapSegments(t *testing.T) {
+	gen := NewGenerator(staticPathGen{})
+	segments := []domain.Segment{
+		{Index: 0, Duration: 6},
+		{Index: 1, Duration: 6, Gap: true},
+		{Index: 2, Duration: 6},
+	}
+
+	out := gen.Variant("media", "720p", domain.StreamVideo, domain.ContainerTS, segments, domain.VariantOptions{})
+
+	if !strings.Contains(out, "#EXT-X-VERSION:8\n") {
+		t.Fatalf("EXT-X-GAP needs protocol version 8: %s", out)
+	}
+	if !strings.Contains(out, "#EXT-X-GAP\n#EXTINF:6.000,\n/media/video/720p/segment-1.ts") {
+		t.Fatalf("expected segment 1 tagged as a gap: %s", out)
+	}
+	if strings.Count(out, "#EXT-X-GAP") != 1 {
+		t.Fatalf("expected exactly one gap: %s", out)
+	}
+}
+
+func TestGenerator_MasterAppliesAudioGroupPolicy(t *testing.T) {
+	gen := NewGenerator(staticPathGen{})
+
+	videos := []domain.VideoRendition{{Name: "720p", Width: 1280, Height: 720, Bitrate: 2_000_000}}
+	audios := []domain.AudioRendition{
+		{Name: "aac_stereo", Codec: "aac"},
+		{Name: "aac_surround", Codec: "aac"},
+		{Name: "ac3_passthrough", Codec: "ac3"},
+	}
+
+	policy := domain.AudioGroupPolicy{
+		GroupID:   func(a domain.AudioRendition) string { return "audio_" + a.Codec },
+		IsDefault: func(a domain.AudioRendition) bool { return a.Name == "aac_surround" },
+	}
+
+	out := gen.Master("media", videos, audios, policy, domain.MasterOptions{}, false)
+
+	if !strings.Contains(out, "GROUP-ID=\"audio_aac\",NAME=\"aac_surround\",DEFAULT=YES") {
+		t.Fatalf("expected policy default in aac group: %s", out)
+	}
+	if !strings.Contains(out, "GROUP-ID=\"audio_aac\",NAME=\"aac_stereo\",DEFAULT=NO") {
+		t.Fatalf("expected stereo to be non-default: %s", out)
+	}
+	if !strings.Contains(out, "GROUP-ID=\"audio_ac3\",NAME=\"ac3_passthrough\",DEFAULT=YES") {
+		t.Fatalf("group without a policy default should default its first track: %s", out)
+	}
+	if !strings.Contains(out, "AUDIO=\"audio_aac\"") || !strings.Contains(out, "AUDIO=\"audio_ac3\"") {
+		t.Fatalf("expected a variant per audio group: %s", out)
+	}
+	if got := strings.Count(out, "#EXT-X-STREAM-INF"); got != 2 {
+		t.Fatalf("expected 2 stream infs (one per group), got %d", got)
+	}
+
+	listed, variants := gen.MasterVariants("media", videos, audios, policy, domain.MasterOptions{}, false)
+	want := []Variant{
+		{domain.StreamAudio, "aac_stereo"},
+		{domain.StreamAudio, "aac_surround"},
+		{domain.StreamAudio, "ac3_passthrough"},
+		{domain.StreamVideo, "720p"},
+	}
+	if listed != out || !slices.Equal(variants, want) {
+		t.Fatalf("expected each referenced variant once, got %+v", variants)
+	}
+}
+
+func TestGenerator_MasterDefaultFollowsSourceDefaultTrack(t *testing.T) {
+	gen := NewGenerator(staticPathGen{})
+
+	videos := []domain.VideoRendition{{Name: "720p", Width: 1280, Height: 720, Bitrate: 2_000_000}}
+	audios := []domain.AudioRendition{
+		{Name: "aac_stereo", Codec: "aac"},
+		{Name: "ac3_passthrough", Codec: "ac3", Default: true},
+	}
+
+	out := gen.Master("media", videos, audios, domain.AudioGroupPolicy{}, domain.MasterOptions{}, false)
+	if !strings.Contains(out, "NAME=\"ac3_passthrough\",DEFAULT=YES") || !strings.Contains(out, "NAME=\"aac_stereo\",DEFAULT=NO") {
+		t.Fatalf("expected source default track to be DEFAULT: %s", out)
+	}
+
+	audios[1].Default = false
+	out = gen.Master("media", videos, audios, domain.AudioGroupPolicy{}, domain.MasterOptions{}, false)
+	if !strings.Contains(out, "NAME=\"aac_stereo\",DEFAULT=YES") {
+		t.Fatalf("expected aac_stereo fallback without a source default: %s", out)
+	}
+}
+
+func TestGenerator_MasterCodecsFollowAudioGroup(t *testing.T) {
+	gen := NewGenerator(staticPathGen{})
+
+	videos := []domain.VideoRendition{{Name: "1080p", Width: 1920, Height: 1080, Bitrate: 5_000_000}}
+	audios := []domain.AudioRendition{
+		{Name: "aac_stereo", Codec: "aac"},
+		{Name: "eac3_passthrough", Codec: "eac3"},
+	}
+	policy := domain.AudioGroupPolicy{
+		GroupID: func(a domain.AudioRendition) string { return "audio_" + a.Codec },
+	}
+
+	out := gen.Master("media", videos, audios, policy, domain.MasterOptions{}, false)
+
+	if !strings.Contains(out, "CODECS=\"avc1.640028,mp4a.40.2\",AUDIO=\"audio_aac\"") {
+		t.Fatalf("aac variant should declare mp4a: %s", out)
+	}
+	if !strings.Contains(out, "CODECS=\"avc1.640028,ec-3\",AUDIO=\"audio_eac3\"") {
+		t.Fatalf("eac3 variant should declare ec-3: %s", out)
+	}
+}
+
+func TestAudioCodecStringHEAAC(t *testing.T) {
+	if got := audioCodecString(domain.AudioRendition{Codec: "aac", Profile: "aac_he"}); got != "mp4a.40.5" {
+		t.Fatalf("expected HE-AAC codec tag, got %s", got)
+	}
+	if got := audioCodecString(domain.AudioRendition{Codec: "aac"}); got != "mp4a.40.2" {
+		t.Fatalf("expected LC codec tag, got %s", got)
+	}
+}
+
+func TestAudioCodecStringMapsCodecs(t *testing.T) {
+	cases := map[string]string{
+		"aac":  "mp4a.40.2",
+		"ac3":  "ac-3",
+		"eac3": "ec-3",
+		"opus": "opus",
+		"":     "mp4a.40.2",
+	}
+	for codec, want := range cases {
+		if got := audioCodecString(domain.AudioRendition{Codec: codec}); got != want {
+			t.Errorf("codec %q: expected %s, got %s", codec, want, got)
+		}
+	}
+}
+
+func TestGenerator_StartOffsetEmitsExtXStart(t *testing.T) {
+	gen := NewGenerator(staticPathGen{})
+	segments := []domain.Segment{{Index: 0, Duration: 6}}
+
+	plain := gen.Variant("media", "720p", domain.StreamVideo, domain.ContainerTS, segments, domain.VariantOptions{})
+	if strings.Contains(plain, "#EXT-X-START") {
+		t.Fatalf("EXT-X-START should be omitted without an offset: %s", plain)
+	}
+
+	variant := gen.Variant("media", "720p", domain.StreamVideo, domain.ContainerTS, segments, domain.VariantOptions{StartOffset: 90.5})
+	if !strings.Contains(variant, "#EXT-X-START:TIME-OFFSET=90.500\n") {
+		t.Fatalf("expected EXT-X-START in variant: %s", variant)
+	}
+
+	master := gen.Master("media", nil, nil, domain.AudioGroupPolicy{}, domain.MasterOptions{StartOffset: -30}, false)
+	if !strings.Contains(master, "#EXT-X-START:TIME-OFFSET=-30.000\n") {
+		t.Fatalf("expected EXT-X-START in master: %s", master)
+	}
+}
+
+func TestGenerator_ProgramDateTimeAccumulatesDurations(t *testing.T) {
+	gen := NewGenerator(staticPathGen{})
+	segments := []domain.Segment{
+		{Index: 0, Duration: 6.5},
+		{Index: 1, Duration: 5.25},
+		{Index: 2, Duration: 4},
+	}
+	base := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	out := gen.Variant("media", "720p", domain.StreamVideo, domain.ContainerTS, segments, domain.VariantOptions{ProgramDateTime: base})
+
+	want := []string{
+		"#EXT-X-PROGRAM-DATE-TIME:2024-03-01T12:00:00.000Z\n#EXTINF:6.500,",
+		"#EXT-X-PROGRAM-DATE-TIME:2024-03-01T12:00:06.500Z\n#EXTINF:5.250,",
+		"#EXT-X-PROGRAM-DATE-TIME:2024-03-01T12:00:11.750Z\n#EXTINF:4.000,",
+	}
+	for _, w := range want {
+		if !strings.Contains(out, w) {
+			t.Fatalf("missing %q in output: %s", w, out)
+		}
+	}
+
+	plain := gen.Variant("media", "720p", domain.StreamVideo, domain.ContainerTS, segments, domain.VariantOptions{})
+	if strings.Contains(plain, "PROGRAM-DATE-TIME") {
+		t.Fatalf("program date time should be opt-in: %s", plain)
+	}
+}
+
+type fmp4PathGen struct{ staticPathGen }
+
+func (fmp4PathGen) InitSegment(mediaID string, rendition string, streamType domain.StreamType) string {
+	return "/" + mediaID + "/" + rendition + "/init.mp4"
+}
+
+func (fmp4PathGen) FMP4Segment(mediaID string, rendition string, streamType domain.StreamType, index int) string {
+	return "/" + mediaID + "/" + rendition + "/" + strconv.Itoa(index) + ".m4s"
+}
+
+func TestGenerator_FMP4VariantEmitsMapAndM4SURLs(t *testing.T) {
+	segments := []domain.Segment{{Index: 0, Duration: 6}, {Index: 1, Duration: 6}}
+
+	out := NewGenerator(fmp4PathGen{}).Variant("media", "720p", domain.StreamVideo, domain.ContainerFMP4, segments, domain.VariantOptions{})
+	if !strings.Contains(out, "#EXT-X-MAP:URI=\"/media/720p/init.mp4\"") {
+		t.Fatalf("expected EXT-X-MAP from PathGenerator: %s", out)
+	}
+	if !strings.Contains(out, "/media/720p/1.m4s") {
+		t.Fatalf("expected fMP4 segment URL from PathGenerator: %s", out)
+	}
+	if !strings.Contains(out, "#EXT-X-VERSION:6") {
+		t.Fatalf("EXT-X-MAP requires version 6: %s", out)
+	}
+
+	fallback := NewGenerator(staticPathGen{}).Variant("media", "720p", domain.StreamVideo, domain.ContainerFMP4, segments, domain.VariantOptions{})
+	if !strings.Contains(fallback, "#EXT-X-MAP:URI=\"/media/video/720p/init.mp4\"") {
+		t.Fatalf("expected derived init segment URL: %s", fallback)
+	}
+	if !strings.Contains(fallback, "/media/video/720p/segment-1.m4s") || strings.Contains(fallback, ".ts") {
+		t.Fatalf("expected derived .m4s segment URLs: %s", fallback)
+	}
+
+	ts := NewGenerator(fmp4PathGen{}).Variant("media", "720p", domain.StreamVideo, domain.ContainerTS, segments, domain.VariantOptions{})
+	if strings.Contains(ts, "EXT-X-MAP") || !strings.Contains(ts, "segment-1.ts") {
+		t.Fatalf("TS renditions must use PathGenerator.Segment without a map: %s", ts)
+	}
+}
+
+func TestVideoCodecStringUsesFrameRateForLevel(t *testing.T) {
+	cases := []struct {
+		video domain.VideoRendition
+		want  string
+	}{
+		{domain.VideoRendition{Width: 1920, Height: 1080, FrameRate: 30}, "avc1.640028"},
+		{domain.VideoRendition{Width: 1920, Height: 1080, FrameRate: 60}, "avc1.64002a"},
+		{domain.VideoRendition{Width: 1280, Height: 720, FrameRate: 60}, "avc1.640020"},
+		{domain.VideoRendition{Width: 3840, Height: 2160, FrameRate: 60}, "avc1.640034"},
+		{domain.VideoRendition{Width: 1920, Height: 1080}, "avc1.640028"},
+		{domain.VideoRendition{Codec: domain.VideoCodecVP9, Width: 1920, Height: 1080, FrameRate: 30}, "vp09.00.40.08"},
+		{domain.VideoRendition{Codec: domain.VideoCodecVP9, Width: 1920, Height: 1080, FrameRate: 60}, "vp09.00.41.08"},
+		{domain.VideoRendition{Codec: domain.VideoCodecVP9, Width: 3840, Height: 2160, FrameRate: 60}, "vp09.00.51.08"},
+		{domain.VideoRendition{Codec: domain.VideoCodecVP9, Width: 1280, Height: 720}, "vp09.00.31.08"},
+		{domain.VideoRendition{Codec: domain.VideoCodecHEVC, Width: 1920, Height: 1080, FrameRate: 30}, "hvc1.1.6.L120.B0"},
+		{domain.VideoRendition{Codec: domain.VideoCodecHEVC, Width: 1920, Height: 1080, FrameRate: 60}, "hvc1.1.6.L123.B0"},
+		{domain.VideoRendition{Codec: domain.VideoCodecHEVC, Width: 3840, Height: 2160, FrameRate: 60}, "hvc1.1.6.L153.B0"},
+		{domain.VideoRendition{Codec: domain.VideoCodecHEVC, Width: 1280, Height: 720}, "hvc1.1.6.L93.B0"},
+		{domain.VideoRendition{Codec: domain.VideoCodecHEVC, Width: 3840, Height: 2160, FrameRate: 24, BitDepth: 10}, "hvc1.2.4.L150.B0"},
+		{domain.VideoRendition{Width: 1920, Height: 1080, FrameRate: 30, BitDepth: 10}, "avc1.6e0028"},
+	}
+	for _, tc := range cases {
+		if got := videoCodecString(tc.video); got != tc.want {
+			t.Fatalf("%dx%d@%v: expected %s, got %s", tc.video.Width, tc.video.Height, tc.video.FrameRate, tc.want, got)
+		}
+	}
+}
+
+func TestGenerator_MasterOmitsUnknownResolution(t *testing.T) {
+	gen := NewGenerator(staticPathGen{})
+	videos := []domain.VideoRendition{{Name: "720p", Height: 720, Bitrate: 2_000_000}}
+	audios := []domain.AudioRendition{{Name: "aac_stereo", Codec: "aac", Bitrate: 128000}}
+
+	for _, opts := range []domain.MasterOptions{{}, {Muxed: true}} {
+		out := gen.Master("media", videos, audios, domain.AudioGroupPolicy{}, opts, false)
+		if strings.Contains(out, "RESOLUTION") || !strings.Contains(out, "#EXT-X-STREAM-INF:BANDWIDTH=") {
+			t.Fatalf("expected a variant without RESOLUTION: %s", out)
+		}
+	}
+}
+
+func TestGenerator_MasterWithoutVideoListsAudioVariants(t *testing.T) {
+	gen := NewGenerator(staticPathGen{})
+	audios := []domain.AudioRendition{
+		{Name: "aac_stereo", Codec: "aac", Bitrate: 128000},
+		{Name: "ac3_passthrough", Codec: "ac3", Channels: 6},
+	}
+
+	out := gen.Master("media", nil, audios, domain.AudioGroupPolicy{}, domain.MasterOptions{}, false)
+	want := "#EXT-X-STREAM-INF:BANDWIDTH=128000,CODECS=\"mp4a.40.2\"\n/media/audio/aac_stereo/playlist.m3u8\n" +
+		"#EXT-X-STREAM-INF:BANDWIDTH=640000,CODECS=\"ac-3\"\n/media/audio/ac3_passthrough/playlist.m3u8\n"
+	if !strings.HasSuffix(out, want) || strings.Contains(out, "EXT-X-MEDIA") {
+		t.Fatalf("expected audio-only variants, got %s", out)
+	}
+}
+
+func TestGenerator_MasterSevenOneEAC3Passthrough(t *testing.T) {
+	gen := NewGenerator(staticPathGen{})
+	videos := []domain.VideoRendition{{Name: "1080p", Width: 1920, Height: 1080, Bitrate: 5_000_000}}
+	audios := []domain.AudioRendition{
+		{Name: "aac_stereo", Codec: "aac", Channels: 2, Bitrate: 128_000},
+		{Name: "aac_71", Codec: "aac", Channels: 8, Bitrate: 512_000, ChannelLayout: "7.1"},
+		{Name: "eac3_passthrough", Codec: "eac3", Channels: 8, Bitrate: 1_024_000, Method: domain.DirectStream, ChannelLayout: "7.1"},
+	}
+
+	out := gen.Master("media", videos, audios, domain.AudioGroupPolicy{}, domain.MasterOptions{}, false)
+
+	if !strings.Contains(out, `NAME="eac3_passthrough",DEFAULT=NO,AUTOSELECT=YES,CHANNELS="8",`) {
+		t.Fatalf("expected the passthrough to declare 8 channels: %s", out)
+	}
+	if !strings.Contains(out, `NAME="aac_71",DEFAULT=NO,AUTOSELECT=YES,CHANNELS="8",`) {
+		t.Fatalf("expected the 7.1 AAC tier to declare 8 channels: %s", out)
+	}
+	if !strings.Contains(out, `CODECS="avc1.640028,mp4a.40.2,ec-3"`) {
+		t.Fatalf("expected the passthrough declared as ec-3: %s", out)
+	}
+	if err := Validate(out); err != nil {
+		t.Fatalf("invalid master: %v\n%s", err, out)
+	}
+}
+
+func TestGenerator_MasterMixedCodecLadder(t *testing.T) {
+	gen := NewGenerator(staticPathGen{})
+	videos := []domain.VideoRendition{
+		{Name: "1080p", Width: 1920, Height: 1080, FrameRate: 30, Bitrate: 4_000_000, Codec: domain.VideoCodecHEVC, Container: domain.ContainerFMP4},
+		{Name: "480p", Width: 854, Height: 480, FrameRate: 30, Bitrate: 900_000},
+	}
+	audios := []domain.AudioRendition{{Name: "aac_stereo", Codec: "aac"}}
+
+	out := gen.Master("media", videos, audios, domain.AudioGroupPolicy{}, domain.MasterOptions{}, false)
+	if !strings.Contains(out, `CODECS="hvc1.1.6.L120.B0,mp4a.40.2"`) || !strings.Contains(out, `CODECS="avc1.64001f,mp4a.40.2"`) {
+		t.Fatalf("expected per-variant video codecs: %s", out)
+	}
+}
+
+func TestGenerator_MasterMuxedUsesDefaultAudio(t *testing.T) {
+	gen := NewGenerator(staticPathGen{})
+	videos := []domain.VideoRendition{
+		{Name: "1080p", Width: 1920, Height: 1080, Bitrate: 5_000_000},
+		{Name: "720p", Width: 1280, Height: 720, Bitrate: 2_000_000},
+	}
+	audios := []domain.AudioRendition{
+		{Name: "ac3_passthrough", Codec: "ac3", Channels: 6, Bitrate: 640_000},
+		{Name: "aac_stereo", Codec: "aac", Channels: 2, Bitrate: 128_000},
+	}
+
+	out := gen.Master("media", videos, audios, domain.AudioGroupPolicy{}, domain.MasterOptions{Muxed: true}, false)
+	if strings.Contains(out, "#EXT-X-MEDIA") {
+		t.Fatalf("muxed master must not declare audio groups: %s", out)
+	}
+	if strings.Count(out, "#EXT-X-STREAM-INF") != 2 {
+		t.Fatalf("expected one variant per video rendition: %s", out)
+	}
+	if !strings.Contains(out, "BANDWIDTH=2128000,RESOLUTION=1280x720,CODECS=\"avc1.64001f,mp4a.40.2\"\n") {
+		t.Fatalf("expected audio counted in BANDWIDTH and CODECS: %s", out)
+	}
+	if !strings.Contains(out, "720p+aac_stereo") || strings.Contains(out, "ac3_passthrough") {
+		t.Fatalf("expected the default audio muxed into each variant: %s", out)
+	}
+
+	out = gen.Master("media", videos, nil, domain.AudioGroupPolicy{}, domain.MasterOptions{Muxed: true}, false)
+	if strings.Contains(out, "+") {
+		t.Fatalf("without audio the plain renditions are listed: %s", out)
+	}
+}
+
+func TestGenerator_MasterIndependentSegments(t *testing.T) {
+	gen := NewGenerator(staticPathGen{})
+	videos := []domain.VideoRendition{{Name: "720p", Width: 1280, Height: 720, Bitrate: 2_000_000}}
+
+	out := gen.Master("media", videos, nil, domain.AudioGroupPolicy{}, domain.MasterOptions{}, true)
+	if !strings.Contains(out, "#EXT-X-VERSION:4\n#EXT-X-INDEPENDENT-SEGMENTS\n") {
+		t.Fatalf("expected EXT-X-INDEPENDENT-SEGMENTS after the version: %s", out)
+	}
+
+	out = gen.Master("media", videos, nil, domain.AudioGroupPolicy{}, domain.MasterOptions{}, false)
+	if strings.Contains(out, "INDEPENDENT-SEGMENTS") {
+		t.Fatalf("tag must be omitted unless claimed: %s", out)
+	}
+}
+
+func TestGenerator_VersionFollowsFeatures(t *testing.T) {
+	gen := NewGenerator(fmp4PathGen{})
+	ts := []domain.VideoRendition{{Name: "720p", Width: 1280, Height: 720, Bitrate: 2_000_000}}
+	fmp4 := []domain.VideoRendition{{Name: "720p", Width: 1280, Height: 720, Bitrate: 2_000_000, Container: domain.ContainerFMP4}}
+	audios := []domain.AudioRendition{{Name: "aac_stereo", Codec: "aac", Channels: 2}}
+	fmp4Audios := []domain.AudioRendition{{Name: "aac_stereo", Codec: "aac", Channels: 2, Container: domain.ContainerFMP4}}
+
+	masters := []struct {
+		name   string
+		videos []domain.VideoRendition
+		audios []domain.AudioRendition
+		want   string
+	}{
+		{"ts with audio groups", ts, audios, "#EXT-X-VERSION:4\n"},
+		{"fmp4 video", fmp4, audios, "#EXT-X-VERSION:6\n"},
+		{"fmp4 audio", ts, fmp4Audios, "#EXT-X-VERSION:6\n"},
+	}
+	for _, tc := range masters {
+		out := gen.Master("media", tc.videos, tc.audios, domain.AudioGroupPolicy{}, domain.MasterOptions{}, false)
+		if !strings.Contains(out, tc.want) {
+			t.Fatalf("%s: expected %q: %s", tc.name, tc.want, out)
+		}
+	}
+
+	gap := []domain.Segment{{Index: 0, Duration: 6, Gap: true}}
+	out := gen.Variant("media", "720p", domain.StreamVideo, domain.ContainerFMP4, gap, domain.VariantOptions{})
+	if !strings.Contains(out, "#EXT-X-VERSION:8\n") {
+		t.Fatalf("gaps in an fMP4 playlist need version 8: %s", out)
+	}
+}
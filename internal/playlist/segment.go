@@ -1,6 +1,11 @@
 package playlist
 
-import "github.com/eleven-am/goshl/internal/domain"
+import (
+	"math"
+	"sort"
+
+	"github.com/eleven-am/goshl/internal/domain"
+)
 
 func CalculateSegments(keyframes []float64, duration float64, targetDuration float64) []domain.Segment {
 	if len(keyframes) == 0 {
@@ -37,3 +42,111 @@ func CalculateSegments(keyframes []float64, duration float64, targetDuration flo
 
 	return segments
 }
+
+// SegmentAt returns the index of the segment of a layout that contains at,
+// the one with Start <= at < End. Times before the first segment give the
+// first and times at or past the end give the last. It returns -1 for an
+// empty layout.
+func SegmentAt(segments []domain.Segment, at float64) int {
+	if len(segments) == 0 {
+		return -1
+	}
+	i := sort.Search(len(segments), func(i int) bool { return segments[i].End > at })
+	return segments[min(i, len(segments)-1)].Index
+}
+
+// minUniformTail is the shortest final segment UniformSegments keeps on its
+// own, about two AAC frames at 48 kHz.
+const minUniformTail = 0.05
+
+// UniformSegments cuts [0, duration] into segments of exactly targetDuration
+// seconds. It is used for audio renditions, where every frame is a sync point
+// so cuts need not follow video keyframes. A remainder shorter than
+// minUniformTail is folded into the segment before it.
+func UniformSegments(duration float64, targetDuration float64) []domain.Segment {
+	if duration <= 0 || targetDuration <= 0 {
+		return nil
+	}
+
+	count := int(math.Ceil(duration/targetDuration - 1e-9))
+	if count > 1 && duration-float64(count-1)*targetDuration < minUniformTail {
+		count--
+	}
+
+	segments := make([]domain.Segment, count)
+	for i := range segments {
+		start := float64(i) * targetDuration
+		end := start + targetDuration
+		if i == count-1 {
+			end = duration
+		}
+		segments[i] = domain.Segment{
+			Index:    i,
+			Start:    start,
+			End:      end,
+			Duration: end - start,
+		}
+	}
+	return segments
+}
+
+// MergeShortTail folds a final segment shorter than one frame at frameRate
+// into the segment before it. Such a sliver holds no complete frame, so
+// ffmpeg never produces it and advertising it would stall players. A
+// non-positive frameRate leaves segments unchanged.
+func MergeShortTail(segments []domain.Segment, frameRate float64) []domain.Segment {
+	if frameRate <= 0 || len(segments) < 2 {
+		return segments
+	}
+
+	last := segments[len(segments)-1]
+	if last.Duration >= 1/frameRate {
+		return segments
+	}
+
+	segments = segments[:len(segments)-1]
+	prev := &segments[len(segments)-1]
+	prev.End = last.End
+	prev.Duration = prev.End - prev.Start
+	return segments
+}
+
+// Layout cuts a source's segments at target: on a fixed grid when uniform,
+// as for audio with AudioTargetDuration, and otherwise at the video
+// keyframes with any sub-frame tail folded away. Playlists and transcode jobs
+// both cut segments here, so an index refers to the same source range in
+// each.
+func Layout(meta *domain.Metadata, target float64, uniform bool) []domain.Segment {
+	if uniform {
+		return UniformSegments(meta.Duration, target)
+	}
+	return MergeShortTail(CalculateSegments(meta.Keyframes, meta.Duration, target), meta.Video.FrameRate)
+}
+
+// IndependentSegments reports whether every segment of the given video
+// renditions can be decoded on its own. Transcoded renditions are keyed at
+// each segment boundary. Direct-stream renditions are cut at the source's own
+// keyframes, which only qualifies when the keyframe index is regular: present,
+// starting at the beginning, and never more than twice targetDuration apart.
+// Longer gaps usually mean the source's keyframe flags mark open-GOP recovery
+// points rather than clean entry points.
+func IndependentSegments(videos []domain.VideoRendition, keyframes []float64, targetDuration float64) bool {
+	for _, video := range videos {
+		if video.Method == domain.DirectStream && !regularKeyframes(keyframes, targetDuration) {
+			return false
+		}
+	}
+	return true
+}
+
+func regularKeyframes(keyframes []float64, targetDuration float64) bool {
+	if len(keyframes) == 0 || keyframes[0] > targetDuration {
+		return false
+	}
+	for i := 1; i < len(keyframes); i++ {
+		if keyframes[i]-keyframes[i-1] > 2*targetDuration {
+			return false
+		}
+	}
+	return true
+}
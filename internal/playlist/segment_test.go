@@ -55,3 +55,77 @@ func almostEqual(a, b float64) bool {
 	const eps = 1e-9
 	return math.Abs(a-b) <= eps
 }
+
+func TestMergeShortTail_FoldsSubFrameSliver(t *testing.T) {
+	segments := CalculateSegments([]float64{0, 6, 12}, 12.01, 6)
+	if len(segments) != 3 {
+		t.Fatalf("expected a trailing sliver before merging, got %#v", segments)
+	}
+
+	merged := MergeShortTail(segments, 30)
+	if len(merged) != 2 || merged[1].End != 12.01 || math.Abs(merged[1].Duration-6.01) > 1e-9 {
+		t.Fatalf("expected sliver folded into previous segment, got %#v", merged)
+	}
+
+	if got := MergeShortTail(CalculateSegments([]float64{0, 6, 12}, 12.5, 6), 30); len(got) != 3 {
+		t.Fatalf("segments of at least one frame must be kept, got %#v", got)
+	}
+	if got := MergeShortTail(segments, 0); len(got) != 3 {
+		t.Fatalf("unknown frame rate must leave segments unchanged, got %#v", got)
+	}
+}
+
+func TestUniformSegments_FixedGridWithShortRemainderFolded(t *testing.T) {
+	segments := UniformSegments(5, 2)
+	if len(segments) != 3 || segments[2].Start != 4 || segments[2].End != 5 || segments[2].Duration != 1 {
+		t.Fatalf("expected 2s grid with a 1s tail, got %#v", segments)
+	}
+
+	segments = UniformSegments(6.01, 2)
+	if len(segments) != 3 || segments[2].End != 6.01 || math.Abs(segments[2].Duration-2.01) > 1e-9 {
+		t.Fatalf("expected a sliver folded into the last segment, got %#v", segments)
+	}
+
+	if got := UniformSegments(6, 2); len(got) != 3 {
+		t.Fatalf("exact multiple must not add an empty segment, got %#v", got)
+	}
+	if got := UniformSegments(0, 2); got != nil {
+		t.Fatalf("expected nil for zero duration, got %#v", got)
+	}
+}
+
+func TestIndependentSegments(t *testing.T) {
+	transcoded := []domain.VideoRendition{{Name: "720p", Method: domain.Transcode}}
+	direct := []domain.VideoRendition{{Name: "1080p", Method: domain.DirectStream}, transcoded[0]}
+	regular := []float64{0, 2, 4, 6.5, 9, 12}
+
+	if !IndependentSegments(transcoded, nil, 6) {
+		t.Fatal("transcoded renditions are keyed at every boundary")
+	}
+	if !IndependentSegments(direct, regular, 6) {
+		t.Fatal("direct stream with regular keyframes should be independent")
+	}
+	if IndependentSegments(direct, []float64{0, 2, 30, 32}, 6) {
+		t.Fatal("a keyframe gap over twice the target must not be claimed independent")
+	}
+	if IndependentSegments(direct, []float64{8, 10, 12}, 6) {
+		t.Fatal("a source without a keyframe near the start must not be claimed independent")
+	}
+	if IndependentSegments(direct, nil, 6) {
+		t.Fatal("a source without keyframes must not be claimed independent")
+	}
+}
+
+func TestSegmentAt(t *testing.T) {
+	segments := CalculateSegments([]float64{0, 1, 2.5, 4.9, 7.1}, 8.0, 2.0)
+
+	cases := map[float64]int{-1: 0, 0: 0, 2.499: 0, 2.5: 1, 4.9: 2, 7.0: 2, 7.1: 3, 8: 3, 100: 3}
+	for at, want := range cases {
+		if got := SegmentAt(segments, at); got != want {
+			t.Fatalf("SegmentAt(%v) = %d, want %d", at, got, want)
+		}
+	}
+	if got := SegmentAt(nil, 1); got != -1 {
+		t.Fatalf("expected -1 for an empty layout, got %d", got)
+	}
+}
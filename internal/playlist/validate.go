@@ -0,0 +1,303 @@
+package playlist
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/eleven-am/goshl/internal/domain"
+)
+
+// Validate checks that m3u8 is a well-formed master or media playlist. It
+// enforces the rules players reject playlists over, not every detail of
+// RFC 8216:
+//
+//   - Every playlist starts with #EXTM3U and declares at most one
+//     EXT-X-VERSION, high enough for the fMP4 and gap tags it uses.
+//   - A master lists at least one EXT-X-STREAM-INF. Each has a positive
+//     BANDWIDTH and a URI line, and any AUDIO group it names is declared by
+//     an EXT-X-MEDIA tag.
+//   - A media playlist has one EXT-X-TARGETDURATION and at most one
+//     EXT-X-MEDIA-SEQUENCE, a non-negative integer set before the first
+//     segment. Every EXTINF is followed by exactly one segment URI. No
+//     EXTINF, rounded to the nearest second, exceeds the target duration,
+//     and a VOD playlist ends with EXT-X-ENDLIST.
+//
+// Errors name the offending line.
+func Validate(m3u8 string) error {
+	return ValidateWith(m3u8, domain.ValidateOptions{})
+}
+
+// ValidateWith is Validate with the optional checks in opts, such as
+// rejecting repeated segment URIs.
+func ValidateWith(m3u8 string, opts domain.ValidateOptions) error {
+	lines := strings.Split(strings.ReplaceAll(m3u8, "\r\n", "\n"), "\n")
+	if len(lines) == 0 || strings.TrimSpace(lines[0]) != "#EXTM3U" {
+		return fmt.Errorf("playlist: line 1: expected #EXTM3U")
+	}
+
+	v := validator{version: -1, sequence: -1, target: -1, opts: opts}
+	for i, raw := range lines[1:] {
+		v.line = i + 2
+		if err := v.next(strings.TrimSpace(raw)); err != nil {
+			return fmt.Errorf("playlist: line %d: %w", v.line, err)
+		}
+	}
+	if err := v.finish(); err != nil {
+		return fmt.Errorf("playlist: %w", err)
+	}
+	return nil
+}
+
+type validator struct {
+	opts    domain.ValidateOptions
+	line    int
+	version int
+
+	// pending is the tag ("EXTINF" or "EXT-X-STREAM-INF") still waiting
+	// for its URI line, and pendingLine where it was.
+	pending     string
+	pendingLine int
+
+	// Master playlist state.
+	variants    int
+	audioGroups map[string]bool
+	usedGroups  map[string]int
+
+	// Media playlist state.
+	target   int
+	sequence int
+	segments int
+	maxRound int
+	vod      bool
+	ended    bool
+	uris     map[string]int
+	used     features
+}
+
+func (v *validator) next(line string) error {
+	if line == "" {
+		return nil
+	}
+	if !strings.HasPrefix(line, "#") {
+		return v.uri(line)
+	}
+	if !strings.HasPrefix(line, "#EXT") {
+		return nil
+	}
+
+	tag, value, _ := strings.Cut(line[1:], ":")
+	// Segment tags such as EXT-X-PROGRAM-DATE-TIME may sit between an
+	// EXTINF and its URI, but nothing may come between an EXT-X-STREAM-INF
+	// and its URI.
+	if v.pending == "EXT-X-STREAM-INF" || v.pending != "" && (tag == "EXTINF" || tag == "EXT-X-STREAM-INF" || tag == "EXT-X-ENDLIST") {
+		v.line = v.pendingLine
+		return fmt.Errorf("%s is not followed by a URI", v.pending)
+	}
+	if tag == "EXTINF" || tag == "EXT-X-STREAM-INF" {
+		v.pending, v.pendingLine = tag, v.line
+	}
+	if isMediaTag(tag) && v.variants > 0 || tag == "EXT-X-STREAM-INF" && v.isMedia() {
+		return fmt.Errorf("%s mixes master and media playlist tags", tag)
+	}
+
+	switch tag {
+	case "EXTM3U":
+		return fmt.Errorf("repeated #EXTM3U")
+	case "EXT-X-VERSION":
+		if v.version != -1 {
+			return fmt.Errorf("repeated EXT-X-VERSION")
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			return fmt.Errorf("invalid EXT-X-VERSION %q", value)
+		}
+		v.version = n
+	case "EXT-X-STREAM-INF":
+		return v.streamInf(value)
+	case "EXT-X-MEDIA":
+		return v.media(value)
+	case "EXT-X-TARGETDURATION":
+		if v.target != -1 {
+			return fmt.Errorf("repeated EXT-X-TARGETDURATION")
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid EXT-X-TARGETDURATION %q", value)
+		}
+		v.target = n
+	case "EXT-X-MEDIA-SEQUENCE":
+		if v.sequence != -1 {
+			return fmt.Errorf("repeated EXT-X-MEDIA-SEQUENCE")
+		}
+		if v.segments > 0 {
+			return fmt.Errorf("EXT-X-MEDIA-SEQUENCE after the first segment")
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid EXT-X-MEDIA-SEQUENCE %q", value)
+		}
+		v.sequence = n
+	case "EXT-X-PLAYLIST-TYPE":
+		if value != "VOD" && value != "EVENT" {
+			return fmt.Errorf("invalid EXT-X-PLAYLIST-TYPE %q", value)
+		}
+		v.vod = value == "VOD"
+	case "EXT-X-MAP":
+		if parseAttributes(value)["URI"] == "" {
+			return fmt.Errorf("EXT-X-MAP without a URI")
+		}
+		v.used.fmp4 = true
+	case "EXT-X-GAP":
+		v.used.gap = true
+	case "EXTINF":
+		if v.ended {
+			return fmt.Errorf("segment after EXT-X-ENDLIST")
+		}
+		duration, _, _ := strings.Cut(value, ",")
+		d, err := strconv.ParseFloat(duration, 64)
+		if err != nil || d < 0 {
+			return fmt.Errorf("invalid EXTINF duration %q", duration)
+		}
+		v.maxRound = max(v.maxRound, int(math.Round(d)))
+	case "EXT-X-ENDLIST":
+		v.ended = true
+	}
+	return nil
+}
+
+func (v *validator) streamInf(value string) error {
+	attrs := parseAttributes(value)
+	bandwidth, err := strconv.Atoi(attrs["BANDWIDTH"])
+	if err != nil || bandwidth <= 0 {
+		return fmt.Errorf("EXT-X-STREAM-INF needs a positive BANDWIDTH, got %q", attrs["BANDWIDTH"])
+	}
+	if res, ok := attrs["RESOLUTION"]; ok {
+		w, h, _ := strings.Cut(res, "x")
+		width, werr := strconv.Atoi(w)
+		height, herr := strconv.Atoi(h)
+		if werr != nil || herr != nil || width <= 0 || height <= 0 {
+			return fmt.Errorf("invalid RESOLUTION %q", res)
+		}
+	}
+	if group, ok := attrs["AUDIO"]; ok {
+		if v.usedGroups == nil {
+			v.usedGroups = make(map[string]int)
+		}
+		if _, seen := v.usedGroups[group]; !seen {
+			v.usedGroups[group] = v.line
+		}
+	}
+	v.variants++
+	return nil
+}
+
+func (v *validator) media(value string) error {
+	attrs := parseAttributes(value)
+	for _, name := range []string{"TYPE", "GROUP-ID", "NAME"} {
+		if attrs[name] == "" {
+			return fmt.Errorf("EXT-X-MEDIA without %s", name)
+		}
+	}
+	if attrs["TYPE"] == "AUDIO" {
+		if v.audioGroups == nil {
+			v.audioGroups = make(map[string]bool)
+		}
+		v.audioGroups[attrs["GROUP-ID"]] = true
+	}
+	return nil
+}
+
+func (v *validator) uri(line string) error {
+	switch v.pending {
+	case "EXTINF":
+		if v.opts.UniqueSegmentURIs {
+			if first, dup := v.uris[line]; dup {
+				return fmt.Errorf("segment URI %q repeats line %d", line, first)
+			}
+			if v.uris == nil {
+				v.uris = make(map[string]int)
+			}
+			v.uris[line] = v.line
+		}
+		v.segments++
+	case "EXT-X-STREAM-INF":
+	default:
+		return fmt.Errorf("URI %q without a preceding EXTINF or EXT-X-STREAM-INF", line)
+	}
+	v.pending = ""
+	return nil
+}
+
+func (v *validator) finish() error {
+	if v.pending != "" {
+		return fmt.Errorf("line %d: %s is not followed by a URI", v.pendingLine, v.pending)
+	}
+
+	if v.variants > 0 {
+		for group, line := range v.usedGroups {
+			if !v.audioGroups[group] {
+				return fmt.Errorf("line %d: AUDIO group %q has no EXT-X-MEDIA", line, group)
+			}
+		}
+		return nil
+	}
+
+	if !v.isMedia() {
+		return fmt.Errorf("no EXT-X-STREAM-INF or EXTINF: neither a master nor a media playlist")
+	}
+	if v.target == -1 {
+		return fmt.Errorf("missing EXT-X-TARGETDURATION")
+	}
+	if v.maxRound > v.target {
+		return fmt.Errorf("EXTINF of %ds exceeds EXT-X-TARGETDURATION %d", v.maxRound, v.target)
+	}
+	if v.vod && !v.ended {
+		return fmt.Errorf("VOD playlist without EXT-X-ENDLIST")
+	}
+	if need := v.used.version(); v.version < need && need > versionBase {
+		return fmt.Errorf("EXT-X-VERSION %d is below %d, which its tags require", max(v.version, 1), need)
+	}
+	return nil
+}
+
+func (v *validator) isMedia() bool {
+	return v.segments > 0 || v.target != -1 || v.pending == "EXTINF"
+}
+
+// isMediaTag reports whether tag only belongs in a media playlist.
+func isMediaTag(tag string) bool {
+	switch tag {
+	case "EXTINF", "EXT-X-TARGETDURATION", "EXT-X-MEDIA-SEQUENCE", "EXT-X-ENDLIST", "EXT-X-MAP", "EXT-X-PLAYLIST-TYPE":
+		return true
+	}
+	return false
+}
+
+// parseAttributes splits an attribute list into names and values, with
+// quotes removed from quoted strings. Commas inside quotes do not split.
+func parseAttributes(list string) map[string]string {
+	attrs := make(map[string]string)
+	for list != "" {
+		name, rest, ok := strings.Cut(list, "=")
+		if !ok {
+			break
+		}
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.Index(rest[1:], `"`)
+			if end < 0 {
+				value, rest = rest[1:], ""
+			} else {
+				value, rest = rest[1:end+1], rest[end+2:]
+			}
+			rest = strings.TrimPrefix(rest, ",")
+		} else {
+			value, rest, _ = strings.Cut(rest, ",")
+		}
+		attrs[strings.TrimSpace(name)] = value
+		list = rest
+	}
+	return attrs
+}
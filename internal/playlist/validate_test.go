@@ -0,0 +1,82 @@
+package playlist
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/eleven-am/goshl/internal/domain"
+)
+
+func TestValidateAcceptsGeneratedPlaylists(t *testing.T) {
+	gen := NewGenerator(fmp4PathGen{})
+	videos := []domain.VideoRendition{
+		{Name: "1080p", Width: 1920, Height: 1080, Bitrate: 5_000_000},
+		{Name: "720p", Width: 1280, Height: 720, Bitrate: 2_500_000, Container: domain.ContainerFMP4},
+	}
+	audios := []domain.AudioRendition{{Name: "aac_stereo", Codec: "aac", Bitrate: 128000}, {Name: "ac3_passthrough", Codec: "ac3", Channels: 6}}
+	segments := []domain.Segment{{Index: 0, Duration: 6.006}, {Index: 1, Duration: 5.5, Gap: true}, {Index: 2, Duration: 2}}
+
+	playlists := map[string]string{
+		"master":       gen.Master("media", videos, audios, domain.AudioGroupPolicy{}, domain.MasterOptions{StartOffset: 30}, true),
+		"muxed master": gen.Master("media", videos, audios, domain.AudioGroupPolicy{}, domain.MasterOptions{Muxed: true}, false),
+		"audio only":   gen.Master("media", nil, audios, domain.AudioGroupPolicy{}, domain.MasterOptions{}, false),
+		"ts variant":   gen.Variant("media", "1080p", domain.StreamVideo, domain.ContainerTS, segments, domain.VariantOptions{ProgramDateTime: time.Unix(0, 0)}),
+		"fmp4 variant": gen.Variant("media", "720p", domain.StreamVideo, domain.ContainerFMP4, segments, domain.VariantOptions{}),
+	}
+	for name, out := range playlists {
+		if err := Validate(out); err != nil {
+			t.Fatalf("%s: %v\n%s", name, err, out)
+		}
+	}
+}
+
+func TestValidateRejectsMalformedPlaylists(t *testing.T) {
+	const media = "#EXTM3U\n#EXT-X-VERSION:4\n#EXT-X-TARGETDURATION:6\n#EXT-X-PLAYLIST-TYPE:VOD\n#EXT-X-MEDIA-SEQUENCE:0\n"
+	const master = "#EXTM3U\n#EXT-X-VERSION:4\n"
+
+	cases := map[string]struct {
+		m3u8 string
+		want string
+	}{
+		"missing header":     {"#EXT-X-VERSION:4\n", "expected #EXTM3U"},
+		"empty":              {"#EXTM3U\n", "neither a master nor a media playlist"},
+		"repeated version":   {master + "#EXT-X-VERSION:4\n", "repeated EXT-X-VERSION"},
+		"no target duration": {"#EXTM3U\n#EXTINF:6.000,\nseg0.ts\n#EXT-X-ENDLIST\n", "missing EXT-X-TARGETDURATION"},
+		"segment too long":   {media + "#EXTINF:6.000,\nseg0.ts\n#EXTINF:6.600,\nseg1.ts\n#EXT-X-ENDLIST\n", "exceeds EXT-X-TARGETDURATION 6"},
+		"extinf without uri": {media + "#EXTINF:6.000,\n#EXTINF:6.000,\nseg1.ts\n#EXT-X-ENDLIST\n", "line 6: EXTINF is not followed by a URI"},
+		"trailing extinf":    {media + "#EXTINF:6.000,\n", "line 6: EXTINF is not followed by a URI"},
+		"uri without extinf": {media + "seg0.ts\n#EXT-X-ENDLIST\n", "without a preceding EXTINF"},
+		"bad duration":       {media + "#EXTINF:six,\nseg0.ts\n#EXT-X-ENDLIST\n", "invalid EXTINF duration"},
+		"late sequence":      {"#EXTM3U\n#EXT-X-TARGETDURATION:6\n#EXTINF:6.000,\nseg0.ts\n#EXT-X-MEDIA-SEQUENCE:1\n", "after the first segment"},
+		"negative sequence":  {"#EXTM3U\n#EXT-X-TARGETDURATION:6\n#EXT-X-MEDIA-SEQUENCE:-1\n", "invalid EXT-X-MEDIA-SEQUENCE"},
+		"repeated sequence":  {media + "#EXT-X-MEDIA-SEQUENCE:3\n", "repeated EXT-X-MEDIA-SEQUENCE"},
+		"vod without end":    {media + "#EXTINF:6.000,\nseg0.ts\n", "without EXT-X-ENDLIST"},
+		"after endlist":      {media + "#EXT-X-ENDLIST\n#EXTINF:6.000,\nseg0.ts\n", "after EXT-X-ENDLIST"},
+		"map needs version":  {media + "#EXT-X-MAP:URI=\"init.mp4\"\n#EXTINF:6.000,\nseg0.m4s\n#EXT-X-ENDLIST\n", "EXT-X-VERSION 4 is below 6"},
+		"no bandwidth":       {master + "#EXT-X-STREAM-INF:RESOLUTION=1280x720\n720p.m3u8\n", "positive BANDWIDTH"},
+		"zero resolution":    {master + "#EXT-X-STREAM-INF:BANDWIDTH=1000,RESOLUTION=0x0\n720p.m3u8\n", `invalid RESOLUTION "0x0"`},
+		"variant without uri": {master + "#EXT-X-STREAM-INF:BANDWIDTH=1000\n#EXT-X-STREAM-INF:BANDWIDTH=2000\n1080p.m3u8\n",
+			"line 3: EXT-X-STREAM-INF is not followed by a URI"},
+		"unknown audio group": {master + "#EXT-X-STREAM-INF:BANDWIDTH=1000,CODECS=\"avc1.64001f,mp4a.40.2\",AUDIO=\"aud\"\n720p.m3u8\n", `AUDIO group "aud" has no EXT-X-MEDIA`},
+		"media without name":  {master + "#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID=\"audio\",URI=\"a.m3u8\"\n", "EXT-X-MEDIA without NAME"},
+		"mixed":               {master + "#EXT-X-STREAM-INF:BANDWIDTH=1000\n720p.m3u8\n#EXTINF:6.000,\nseg0.ts\n", "mixes master and media"},
+	}
+	for name, tc := range cases {
+		err := Validate(tc.m3u8)
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Fatalf("%s: expected error containing %q, got %v", name, tc.want, err)
+		}
+	}
+}
+
+func TestValidateRepeatedSegmentURIsAreOptIn(t *testing.T) {
+	const m3u8 = "#EXTM3U\n#EXT-X-TARGETDURATION:6\n#EXT-X-PLAYLIST-TYPE:VOD\n#EXTINF:6.000,\nseg.ts\n#EXTINF:6.000,\nseg.ts\n#EXT-X-ENDLIST\n"
+	if err := Validate(m3u8); err != nil {
+		t.Fatalf("RFC 8216 allows repeated segment URIs: %v", err)
+	}
+	err := ValidateWith(m3u8, domain.ValidateOptions{UniqueSegmentURIs: true})
+	if err == nil || !strings.Contains(err.Error(), `segment URI "seg.ts" repeats line 5`) {
+		t.Fatalf("expected the repeated URI reported, got %v", err)
+	}
+}
@@ -0,0 +1,50 @@
+package playlist
+
+import "github.com/eleven-am/goshl/internal/domain"
+
+// Protocol versions (RFC 8216, section 7) required by the tags goshl writes.
+const (
+	// versionBase is the floor every playlist declares. Decimal EXTINF
+	// durations need version 3; 4 also covers byte ranges and I-frame
+	// playlists, which is what players have always been given here.
+	versionBase = 4
+
+	// versionMap is needed for EXT-X-MAP in a playlist that is not
+	// EXT-X-I-FRAMES-ONLY, i.e. for fragmented MP4 renditions.
+	versionMap = 6
+
+	// versionGap is needed for EXT-X-GAP.
+	versionGap = 8
+)
+
+// features records which version-dependent tags a playlist uses.
+type features struct {
+	fmp4 bool
+	gap  bool
+}
+
+// version returns the lowest protocol version that allows every feature.
+func (f features) version() int {
+	v := versionBase
+	if f.fmp4 {
+		v = max(v, versionMap)
+	}
+	if f.gap {
+		v = max(v, versionGap)
+	}
+	return v
+}
+
+// masterFeatures returns the features of the media playlists a master
+// playlist lists, so the master never declares a lower version than its
+// renditions.
+func masterFeatures(videos []domain.VideoRendition, audios []domain.AudioRendition) features {
+	var f features
+	for _, video := range videos {
+		f.fmp4 = f.fmp4 || video.Container == domain.ContainerFMP4
+	}
+	for _, audio := range audios {
+		f.fmp4 = f.fmp4 || audio.Container == domain.ContainerFMP4
+	}
+	return f
+}
@@ -4,22 +4,157 @@ import (
 	"bufio"
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
 	"os/exec"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/eleven-am/goshl/internal/domain"
+	"github.com/eleven-am/goshl/internal/source"
 )
 
+// ErrUnknownDuration is returned when neither the container, any stream, nor
+// the keyframe index gives the source a duration.
+var ErrUnknownDuration = errors.New("unknown source duration")
+
+// keyframeEpsilon is the spacing below which two keyframe timestamps are
+// taken to be the same frame.
+const keyframeEpsilon = 1e-6
+
 type Prober struct {
+	// AnalyzeDuration and ProbeSize are passed to ffprobe as -analyzeduration
+	// and -probesize. Zero leaves ffprobe's defaults in place.
+	AnalyzeDuration time.Duration
+	ProbeSize       int64
+
+	// Keyframes selects packet-flag or decoded-frame keyframe detection.
+	Keyframes domain.KeyframeStrategy
+
+	// OpenSource supplies the bytes of "pipe:" sources. Nil rejects them.
+	OpenSource domain.SourceOpener
+
+	// Logger receives corrections made to probed metadata, such as fixed
+	// keyframes or a clamped duration, and the program chosen in a
+	// multi-program source. NewProber sets one that discards them.
+	Logger *slog.Logger
+
 	storage domain.Storage
+	run     func(ctx context.Context, url string) (*domain.Metadata, error)
+
+	mu       sync.Mutex
+	inflight map[string]*probeCall
+
+	// waiting, when set, is called each time a caller starts waiting on a
+	// probe. Tests use it to know every caller has joined.
+	waiting func(sourceURL string)
+}
+
+// probeCall is a single in-flight probe shared by concurrent callers for the
+// same source. waiters counts the callers still waiting on it.
+type probeCall struct {
+	done    chan struct{}
+	cancel  context.CancelFunc
+	waiters int
+	meta    *domain.Metadata
+	err     error
 }
 
 func NewProber(storage domain.Storage) *Prober {
-	return &Prober{storage: storage}
+	p := &Prober{
+		Logger:   slog.New(slog.DiscardHandler),
+		storage:  storage,
+		inflight: make(map[string]*probeCall),
+	}
+	p.run = p.probe
+	return p
+}
+
+// SetProbeFunc makes the prober take metadata from fn instead of running
+// ffprobe, for callers that already hold stream information. Keyframes are
+// normalized and a missing duration is derived from them, as for probed
+// metadata, and the result is cached the same way. Metadata without
+// keyframes cannot be segmented and is rejected.
+func (p *Prober) SetProbeFunc(fn func(ctx context.Context, sourceURL string) (*domain.Metadata, error)) {
+	p.run = func(ctx context.Context, url string) (*domain.Metadata, error) {
+		meta, err := fn(ctx, url)
+		if err != nil {
+			return nil, err
+		}
+		if meta == nil || len(meta.Keyframes) == 0 {
+			return nil, fmt.Errorf("supplied metadata for %s has no keyframes", url)
+		}
+		supplied := *meta
+		return &supplied, p.complete(url, &supplied)
+	}
 }
 
+// Probe returns the metadata for sourceURL, running ffprobe and persisting the
+// result on first use. Cached metadata from an older schema version is probed
+// again and overwritten. Concurrent calls for the same source share one probe.
+// The shared probe is detached from the caller that started it, so each
+// caller only gives up through its own ctx and the others still get the
+// result. Once every caller has given up the probe is cancelled.
 func (p *Prober) Probe(ctx context.Context, sourceURL string) (*domain.Metadata, error) {
+	p.mu.Lock()
+	call, ok := p.inflight[sourceURL]
+	if !ok {
+		runCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+		call = &probeCall{done: make(chan struct{}), cancel: cancel}
+		p.inflight[sourceURL] = call
+		go p.share(runCtx, sourceURL, call)
+	}
+	call.waiters++
+	p.mu.Unlock()
+
+	if p.waiting != nil {
+		p.waiting(sourceURL)
+	}
+	select {
+	case <-call.done:
+		return call.meta, call.err
+	case <-ctx.Done():
+		p.leave(sourceURL, call)
+		return nil, ctx.Err()
+	}
+}
+
+// leave drops a caller that stopped waiting on call, cancelling the probe
+// when it was the last one. The next caller then starts a fresh probe.
+func (p *Prober) leave(sourceURL string, call *probeCall) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	call.waiters--
+	if call.waiters > 0 {
+		return
+	}
+	call.cancel()
+	if p.inflight[sourceURL] == call {
+		delete(p.inflight, sourceURL)
+	}
+}
+
+// share runs the probe every caller of call waits on.
+func (p *Prober) share(ctx context.Context, sourceURL string, call *probeCall) {
+	call.meta, call.err = p.load(ctx, sourceURL)
+	call.cancel()
+
+	p.mu.Lock()
+	if p.inflight[sourceURL] == call {
+		delete(p.inflight, sourceURL)
+	}
+	p.mu.Unlock()
+	close(call.done)
+}
+
+func (p *Prober) load(ctx context.Context, sourceURL string) (*domain.Metadata, error) {
 	exists, err := p.storage.MetadataExists(ctx, sourceURL)
 	if err != nil {
 		return nil, err
@@ -33,13 +168,16 @@ func (p *Prober) Probe(ctx context.Context, sourceURL string) (*domain.Metadata,
 		if err := json.Unmarshal(data, &meta); err != nil {
 			return nil, err
 		}
-		return &meta, nil
+		if !meta.Stale() {
+			return &meta, nil
+		}
 	}
 
-	metadata, err := p.probe(ctx, sourceURL)
+	metadata, err := p.run(ctx, sourceURL)
 	if err != nil {
 		return nil, err
 	}
+	metadata.SchemaVersion = domain.MetadataSchemaVersion
 
 	data, err := json.Marshal(metadata)
 	if err != nil {
@@ -53,37 +191,129 @@ func (p *Prober) Probe(ctx context.Context, sourceURL string) (*domain.Metadata,
 	return metadata, nil
 }
 
+// RawProbe returns ffprobe's unparsed JSON description of sourceURL, with
+// format, stream, chapter and program sections, running ffprobe and caching
+// the output on first use when storage implements RawProbeStore. It is
+// independent of the parsed metadata.
+func (p *Prober) RawProbe(ctx context.Context, sourceURL string) ([]byte, error) {
+	cache, cached := p.storage.(domain.RawProbeStore)
+	if cached {
+		exists, err := cache.RawProbeExists(ctx, sourceURL)
+		if err != nil {
+			return nil, fmt.Errorf("check raw probe: %w", err)
+		}
+		if exists {
+			return cache.ReadRawProbe(ctx, sourceURL)
+		}
+	}
+
+	args := append([]string{"-v", "error"}, p.inputArgs()...)
+	args = append(args,
+		"-show_format",
+		"-show_streams",
+		"-show_chapters",
+		"-show_programs",
+		"-of", "json",
+		"-i", sourceURL,
+	)
+	cmd := exec.CommandContext(ctx, "ffprobe", args...)
+	input, err := source.Attach(ctx, cmd, p.OpenSource, sourceURL)
+	if err != nil {
+		return nil, err
+	}
+	defer input.Close()
+
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("ffprobe: %w", err)
+	}
+
+	if !cached {
+		return output, nil
+	}
+	if err := cache.WriteRawProbe(ctx, sourceURL, output); err != nil {
+		return nil, fmt.Errorf("write raw probe: %w", err)
+	}
+	return output, nil
+}
+
 func (p *Prober) probe(ctx context.Context, url string) (*domain.Metadata, error) {
 	streams, err := p.probeStreams(ctx, url)
 	if err != nil {
 		return nil, err
 	}
 
-	keyframes, err := p.probeKeyframes(ctx, url)
+	keyframes, err := p.sidecarKeyframes(ctx, url)
 	if err != nil {
 		return nil, err
 	}
+	if keyframes == nil {
+		keyframes, err = p.probeKeyframes(ctx, url, streams.Program)
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	streams.Keyframes = keyframes
+	if err := p.complete(url, streams); err != nil {
+		return nil, err
+	}
 	return streams, nil
 }
 
+// complete normalizes the keyframes of meta and derives a missing duration
+// from them. It returns ErrUnknownDuration if there is still none. A duration
+// past the end of the video stream is clamped to it, so that audio which runs
+// longer than the picture does not add segments video has no frames for.
+func (p *Prober) complete(url string, meta *domain.Metadata) error {
+	keyframes, fixed := normalizeKeyframes(meta.Keyframes)
+	if fixed > 0 {
+		p.Logger.Warn("fixed out-of-order, duplicate or invalid keyframes", "source", url, "fixed", fixed)
+	}
+	meta.Keyframes = keyframes
+
+	if meta.Duration <= 0 && len(keyframes) > 0 {
+		meta.Duration = keyframes[len(keyframes)-1]
+	}
+	if meta.Duration <= 0 {
+		return ErrUnknownDuration
+	}
+	if video := meta.Video.Duration; video > 0 && video < meta.Duration {
+		p.Logger.Info("clamping the duration to the end of the video stream", "source", url, "video", video, "duration", meta.Duration)
+		meta.Duration = video
+	}
+	return nil
+}
+
 type ffprobeOutput struct {
-	Streams []ffprobeStream `json:"streams"`
-	Format  ffprobeFormat   `json:"format"`
+	Streams  []ffprobeStream  `json:"streams"`
+	Programs []ffprobeProgram `json:"programs"`
+	Format   ffprobeFormat    `json:"format"`
+}
+
+type ffprobeProgram struct {
+	ProgramID int               `json:"program_id"`
+	Tags      map[string]string `json:"tags"`
+	Streams   []struct {
+		Index int `json:"index"`
+	} `json:"streams"`
 }
 
 type ffprobeStream struct {
-	Index       int               `json:"index"`
-	CodecName   string            `json:"codec_name"`
-	CodecType   string            `json:"codec_type"`
-	Width       int               `json:"width"`
-	Height      int               `json:"height"`
-	RFrameRate  string            `json:"r_frame_rate"`
-	Channels    int               `json:"channels"`
-	BitRate     string            `json:"bit_rate"`
-	Tags        map[string]string `json:"tags"`
-	Disposition ffprobeDisp       `json:"disposition"`
+	Index         int               `json:"index"`
+	CodecName     string            `json:"codec_name"`
+	CodecType     string            `json:"codec_type"`
+	Width         int               `json:"width"`
+	Height        int               `json:"height"`
+	RFrameRate    string            `json:"r_frame_rate"`
+	AvgFrameRate  string            `json:"avg_frame_rate"`
+	PixFmt        string            `json:"pix_fmt"`
+	Channels      int               `json:"channels"`
+	ChannelLayout string            `json:"channel_layout"`
+	BitRate       string            `json:"bit_rate"`
+	Duration      string            `json:"duration"`
+	Tags          map[string]string `json:"tags"`
+	Disposition   ffprobeDisp       `json:"disposition"`
 }
 
 type ffprobeFormat struct {
@@ -91,17 +321,25 @@ type ffprobeFormat struct {
 }
 
 type ffprobeDisp struct {
-	Forced int `json:"forced"`
+	Default int `json:"default"`
+	Forced  int `json:"forced"`
 }
 
 func (p *Prober) probeStreams(ctx context.Context, url string) (*domain.Metadata, error) {
-	cmd := exec.CommandContext(ctx, "ffprobe",
-		"-v", "error",
+	args := append([]string{"-v", "error"}, p.inputArgs()...)
+	args = append(args,
 		"-show_format",
 		"-show_streams",
+		"-show_programs",
 		"-of", "json",
-		url,
+		"-i", url,
 	)
+	cmd := exec.CommandContext(ctx, "ffprobe", args...)
+	input, err := source.Attach(ctx, cmd, p.OpenSource, url)
+	if err != nil {
+		return nil, err
+	}
+	defer input.Close()
 
 	output, err := cmd.Output()
 	if err != nil {
@@ -117,19 +355,34 @@ func (p *Prober) probeStreams(ctx context.Context, url string) (*domain.Metadata
 
 	if dur, err := strconv.ParseFloat(ff.Format.Duration, 64); err == nil {
 		metadata.Duration = dur
+	} else {
+		metadata.Duration = streamDuration(ff.Streams)
+	}
+
+	inProgram := selectProgram(metadata, ff)
+	if metadata.Program != 0 {
+		p.Logger.Info("using the first program with video", "source", url, "programs", len(metadata.Programs), "program", metadata.Program)
 	}
 
 	for _, s := range ff.Streams {
+		if (s.CodecType == "video" || s.CodecType == "audio") && !inProgram(s.Index) {
+			continue
+		}
 		switch s.CodecType {
 		case "video":
 			if metadata.Video.Index == 0 && metadata.Video.Codec == "" {
+				frameRate, vfr := videoFrameRate(s.RFrameRate, s.AvgFrameRate)
 				metadata.Video = domain.VideoStream{
 					Index:     s.Index,
 					Codec:     s.CodecName,
 					Width:     s.Width,
 					Height:    s.Height,
 					Bitrate:   parseBitrate(s.Tags["BPS"]),
-					FrameRate: parseFrameRate(s.RFrameRate),
+					FrameRate: frameRate,
+					VFR:       vfr,
+					Duration:  s.duration(),
+
+					PixelFormat: s.PixFmt,
 				}
 			}
 		case "audio":
@@ -139,13 +392,19 @@ func (p *Prober) probeStreams(ctx context.Context, url string) (*domain.Metadata
 				Language: s.Tags["language"],
 				Channels: s.Channels,
 				Bitrate:  parseBitrate(s.BitRate),
+				Default:  s.Disposition.Default == 1,
+				Duration: s.duration(),
+
+				ChannelLayout: s.ChannelLayout,
 			})
 		case "subtitle":
 			metadata.Subtitles = append(metadata.Subtitles, domain.SubtitleStream{
 				Index:    s.Index,
 				Codec:    s.CodecName,
 				Language: s.Tags["language"],
+				Title:    s.Tags["title"],
 				Forced:   s.Disposition.Forced == 1,
+				Default:  s.Disposition.Default == 1,
 			})
 		}
 	}
@@ -153,14 +412,129 @@ func (p *Prober) probeStreams(ctx context.Context, url string) (*domain.Metadata
 	return metadata, nil
 }
 
-func (p *Prober) probeKeyframes(ctx context.Context, url string) ([]float64, error) {
-	cmd := exec.CommandContext(ctx, "ffprobe",
-		"-v", "error",
-		"-select_streams", "v:0",
-		"-show_entries", "packet=pts_time,flags",
-		"-of", "csv=p=0",
-		url,
-	)
+// selectProgram records the source's programs in metadata. When there is
+// more than one, it selects the first program carrying video (or the first
+// program, for radio services) and returns a filter for the streams that
+// belong to it; otherwise the filter accepts every stream.
+func selectProgram(metadata *domain.Metadata, ff ffprobeOutput) func(index int) bool {
+	isVideo := make(map[int]bool)
+	for _, s := range ff.Streams {
+		isVideo[s.Index] = s.CodecType == "video"
+	}
+
+	selected := -1
+	for _, fp := range ff.Programs {
+		program := domain.Program{ID: fp.ProgramID, Name: fp.Tags["service_name"]}
+		hasVideo := false
+		for _, s := range fp.Streams {
+			program.Streams = append(program.Streams, s.Index)
+			hasVideo = hasVideo || isVideo[s.Index]
+		}
+		metadata.Programs = append(metadata.Programs, program)
+		if hasVideo && selected == -1 {
+			selected = len(metadata.Programs) - 1
+		}
+	}
+
+	if len(metadata.Programs) < 2 {
+		return func(int) bool { return true }
+	}
+	if selected == -1 {
+		selected = 0
+	}
+	program := metadata.Programs[selected]
+	metadata.Program = program.ID
+
+	streams := make(map[int]bool, len(program.Streams))
+	for _, index := range program.Streams {
+		streams[index] = true
+	}
+	return func(index int) bool { return streams[index] }
+}
+
+// streamDuration returns the longest stream-level duration. It is used when
+// the container reports no duration.
+func streamDuration(streams []ffprobeStream) float64 {
+	var longest float64
+	for _, s := range streams {
+		longest = max(longest, s.duration())
+	}
+	return longest
+}
+
+// duration returns the stream's duration field, or its Matroska-style
+// DURATION tag ("01:23:45.678000000"), or zero when it has neither.
+func (s ffprobeStream) duration() float64 {
+	if dur, err := strconv.ParseFloat(s.Duration, 64); err == nil {
+		return dur
+	}
+	return parseDurationTag(s.Tags["DURATION"])
+}
+
+func parseDurationTag(tag string) float64 {
+	parts := strings.Split(tag, ":")
+	if len(parts) != 3 {
+		return 0
+	}
+	hours, err1 := strconv.Atoi(parts[0])
+	minutes, err2 := strconv.Atoi(parts[1])
+	seconds, err3 := strconv.ParseFloat(parts[2], 64)
+	if err1 != nil || err2 != nil || err3 != nil {
+		return 0
+	}
+	return float64(hours*3600+minutes*60) + seconds
+}
+
+// sidecarKeyframes returns precomputed keyframes from storage, or nil when no
+// sidecar exists for the source or storage does not implement KeyframeStore.
+func (p *Prober) sidecarKeyframes(ctx context.Context, url string) ([]float64, error) {
+	sidecars, ok := p.storage.(domain.KeyframeStore)
+	if !ok {
+		return nil, nil
+	}
+	exists, err := sidecars.KeyframesExists(ctx, url)
+	if err != nil {
+		return nil, fmt.Errorf("check keyframes sidecar: %w", err)
+	}
+	if !exists {
+		return nil, nil
+	}
+
+	data, err := sidecars.ReadKeyframes(ctx, url)
+	if err != nil {
+		return nil, fmt.Errorf("read keyframes sidecar: %w", err)
+	}
+
+	keyframes := []float64{}
+	if err := json.Unmarshal(data, &keyframes); err != nil {
+		return nil, fmt.Errorf("decode keyframes sidecar: %w", err)
+	}
+	return keyframes, nil
+}
+
+func (p *Prober) probeKeyframes(ctx context.Context, url string, program int) ([]float64, error) {
+	args := append([]string{"-v", "error"}, p.inputArgs()...)
+	video := "v:0"
+	if program != 0 {
+		video = fmt.Sprintf("p:%d:v:0", program)
+	}
+	args = append(args, "-select_streams", video)
+
+	parse := parsePacketKeyframes
+	if p.Keyframes == domain.KeyframesFromFrames {
+		args = append(args, "-skip_frame", "nokey", "-show_entries", "frame=pts_time,pict_type")
+		parse = parseFrameKeyframes
+	} else {
+		args = append(args, "-show_entries", "packet=pts_time,flags")
+	}
+	args = append(args, "-of", "csv=p=0", "-i", url)
+
+	cmd := exec.CommandContext(ctx, "ffprobe", args...)
+	input, err := source.Attach(ctx, cmd, p.OpenSource, url)
+	if err != nil {
+		return nil, err
+	}
+	defer input.Close()
 
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
@@ -171,16 +545,36 @@ func (p *Prober) probeKeyframes(ctx context.Context, url string) ([]float64, err
 		return nil, err
 	}
 
+	keyframes := parse(stdout)
+
+	if err := cmd.Wait(); err != nil {
+		return nil, err
+	}
+
+	return keyframes, nil
+}
+
+// parsePacketKeyframes reads "pts_time,flags" lines and keeps packets whose
+// flags contain K.
+func parsePacketKeyframes(r io.Reader) []float64 {
+	return parseKeyframeCSV(r, func(field string) bool { return strings.Contains(field, "K") })
+}
+
+// parseFrameKeyframes reads "pts_time,pict_type" lines and keeps I frames.
+func parseFrameKeyframes(r io.Reader) []float64 {
+	return parseKeyframeCSV(r, func(field string) bool { return field == "I" })
+}
+
+func parseKeyframeCSV(r io.Reader, isKey func(field string) bool) []float64 {
 	var keyframes []float64
-	scanner := bufio.NewScanner(stdout)
+	scanner := bufio.NewScanner(r)
 
 	for scanner.Scan() {
-		line := scanner.Text()
-		parts := strings.Split(line, ",")
+		parts := strings.Split(strings.TrimSpace(scanner.Text()), ",")
 		if len(parts) < 2 {
 			continue
 		}
-		if !strings.Contains(parts[1], "K") {
+		if !isKey(parts[1]) {
 			continue
 		}
 		pts, err := strconv.ParseFloat(parts[0], 64)
@@ -190,11 +584,48 @@ func (p *Prober) probeKeyframes(ctx context.Context, url string) ([]float64, err
 		keyframes = append(keyframes, pts)
 	}
 
-	if err := cmd.Wait(); err != nil {
-		return nil, err
+	return keyframes
+}
+
+// normalizeKeyframes sorts keyframes, drops duplicates and invalid
+// timestamps, and returns how many entries it moved or dropped. Some TS
+// captures report PTS out of order or twice, which would otherwise produce
+// segments with zero or negative durations.
+func normalizeKeyframes(keyframes []float64) ([]float64, int) {
+	var fixed int
+	cleaned := make([]float64, 0, len(keyframes))
+	for _, pts := range keyframes {
+		if math.IsNaN(pts) || math.IsInf(pts, 0) || pts < 0 {
+			fixed++
+			continue
+		}
+		if n := len(cleaned); n > 0 && pts < cleaned[n-1] {
+			fixed++
+		}
+		cleaned = append(cleaned, pts)
 	}
+	sort.Float64s(cleaned)
 
-	return keyframes, nil
+	out := cleaned[:0]
+	for _, pts := range cleaned {
+		if n := len(out); n > 0 && pts-out[n-1] < keyframeEpsilon {
+			fixed++
+			continue
+		}
+		out = append(out, pts)
+	}
+	return out, fixed
+}
+
+func (p *Prober) inputArgs() []string {
+	var args []string
+	if p.AnalyzeDuration > 0 {
+		args = append(args, "-analyzeduration", strconv.FormatInt(p.AnalyzeDuration.Microseconds(), 10))
+	}
+	if p.ProbeSize > 0 {
+		args = append(args, "-probesize", strconv.FormatInt(p.ProbeSize, 10))
+	}
+	return args
 }
 
 func parseBitrate(s string) int {
@@ -205,6 +636,21 @@ func parseBitrate(s string) int {
 	return v
 }
 
+// videoFrameRate returns the stream's frame rate and whether it is variable.
+// A stream is treated as VFR when its average rate differs from the base rate
+// by more than 1%; its average rate is then the more useful figure.
+func videoFrameRate(rFrameRate, avgFrameRate string) (float64, bool) {
+	r := parseFrameRate(rFrameRate)
+	avg := parseFrameRate(avgFrameRate)
+	if r <= 0 || avg <= 0 {
+		return r, false
+	}
+	if math.Abs(r-avg)/r > 0.01 {
+		return avg, true
+	}
+	return r, false
+}
+
 func parseFrameRate(s string) float64 {
 	parts := strings.Split(s, "/")
 	if len(parts) != 2 {
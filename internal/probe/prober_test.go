@@ -1,11 +1,20 @@
 package probe
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
+	"log/slog"
+	"math"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/eleven-am/goshl/internal/domain"
 )
@@ -13,6 +22,8 @@ import (
 type stubStorage struct {
 	exists    bool
 	metaData  []byte
+	keyframes []byte
+	rawProbe  []byte
 	existsCnt int
 	getCnt    int
 	setCnt    int
@@ -35,6 +46,19 @@ func (s *stubStorage) SetMetadata(ctx context.Context, sourceURL string, data []
 	return nil
 }
 
+func (s *stubStorage) WriteRawProbe(ctx context.Context, sourceURL string, data []byte) error {
+	s.rawProbe = data
+	return nil
+}
+
+func (s *stubStorage) ReadRawProbe(ctx context.Context, sourceURL string) ([]byte, error) {
+	return s.rawProbe, nil
+}
+
+func (s *stubStorage) RawProbeExists(ctx context.Context, sourceURL string) (bool, error) {
+	return s.rawProbe != nil, nil
+}
+
 func (s *stubStorage) WriteSegment(ctx context.Context, info domain.SegmentData, data []byte) error {
 	return nil
 }
@@ -44,6 +68,21 @@ func (s *stubStorage) ReadSegment(ctx context.Context, info domain.SegmentData)
 func (s *stubStorage) SegmentExists(ctx context.Context, info domain.SegmentData) (bool, error) {
 	return false, nil
 }
+func (s *stubStorage) SegmentSize(ctx context.Context, info domain.SegmentData) (int64, error) {
+	return 0, nil
+}
+func (s *stubStorage) WriteSegmentFailure(ctx context.Context, info domain.SegmentData, data []byte) error {
+	return nil
+}
+func (s *stubStorage) ReadSegmentFailure(ctx context.Context, info domain.SegmentData) ([]byte, error) {
+	return nil, nil
+}
+func (s *stubStorage) SegmentFailureExists(ctx context.Context, info domain.SegmentData) (bool, error) {
+	return false, nil
+}
+func (s *stubStorage) DeleteSegmentFailure(ctx context.Context, info domain.SegmentData) error {
+	return nil
+}
 func (s *stubStorage) WriteSprite(ctx context.Context, sourceURL string, index int, data []byte) error {
 	return nil
 }
@@ -71,9 +110,60 @@ func (s *stubStorage) ReadSubtitleVTT(ctx context.Context, sourceURL string, lan
 func (s *stubStorage) SubtitleVTTExists(ctx context.Context, sourceURL string, lang string) (bool, error) {
 	return false, nil
 }
+func (s *stubStorage) WriteIndex(ctx context.Context, sourceURL string, rendition string, streamType domain.StreamType, data []byte) error {
+	return nil
+}
+func (s *stubStorage) ReadIndex(ctx context.Context, sourceURL string, rendition string, streamType domain.StreamType) ([]byte, error) {
+	return nil, nil
+}
+func (s *stubStorage) IndexExists(ctx context.Context, sourceURL string, rendition string, streamType domain.StreamType) (bool, error) {
+	return false, nil
+}
+func (s *stubStorage) ReadKeyframes(ctx context.Context, sourceURL string) ([]byte, error) {
+	return s.keyframes, nil
+}
+func (s *stubStorage) KeyframesExists(ctx context.Context, sourceURL string) (bool, error) {
+	return s.keyframes != nil, nil
+}
+func (s *stubStorage) WriteThumbnail(ctx context.Context, info domain.ThumbnailData, data []byte) error {
+	return nil
+}
+func (s *stubStorage) ReadThumbnail(ctx context.Context, info domain.ThumbnailData) ([]byte, error) {
+	return nil, nil
+}
+func (s *stubStorage) ThumbnailExists(ctx context.Context, info domain.ThumbnailData) (bool, error) {
+	return false, nil
+}
+func (s *stubStorage) WritePoster(ctx context.Context, sourceURL string, data []byte) error {
+	return nil
+}
+func (s *stubStorage) ReadPoster(ctx context.Context, sourceURL string) ([]byte, error) {
+	return nil, nil
+}
+func (s *stubStorage) PosterExists(ctx context.Context, sourceURL string) (bool, error) {
+	return false, nil
+}
+func (s *stubStorage) WriteSubtitleASS(ctx context.Context, sourceURL string, lang string, data []byte) error {
+	return nil
+}
+func (s *stubStorage) ReadSubtitleASS(ctx context.Context, sourceURL string, lang string) ([]byte, error) {
+	return nil, nil
+}
+func (s *stubStorage) SubtitleASSExists(ctx context.Context, sourceURL string, lang string) (bool, error) {
+	return false, nil
+}
+func (s *stubStorage) WriteInitSegment(ctx context.Context, sourceURL string, rendition string, streamType domain.StreamType, data []byte) error {
+	return nil
+}
+func (s *stubStorage) ReadInitSegment(ctx context.Context, sourceURL string, rendition string, streamType domain.StreamType) ([]byte, error) {
+	return nil, nil
+}
+func (s *stubStorage) InitSegmentExists(ctx context.Context, sourceURL string, rendition string, streamType domain.StreamType) (bool, error) {
+	return false, nil
+}
 
 func TestProbe_UsesCacheAndSkipsFFProbe(t *testing.T) {
-	cached := &domain.Metadata{Duration: 5}
+	cached := &domain.Metadata{SchemaVersion: domain.MetadataSchemaVersion, Duration: 5}
 	cachedBytes, _ := json.Marshal(cached)
 	storage := &stubStorage{exists: true, metaData: cachedBytes}
 	p := NewProber(storage)
@@ -90,6 +180,76 @@ func TestProbe_UsesCacheAndSkipsFFProbe(t *testing.T) {
 	}
 }
 
+func TestProbe_SuppliedMetadataSkipsFFProbe(t *testing.T) {
+	storage := &stubStorage{}
+	p := NewProber(storage)
+	var logs bytes.Buffer
+	p.Logger = slog.New(slog.NewTextHandler(&logs, nil))
+	calls := 0
+	p.SetProbeFunc(func(ctx context.Context, url string) (*domain.Metadata, error) {
+		calls++
+		switch url {
+		case "file:///bare":
+			return &domain.Metadata{Duration: 10}, nil
+		case "file:///missing":
+			return nil, errors.New("not in catalog")
+		}
+		return &domain.Metadata{Keyframes: []float64{4, 0, 8, 4}, Video: domain.VideoStream{Codec: "h264", Width: 1920, Height: 1080}}, nil
+	})
+
+	got, err := p.Probe(context.Background(), "file:///movie")
+	if err != nil {
+		t.Fatalf("probe returned error: %v", err)
+	}
+	if !slices.Equal(got.Keyframes, []float64{0, 4, 8}) || got.Duration != 8 || got.SchemaVersion != domain.MetadataSchemaVersion {
+		t.Fatalf("expected normalized keyframes and a derived duration, got %#v", got)
+	}
+	if !strings.Contains(logs.String(), "invalid keyframes") || !strings.Contains(logs.String(), "source=file:///movie") {
+		t.Fatalf("expected the keyframe fix to be logged, got %q", logs.String())
+	}
+	if storage.setCnt != 1 {
+		t.Fatalf("supplied metadata should be cached, got %d writes", storage.setCnt)
+	}
+
+	storage.exists = true
+	if _, err := p.Probe(context.Background(), "file:///movie"); err != nil || calls != 1 {
+		t.Fatalf("cached metadata must not be supplied again: %d calls, %v", calls, err)
+	}
+	storage.exists = false
+
+	if _, err := p.Probe(context.Background(), "file:///bare"); err == nil || !strings.Contains(err.Error(), "no keyframes") {
+		t.Fatalf("expected metadata without keyframes to be rejected, got %v", err)
+	}
+	if _, err := p.Probe(context.Background(), "file:///missing"); err == nil || err.Error() != "not in catalog" {
+		t.Fatalf("expected the supplier's error, got %v", err)
+	}
+}
+
+func TestProbe_ReprobesStaleSchemaVersion(t *testing.T) {
+	stale, _ := json.Marshal(&domain.Metadata{Duration: 5})
+	storage := &stubStorage{exists: true, metaData: stale}
+	p := NewProber(storage)
+	p.run = func(ctx context.Context, url string) (*domain.Metadata, error) {
+		return &domain.Metadata{Duration: 7}, nil
+	}
+
+	got, err := p.Probe(context.Background(), "file:///stale")
+	if err != nil {
+		t.Fatalf("probe returned error: %v", err)
+	}
+	if got.Duration != 7 || got.SchemaVersion != domain.MetadataSchemaVersion {
+		t.Fatalf("expected fresh metadata at the current schema, got %#v", got)
+	}
+	if storage.setCnt != 1 {
+		t.Fatalf("re-probed metadata should overwrite the cache, got %d writes", storage.setCnt)
+	}
+
+	var stored domain.Metadata
+	if err := json.Unmarshal(storage.metaData, &stored); err != nil || stored.SchemaVersion != domain.MetadataSchemaVersion {
+		t.Fatalf("expected stored schema version %d, got %#v (%v)", domain.MetadataSchemaVersion, stored, err)
+	}
+}
+
 func TestProbe_InvokesFFProbeAndPersistsMetadata(t *testing.T) {
 	tmpDir := t.TempDir()
 	script := filepath.Join(tmpDir, "ffprobe")
@@ -123,14 +283,24 @@ func TestProbe_InvokesFFProbeAndPersistsMetadata(t *testing.T) {
 	if meta.Video.FrameRate < 29.9 || meta.Video.FrameRate > 30.1 {
 		t.Fatalf("expected parsed framerate around 29.97, got %f", meta.Video.FrameRate)
 	}
+	if meta.Video.PixelFormat != "yuv420p10le" {
+		t.Fatalf("expected the pixel format, got %q", meta.Video.PixelFormat)
+	}
 
 	if len(meta.Audios) != 1 {
 		t.Fatalf("expected one audio stream, got %d", len(meta.Audios))
 	}
-	if a := meta.Audios[0]; a.Codec != "ac3" || a.Channels != 6 || a.Bitrate != 640000 || a.Language != "eng" {
+	if a := meta.Audios[0]; a.Codec != "ac3" || a.Channels != 6 || a.Bitrate != 640000 || a.Language != "eng" || !a.Default || a.ChannelLayout != "5.1(side)" {
 		t.Fatalf("unexpected audio: %#v", a)
 	}
 
+	if len(meta.Subtitles) != 1 {
+		t.Fatalf("expected one subtitle stream, got %d", len(meta.Subtitles))
+	}
+	if s := meta.Subtitles[0]; s.Index != 2 || s.Title != "Signs" || !s.Default || !s.Forced {
+		t.Fatalf("unexpected subtitle: %#v", s)
+	}
+
 	if got := len(meta.Keyframes); got != 3 {
 		t.Fatalf("expected 3 keyframes parsed, got %d (%#v)", got, meta.Keyframes)
 	}
@@ -143,6 +313,442 @@ func TestProbe_InvokesFFProbeAndPersistsMetadata(t *testing.T) {
 	}
 }
 
+func TestProbe_ConcurrentCallsShareOneProbe(t *testing.T) {
+	storage := &stubStorage{}
+	p := NewProber(storage)
+
+	var runs atomic.Int32
+	release := make(chan struct{})
+	p.run = func(ctx context.Context, url string) (*domain.Metadata, error) {
+		runs.Add(1)
+		<-release
+		return &domain.Metadata{Duration: 42}, nil
+	}
+
+	const callers = 20
+	var wg sync.WaitGroup
+	results := make([]*domain.Metadata, callers)
+	errs := make([]error, callers)
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], errs[i] = p.Probe(context.Background(), "file:///shared")
+		}(i)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if got := runs.Load(); got != 1 {
+		t.Fatalf("expected ffprobe to run once, ran %d times", got)
+	}
+	if storage.setCnt != 1 {
+		t.Fatalf("expected a single SetMetadata, got %d", storage.setCnt)
+	}
+	for i := 0; i < callers; i++ {
+		if errs[i] != nil || results[i] == nil || results[i].Duration != 42 {
+			t.Fatalf("caller %d got %#v, %v", i, results[i], errs[i])
+		}
+	}
+}
+
+func TestProbe_CancelledCallerDoesNotFailOthers(t *testing.T) {
+	storage := &stubStorage{}
+	p := NewProber(storage)
+
+	joined := make(chan struct{}, 2)
+	p.waiting = func(string) { joined <- struct{}{} }
+	release := make(chan struct{})
+	p.run = func(ctx context.Context, url string) (*domain.Metadata, error) {
+		<-release
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		return &domain.Metadata{Duration: 42}, nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	firstErr := make(chan error, 1)
+	go func() {
+		_, err := p.Probe(ctx, "file:///shared")
+		firstErr <- err
+	}()
+	<-joined
+
+	type result struct {
+		meta *domain.Metadata
+		err  error
+	}
+	second := make(chan result, 1)
+	go func() {
+		meta, err := p.Probe(context.Background(), "file:///shared")
+		second <- result{meta, err}
+	}()
+	<-joined
+
+	cancel()
+	if err := <-firstErr; !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the first caller to give up with its context, got %v", err)
+	}
+	close(release)
+
+	if r := <-second; r.err != nil || r.meta == nil || r.meta.Duration != 42 {
+		t.Fatalf("expected the second caller to get the metadata, got %#v, %v", r.meta, r.err)
+	}
+}
+
+func TestProbe_LastCallerLeavingCancelsProbe(t *testing.T) {
+	storage := &stubStorage{}
+	p := NewProber(storage)
+
+	var runs atomic.Int32
+	cancelled := make(chan struct{})
+	p.run = func(ctx context.Context, url string) (*domain.Metadata, error) {
+		if runs.Add(1) > 1 {
+			return &domain.Metadata{Duration: 42}, nil
+		}
+		<-ctx.Done()
+		close(cancelled)
+		return nil, ctx.Err()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	joined := make(chan struct{}, 1)
+	p.waiting = func(string) { joined <- struct{}{} }
+	errs := make(chan error, 1)
+	go func() {
+		_, err := p.Probe(ctx, "file:///shared")
+		errs <- err
+	}()
+	<-joined
+	cancel()
+	if err := <-errs; !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the caller to give up with its context, got %v", err)
+	}
+
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the probe kept running after its only caller left")
+	}
+
+	p.waiting = nil
+	meta, err := p.Probe(context.Background(), "file:///shared")
+	if err != nil || meta == nil || meta.Duration != 42 || runs.Load() != 2 {
+		t.Fatalf("expected a fresh probe for the next caller, got %#v, %v after %d runs", meta, err, runs.Load())
+	}
+}
+
+func TestProbe_PassesAnalyzeDurationAndProbeSize(t *testing.T) {
+	tmpDir := t.TempDir()
+	argsFile := filepath.Join(tmpDir, "args")
+	script := "#!/bin/sh\necho \"$*\" >> " + argsFile + "\n" + strings.TrimPrefix(ffprobeScript, "#!/bin/sh\n")
+	if err := os.WriteFile(filepath.Join(tmpDir, "ffprobe"), []byte(script), 0755); err != nil {
+		t.Fatalf("failed to write fake ffprobe: %v", err)
+	}
+	t.Setenv("PATH", tmpDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	p := NewProber(&stubStorage{})
+	p.AnalyzeDuration = 20 * time.Second
+	p.ProbeSize = 50_000_000
+	if _, err := p.Probe(context.Background(), "file:///input"); err != nil {
+		t.Fatalf("probe returned error: %v", err)
+	}
+
+	data, err := os.ReadFile(argsFile)
+	if err != nil {
+		t.Fatalf("read recorded args: %v", err)
+	}
+	calls := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(calls) != 2 {
+		t.Fatalf("expected two ffprobe calls, got %q", calls)
+	}
+	for _, call := range calls {
+		if !strings.Contains(call, "-analyzeduration 20000000") || !strings.Contains(call, "-probesize 50000000") {
+			t.Fatalf("missing probe tuning flags: %q", call)
+		}
+	}
+}
+
+func TestProbe_UsesKeyframesSidecar(t *testing.T) {
+	tmpDir := t.TempDir()
+	script := "#!/bin/sh\nif printf \"%s\" \"$*\" | grep -q \"show_entries\"; then\n  echo \"packet scan must be skipped\" >&2\n  exit 1\nfi\n" + strings.TrimPrefix(ffprobeScript, "#!/bin/sh\n")
+	if err := os.WriteFile(filepath.Join(tmpDir, "ffprobe"), []byte(script), 0755); err != nil {
+		t.Fatalf("failed to write fake ffprobe: %v", err)
+	}
+	t.Setenv("PATH", tmpDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	storage := &stubStorage{keyframes: []byte("[0, 2.5, 5]")}
+	meta, err := NewProber(storage).Probe(context.Background(), "file:///input")
+	if err != nil {
+		t.Fatalf("probe returned error: %v", err)
+	}
+	if len(meta.Keyframes) != 3 || meta.Keyframes[1] != 2.5 {
+		t.Fatalf("expected sidecar keyframes, got %#v", meta.Keyframes)
+	}
+	if meta.Video.Codec != "h264" {
+		t.Fatalf("streams should still be probed: %#v", meta.Video)
+	}
+}
+
+func TestProbe_IgnoresSidecarWithoutKeyframeStore(t *testing.T) {
+	tmpDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(tmpDir, "ffprobe"), []byte(ffprobeScript), 0755); err != nil {
+		t.Fatalf("failed to write fake ffprobe: %v", err)
+	}
+	t.Setenv("PATH", tmpDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	storage := &stubStorage{keyframes: []byte("[0, 2.5, 5]")}
+	meta, err := NewProber(struct{ domain.Storage }{storage}).Probe(context.Background(), "file:///input")
+	if err != nil {
+		t.Fatalf("probe returned error: %v", err)
+	}
+	if len(meta.Keyframes) == 3 && meta.Keyframes[1] == 2.5 {
+		t.Fatalf("expected scanned keyframes, got the sidecar's %#v", meta.Keyframes)
+	}
+}
+
+func TestProbe_StoresNormalizedKeyframes(t *testing.T) {
+	tmpDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(tmpDir, "ffprobe"), []byte(ffprobeScript), 0755); err != nil {
+		t.Fatalf("failed to write fake ffprobe: %v", err)
+	}
+	t.Setenv("PATH", tmpDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	storage := &stubStorage{keyframes: []byte("[0, 5, 2.5, 2.5]")}
+	if _, err := NewProber(storage).Probe(context.Background(), "file:///input"); err != nil {
+		t.Fatalf("probe returned error: %v", err)
+	}
+
+	var stored domain.Metadata
+	if err := json.Unmarshal(storage.metaData, &stored); err != nil {
+		t.Fatalf("decode stored metadata: %v", err)
+	}
+	if len(stored.Keyframes) != 3 || stored.Keyframes[1] != 2.5 || stored.Keyframes[2] != 5 {
+		t.Fatalf("expected sorted, deduplicated keyframes to be stored, got %#v", stored.Keyframes)
+	}
+}
+
+func TestProbe_SelectsFirstVideoProgram(t *testing.T) {
+	tmpDir := t.TempDir()
+	calls := filepath.Join(tmpDir, "calls")
+	script := `#!/bin/sh
+echo "$*" >> ` + calls + `
+if printf "%s" "$*" | grep -q "show_entries"; then
+  printf "0.000000,K\n"
+  exit 0
+fi
+cat <<'EOF'
+{"programs":[
+ {"program_id":1,"tags":{"service_name":"Radio"},"streams":[{"index":0}]},
+ {"program_id":2,"tags":{"service_name":"News HD"},"streams":[{"index":1},{"index":2}]},
+ {"program_id":3,"tags":{"service_name":"Sport"},"streams":[{"index":3},{"index":4}]}],
+ "streams":[
+ {"index":0,"codec_name":"mp2","codec_type":"audio","channels":2},
+ {"index":1,"codec_name":"h264","codec_type":"video","width":1920,"height":1080},
+ {"index":2,"codec_name":"ac3","codec_type":"audio","channels":6},
+ {"index":3,"codec_name":"mpeg2video","codec_type":"video","width":720,"height":576},
+ {"index":4,"codec_name":"mp2","codec_type":"audio","channels":2}],
+ "format":{"duration":"60"}}
+EOF
+`
+	if err := os.WriteFile(filepath.Join(tmpDir, "ffprobe"), []byte(script), 0755); err != nil {
+		t.Fatalf("failed to write fake ffprobe: %v", err)
+	}
+	t.Setenv("PATH", tmpDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	var logs bytes.Buffer
+	p := NewProber(&stubStorage{})
+	p.Logger = slog.New(slog.NewTextHandler(&logs, nil))
+	meta, err := p.Probe(context.Background(), "file:///capture.ts")
+	if err != nil {
+		t.Fatalf("probe returned error: %v", err)
+	}
+	if !strings.Contains(logs.String(), "programs=3 program=2") {
+		t.Fatalf("expected the program choice logged, got %q", logs.String())
+	}
+
+	if len(meta.Programs) != 3 || meta.Programs[1].Name != "News HD" || len(meta.Programs[1].Streams) != 2 {
+		t.Fatalf("unexpected programs: %#v", meta.Programs)
+	}
+	if meta.Program != 2 {
+		t.Fatalf("expected the first program with video, got %d", meta.Program)
+	}
+	if meta.Video.Index != 1 || meta.Video.Codec != "h264" {
+		t.Fatalf("expected the selected program's video, got %#v", meta.Video)
+	}
+	if len(meta.Audios) != 1 || meta.Audios[0].Index != 2 {
+		t.Fatalf("expected only the selected program's audio, got %#v", meta.Audios)
+	}
+
+	data, err := os.ReadFile(calls)
+	if err != nil {
+		t.Fatalf("read calls: %v", err)
+	}
+	if !strings.Contains(string(data), "-select_streams p:2:v:0") {
+		t.Fatalf("expected keyframes read from the selected program: %s", data)
+	}
+}
+
+func TestRawProbeCachesFullOutput(t *testing.T) {
+	tmpDir := t.TempDir()
+	script := "#!/bin/sh\nprintf \"%s\" \"$*\" | grep -q show_chapters || exit 1\n" + strings.TrimPrefix(ffprobeScript, "#!/bin/sh\n")
+	if err := os.WriteFile(filepath.Join(tmpDir, "ffprobe"), []byte(script), 0755); err != nil {
+		t.Fatalf("failed to write fake ffprobe: %v", err)
+	}
+	t.Setenv("PATH", tmpDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	storage := &stubStorage{}
+	p := NewProber(storage)
+	raw, err := p.RawProbe(context.Background(), "file:///input")
+	if err != nil {
+		t.Fatalf("raw probe returned error: %v", err)
+	}
+	if !strings.Contains(string(raw), `"channel_layout":"5.1(side)"`) || string(storage.rawProbe) != string(raw) {
+		t.Fatalf("expected the ffprobe output to be returned and cached, got %s", raw)
+	}
+	if storage.setCnt != 0 {
+		t.Fatal("raw probe must not touch parsed metadata")
+	}
+
+	if err := os.WriteFile(filepath.Join(tmpDir, "ffprobe"), []byte("#!/bin/sh\nexit 1\n"), 0755); err != nil {
+		t.Fatalf("failed to replace fake ffprobe: %v", err)
+	}
+	cached, err := p.RawProbe(context.Background(), "file:///input")
+	if err != nil || string(cached) != string(raw) {
+		t.Fatalf("expected cached output, got %s, %v", cached, err)
+	}
+}
+
+func TestRawProbeWithoutStoreIsNotCached(t *testing.T) {
+	tmpDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(tmpDir, "ffprobe"), []byte(ffprobeScript), 0755); err != nil {
+		t.Fatalf("failed to write fake ffprobe: %v", err)
+	}
+	t.Setenv("PATH", tmpDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	storage := &stubStorage{}
+	p := NewProber(struct{ domain.Storage }{storage})
+	raw, err := p.RawProbe(context.Background(), "file:///input")
+	if err != nil || len(raw) == 0 {
+		t.Fatalf("expected ffprobe output, got %s, %v", raw, err)
+	}
+	if storage.rawProbe != nil {
+		t.Fatal("raw probe must not be cached without a RawProbeStore")
+	}
+}
+
+func TestVideoFrameRateDetectsVFR(t *testing.T) {
+	if fps, vfr := videoFrameRate("30000/1001", "30000/1001"); vfr || fps < 29.9 || fps > 30 {
+		t.Fatalf("expected CFR 29.97, got %v %v", fps, vfr)
+	}
+	if fps, vfr := videoFrameRate("60/1", "2997/125"); !vfr || fps < 23.9 || fps > 24 {
+		t.Fatalf("expected VFR at the average rate, got %v %v", fps, vfr)
+	}
+	if _, vfr := videoFrameRate("25/1", "0/0"); vfr {
+		t.Fatalf("missing average rate must not flag VFR")
+	}
+}
+
+const packetKeyframesFixture = `0.000000,K__
+0.041708,___
+0.083417,___
+2.002000,K__
+N/A,K__
+2.043708,___
+4.004000,K_D
+`
+
+// outOfOrderKeyframesFixture mimics a TS capture whose packets arrive with
+// repeated and reordered PTS.
+const outOfOrderKeyframesFixture = `0.000000,K__
+2.002000,K__
+2.002000,K__
+6.006000,K__
+4.004000,K__
+-0.500000,K__
+8.008000,K__
+`
+
+const frameKeyframesFixture = `0.000000,I
+2.002000,I
+3.003000,P
+4.004000,I
+N/A,I
+`
+
+func TestParsePacketKeyframes(t *testing.T) {
+	got := parsePacketKeyframes(strings.NewReader(packetKeyframesFixture))
+	want := []float64{0, 2.002, 4.004}
+	if len(got) != len(want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("expected %v, got %v", want, got)
+		}
+	}
+}
+
+func TestNormalizeKeyframesFixesOutOfOrderCapture(t *testing.T) {
+	got, fixed := normalizeKeyframes(parsePacketKeyframes(strings.NewReader(outOfOrderKeyframesFixture)))
+	want := []float64{0, 2.002, 4.004, 6.006, 8.008}
+	if len(got) != len(want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("expected %v, got %v", want, got)
+		}
+	}
+	if fixed != 3 {
+		t.Fatalf("expected 3 fixed keyframes (duplicate, reordered, negative), got %d", fixed)
+	}
+
+	if _, fixed := normalizeKeyframes(want); fixed != 0 {
+		t.Fatalf("clean keyframes reported %d fixes", fixed)
+	}
+}
+
+func TestParseFrameKeyframes(t *testing.T) {
+	got := parseFrameKeyframes(strings.NewReader(frameKeyframesFixture))
+	want := []float64{0, 2.002, 4.004}
+	if len(got) != len(want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("expected %v, got %v", want, got)
+		}
+	}
+}
+
+func TestProbe_FrameKeyframeStrategy(t *testing.T) {
+	tmpDir := t.TempDir()
+	script := `#!/bin/sh
+if printf "%s" "$*" | grep -q "frame=pts_time,pict_type"; then
+  printf "0.000000,I\n5.000000,I\n"
+  exit 0
+fi
+` + strings.TrimPrefix(ffprobeScript, "#!/bin/sh\n")
+	if err := os.WriteFile(filepath.Join(tmpDir, "ffprobe"), []byte(script), 0755); err != nil {
+		t.Fatalf("failed to write fake ffprobe: %v", err)
+	}
+	t.Setenv("PATH", tmpDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	p := NewProber(&stubStorage{})
+	p.Keyframes = domain.KeyframesFromFrames
+	meta, err := p.Probe(context.Background(), "file:///input")
+	if err != nil {
+		t.Fatalf("probe returned error: %v", err)
+	}
+	if len(meta.Keyframes) != 2 || meta.Keyframes[1] != 5 {
+		t.Fatalf("expected frame-based keyframes, got %#v", meta.Keyframes)
+	}
+}
+
 const ffprobeScript = `#!/bin/sh
 if printf "%s" "$*" | grep -q "show_entries"; then
   cat <<'EOF'
@@ -156,7 +762,7 @@ fi
 
 if printf "%s" "$*" | grep -q "show_format"; then
   cat <<'EOF'
-{"streams":[{"index":0,"codec_name":"h264","codec_type":"video","width":1920,"height":1080,"r_frame_rate":"30000/1001","tags":{"BPS":"6000000"}},{"index":1,"codec_name":"ac3","codec_type":"audio","channels":6,"bit_rate":"640000","tags":{"language":"eng"}}],"format":{"duration":"12.5"}}
+{"streams":[{"index":0,"codec_name":"h264","codec_type":"video","width":1920,"height":1080,"r_frame_rate":"30000/1001","pix_fmt":"yuv420p10le","tags":{"BPS":"6000000"}},{"index":1,"codec_name":"ac3","codec_type":"audio","channels":6,"channel_layout":"5.1(side)","bit_rate":"640000","tags":{"language":"eng"},"disposition":{"default":1}},{"index":2,"codec_name":"subrip","codec_type":"subtitle","tags":{"language":"eng","title":"Signs"},"disposition":{"default":1,"forced":1}}],"format":{"duration":"12.5"}}
 EOF
   exit 0
 fi
@@ -164,3 +770,89 @@ fi
 echo "unexpected args: $*" >&2
 exit 1
 `
+
+func TestProbe_DurationFallbacks(t *testing.T) {
+	cases := []struct {
+		name      string
+		streams   string
+		keyframes string
+		want      float64
+	}{
+		{"stream duration", `{"index":0,"codec_name":"h264","codec_type":"video","duration":"12.400000"}`, "0.000000,K\n", 12.4},
+		{"duration tag", `{"index":0,"codec_name":"h264","codec_type":"video","tags":{"DURATION":"00:01:10.500000000"}}`, "0.000000,K\n", 70.5},
+		{"last keyframe", `{"index":0,"codec_name":"h264","codec_type":"video"}`, "0.000000,K\n3.000000,K\n6.200000,K\n", 6.2},
+		{"unknown", `{"index":0,"codec_name":"h264","codec_type":"video"}`, "", 0},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			tmpDir := t.TempDir()
+			script := "#!/bin/sh\nif printf \"%s\" \"$*\" | grep -q show_entries; then printf '" + tc.keyframes + "'; exit 0; fi\n" +
+				"echo '{\"streams\":[" + tc.streams + "],\"format\":{\"duration\":\"N/A\"}}'\n"
+			if err := os.WriteFile(filepath.Join(tmpDir, "ffprobe"), []byte(script), 0755); err != nil {
+				t.Fatalf("failed to write fake ffprobe: %v", err)
+			}
+			t.Setenv("PATH", tmpDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+			storage := &stubStorage{}
+			meta, err := NewProber(storage).Probe(context.Background(), "file:///input")
+			if tc.want == 0 {
+				if !errors.Is(err, ErrUnknownDuration) || storage.setCnt != 0 {
+					t.Fatalf("expected ErrUnknownDuration without persisting, got %v (%d sets)", err, storage.setCnt)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("probe returned error: %v", err)
+			}
+			if math.Abs(meta.Duration-tc.want) > 1e-9 {
+				t.Fatalf("expected duration %v, got %v", tc.want, meta.Duration)
+			}
+		})
+	}
+}
+
+func TestProbe_ClampsDurationToVideoStream(t *testing.T) {
+	cases := []struct {
+		name      string
+		format    string
+		audio     string
+		want      float64
+		wantAudio float64
+		clamped   bool
+	}{
+		{"audio runs long", "62.500000", `"duration":"62.500000"`, 60, 62.5, true},
+		{"audio ends early", "60.000000", `"tags":{"DURATION":"00:00:55.250000000"}`, 60, 55.25, false},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			tmpDir := t.TempDir()
+			streams := `{"index":0,"codec_name":"h264","codec_type":"video","duration":"60.000000"},` +
+				`{"index":1,"codec_name":"aac","codec_type":"audio","channels":2,` + tc.audio + `}`
+			script := "#!/bin/sh\nif printf \"%s\" \"$*\" | grep -q show_entries; then printf '0.000000,K\\n6.000000,K\\n'; exit 0; fi\n" +
+				"echo '{\"streams\":[" + streams + "],\"format\":{\"duration\":\"" + tc.format + "\"}}'\n"
+			if err := os.WriteFile(filepath.Join(tmpDir, "ffprobe"), []byte(script), 0755); err != nil {
+				t.Fatalf("failed to write fake ffprobe: %v", err)
+			}
+			t.Setenv("PATH", tmpDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+			var logs bytes.Buffer
+			p := NewProber(&stubStorage{})
+			p.Logger = slog.New(slog.NewTextHandler(&logs, nil))
+			meta, err := p.Probe(context.Background(), "file:///input")
+			if err != nil {
+				t.Fatalf("probe returned error: %v", err)
+			}
+			if logged := strings.Contains(logs.String(), "clamping the duration"); logged != tc.clamped {
+				t.Fatalf("expected the clamp logged only when it happens, got %q", logs.String())
+			}
+			if meta.Duration != tc.want || meta.Video.Duration != 60 {
+				t.Fatalf("expected duration %v from the video stream, got %v (video %v)", tc.want, meta.Duration, meta.Video.Duration)
+			}
+			if len(meta.Audios) != 1 || meta.Audios[0].Duration != tc.wantAudio {
+				t.Fatalf("expected audio duration %v, got %#v", tc.wantAudio, meta.Audios)
+			}
+		})
+	}
+}
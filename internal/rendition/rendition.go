@@ -2,6 +2,9 @@ package rendition
 
 import (
 	"fmt"
+	"math"
+	"strconv"
+	"strings"
 
 	"github.com/eleven-am/goshl/internal/domain"
 )
@@ -21,25 +24,120 @@ var bitrateBounds = map[int]bounds{
 	360:  {min: 300000, max: 1000000},
 }
 
-var directStreamCodecs = map[string]bool{
-	"h264": true,
+// Options tunes ladder generation. The same Options must be used everywhere a
+// ladder is generated for a source so that rendition names resolve consistently.
+type Options struct {
+	// HEAAC adds a low-bitrate HE-AAC stereo rendition. Requires an ffmpeg
+	// build with libfdk_aac.
+	HEAAC bool
+
+	// MaxHeight drops video tiers taller than the cap, so a larger source is
+	// transcoded down to the highest remaining tier instead of being direct
+	// streamed. The smallest tier is always kept. Zero means no cap.
+	MaxHeight int
+
+	// Mode selects height-driven (default) or pixel-budget tier sizing.
+	Mode domain.LadderMode
+
+	// ConstantFrameRate makes every transcoded rendition constant frame
+	// rate, at the source rate or MaxFrameRate, whichever is lower.
+	ConstantFrameRate bool
+
+	// MaxFrameRate caps the constant output rate. It is also used when the
+	// source rate is unknown. Zero means no cap.
+	MaxFrameRate float64
+
+	// DisableDirectStream forces every video rendition to be transcoded.
+	DisableDirectStream bool
+
+	// UpscaleHeights lists ladder tiers (e.g. 720, 1080) that are produced
+	// even when taller than the source. Such renditions are marked Upscaled.
+	// Nil means no upscaling.
+	UpscaleHeights []int
+
+	// VideoCodec is the codec of transcoded renditions. VP9 and HEVC
+	// renditions are packaged as fragmented MP4. Empty means h264.
+	VideoCodec domain.VideoCodec
+
+	// TierCodecs overrides VideoCodec for the transcoded renditions of
+	// single tiers, keyed by nominal height (e.g. 480 for an H.264 fallback
+	// in an HEVC ladder).
+	TierCodecs map[int]domain.VideoCodec
+
+	// DirectStreamCodecs lists the source video codecs (ffprobe names) that
+	// may be direct streamed. Nil means h264 only.
+	DirectStreamCodecs []string
+
+	// Naming selects how video renditions are named. The zero value names
+	// them by tier alone.
+	Naming domain.RenditionNaming
+
+	// AudioTiers replaces the AAC transcode renditions of the audio ladder.
+	// Nil means DefaultAudioTiers.
+	AudioTiers []domain.AudioTier
 }
 
-func GenerateVideo(video domain.VideoStream) []domain.VideoRendition {
+// DefaultAudioTiers is the audio ladder used when Options.AudioTiers is nil:
+// 128 kbps stereo, 384 kbps 5.1 for surround sources and 512 kbps 7.1 for
+// sources with eight or more channels.
+var DefaultAudioTiers = []domain.AudioTier{
+	{Name: "aac_stereo", Bitrate: 128000, Channels: 2},
+	{Name: "aac_surround", Bitrate: 384000, Channels: 6},
+	{Name: "aac_71", Bitrate: 512000, Channels: 8},
+}
+
+var directStreamCodecs = []string{"h264"}
+
+// canDirectStream reports whether a source with the given codec may be copied
+// rather than transcoded.
+func (o Options) canDirectStream(codec string) bool {
+	if o.DisableDirectStream {
+		return false
+	}
+	codecs := o.DirectStreamCodecs
+	if codecs == nil {
+		codecs = directStreamCodecs
+	}
+	for _, c := range codecs {
+		if c == codec {
+			return true
+		}
+	}
+	return false
+}
+
+// GenerateVideo builds the video ladder for a source. A tier matching the
+// source height is direct streamed when opts allow the source codec. Variable
+// frame rate sources are never direct streamed; their renditions are
+// transcoded to a constant rate so segment durations stay predictable. A
+// source whose dimensions could not be probed gets no video renditions.
+func GenerateVideo(video domain.VideoStream, opts Options) []domain.VideoRendition {
+	if video.Width <= 0 || video.Height <= 0 {
+		return nil
+	}
+
 	var renditions []domain.VideoRendition
 
 	srcWidth := video.Width
 	srcHeight := video.Height
 	srcBitrate := video.Bitrate
 	srcPixels := srcWidth * srcHeight
-	srcCodec := video.Codec
 
 	if srcBitrate <= 0 {
 		srcBitrate = estimateBitrate(srcHeight)
 	}
 
-	for _, targetHeight := range targetHeights {
-		if targetHeight > srcHeight {
+	for _, tier := range targetHeights {
+		targetHeight := tier
+		if opts.Mode == domain.LadderByPixels {
+			targetHeight = pixelBudgetHeight(srcWidth, srcHeight, tier)
+		}
+
+		upscaled := targetHeight > srcHeight
+		if upscaled && !containsHeight(opts.UpscaleHeights, tier) {
+			continue
+		}
+		if opts.MaxHeight > 0 && targetHeight > opts.MaxHeight && tier != targetHeights[len(targetHeights)-1] {
 			continue
 		}
 
@@ -49,25 +147,120 @@ func GenerateVideo(video domain.VideoStream) []domain.VideoRendition {
 		ratio := float64(targetPixels) / float64(srcPixels)
 		bitrate := int(float64(srcBitrate) * ratio)
 
-		bitrate = clampBitrate(targetHeight, bitrate)
+		bitrate = clampBitrate(tier, bitrate)
 
 		method := domain.Transcode
-		if directStreamCodecs[srcCodec] && targetHeight == srcHeight {
+		if opts.canDirectStream(video.Codec) && targetHeight == srcHeight && !video.VFR {
 			method = domain.DirectStream
 		}
 
+		frameRate := video.FrameRate
+		cfr := video.VFR
+		if opts.ConstantFrameRate && method == domain.Transcode {
+			cfr = true
+			if opts.MaxFrameRate > 0 && (frameRate <= 0 || frameRate > opts.MaxFrameRate) {
+				frameRate = opts.MaxFrameRate
+			}
+		}
+
+		codec := opts.outputCodec(tier, method, video.Codec)
+		var container domain.Container
+		if codec.NeedsFMP4() {
+			container = domain.ContainerFMP4
+		}
+		var bitDepth int
+		if depth := domain.BitDepth(video.PixelFormat); method == domain.DirectStream && depth > 8 {
+			bitDepth = depth
+		}
+
 		renditions = append(renditions, domain.VideoRendition{
-			Name:    fmt.Sprintf("%dp", targetHeight),
-			Width:   targetWidth,
-			Height:  targetHeight,
-			Bitrate: bitrate,
-			Method:  method,
+			Name:      videoName(tier, bitrate, method, codec, video.Codec, opts.Naming),
+			Width:     targetWidth,
+			Height:    targetHeight,
+			Bitrate:   bitrate,
+			FrameRate: frameRate,
+			Method:    method,
+			Container: container,
+			Codec:     codec,
+			BitDepth:  bitDepth,
+			Upscaled:  upscaled,
+
+			ConstantFrameRate: cfr && frameRate > 0,
 		})
 	}
 
 	return renditions
 }
 
+// outputCodec returns the codec a rendition of tier is encoded in. Empty
+// means h264. Direct streams keep the source codec, which is only recorded
+// when it is HEVC so that its segments are packaged as fMP4.
+func (o Options) outputCodec(tier int, method domain.PlaybackMethod, sourceCodec string) domain.VideoCodec {
+	if method == domain.DirectStream {
+		if sourceCodec == string(domain.VideoCodecHEVC) {
+			return domain.VideoCodecHEVC
+		}
+		return ""
+	}
+	codec := o.VideoCodec
+	if override, ok := o.TierCodecs[tier]; ok {
+		codec = override
+	}
+	if codec == domain.VideoCodecH264 {
+		return ""
+	}
+	return codec
+}
+
+// videoName names a rendition of the given tier according to naming.
+func videoName(tier, bitrate int, method domain.PlaybackMethod, codec domain.VideoCodec, sourceCodec string, naming domain.RenditionNaming) string {
+	name := fmt.Sprintf("%dp", tier)
+	switch naming {
+	case domain.NameWithBitrate:
+		return fmt.Sprintf("%s_%dk", name, bitrate/1000)
+	case domain.NameWithCodec:
+		switch {
+		case method == domain.DirectStream && sourceCodec != "":
+			return name + "_" + sourceCodec
+		case codec != "":
+			return name + "_" + string(codec)
+		default:
+			return name + "_" + string(domain.VideoCodecH264)
+		}
+	}
+	return name
+}
+
+func containsHeight(heights []int, height int) bool {
+	for _, h := range heights {
+		if h == height {
+			return true
+		}
+	}
+	return false
+}
+
+// pixelBudgetHeight returns the even height at which a frame with the source
+// aspect ratio covers the pixel area of a 16:9 frame of tierHeight. Results
+// within 1% of the source height snap to it so the top tier can direct stream.
+func pixelBudgetHeight(srcWidth, srcHeight, tierHeight int) int {
+	if srcWidth <= 0 || srcHeight <= 0 {
+		return tierHeight
+	}
+
+	budget := float64(tierHeight) * float64(tierHeight) * 16 / 9
+	aspectRatio := float64(srcWidth) / float64(srcHeight)
+	height := int(math.Round(math.Sqrt(budget / aspectRatio)))
+
+	if math.Abs(float64(height-srcHeight)) <= float64(srcHeight)/100 {
+		return srcHeight
+	}
+	if height%2 != 0 {
+		height++
+	}
+	return height
+}
+
 func calculateWidth(srcWidth, srcHeight, targetHeight int) int {
 	aspectRatio := float64(srcWidth) / float64(srcHeight)
 	width := int(float64(targetHeight) * aspectRatio)
@@ -106,41 +299,204 @@ func estimateBitrate(height int) int {
 	}
 }
 
+// surroundLayout is the 5.1 layout AAC encodes natively (ffmpeg's "5.1" has
+// back surrounds). Sources in "5.1(side)", 7.1 and similar layouts are
+// remixed to it rather than left to the encoder's default 6-channel layout.
+const surroundLayout = "5.1"
+
 var passthroughCodecs = map[string]bool{
 	"ac3":  true,
 	"eac3": true,
 }
 
-func GenerateAudio(audio domain.AudioStream) []domain.AudioRendition {
+func GenerateAudio(audio domain.AudioStream, opts Options) []domain.AudioRendition {
 	var renditions []domain.AudioRendition
 
-	renditions = append(renditions, domain.AudioRendition{
-		Name:     "aac_stereo",
-		Codec:    "aac",
-		Bitrate:  128000,
-		Channels: 2,
-		Method:   domain.Transcode,
-	})
+	tiers := opts.AudioTiers
+	if tiers == nil {
+		tiers = DefaultAudioTiers
+	}
 
-	if audio.Channels >= 6 {
+	for _, tier := range tiers {
+		if tier.Channels <= 2 {
+			renditions = append(renditions, tierRendition(audio, tier))
+		}
+	}
+
+	if opts.HEAAC {
 		renditions = append(renditions, domain.AudioRendition{
-			Name:     "aac_surround",
+			Name:     "aac_he_stereo",
 			Codec:    "aac",
-			Bitrate:  384000,
-			Channels: 6,
+			Profile:  "aac_he",
+			Bitrate:  48000,
+			Channels: 2,
 			Method:   domain.Transcode,
+			Language: audio.Language,
+			Default:  audio.Default,
+
+			ChannelLayout: "stereo",
 		})
 	}
 
+	channels := sourceChannels(audio)
+	for _, tier := range tiers {
+		if tier.Channels > 2 && channels >= tier.Channels {
+			renditions = append(renditions, tierRendition(audio, tier))
+		}
+	}
+
 	if passthroughCodecs[audio.Codec] {
 		renditions = append(renditions, domain.AudioRendition{
 			Name:     audio.Codec + "_passthrough",
 			Codec:    audio.Codec,
 			Bitrate:  audio.Bitrate,
-			Channels: audio.Channels,
+			Channels: channels,
 			Method:   domain.DirectStream,
+			Language: audio.Language,
+			Default:  audio.Default,
+
+			ChannelLayout: audio.ChannelLayout,
 		})
 	}
 
 	return renditions
 }
+
+// sourceChannels returns the channel count of audio. Where the probed count
+// is missing or smaller than the declared layout, the layout wins.
+func sourceChannels(audio domain.AudioStream) int {
+	return max(audio.Channels, layoutChannels(audio.ChannelLayout))
+}
+
+// namedLayouts gives the channel counts of ffmpeg layouts whose names are not
+// speaker counts.
+var namedLayouts = map[string]int{
+	"mono":          1,
+	"stereo":        2,
+	"downmix":       2,
+	"quad":          4,
+	"hexagonal":     6,
+	"octagonal":     8,
+	"hexadecagonal": 16,
+}
+
+// layoutChannels returns the number of channels in an ffmpeg layout name
+// such as "stereo", "5.1(side)" or "7.1.4", or 0 if it is not recognized.
+func layoutChannels(layout string) int {
+	name, _, _ := strings.Cut(layout, "(")
+	if n, ok := namedLayouts[name]; ok {
+		return n
+	}
+
+	total := 0
+	for part := range strings.SplitSeq(name, ".") {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return 0
+		}
+		total += n
+	}
+	return total
+}
+
+// tierRendition returns the AAC transcode of audio described by tier.
+func tierRendition(audio domain.AudioStream, tier domain.AudioTier) domain.AudioRendition {
+	return domain.AudioRendition{
+		Name:     tier.Name,
+		Codec:    "aac",
+		Bitrate:  tier.Bitrate,
+		Channels: tier.Channels,
+		Method:   domain.Transcode,
+		Language: audio.Language,
+		Default:  audio.Default,
+
+		ChannelLayout: tierLayouts[tier.Channels],
+	}
+}
+
+// tierLayouts maps tier channel counts to the layout they are downmixed to.
+// Other counts keep the encoder's default layout.
+var tierLayouts = map[int]string{
+	1: "mono",
+	2: "stereo",
+	6: surroundLayout,
+	8: "7.1",
+}
+
+// FilterVideo drops renditions outside the client's capabilities. If nothing
+// fits, the rendition nearest the requested bounds is kept so the client still
+// has something to play, preferring one in a codec the client decodes.
+func FilterVideo(videos []domain.VideoRendition, caps domain.ClientCapabilities) []domain.VideoRendition {
+	var decodable []domain.VideoRendition
+	for _, v := range videos {
+		switch {
+		case v.Codec == domain.VideoCodecHEVC && !caps.HEVC:
+		case v.Codec == domain.VideoCodecVP9 && !caps.VP9:
+		default:
+			decodable = append(decodable, v)
+		}
+	}
+	if len(decodable) > 0 {
+		videos = decodable
+	}
+
+	var filtered []domain.VideoRendition
+	for _, v := range videos {
+		if caps.MinHeight > 0 && v.Height < caps.MinHeight {
+			continue
+		}
+		if caps.MaxHeight > 0 && v.Height > caps.MaxHeight {
+			continue
+		}
+		if caps.MaxBitrate > 0 && v.Bitrate > caps.MaxBitrate {
+			continue
+		}
+		filtered = append(filtered, v)
+	}
+
+	if len(filtered) == 0 && len(videos) > 0 {
+		if caps.MinHeight > 0 && videos[0].Height < caps.MinHeight {
+			return videos[:1]
+		}
+		return videos[len(videos)-1:]
+	}
+	return filtered
+}
+
+// Native returns the single rendition closest to the source resolution: the
+// direct-stream rendition if there is one, otherwise the tallest rendition
+// that is not upscaled, otherwise the smallest.
+func Native(videos []domain.VideoRendition) []domain.VideoRendition {
+	for i, v := range videos {
+		if v.Method == domain.DirectStream {
+			return videos[i : i+1]
+		}
+	}
+
+	var native []domain.VideoRendition
+	for i, v := range videos {
+		if !v.Upscaled && (native == nil || v.Height > native[0].Height) {
+			native = videos[i : i+1]
+		}
+	}
+	if native == nil && len(videos) > 0 {
+		native = videos[len(videos)-1:]
+	}
+	return native
+}
+
+// FilterAudio drops passthrough renditions whose codec the client does not
+// declare support for. Transcoded AAC renditions are always kept.
+func FilterAudio(audios []domain.AudioRendition, caps domain.ClientCapabilities) []domain.AudioRendition {
+	var filtered []domain.AudioRendition
+	for _, a := range audios {
+		if a.Codec == "ac3" && !caps.AC3 {
+			continue
+		}
+		if a.Codec == "eac3" && !caps.EAC3 {
+			continue
+		}
+		filtered = append(filtered, a)
+	}
+	return filtered
+}
@@ -1,6 +1,7 @@
 package rendition
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/eleven-am/goshl/internal/domain"
@@ -9,7 +10,7 @@ import (
 func TestGenerateVideo_DirectStreamAndClamping(t *testing.T) {
 	src := domain.VideoStream{Codec: "h264", Width: 1920, Height: 1080, Bitrate: 10_000_000}
 
-	renditions := GenerateVideo(src)
+	renditions := GenerateVideo(src, Options{})
 
 	if len(renditions) == 0 || renditions[0].Name != "1080p" {
 		t.Fatalf("expected first rendition to be 1080p, got %#v", renditions)
@@ -40,10 +41,336 @@ func TestGenerateVideo_DirectStreamAndClamping(t *testing.T) {
 	}
 }
 
+func TestGenerateVideo_MaxHeightCapsLadder(t *testing.T) {
+	src := domain.VideoStream{Codec: "h264", Width: 3840, Height: 2160, Bitrate: 20_000_000}
+
+	renditions := GenerateVideo(src, Options{MaxHeight: 1080})
+	if len(renditions) == 0 || renditions[0].Name != "1080p" {
+		t.Fatalf("expected 1080p at the top of a capped ladder, got %#v", renditions)
+	}
+	for _, r := range renditions {
+		if r.Height > 1080 {
+			t.Fatalf("rendition above cap: %#v", r)
+		}
+		if r.Method == domain.DirectStream {
+			t.Fatalf("capped source must not be direct streamed: %#v", r)
+		}
+	}
+
+	tiny := GenerateVideo(src, Options{MaxHeight: 240})
+	if len(tiny) != 1 || tiny[0].Name != "360p" {
+		t.Fatalf("expected smallest tier to survive a tiny cap, got %#v", tiny)
+	}
+}
+
+func TestGenerateVideo_PixelBudgetModeSizesByArea(t *testing.T) {
+	portrait := GenerateVideo(domain.VideoStream{Codec: "h264", Width: 1080, Height: 1920}, Options{Mode: domain.LadderByPixels})
+	if len(portrait) == 0 || portrait[0].Name != "1080p" || portrait[0].Width != 1080 || portrait[0].Height != 1920 {
+		t.Fatalf("expected portrait 1080p tier at source size, got %#v", portrait)
+	}
+	if portrait[0].Method != domain.DirectStream {
+		t.Fatalf("expected source-sized tier to direct stream, got %s", portrait[0].Method)
+	}
+
+	byHeight := GenerateVideo(domain.VideoStream{Codec: "h264", Width: 1080, Height: 1920}, Options{})
+	if byHeight[0].Name != "1080p" || byHeight[0].Width >= 1080 {
+		t.Fatalf("height mode should keep the under-sized portrait tier, got %#v", byHeight[0])
+	}
+
+	scope := GenerateVideo(domain.VideoStream{Codec: "hevc", Width: 3840, Height: 1606}, Options{Mode: domain.LadderByPixels})
+	var r1080 domain.VideoRendition
+	for _, r := range scope {
+		if r.Name == "1080p" {
+			r1080 = r
+		}
+		if r.Height%2 != 0 || r.Width%2 != 0 {
+			t.Fatalf("dimensions must be even: %#v", r)
+		}
+	}
+	pixels := r1080.Width * r1080.Height
+	if r1080.Name == "" || pixels < 1920*1080*95/100 || pixels > 1920*1080*105/100 {
+		t.Fatalf("expected 1080p tier near a 1920x1080 pixel budget, got %#v", r1080)
+	}
+}
+
+func TestGenerateVideo_VFRSourceIsTranscodedAtConstantRate(t *testing.T) {
+	renditions := GenerateVideo(domain.VideoStream{Codec: "h264", Width: 1280, Height: 720, FrameRate: 29.5, VFR: true}, Options{})
+
+	for _, r := range renditions {
+		if r.Method == domain.DirectStream {
+			t.Fatalf("VFR source must not be direct streamed: %#v", r)
+		}
+		if !r.ConstantFrameRate || r.FrameRate != 29.5 {
+			t.Fatalf("expected constant-rate output at the source average, got %#v", r)
+		}
+	}
+}
+
+func TestGenerateVideo_ConstantFrameRateOption(t *testing.T) {
+	src := domain.VideoStream{Codec: "h264", Width: 1920, Height: 1080, FrameRate: 59.94}
+
+	for _, r := range GenerateVideo(src, Options{ConstantFrameRate: true, MaxFrameRate: 30}) {
+		if r.Method == domain.DirectStream {
+			if r.ConstantFrameRate || r.FrameRate != 59.94 {
+				t.Fatalf("direct stream must keep the source timing: %#v", r)
+			}
+			continue
+		}
+		if !r.ConstantFrameRate || r.FrameRate != 30 {
+			t.Fatalf("expected transcodes capped to constant 30fps, got %#v", r)
+		}
+	}
+
+	for _, r := range GenerateVideo(src, Options{ConstantFrameRate: true}) {
+		if r.Method == domain.Transcode && (!r.ConstantFrameRate || r.FrameRate != 59.94) {
+			t.Fatalf("expected constant source rate without a cap, got %#v", r)
+		}
+	}
+
+	for _, r := range GenerateVideo(src, Options{}) {
+		if r.ConstantFrameRate {
+			t.Fatalf("constant frame rate must be opt-in for CFR sources: %#v", r)
+		}
+	}
+}
+
+func TestGenerateVideo_DirectStreamCanBeDisabledOrAllowlisted(t *testing.T) {
+	h264 := domain.VideoStream{Codec: "h264", Width: 1920, Height: 1080, Bitrate: 5_000_000}
+	hevc := domain.VideoStream{Codec: "hevc", Width: 1920, Height: 1080, Bitrate: 5_000_000}
+
+	countDirect := func(renditions []domain.VideoRendition) int {
+		n := 0
+		for _, r := range renditions {
+			if r.Method == domain.DirectStream {
+				n++
+			}
+		}
+		return n
+	}
+
+	if n := countDirect(GenerateVideo(h264, Options{})); n != 1 {
+		t.Fatalf("expected h264 source to direct stream by default, got %d", n)
+	}
+	if n := countDirect(GenerateVideo(hevc, Options{})); n != 0 {
+		t.Fatalf("expected hevc to be transcoded by default, got %d", n)
+	}
+	if n := countDirect(GenerateVideo(h264, Options{DisableDirectStream: true, DirectStreamCodecs: []string{"h264"}})); n != 0 {
+		t.Fatalf("DisableDirectStream must win over the allowlist, got %d", n)
+	}
+	if n := countDirect(GenerateVideo(hevc, Options{DirectStreamCodecs: []string{"h264", "hevc"}})); n != 1 {
+		t.Fatalf("expected allowlisted hevc to direct stream, got %d", n)
+	}
+	if n := countDirect(GenerateVideo(h264, Options{DirectStreamCodecs: []string{}})); n != 0 {
+		t.Fatalf("empty allowlist must disable direct stream, got %d", n)
+	}
+}
+
+func TestGenerateAudio_CarriesChannelLayouts(t *testing.T) {
+	audios := GenerateAudio(domain.AudioStream{Codec: "eac3", Channels: 6, ChannelLayout: "5.1(side)"}, Options{})
+
+	layouts := make(map[string]string)
+	for _, a := range audios {
+		layouts[a.Name] = a.ChannelLayout
+	}
+	if layouts["aac_stereo"] != "stereo" || layouts["aac_surround"] != "5.1" || layouts["eac3_passthrough"] != "5.1(side)" {
+		t.Fatalf("unexpected layouts: %v", layouts)
+	}
+}
+
+// sevenOneEAC3 is a 7.1 E-AC3 track as ffprobe reports it.
+var sevenOneEAC3 = domain.AudioStream{Index: 1, Codec: "eac3", Language: "eng", Channels: 8, Bitrate: 1_024_000, Default: true, ChannelLayout: "7.1"}
+
+func TestGenerateAudio_SevenOneSource(t *testing.T) {
+	audios := GenerateAudio(sevenOneEAC3, Options{})
+
+	byName := make(map[string]domain.AudioRendition)
+	var names []string
+	for _, a := range audios {
+		byName[a.Name] = a
+		names = append(names, a.Name)
+	}
+	if got := strings.Join(names, ","); got != "aac_stereo,aac_surround,aac_71,eac3_passthrough" {
+		t.Fatalf("unexpected 7.1 ladder: %s", got)
+	}
+	if r := byName["aac_71"]; r.Channels != 8 || r.ChannelLayout != "7.1" || r.Method != domain.Transcode {
+		t.Fatalf("unexpected 7.1 tier: %#v", r)
+	}
+	if r := byName["aac_surround"]; r.Channels != 6 || r.ChannelLayout != "5.1" {
+		t.Fatalf("7.1 must still be downmixed to 5.1 for the surround tier: %#v", r)
+	}
+	pass := byName["eac3_passthrough"]
+	if pass.Codec != "eac3" || pass.Channels != 8 || pass.ChannelLayout != "7.1" || pass.Bitrate != 1_024_000 || pass.Method != domain.DirectStream {
+		t.Fatalf("unexpected passthrough: %#v", pass)
+	}
+
+	fiveOne := GenerateAudio(domain.AudioStream{Codec: "eac3", Channels: 6, ChannelLayout: "5.1(side)"}, Options{})
+	for _, a := range fiveOne {
+		if a.Name == "aac_71" {
+			t.Fatalf("7.1 tier offered for a 5.1 source: %#v", fiveOne)
+		}
+	}
+}
+
+func TestGenerateAudio_PassthroughChannelsFromLayout(t *testing.T) {
+	cases := map[string]struct {
+		audio domain.AudioStream
+		want  int
+	}{
+		"count missing":      {domain.AudioStream{Codec: "eac3", ChannelLayout: "7.1"}, 8},
+		"core count":         {domain.AudioStream{Codec: "eac3", Channels: 6, ChannelLayout: "7.1(wide)"}, 8},
+		"height channels":    {domain.AudioStream{Codec: "eac3", Channels: 6, ChannelLayout: "7.1.4"}, 12},
+		"named layout":       {domain.AudioStream{Codec: "ac3", ChannelLayout: "stereo"}, 2},
+		"unknown layout":     {domain.AudioStream{Codec: "ac3", Channels: 6, ChannelLayout: "unknown"}, 6},
+		"count above layout": {domain.AudioStream{Codec: "ac3", Channels: 6, ChannelLayout: "stereo"}, 6},
+	}
+	for name, tc := range cases {
+		audios := GenerateAudio(tc.audio, Options{})
+		pass := audios[len(audios)-1]
+		if pass.Method != domain.DirectStream || pass.Channels != tc.want {
+			t.Fatalf("%s: expected %d passthrough channels, got %#v", name, tc.want, pass)
+		}
+	}
+}
+
+func TestGenerateVideo_VP9TranscodesUseFMP4(t *testing.T) {
+	src := domain.VideoStream{Codec: "h264", Width: 1920, Height: 1080, Bitrate: 5_000_000}
+
+	for _, r := range GenerateVideo(src, Options{VideoCodec: domain.VideoCodecVP9}) {
+		if r.Method == domain.DirectStream {
+			if r.Codec != "" || r.Container != "" {
+				t.Fatalf("direct stream must stay h264 in TS: %#v", r)
+			}
+			continue
+		}
+		if r.Codec != domain.VideoCodecVP9 || r.Container != domain.ContainerFMP4 {
+			t.Fatalf("expected vp9 fmp4 transcode, got %#v", r)
+		}
+	}
+}
+
+func TestGenerateVideo_TierCodecsMixCodecs(t *testing.T) {
+	src := domain.VideoStream{Codec: "hevc", Width: 1920, Height: 1080, Bitrate: 5_000_000}
+	opts := Options{
+		VideoCodec:         domain.VideoCodecHEVC,
+		TierCodecs:         map[int]domain.VideoCodec{480: domain.VideoCodecH264},
+		DirectStreamCodecs: []string{"hevc"},
+	}
+
+	got := make(map[string]domain.VideoRendition)
+	for _, r := range GenerateVideo(src, opts) {
+		got[r.Name] = r
+	}
+	if r := got["1080p"]; r.Method != domain.DirectStream || r.Codec != domain.VideoCodecHEVC || r.Container != domain.ContainerFMP4 {
+		t.Fatalf("expected direct-streamed hevc in fmp4, got %#v", r)
+	}
+	if r := got["720p"]; r.Codec != domain.VideoCodecHEVC || r.Container != domain.ContainerFMP4 {
+		t.Fatalf("expected hevc fmp4 transcode, got %#v", r)
+	}
+	if r := got["480p"]; r.Codec != "" || r.Container != "" {
+		t.Fatalf("expected h264 ts fallback, got %#v", r)
+	}
+
+	src.PixelFormat = "yuv420p10le"
+	for _, r := range GenerateVideo(src, opts) {
+		want := 0
+		if r.Method == domain.DirectStream {
+			want = 10
+		}
+		if r.BitDepth != want {
+			t.Fatalf("expected bit depth %d for %s, got %#v", want, r.Name, r)
+		}
+	}
+}
+
+func TestBitDepthFromPixelFormat(t *testing.T) {
+	for format, want := range map[string]int{
+		"":            8,
+		"yuv420p":     8,
+		"nv12":        8,
+		"yuv420p10le": 10,
+		"yuv444p12be": 12,
+		"p010le":      10,
+		"gray10le":    10,
+	} {
+		if got := domain.BitDepth(format); got != want {
+			t.Fatalf("%q: expected %d, got %d", format, want, got)
+		}
+	}
+}
+
+func TestGenerateVideo_SkipsUnknownDimensions(t *testing.T) {
+	for _, src := range []domain.VideoStream{
+		{Codec: "h264"},
+		{Codec: "h264", Width: 1920},
+		{Codec: "h264", Height: 1080},
+	} {
+		if got := GenerateVideo(src, Options{UpscaleHeights: []int{720}}); len(got) != 0 {
+			t.Fatalf("expected no renditions for %dx%d, got %#v", src.Width, src.Height, got)
+		}
+	}
+}
+
+func TestGenerateVideo_NamingPolicy(t *testing.T) {
+	src := domain.VideoStream{Codec: "hevc", Width: 1920, Height: 1080, Bitrate: 5_000_000}
+
+	names := func(opts Options) []string {
+		var out []string
+		for _, r := range GenerateVideo(src, opts) {
+			out = append(out, r.Name)
+		}
+		return out
+	}
+
+	if got := names(Options{}); got[0] != "1080p" || got[1] != "720p" {
+		t.Fatalf("default naming must stay height-only, got %v", got)
+	}
+	if got := names(Options{Naming: domain.NameWithBitrate}); got[0] != "1080p_5000k" || got[1] != "720p_2222k" {
+		t.Fatalf("unexpected bitrate names: %v", got)
+	}
+	if got := names(Options{Naming: domain.NameWithCodec, DirectStreamCodecs: []string{"hevc"}}); got[0] != "1080p_hevc" || got[1] != "720p_h264" {
+		t.Fatalf("direct streams must carry the source codec: %v", got)
+	}
+	if got := names(Options{Naming: domain.NameWithCodec, VideoCodec: domain.VideoCodecVP9}); got[0] != "1080p_vp9" {
+		t.Fatalf("transcodes must carry the output codec: %v", got)
+	}
+}
+
+func TestGenerateVideo_UpscalesOnlyConfiguredTiers(t *testing.T) {
+	src := domain.VideoStream{Codec: "h264", Width: 854, Height: 480, Bitrate: 1_500_000}
+
+	if got := GenerateVideo(src, Options{}); len(got) != 2 || got[0].Name != "480p" {
+		t.Fatalf("expected no upscaling by default, got %#v", got)
+	}
+
+	got := GenerateVideo(src, Options{UpscaleHeights: []int{720, 1080}})
+	names := make([]string, len(got))
+	for i, r := range got {
+		names[i] = r.Name
+	}
+	if strings.Join(names, ",") != "1080p,720p,480p,360p" {
+		t.Fatalf("unexpected ladder: %v", names)
+	}
+	for _, r := range got[:2] {
+		if !r.Upscaled || r.Method != domain.Transcode {
+			t.Fatalf("expected upscaled transcode, got %#v", r)
+		}
+		if b := bitrateBounds[r.Height]; r.Bitrate < b.min || r.Bitrate > b.max {
+			t.Fatalf("upscaled bitrate outside tier bounds: %#v", r)
+		}
+	}
+	if got[2].Upscaled || got[2].Method != domain.DirectStream {
+		t.Fatalf("source tier must not be marked upscaled: %#v", got[2])
+	}
+
+	if got := GenerateVideo(src, Options{UpscaleHeights: []int{1080}, MaxHeight: 720}); got[0].Name != "480p" {
+		t.Fatalf("MaxHeight must still cap upscaled tiers, got %#v", got[0])
+	}
+}
+
 func TestGenerateVideo_EstimatesBitrateAndEvenWidth(t *testing.T) {
 	src := domain.VideoStream{Codec: "hevc", Width: 1919, Height: 800, Bitrate: 0}
 
-	renditions := GenerateVideo(src)
+	renditions := GenerateVideo(src, Options{})
 
 	var r720 domain.VideoRendition
 	for _, r := range renditions {
@@ -67,7 +394,7 @@ func TestGenerateVideo_EstimatesBitrateAndEvenWidth(t *testing.T) {
 
 func TestGenerateAudio_IncludesSurroundAndPassthrough(t *testing.T) {
 	audio := domain.AudioStream{Codec: "ac3", Channels: 6, Bitrate: 640_000}
-	renditions := GenerateAudio(audio)
+	renditions := GenerateAudio(audio, Options{})
 
 	if len(renditions) != 3 {
 		t.Fatalf("expected stereo, surround, and passthrough, got %d renditions", len(renditions))
@@ -95,3 +422,155 @@ func TestGenerateAudio_IncludesSurroundAndPassthrough(t *testing.T) {
 		t.Fatalf("unexpected passthrough rendition: %#v", passthrough)
 	}
 }
+
+func TestGenerateAudio_CarriesSourceDefault(t *testing.T) {
+	for _, r := range GenerateAudio(domain.AudioStream{Codec: "ac3", Channels: 6, Default: true}, Options{}) {
+		if !r.Default {
+			t.Fatalf("rendition should inherit source default: %#v", r)
+		}
+	}
+	for _, r := range GenerateAudio(domain.AudioStream{Codec: "ac3", Channels: 6}, Options{}) {
+		if r.Default {
+			t.Fatalf("rendition should not be default: %#v", r)
+		}
+	}
+}
+
+func TestGenerateAudio_HEAACIsOptIn(t *testing.T) {
+	audio := domain.AudioStream{Codec: "aac", Channels: 2, Bitrate: 128_000}
+
+	for _, r := range GenerateAudio(audio, Options{}) {
+		if r.Profile == "aac_he" {
+			t.Fatalf("HE-AAC rendition should not be generated by default: %#v", r)
+		}
+	}
+
+	var he *domain.AudioRendition
+	renditions := GenerateAudio(audio, Options{HEAAC: true})
+	for i := range renditions {
+		if renditions[i].Name == "aac_he_stereo" {
+			he = &renditions[i]
+		}
+	}
+	if he == nil || he.Profile != "aac_he" || he.Channels != 2 || he.Bitrate >= 128_000 {
+		t.Fatalf("unexpected HE-AAC rendition: %#v", he)
+	}
+}
+
+func TestGenerateAudio_CustomTiers(t *testing.T) {
+	opts := Options{HEAAC: true, AudioTiers: []domain.AudioTier{
+		{Name: "aac_stereo_64k", Bitrate: 64_000, Channels: 2},
+		{Name: "aac_71", Bitrate: 512_000, Channels: 8},
+		{Name: "aac_stereo_256k", Bitrate: 256_000, Channels: 2},
+	}}
+
+	names := func(renditions []domain.AudioRendition) string {
+		var out []string
+		for _, r := range renditions {
+			out = append(out, r.Name)
+		}
+		return strings.Join(out, ",")
+	}
+
+	stereo := GenerateAudio(domain.AudioStream{Codec: "aac", Channels: 2}, opts)
+	if got := names(stereo); got != "aac_stereo_64k,aac_stereo_256k,aac_he_stereo" {
+		t.Fatalf("unexpected stereo source ladder: %s", got)
+	}
+	if stereo[0].Bitrate != 64_000 || stereo[0].ChannelLayout != "stereo" || stereo[0].Method != domain.Transcode {
+		t.Fatalf("unexpected 64k tier: %#v", stereo[0])
+	}
+
+	surround := GenerateAudio(domain.AudioStream{Codec: "eac3", Channels: 8}, opts)
+	if got := names(surround); got != "aac_stereo_64k,aac_stereo_256k,aac_he_stereo,aac_71,eac3_passthrough" {
+		t.Fatalf("unexpected 7.1 source ladder: %s", got)
+	}
+	if surround[3].ChannelLayout != "7.1" {
+		t.Fatalf("expected 7.1 layout on the 8 channel tier: %#v", surround[3])
+	}
+}
+
+func TestFilterVideoAppliesCapsAndKeepsSmallestFallback(t *testing.T) {
+	videos := GenerateVideo(domain.VideoStream{Codec: "h264", Width: 1920, Height: 1080, Bitrate: 6_000_000}, Options{})
+
+	capped := FilterVideo(videos, domain.ClientCapabilities{MaxHeight: 720})
+	for _, v := range capped {
+		if v.Height > 720 {
+			t.Fatalf("rendition above cap survived: %#v", v)
+		}
+	}
+	if len(capped) != len(videos)-1 {
+		t.Fatalf("expected only 1080p to be dropped, got %#v", capped)
+	}
+
+	none := FilterVideo(videos, domain.ClientCapabilities{MaxHeight: 100})
+	if len(none) != 1 || none[0].Name != "360p" {
+		t.Fatalf("expected smallest rendition fallback, got %#v", none)
+	}
+}
+
+func TestFilterAudioDropsUnsupportedPassthrough(t *testing.T) {
+	audios := GenerateAudio(domain.AudioStream{Codec: "ac3", Channels: 6, Bitrate: 640_000}, Options{})
+
+	for _, a := range FilterAudio(audios, domain.ClientCapabilities{}) {
+		if a.Codec == "ac3" {
+			t.Fatalf("ac3 passthrough should be dropped without AC3 support")
+		}
+	}
+	if got := FilterAudio(audios, domain.ClientCapabilities{AC3: true}); len(got) != len(audios) {
+		t.Fatalf("expected all renditions with AC3 support, got %#v", got)
+	}
+}
+
+func TestFilterVideoDropsUnsupportedCodecs(t *testing.T) {
+	videos := []domain.VideoRendition{
+		{Name: "original", Height: 1080, Codec: domain.VideoCodecHEVC, Method: domain.DirectStream},
+		{Name: "720p_vp9", Height: 720, Codec: domain.VideoCodecVP9},
+		{Name: "720p", Height: 720},
+		{Name: "480p", Height: 480},
+	}
+
+	got := FilterVideo(videos, domain.ClientCapabilities{})
+	if len(got) != 2 || got[0].Name != "720p" || got[1].Name != "480p" {
+		t.Fatalf("expected only h264 renditions, got %#v", got)
+	}
+
+	got = FilterVideo(videos, domain.ClientCapabilities{HEVC: true})
+	if len(got) != 3 || got[0].Name != "original" {
+		t.Fatalf("expected hevc kept with HEVC support, got %#v", got)
+	}
+
+	hevcOnly := FilterVideo(videos[:1], domain.ClientCapabilities{})
+	if len(hevcOnly) != 1 {
+		t.Fatalf("expected a fallback when no rendition is decodable, got %#v", hevcOnly)
+	}
+}
+
+func TestFilterVideoHonorsMinHeight(t *testing.T) {
+	videos := GenerateVideo(domain.VideoStream{Codec: "h264", Width: 1920, Height: 1080, Bitrate: 6_000_000}, Options{})
+
+	got := FilterVideo(videos, domain.ClientCapabilities{MinHeight: 480, MaxHeight: 720})
+	if len(got) != 2 || got[0].Name != "720p" || got[1].Name != "480p" {
+		t.Fatalf("expected 720p and 480p, got %#v", got)
+	}
+
+	tooHigh := FilterVideo(videos, domain.ClientCapabilities{MinHeight: 2160})
+	if len(tooHigh) != 1 || tooHigh[0].Name != "1080p" {
+		t.Fatalf("expected largest rendition fallback, got %#v", tooHigh)
+	}
+}
+
+func TestNativePicksSourceResolution(t *testing.T) {
+	direct := GenerateVideo(domain.VideoStream{Codec: "h264", Width: 1920, Height: 1080, Bitrate: 6_000_000}, Options{})
+	if got := Native(direct); len(got) != 1 || got[0].Name != "1080p" || got[0].Method != domain.DirectStream {
+		t.Fatalf("expected the direct-stream 1080p rendition, got %#v", got)
+	}
+
+	hevc := GenerateVideo(domain.VideoStream{Codec: "hevc", Width: 1280, Height: 720}, Options{UpscaleHeights: []int{1080}})
+	if got := Native(hevc); len(got) != 1 || got[0].Name != "720p" {
+		t.Fatalf("expected the tallest non-upscaled rendition, got %#v", got)
+	}
+
+	if got := Native(nil); len(got) != 0 {
+		t.Fatalf("expected nothing for an empty ladder, got %#v", got)
+	}
+}
@@ -2,20 +2,39 @@ package segment
 
 import (
 	"context"
+	"crypto/sha256"
 	"fmt"
 
 	"github.com/eleven-am/goshl/internal/domain"
 )
 
 type NotifyingStorage struct {
+	// WritePolicy decides whether a segment that already exists is
+	// overwritten (the default) or kept.
+	WritePolicy domain.SegmentWritePolicy
+
+	// Checksums, if set, receives the SHA-256 of each segment just before
+	// the segment is written. A segment kept by SegmentWriteSkipExisting
+	// keeps its stored checksum.
+	Checksums domain.SegmentChecksummer
+
+	// Failures, if set, has its failure record of a segment deleted once
+	// the segment is written, so earlier failures stop counting against it.
+	Failures domain.SegmentFailureStore
+
 	storage     domain.Storage
 	coordinator domain.Coordinator
+	onReady     func(domain.SegmentData)
 }
 
-func NewNotifyingStorage(storage domain.Storage, coordinator domain.Coordinator) *NotifyingStorage {
+// NewNotifyingStorage wraps storage so segment writes are announced through
+// coordinator. onReady, if non-nil, is invoked asynchronously after each
+// successful write and notification.
+func NewNotifyingStorage(storage domain.Storage, coordinator domain.Coordinator, onReady func(domain.SegmentData)) *NotifyingStorage {
 	return &NotifyingStorage{
 		storage:     storage,
 		coordinator: coordinator,
+		onReady:     onReady,
 	}
 }
 
@@ -32,23 +51,64 @@ func (s *NotifyingStorage) SetMetadata(ctx context.Context, sourceURL string, da
 }
 
 func (s *NotifyingStorage) WriteSegment(ctx context.Context, info domain.SegmentData, data []byte) error {
-	if err := s.storage.WriteSegment(ctx, info, data); err != nil {
-		status := domain.SegmentStatus{
-			State: domain.SegmentStateError,
-			Error: err.Error(),
+	if s.WritePolicy == domain.SegmentWriteSkipExisting {
+		exists, err := s.storage.SegmentExists(ctx, info)
+		if err != nil {
+			return fmt.Errorf("check segment: %w", err)
 		}
-		s.coordinator.NotifySegment(ctx, info, status)
+		if exists {
+			s.clearFailure(ctx, info)
+			status := domain.SegmentStatus{State: domain.SegmentStateReady}
+			if err := s.coordinator.NotifySegment(ctx, info, status); err != nil {
+				return fmt.Errorf("notify segment: %w", err)
+			}
+			return nil
+		}
+	}
+
+	if s.Checksums != nil {
+		sum := sha256.Sum256(data)
+		if err := s.Checksums.WriteSegmentChecksum(ctx, info, sum[:]); err != nil {
+			s.notifyError(ctx, info, err)
+			return fmt.Errorf("write checksum: %w", err)
+		}
+	}
+
+	if err := s.storage.WriteSegment(ctx, info, data); err != nil {
+		s.notifyError(ctx, info, err)
 		return fmt.Errorf("storage write: %w", err)
 	}
+	s.clearFailure(ctx, info)
 
 	status := domain.SegmentStatus{State: domain.SegmentStateReady}
 	if err := s.coordinator.NotifySegment(ctx, info, status); err != nil {
 		return fmt.Errorf("notify segment: %w", err)
 	}
 
+	if s.onReady != nil {
+		go s.onReady(info)
+	}
+
 	return nil
 }
 
+// clearFailure deletes the failure record of a segment that now exists. It is
+// best effort: a record left behind is ignored by playlists once the segment
+// exists, and only counts towards MaxSegmentRetries until the next success.
+func (s *NotifyingStorage) clearFailure(ctx context.Context, info domain.SegmentData) {
+	if s.Failures != nil {
+		s.Failures.DeleteSegmentFailure(ctx, info)
+	}
+}
+
+func (s *NotifyingStorage) notifyError(ctx context.Context, info domain.SegmentData, err error) {
+	status := domain.SegmentStatus{
+		State: domain.SegmentStateError,
+		Error: err.Error(),
+	}
+	s.coordinator.NotifySegment(ctx, info, status)
+}
+
 func (s *NotifyingStorage) ReadSegment(ctx context.Context, info domain.SegmentData) ([]byte, error) {
 	return s.storage.ReadSegment(ctx, info)
 }
@@ -92,3 +152,15 @@ func (s *NotifyingStorage) ReadSubtitleVTT(ctx context.Context, sourceURL string
 func (s *NotifyingStorage) SubtitleVTTExists(ctx context.Context, sourceURL string, lang string) (bool, error) {
 	return s.storage.SubtitleVTTExists(ctx, sourceURL, lang)
 }
+
+func (s *NotifyingStorage) WriteIndex(ctx context.Context, sourceURL string, rendition string, streamType domain.StreamType, data []byte) error {
+	return s.storage.WriteIndex(ctx, sourceURL, rendition, streamType, data)
+}
+
+func (s *NotifyingStorage) ReadIndex(ctx context.Context, sourceURL string, rendition string, streamType domain.StreamType) ([]byte, error) {
+	return s.storage.ReadIndex(ctx, sourceURL, rendition, streamType)
+}
+
+func (s *NotifyingStorage) IndexExists(ctx context.Context, sourceURL string, rendition string, streamType domain.StreamType) (bool, error) {
+	return s.storage.IndexExists(ctx, sourceURL, rendition, streamType)
+}
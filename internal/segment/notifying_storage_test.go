@@ -1,10 +1,13 @@
 package segment
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
 	"errors"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/eleven-am/goshl/internal/domain"
 )
@@ -12,6 +15,7 @@ import (
 type stubStorage struct {
 	err    error
 	writes []domain.SegmentData
+	exists bool
 }
 
 func (s *stubStorage) MetadataExists(ctx context.Context, sourceURL string) (bool, error) {
@@ -23,6 +27,15 @@ func (s *stubStorage) GetMetadata(ctx context.Context, sourceURL string) ([]byte
 func (s *stubStorage) SetMetadata(ctx context.Context, sourceURL string, data []byte) error {
 	return nil
 }
+func (s *stubStorage) WriteRawProbe(ctx context.Context, sourceURL string, data []byte) error {
+	return nil
+}
+func (s *stubStorage) ReadRawProbe(ctx context.Context, sourceURL string) ([]byte, error) {
+	return nil, nil
+}
+func (s *stubStorage) RawProbeExists(ctx context.Context, sourceURL string) (bool, error) {
+	return false, nil
+}
 func (s *stubStorage) WriteSegment(ctx context.Context, info domain.SegmentData, data []byte) error {
 	s.writes = append(s.writes, info)
 	return s.err
@@ -31,7 +44,10 @@ func (s *stubStorage) ReadSegment(ctx context.Context, info domain.SegmentData)
 	return nil, nil
 }
 func (s *stubStorage) SegmentExists(ctx context.Context, info domain.SegmentData) (bool, error) {
-	return false, nil
+	return s.exists, nil
+}
+func (s *stubStorage) SegmentSize(ctx context.Context, info domain.SegmentData) (int64, error) {
+	return 0, nil
 }
 func (s *stubStorage) WriteSprite(ctx context.Context, mediaID string, index int, data []byte) error {
 	return nil
@@ -60,6 +76,57 @@ func (s *stubStorage) ReadSubtitleVTT(ctx context.Context, mediaID string, lang
 func (s *stubStorage) SubtitleVTTExists(ctx context.Context, mediaID string, lang string) (bool, error) {
 	return false, nil
 }
+func (s *stubStorage) WriteIndex(ctx context.Context, sourceURL string, rendition string, streamType domain.StreamType, data []byte) error {
+	return nil
+}
+func (s *stubStorage) ReadIndex(ctx context.Context, sourceURL string, rendition string, streamType domain.StreamType) ([]byte, error) {
+	return nil, nil
+}
+func (s *stubStorage) IndexExists(ctx context.Context, sourceURL string, rendition string, streamType domain.StreamType) (bool, error) {
+	return false, nil
+}
+func (s *stubStorage) ReadKeyframes(ctx context.Context, sourceURL string) ([]byte, error) {
+	return nil, nil
+}
+func (s *stubStorage) KeyframesExists(ctx context.Context, sourceURL string) (bool, error) {
+	return false, nil
+}
+func (s *stubStorage) WriteThumbnail(ctx context.Context, info domain.ThumbnailData, data []byte) error {
+	return nil
+}
+func (s *stubStorage) ReadThumbnail(ctx context.Context, info domain.ThumbnailData) ([]byte, error) {
+	return nil, nil
+}
+func (s *stubStorage) ThumbnailExists(ctx context.Context, info domain.ThumbnailData) (bool, error) {
+	return false, nil
+}
+func (s *stubStorage) WritePoster(ctx context.Context, sourceURL string, data []byte) error {
+	return nil
+}
+func (s *stubStorage) ReadPoster(ctx context.Context, sourceURL string) ([]byte, error) {
+	return nil, nil
+}
+func (s *stubStorage) PosterExists(ctx context.Context, sourceURL string) (bool, error) {
+	return false, nil
+}
+func (s *stubStorage) WriteSubtitleASS(ctx context.Context, sourceURL string, lang string, data []byte) error {
+	return nil
+}
+func (s *stubStorage) ReadSubtitleASS(ctx context.Context, sourceURL string, lang string) ([]byte, error) {
+	return nil, nil
+}
+func (s *stubStorage) SubtitleASSExists(ctx context.Context, sourceURL string, lang string) (bool, error) {
+	return false, nil
+}
+func (s *stubStorage) WriteInitSegment(ctx context.Context, sourceURL string, rendition string, streamType domain.StreamType, data []byte) error {
+	return nil
+}
+func (s *stubStorage) ReadInitSegment(ctx context.Context, sourceURL string, rendition string, streamType domain.StreamType) ([]byte, error) {
+	return nil, nil
+}
+func (s *stubStorage) InitSegmentExists(ctx context.Context, sourceURL string, rendition string, streamType domain.StreamType) (bool, error) {
+	return false, nil
+}
 
 type stubPubSub struct {
 	publishes []struct {
@@ -93,7 +160,7 @@ func (p *stubPubSub) Close() {}
 func TestNotifyingStoragePublishesReadyOnSuccess(t *testing.T) {
 	storage := &stubStorage{}
 	pubsub := &stubPubSub{}
-	n := NewNotifyingStorage(storage, pubsub)
+	n := NewNotifyingStorage(storage, pubsub, nil)
 
 	info := domain.SegmentData{Index: 1, Rendition: "1080p", IsVideo: true}
 	if err := n.WriteSegment(context.Background(), info, []byte("abc")); err != nil {
@@ -115,7 +182,7 @@ func TestNotifyingStoragePublishesReadyOnSuccess(t *testing.T) {
 func TestNotifyingStoragePublishesErrorWhenStorageFails(t *testing.T) {
 	storage := &stubStorage{err: errors.New("boom")}
 	pubsub := &stubPubSub{}
-	n := NewNotifyingStorage(storage, pubsub)
+	n := NewNotifyingStorage(storage, pubsub, nil)
 
 	info := domain.SegmentData{Index: 2, Rendition: "aac", IsVideo: false}
 	err := n.WriteSegment(context.Background(), info, nil)
@@ -135,10 +202,175 @@ func TestNotifyingStoragePublishesErrorWhenStorageFails(t *testing.T) {
 func TestNotifyingStorageReturnsErrorWhenPublishFails(t *testing.T) {
 	storage := &stubStorage{}
 	pubsub := &stubPubSub{err: errors.New("pubsub err")}
-	n := NewNotifyingStorage(storage, pubsub)
+	n := NewNotifyingStorage(storage, pubsub, nil)
 
 	err := n.WriteSegment(context.Background(), domain.SegmentData{}, nil)
 	if err == nil || !strings.Contains(err.Error(), "pubsub") {
 		t.Fatalf("expected publish error, got %v", err)
 	}
 }
+
+func TestNotifyingStorageInvokesOnReadyAfterSuccessfulWrite(t *testing.T) {
+	ready := make(chan domain.SegmentData, 1)
+	n := NewNotifyingStorage(&stubStorage{}, &stubPubSub{}, func(info domain.SegmentData) { ready <- info })
+
+	info := domain.SegmentData{Index: 4, Rendition: "720p", IsVideo: true}
+	if err := n.WriteSegment(context.Background(), info, []byte("abc")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	select {
+	case got := <-ready:
+		if got != info {
+			t.Fatalf("unexpected hook info: %#v", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("OnSegmentReady hook was not invoked")
+	}
+
+	// A failed write publishes its error before returning and must start no
+	// hook: the next hook call is the one for the write that follows it.
+	storage := &stubStorage{err: errors.New("boom")}
+	pubsub := &stubPubSub{}
+	n = NewNotifyingStorage(storage, pubsub, func(info domain.SegmentData) { ready <- info })
+	if err := n.WriteSegment(context.Background(), info, nil); err == nil {
+		t.Fatal("expected the storage error")
+	}
+	if len(pubsub.publishes) != 1 || pubsub.publishes[0].status.State != domain.SegmentStateError {
+		t.Fatalf("expected the error published, got %#v", pubsub.publishes)
+	}
+	storage.err = nil
+	next := domain.SegmentData{Index: 5, Rendition: "720p", IsVideo: true}
+	if err := n.WriteSegment(context.Background(), next, []byte("abc")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	select {
+	case got := <-ready:
+		if got != next {
+			t.Fatalf("hook fired for the failed write: %#v", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("OnSegmentReady hook was not invoked")
+	}
+	select {
+	case got := <-ready:
+		t.Fatalf("hook fired for the failed write: %#v", got)
+	default:
+	}
+}
+
+func TestNotifyingStorageWritePolicy(t *testing.T) {
+	info := domain.SegmentData{Index: 5, Rendition: "720p", IsVideo: true}
+
+	storage := &stubStorage{exists: true}
+	pubsub := &stubPubSub{}
+	n := NewNotifyingStorage(storage, pubsub, nil)
+	if err := n.WriteSegment(context.Background(), info, []byte("abc")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(storage.writes) != 1 {
+		t.Fatalf("expected overwrite by default, got %d writes", len(storage.writes))
+	}
+
+	storage = &stubStorage{exists: true}
+	pubsub = &stubPubSub{}
+	n = NewNotifyingStorage(storage, pubsub, nil)
+	n.WritePolicy = domain.SegmentWriteSkipExisting
+	if err := n.WriteSegment(context.Background(), info, []byte("abc")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(storage.writes) != 0 {
+		t.Fatalf("expected existing segment to be kept, got %d writes", len(storage.writes))
+	}
+	if len(pubsub.publishes) != 1 || pubsub.publishes[0].status.State != domain.SegmentStateReady {
+		t.Fatalf("expected skipped segment to still be announced ready, got %#v", pubsub.publishes)
+	}
+
+	storage.exists = false
+	if err := n.WriteSegment(context.Background(), info, []byte("abc")); err != nil || len(storage.writes) != 1 {
+		t.Fatalf("expected missing segment to be written, got %d writes, %v", len(storage.writes), err)
+	}
+}
+
+type stubChecksums struct {
+	sums map[int][]byte
+}
+
+func (c *stubChecksums) WriteSegmentChecksum(ctx context.Context, info domain.SegmentData, sum []byte) error {
+	if c.sums == nil {
+		c.sums = make(map[int][]byte)
+	}
+	c.sums[info.Index] = sum
+	return nil
+}
+func (c *stubChecksums) ReadSegmentChecksum(ctx context.Context, info domain.SegmentData) ([]byte, error) {
+	return c.sums[info.Index], nil
+}
+
+func TestNotifyingStorageWritesChecksums(t *testing.T) {
+	checksums := &stubChecksums{}
+	storage := &stubStorage{}
+	n := NewNotifyingStorage(storage, &stubPubSub{}, nil)
+	n.Checksums = checksums
+
+	info := domain.SegmentData{Index: 3, Rendition: "720p", IsVideo: true}
+	if err := n.WriteSegment(context.Background(), info, []byte("abc")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := sha256.Sum256([]byte("abc"))
+	if !bytes.Equal(checksums.sums[3], want[:]) {
+		t.Fatalf("expected SHA-256 of the segment, got %x", checksums.sums[3])
+	}
+
+	storage.exists = true
+	n.WritePolicy = domain.SegmentWriteSkipExisting
+	if err := n.WriteSegment(context.Background(), info, []byte("other")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !bytes.Equal(checksums.sums[3], want[:]) {
+		t.Fatalf("kept segment must keep its checksum, got %x", checksums.sums[3])
+	}
+}
+
+type stubFailures struct {
+	deleted []int
+}
+
+func (f *stubFailures) WriteSegmentFailure(ctx context.Context, info domain.SegmentData, data []byte) error {
+	return nil
+}
+func (f *stubFailures) ReadSegmentFailure(ctx context.Context, info domain.SegmentData) ([]byte, error) {
+	return nil, nil
+}
+func (f *stubFailures) SegmentFailureExists(ctx context.Context, info domain.SegmentData) (bool, error) {
+	return false, nil
+}
+func (f *stubFailures) ReadSegmentFailures(ctx context.Context, sourceURL string, rendition string, streamType domain.StreamType) (map[int][]byte, error) {
+	return nil, nil
+}
+func (f *stubFailures) DeleteSegmentFailure(ctx context.Context, info domain.SegmentData) error {
+	f.deleted = append(f.deleted, info.Index)
+	return nil
+}
+
+func TestNotifyingStorageClearsFailureOnWrite(t *testing.T) {
+	failures := &stubFailures{}
+	n := NewNotifyingStorage(&stubStorage{}, &stubPubSub{}, nil)
+	n.Failures = failures
+
+	if err := n.WriteSegment(context.Background(), domain.SegmentData{Index: 4}, []byte("abc")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(failures.deleted) != 1 || failures.deleted[0] != 4 {
+		t.Fatalf("expected the failure record of segment 4 deleted, got %v", failures.deleted)
+	}
+
+	n = NewNotifyingStorage(&stubStorage{err: errors.New("boom")}, &stubPubSub{}, nil)
+	n.Failures = failures
+	if err := n.WriteSegment(context.Background(), domain.SegmentData{Index: 5}, []byte("abc")); err == nil {
+		t.Fatal("expected the storage error")
+	}
+	if len(failures.deleted) != 1 {
+		t.Fatalf("a failed write must keep the failure record, got %v", failures.deleted)
+	}
+}
@@ -0,0 +1,79 @@
+// Package source feeds "pipe:" sources to ffmpeg and ffprobe through stdin.
+package source
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/eleven-am/goshl/internal/domain"
+)
+
+// Scheme prefixes source URLs whose bytes come from a domain.SourceOpener
+// rather than from a location ffmpeg can open itself. Names that ffmpeg's
+// own pipe protocol reads as a file descriptor, such as "pipe:0" or
+// "pipe:1", are rejected.
+const Scheme = "pipe:"
+
+// stdin is the ffmpeg input URL for standard input.
+const stdin = "pipe:0"
+
+// waitDelay bounds how long Wait lingers on a source read that is still
+// blocked after the process has exited.
+const waitDelay = 5 * time.Second
+
+// IsPipe reports whether sourceURL is read through a SourceOpener.
+func IsPipe(sourceURL string) bool {
+	return strings.HasPrefix(sourceURL, Scheme)
+}
+
+type nopCloser struct{}
+
+func (nopCloser) Close() error { return nil }
+
+// Attach prepares cmd, which must not have been started, to read sourceURL.
+// For a pipe source it opens the source with open, connects it to cmd's
+// stdin and replaces each "-i" input naming it with "pipe:0". Other
+// arguments, such as "pipe:1" outputs, are left alone. The returned Closer
+// must be closed once cmd has exited. Other sources are left as they are.
+func Attach(ctx context.Context, cmd *exec.Cmd, open domain.SourceOpener, sourceURL string) (io.Closer, error) {
+	if !IsPipe(sourceURL) {
+		return nopCloser{}, nil
+	}
+	if isDescriptor(sourceURL) {
+		return nil, fmt.Errorf("pipe source %s names a file descriptor; use a name after %q", sourceURL, Scheme)
+	}
+	if open == nil {
+		return nil, fmt.Errorf("pipe source %s needs a source opener", sourceURL)
+	}
+	var inputs []int
+	for i := 2; i < len(cmd.Args); i++ {
+		if cmd.Args[i-1] == "-i" && cmd.Args[i] == sourceURL {
+			inputs = append(inputs, i)
+		}
+	}
+	if len(inputs) == 0 {
+		return nil, fmt.Errorf("pipe source %s is not an -i input of the command", sourceURL)
+	}
+
+	r, err := open(ctx, sourceURL)
+	if err != nil {
+		return nil, fmt.Errorf("open source %s: %w", sourceURL, err)
+	}
+	cmd.Stdin = r
+	cmd.WaitDelay = waitDelay
+	for _, i := range inputs {
+		cmd.Args[i] = stdin
+	}
+	return r, nil
+}
+
+// isDescriptor reports whether sourceURL is one ffmpeg's pipe protocol reads
+// as a file descriptor: "pipe:" alone or followed by digits.
+func isDescriptor(sourceURL string) bool {
+	fd := strings.TrimPrefix(sourceURL, Scheme)
+	return strings.Trim(fd, "0123456789") == ""
+}
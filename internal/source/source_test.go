@@ -0,0 +1,99 @@
+package source
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+type trackingReader struct {
+	io.Reader
+	closed bool
+}
+
+func (r *trackingReader) Close() error {
+	r.closed = true
+	return nil
+}
+
+func TestAttachFeedsPipeSourceToStdin(t *testing.T) {
+	var opened string
+	reader := &trackingReader{Reader: strings.NewReader("source bytes")}
+	open := func(ctx context.Context, sourceURL string) (io.ReadCloser, error) {
+		opened = sourceURL
+		return reader, nil
+	}
+
+	cmd := exec.Command("sh", "-c", `test "$1 $2 $3" = "-i pipe:0 pipe:movie-42" && cat`, "sh", "-i", "pipe:movie-42", "pipe:movie-42")
+	input, err := Attach(context.Background(), cmd, open, "pipe:movie-42")
+	if err != nil {
+		t.Fatalf("Attach: %v", err)
+	}
+	output, err := cmd.Output()
+	input.Close()
+	if err != nil {
+		t.Fatalf("run: %v", err)
+	}
+
+	if opened != "pipe:movie-42" {
+		t.Errorf("opened %q, want pipe:movie-42", opened)
+	}
+	if string(output) != "source bytes" {
+		t.Errorf("output = %q, want the source bytes", output)
+	}
+	if !reader.closed {
+		t.Error("source reader was not closed")
+	}
+}
+
+func TestAttachLeavesOtherSourcesAlone(t *testing.T) {
+	cmd := exec.Command("ffmpeg", "-i", "/media/movie.mkv")
+	open := func(ctx context.Context, sourceURL string) (io.ReadCloser, error) {
+		t.Fatal("opener called for a file source")
+		return nil, nil
+	}
+
+	input, err := Attach(context.Background(), cmd, open, "/media/movie.mkv")
+	if err != nil {
+		t.Fatalf("Attach: %v", err)
+	}
+	defer input.Close()
+	if cmd.Stdin != nil || cmd.Args[2] != "/media/movie.mkv" {
+		t.Errorf("command changed: stdin %v, args %v", cmd.Stdin, cmd.Args)
+	}
+}
+
+func TestAttachRequiresOpener(t *testing.T) {
+	cmd := exec.Command("ffmpeg", "-i", "pipe:movie-42")
+	if _, err := Attach(context.Background(), cmd, nil, "pipe:movie-42"); err == nil {
+		t.Fatal("expected an error without an opener")
+	}
+
+	failing := func(ctx context.Context, sourceURL string) (io.ReadCloser, error) {
+		return nil, errors.New("gone")
+	}
+	if _, err := Attach(context.Background(), cmd, failing, "pipe:movie-42"); err == nil || !strings.Contains(err.Error(), "gone") {
+		t.Fatalf("err = %v, want the opener's error", err)
+	}
+}
+
+func TestAttachRejectsDescriptorNames(t *testing.T) {
+	open := func(ctx context.Context, sourceURL string) (io.ReadCloser, error) {
+		t.Fatalf("opener called for %s", sourceURL)
+		return nil, nil
+	}
+	for _, sourceURL := range []string{"pipe:", "pipe:0", "pipe:1"} {
+		cmd := exec.Command("ffmpeg", "-i", sourceURL, "-f", "mpegts", "pipe:1")
+		if _, err := Attach(context.Background(), cmd, open, sourceURL); err == nil {
+			t.Fatalf("%s: expected an error", sourceURL)
+		}
+	}
+
+	cmd := exec.Command("ffprobe", "pipe:movie-42")
+	if _, err := Attach(context.Background(), cmd, open, "pipe:movie-42"); err == nil {
+		t.Fatal("expected an error for a source that is not an -i input")
+	}
+}
@@ -3,15 +3,95 @@ package transcode
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"log/slog"
+	"math"
 	"os"
+	"os/exec"
+	"path/filepath"
 	"sync"
+	"time"
 
 	"github.com/eleven-am/goshl/internal/domain"
 	"github.com/eleven-am/goshl/internal/ffmpeg"
+	"github.com/eleven-am/goshl/internal/hwaccel"
+	"github.com/eleven-am/goshl/internal/playlist"
 	"github.com/eleven-am/goshl/internal/rendition"
 )
 
+// Options holds optional Pool behavior. The zero value is valid.
+type Options struct {
+	// Ladder must match the rendition options used to build playlists.
+	Ladder rendition.Options
+
+	// JobTimeout bounds a single job's ffmpeg run. Zero means no limit.
+	JobTimeout time.Duration
+
+	// OnJobComplete is invoked asynchronously after a job finishes,
+	// whether or not every segment was produced.
+	OnJobComplete func(job domain.Job)
+
+	// OnJobStats is invoked asynchronously with the timing of every job
+	// whose ffmpeg run succeeded.
+	OnJobStats func(stats domain.JobStats)
+
+	// Logger receives notes on how jobs ran, such as a hardware encode
+	// retried in software or a job slower than realtime. Nil discards them.
+	Logger *slog.Logger
+
+	// TwoPass runs software video transcodes as two-pass encodes. The pass
+	// log lives in the job's temp directory and is removed with it.
+	TwoPass bool
+
+	// TargetDuration is the default segment target duration in seconds. It
+	// must match the one used to build playlists, since it decides which
+	// source range each segment index covers. A job whose rendition carries
+	// its own target (see domain.TargetRendition) uses that instead.
+	// Zero means 6 seconds.
+	TargetDuration float64
+
+	// AudioTargetDuration, when set, is the audio pool's default target, and
+	// audio segments are cut on a fixed grid of it rather than at video
+	// keyframes. Zero means audio follows TargetDuration.
+	AudioTargetDuration float64
+
+	// UploadConcurrency is how many segments a job writes to storage at
+	// once. Zero means one at a time.
+	UploadConcurrency int
+
+	// MaxSegmentSize fails a job whose ffmpeg produces a segment larger than
+	// this many bytes. Zero means no limit.
+	MaxSegmentSize int64
+
+	// OpenSource supplies the bytes of "pipe:" sources. Nil rejects them.
+	OpenSource domain.SourceOpener
+
+	// HardwareSessions caps how many hardware-encoded jobs run at once,
+	// independently of the worker count. Hardware jobs are then handed to
+	// that many dedicated hardware workers through a queue of the same
+	// length, so the pool's workers keep taking other jobs until it is
+	// full, then wait with the rest left in the Coordinator. Zero means no
+	// cap.
+	HardwareSessions int
+
+	// OverlapSegments is how many segments before its first one a video job
+	// starts from. Their output is discarded; they let a stream copy, which
+	// can only start at a source keyframe, settle before the first segment
+	// the job keeps. Zero means one; negative means none.
+	OverlapSegments int
+
+	// FastStart encodes a video job starting at segment 0 with the
+	// encoder's fast-start options and never as a two-pass encode, so
+	// playback starts sooner at some cost in quality. The whole job is
+	// affected, and encoders without FastStartFlags only skip two-pass.
+	// Later jobs are unaffected.
+	FastStart bool
+}
+
+const defaultTargetDuration = 6.0
+
 type Pool struct {
 	coordinator domain.Coordinator
 	size        int
@@ -19,6 +99,15 @@ type Pool struct {
 	storage     domain.Storage
 	cmdBuilder  *ffmpeg.CommandBuilder
 	segStorage  domain.Storage
+	opts        Options
+
+	// hwJobs feeds the Options.HardwareSessions hardware workers when it
+	// is set. Its buffer holds one waiting job per session.
+	hwJobs chan hardwareJob
+
+	// failureMu serialises recordFailure's read-modify-write of failure
+	// records, so overlapping jobs in this pool do not lose attempts.
+	failureMu sync.Mutex
 
 	mu     sync.Mutex
 	cancel context.CancelFunc
@@ -32,15 +121,30 @@ func NewPool(
 	storage domain.Storage,
 	cmdBuilder *ffmpeg.CommandBuilder,
 	segStorage domain.Storage,
+	opts Options,
 ) *Pool {
-	return &Pool{
+	p := &Pool{
 		coordinator: coordinator,
 		size:        size,
 		streamType:  streamType,
 		storage:     storage,
 		cmdBuilder:  cmdBuilder,
 		segStorage:  segStorage,
+		opts:        opts,
+	}
+	if opts.HardwareSessions > 0 {
+		p.hwJobs = make(chan hardwareJob, opts.HardwareSessions)
+	}
+	if opts.Logger == nil {
+		p.opts.Logger = slog.New(slog.DiscardHandler)
 	}
+	return p
+}
+
+// hardwareJob is a job waiting for one of the pool's hardware workers.
+type hardwareJob struct {
+	job  domain.Job
+	meta *domain.Metadata
 }
 
 func (p *Pool) Start(ctx context.Context) error {
@@ -61,6 +165,10 @@ func (p *Pool) Start(ctx context.Context) error {
 		p.wg.Add(1)
 		go p.worker(ctx, jobs)
 	}
+	for i := 0; i < p.opts.HardwareSessions; i++ {
+		p.wg.Add(1)
+		go p.hardwareWorker(ctx)
+	}
 
 	return nil
 }
@@ -91,6 +199,21 @@ func (p *Pool) worker(ctx context.Context, jobs <-chan domain.Job) {
 	}
 }
 
+// hardwareWorker runs the hardware-encoded jobs handed over by processJob,
+// one at a time, including their software retries.
+func (p *Pool) hardwareWorker(ctx context.Context) {
+	defer p.wg.Done()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case hw := <-p.hwJobs:
+			p.executeJob(ctx, hw.meta, hw.job, true)
+		}
+	}
+}
+
 func (p *Pool) processJob(ctx context.Context, job domain.Job) {
 	meta, err := p.getMetadata(ctx, job.SourceURL)
 	if err != nil {
@@ -98,76 +221,333 @@ func (p *Pool) processJob(ctx context.Context, job domain.Job) {
 		return
 	}
 
-	segments := p.extractSegments(meta.Keyframes, meta.Duration, job.StartIndex, job.EndIndex)
-	if len(segments) == 0 {
-		p.publishError(ctx, job, fmt.Errorf("no segments for range %d-%d", job.StartIndex, job.EndIndex))
+	hardware := p.hardwareEncoded(meta, job)
+	if hardware && p.hwJobs != nil {
+		// Queue the job for a session. While the queue has room this
+		// worker stays free for direct-stream and software jobs; once it
+		// is full the worker waits, so further jobs stay in the
+		// Coordinator. An unacknowledged job is redelivered if the pool
+		// stops first.
+		select {
+		case p.hwJobs <- hardwareJob{job: job, meta: meta}:
+		case <-ctx.Done():
+		}
 		return
 	}
 
-	tmpDir, err := os.MkdirTemp("", "transcode-*")
+	p.executeJob(ctx, meta, job, hardware)
+}
+
+// executeJob runs job to completion, retrying a failed hardware encode in
+// software, and publishes its outcome.
+func (p *Pool) executeJob(ctx context.Context, meta *domain.Metadata, job domain.Job, hardware bool) {
+	jobCtx, cancel := p.jobContext(ctx)
+	defer cancel()
+
+	started := time.Now()
+	cmd, w, err := p.runJob(jobCtx, meta, job, p.cmdBuilder, nil)
+	if err == nil && jobCtx.Err() == nil && hardware && encoderFailed(w.Err()) {
+		p.opts.Logger.Warn("hardware encode failed, retrying in software",
+			"source", job.SourceURL, "rendition", job.Rendition, "start", job.StartIndex, "end", job.EndIndex, "error", w.Err())
+		retryCtx, cancel := p.jobContext(ctx)
+		defer cancel()
+		started = time.Now()
+		cmd, w, err = p.runJob(retryCtx, meta, job, p.softwareBuilder(), w.uploadedIndexes())
+	}
 	if err != nil {
-		p.publishError(ctx, job, fmt.Errorf("create temp dir: %w", err))
+		p.publishError(ctx, job, err)
 		return
 	}
+
+	p.publishMissing(ctx, job, cmd.segments, w)
+
+	p.coordinator.Ack(ctx, job.ID)
+
+	if w.Err() == nil {
+		p.reportStats(domain.JobStats{Job: job, Elapsed: time.Since(started), Speed: w.Speed()})
+	}
+
+	if p.opts.OnJobComplete != nil {
+		go p.opts.OnJobComplete(job)
+	}
+}
+
+// publishProgress forwards one block of ffmpeg progress for job, converting
+// the output position into the share of the job's range covered.
+func publishProgress(ctx context.Context, notifier domain.ProgressNotifier, job domain.Job, segments []domain.Segment, progress Progress) {
+	start := segments[0].Start
+	end := segments[len(segments)-1].End
+
+	var fraction float64
+	if end > start {
+		fraction = math.Max(0, math.Min(1, (progress.OutTime-start)/(end-start)))
+	}
+
+	notifier.NotifyProgress(ctx, domain.JobProgress{
+		Job:      job,
+		Fraction: fraction,
+		Position: progress.OutTime,
+		Frame:    progress.Frame,
+		Speed:    progress.Speed,
+	})
+}
+
+// reportStats hands a successful job's stats to OnJobStats and logs jobs
+// that encoded slower than realtime, a sign the pool cannot keep up with
+// playback.
+func (p *Pool) reportStats(stats domain.JobStats) {
+	if stats.Speed > 0 && stats.Speed < 1 {
+		job := stats.Job
+		p.opts.Logger.Warn("transcoded slower than realtime",
+			"source", job.SourceURL, "rendition", job.Rendition, "start", job.StartIndex, "end", job.EndIndex, "speed", stats.Speed)
+	}
+	if p.opts.OnJobStats != nil {
+		go p.opts.OnJobStats(stats)
+	}
+}
+
+// jobContext returns the context a job's ffmpeg run is bounded by: ctx with
+// Options.JobTimeout applied, if set.
+func (p *Pool) jobContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if p.opts.JobTimeout > 0 {
+		return context.WithTimeout(ctx, p.opts.JobTimeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// encoderFailed reports whether a worker error comes from ffmpeg exiting
+// non-zero, as opposed to a storage write, a segment size limit or opening
+// the source, which a software retry would not fix.
+func encoderFailed(err error) bool {
+	var exitErr *exec.ExitError
+	return errors.As(err, &exitErr)
+}
+
+// runJob builds the job's command with builder and runs it to completion in
+// a fresh temporary directory. Segments listed in stored were written by an
+// earlier run of the job and are not written again.
+func (p *Pool) runJob(ctx context.Context, meta *domain.Metadata, job domain.Job, builder *ffmpeg.CommandBuilder, stored []int) (*jobCommand, *Worker, error) {
+	tmpDir, err := os.MkdirTemp("", "transcode-*")
+	if err != nil {
+		return nil, nil, fmt.Errorf("create temp dir: %w", err)
+	}
 	defer os.RemoveAll(tmpDir)
 
+	cmd, err := p.buildCommand(builder, meta, job, tmpDir)
+	if err != nil {
+		return nil, nil, err
+	}
+
 	isVideo := p.streamType == domain.StreamVideo
+	w := NewWorker(cmd.args, p.segStorage, job.SourceURL, job.Rendition, isVideo, tmpDir, cmd.firstIndex)
+	w.SetLastIndex(cmd.lastIndex)
+	w.SetStored(stored)
+	w.SetUploadConcurrency(p.opts.UploadConcurrency)
+	w.SetMaxSegmentSize(p.opts.MaxSegmentSize)
+	w.SetSourceOpener(p.opts.OpenSource)
+	if inits, ok := p.storage.(domain.InitSegmentStore); ok {
+		w.SetInitStore(inits)
+	}
+	if notifier, ok := p.coordinator.(domain.ProgressNotifier); ok {
+		w.SetProgressFunc(func(progress Progress) {
+			publishProgress(ctx, notifier, job, cmd.segments, progress)
+		})
+	}
+	if len(cmd.firstPass) > 0 {
+		w.SetFirstPass(cmd.firstPass)
+	}
+	if err := w.Start(ctx); err != nil {
+		return nil, nil, err
+	}
 
-	var args []string
-	var skipFirst bool
-	if isVideo {
-		videoRendition := p.findVideoRendition(meta, job.Rendition)
-		if videoRendition == nil {
-			p.publishError(ctx, job, fmt.Errorf("video rendition %s not found", job.Rendition))
-			return
-		}
+	p.waitForWorker(ctx, w)
+	return cmd, w, nil
+}
 
-		videoSegments := segments
-		if job.StartIndex > 0 {
-			overlapSegments := p.extractSegments(meta.Keyframes, meta.Duration, job.StartIndex-1, job.EndIndex)
-			if len(overlapSegments) > len(segments) {
-				videoSegments = overlapSegments
-				skipFirst = true
-			}
-		}
+// hardwareEncoded reports whether job is encoded by a hardware encoder, and
+// so may be retried in software when the encoder fails at runtime (driver
+// errors, NVENC session limits).
+func (p *Pool) hardwareEncoded(meta *domain.Metadata, job domain.Job) bool {
+	if p.streamType != domain.StreamVideo {
+		return false
+	}
+	r := p.findVideoRendition(meta, job.Rendition)
+	return r != nil && r.Method == domain.Transcode && p.cmdBuilder.Config(r.Codec).Accelerator != domain.AccelNone
+}
 
-		var actualSeekKeyframe float64
-		if videoRendition.Method == domain.DirectStream && len(videoSegments) > 0 {
-			actualSeekKeyframe = findNearestKeyframe(meta.Keyframes, videoSegments[0].Start)
+// softwareBuilder returns a copy of the pool's command builder that encodes
+// every output codec with its software configuration.
+func (p *Pool) softwareBuilder() *ffmpeg.CommandBuilder {
+	b := *p.cmdBuilder
+	b.HWAccel = hwaccel.NewCodecConfig(domain.AccelNone, p.cmdBuilder.HWAccel.Codec)
+	b.Codecs = make(map[domain.VideoCodec]*domain.HWAccelConfig, len(p.cmdBuilder.Codecs))
+	for codec := range p.cmdBuilder.Codecs {
+		b.Codecs[codec] = hwaccel.NewCodecConfig(domain.AccelNone, codec)
+	}
+	return &b
+}
+
+// Command returns the ffmpeg arguments the pool would run for job, with
+// segment output paths rooted at outputDir. Nothing is executed.
+func (p *Pool) Command(ctx context.Context, job domain.Job, outputDir string) ([]string, error) {
+	meta, err := p.getMetadata(ctx, job.SourceURL)
+	if err != nil {
+		return nil, err
+	}
+
+	cmd, err := p.buildCommand(p.cmdBuilder, meta, job, outputDir)
+	if err != nil {
+		return nil, err
+	}
+
+	return cmd.args, nil
+}
+
+// StreamCommand returns the ffmpeg arguments for a single piped MPEG-TS of
+// the named rendition between start and end seconds. An end of zero means the
+// end of the source.
+func (p *Pool) StreamCommand(ctx context.Context, sourceURL string, renditionName string, start, end float64) ([]string, error) {
+	meta, err := p.getMetadata(ctx, sourceURL)
+	if err != nil {
+		return nil, err
+	}
+
+	if end <= 0 || end > meta.Duration {
+		end = meta.Duration
+	}
+	params := ffmpeg.StreamParams{InputURL: sourceURL, StartTime: start, EndTime: end, Program: meta.Program}
+
+	if p.streamType != domain.StreamVideo {
+		audioRendition := p.findAudioRendition(meta, renditionName)
+		if audioRendition == nil {
+			return nil, fmt.Errorf("audio rendition %s not found", renditionName)
 		}
+		return p.cmdBuilder.AudioStream(ffmpeg.AudioStreamParams{StreamParams: params, Rendition: *audioRendition}), nil
+	}
 
-		args = p.cmdBuilder.Video(ffmpeg.VideoParams{
-			InputURL:           job.SourceURL,
-			StreamIndex:        0,
-			Rendition:          *videoRendition,
-			Segments:           videoSegments,
-			OutputDir:          tmpDir,
-			ActualSeekKeyframe: actualSeekKeyframe,
-		})
-	} else {
+	videoRendition := p.findVideoRendition(meta, renditionName)
+	if videoRendition == nil {
+		return nil, fmt.Errorf("video rendition %s not found", renditionName)
+	}
+	audioRendition, err := p.muxedAudio(meta, renditionName)
+	if err != nil {
+		return nil, err
+	}
+	return p.cmdBuilder.VideoStream(ffmpeg.VideoStreamParams{StreamParams: params, Rendition: *videoRendition, SourceCodec: meta.Video.Codec, SourcePixelFormat: meta.Video.PixelFormat, Audio: audioRendition}), nil
+}
+
+// Stream runs StreamCommand and returns ffmpeg's stdout.
+func (p *Pool) Stream(ctx context.Context, sourceURL string, renditionName string, start, end float64) (io.ReadCloser, error) {
+	args, err := p.StreamCommand(ctx, sourceURL, renditionName, start, end)
+	if err != nil {
+		return nil, err
+	}
+	return RunStream(ctx, args, p.opts.OpenSource, sourceURL)
+}
+
+type jobCommand struct {
+	args      []string
+	firstPass []string
+	segments  []domain.Segment
+
+	// firstIndex is the first segment index the job keeps; ffmpeg output
+	// numbered below it is overlap. lastIndex is the last it keeps; video
+	// jobs cut once more at their end, and output numbered above it is what
+	// a stream copy let through past that boundary.
+	firstIndex int
+	lastIndex  int
+}
+
+func (p *Pool) buildCommand(builder *ffmpeg.CommandBuilder, meta *domain.Metadata, job domain.Job, outputDir string) (*jobCommand, error) {
+	target := p.targetDuration(job.Rendition)
+	segments := p.extractSegments(meta, target, job.StartIndex, job.EndIndex)
+	if len(segments) == 0 {
+		return nil, fmt.Errorf("no segments for range %d-%d", job.StartIndex, job.EndIndex)
+	}
+
+	cmd := &jobCommand{segments: segments, lastIndex: segments[len(segments)-1].Index}
+
+	if p.streamType != domain.StreamVideo {
 		audioRendition := p.findAudioRendition(meta, job.Rendition)
 		if audioRendition == nil {
-			p.publishError(ctx, job, fmt.Errorf("audio rendition %s not found", job.Rendition))
-			return
+			return nil, fmt.Errorf("audio rendition %s not found", job.Rendition)
 		}
-		args = p.cmdBuilder.Audio(ffmpeg.AudioParams{
+		cmd.args = builder.Audio(ffmpeg.AudioParams{
 			InputURL:    job.SourceURL,
 			StreamIndex: 0,
 			Rendition:   *audioRendition,
 			Segments:    segments,
-			OutputDir:   tmpDir,
+			OutputDir:   outputDir,
+			Program:     meta.Program,
+			Pad:         audioEndsEarly(meta, segments),
 		})
+		return cmd, nil
 	}
 
-	w := NewWorker(args, p.segStorage, job.SourceURL, job.Rendition, isVideo, tmpDir, skipFirst)
-	if err := w.Start(ctx); err != nil {
-		p.publishError(ctx, job, err)
-		return
+	videoRendition := p.findVideoRendition(meta, job.Rendition)
+	if videoRendition == nil {
+		return nil, fmt.Errorf("video rendition %s not found", job.Rendition)
 	}
 
-	p.waitForWorker(ctx, w)
+	videoSegments := segments
+	if overlap := min(p.overlapSegments(), job.StartIndex); overlap > 0 {
+		videoSegments = p.extractSegments(meta, target, job.StartIndex-overlap, job.EndIndex)
+		cmd.firstIndex = job.StartIndex
+	}
 
-	p.coordinator.Ack(ctx, job.ID)
+	audioRendition, err := p.muxedAudio(meta, job.Rendition)
+	if err != nil {
+		return nil, err
+	}
+
+	var actualSeekKeyframe float64
+	if videoRendition.Method == domain.DirectStream && len(videoSegments) > 0 {
+		actualSeekKeyframe = findNearestKeyframe(meta.Keyframes, videoSegments[0].Start)
+	}
+
+	params := ffmpeg.VideoParams{
+		InputURL:           job.SourceURL,
+		StreamIndex:        0,
+		Rendition:          *videoRendition,
+		Segments:           videoSegments,
+		OutputDir:          outputDir,
+		ActualSeekKeyframe: actualSeekKeyframe,
+		SourceCodec:        meta.Video.Codec,
+		SourcePixelFormat:  meta.Video.PixelFormat,
+		Audio:              audioRendition,
+		PadAudio:           audioRendition != nil && audioEndsEarly(meta, videoSegments),
+		Program:            meta.Program,
+		FastStart:          p.opts.FastStart && job.StartIndex == 0,
+	}
+
+	if p.opts.TwoPass && !params.FastStart && videoRendition.Method == domain.Transcode && builder.Config(videoRendition.Codec).Accelerator == domain.AccelNone {
+		params.PassLogFile = filepath.Join(outputDir, "passlog")
+		cmd.firstPass = builder.VideoFirstPass(params)
+	}
+
+	cmd.args = builder.Video(params)
+
+	return cmd, nil
+}
+
+// audioEndsEarly reports whether the source audio jobs encode, its first
+// stream, runs out before the end of segments. Such audio is padded with
+// silence so that its segments line up with video to the last one.
+func audioEndsEarly(meta *domain.Metadata, segments []domain.Segment) bool {
+	if len(meta.Audios) == 0 || len(segments) == 0 {
+		return false
+	}
+	audio := meta.Audios[0].Duration
+	return audio > 0 && audio < segments[len(segments)-1].End
+}
+
+// overlapSegments returns how many segments a video job encodes ahead of its
+// range and discards.
+func (p *Pool) overlapSegments() int {
+	if p.opts.OverlapSegments == 0 {
+		return 1
+	}
+	return max(p.opts.OverlapSegments, 0)
 }
 
 func (p *Pool) getMetadata(ctx context.Context, sourceURL string) (*domain.Metadata, error) {
@@ -183,71 +563,49 @@ func (p *Pool) getMetadata(ctx context.Context, sourceURL string) (*domain.Metad
 }
 
 func (p *Pool) waitForWorker(ctx context.Context, w *Worker) {
-	ticker := make(chan struct{})
-	go func() {
-		for w.State() == WorkerStateRunning {
-			select {
-			case <-ctx.Done():
-				return
-			default:
-			}
-		}
-		close(ticker)
-	}()
-
 	select {
 	case <-ctx.Done():
 		w.Kill()
-	case <-ticker:
+		<-w.Done()
+	case <-w.Done():
 	}
 }
 
-func (p *Pool) extractSegments(keyframes []float64, duration float64, startIdx, endIdx int) []domain.Segment {
-	targetDuration := 6.0
-	var segments []domain.Segment
-	var idx int
-
-	for i := 0; i < len(keyframes); i++ {
-		start := keyframes[i]
-		var end float64
-
-		for j := i + 1; j < len(keyframes); j++ {
-			if keyframes[j]-start >= targetDuration {
-				end = keyframes[j]
-				i = j - 1
-				break
-			}
-		}
-
-		if end == 0 {
-			if i < len(keyframes)-1 {
-				end = keyframes[len(keyframes)-1]
-				i = len(keyframes)
-			} else {
-				end = duration
-			}
-		}
+// targetDuration returns the segment target for a job's rendition.
+func (p *Pool) targetDuration(renditionKey string) float64 {
+	if _, target := domain.SplitRendition(renditionKey); target > 0 {
+		return target
+	}
+	if p.uniformAudio() {
+		return p.opts.AudioTargetDuration
+	}
+	if p.opts.TargetDuration > 0 {
+		return p.opts.TargetDuration
+	}
+	return defaultTargetDuration
+}
 
-		if idx >= startIdx && idx <= endIdx {
-			segments = append(segments, domain.Segment{
-				Index:    idx,
-				Start:    start,
-				End:      end,
-				Duration: end - start,
-			})
-		}
+// uniformAudio reports whether this pool cuts audio on a fixed grid.
+func (p *Pool) uniformAudio() bool {
+	return p.streamType == domain.StreamAudio && p.opts.AudioTargetDuration > 0
+}
 
-		idx++
-		if idx > endIdx {
-			break
+// extractSegments returns the segments in [startIdx, endIdx], laid out exactly
+// as the playlists are so that indices refer to the same source ranges.
+func (p *Pool) extractSegments(meta *domain.Metadata, target float64, startIdx, endIdx int) []domain.Segment {
+	var segments []domain.Segment
+	for _, seg := range playlist.Layout(meta, target, p.uniformAudio()) {
+		if seg.Index >= startIdx && seg.Index <= endIdx {
+			segments = append(segments, seg)
 		}
 	}
-
 	return segments
 }
 
 func (p *Pool) findVideoRendition(meta *domain.Metadata, name string) *domain.VideoRendition {
-	renditions := rendition.GenerateVideo(meta.Video)
+	name, _ = domain.SplitRendition(name)
+	name, _ = domain.SplitMuxed(name)
+	renditions := rendition.GenerateVideo(meta.Video, p.opts.Ladder)
 	for _, r := range renditions {
 		if r.Name == name {
 			return &r
@@ -256,12 +614,28 @@ func (p *Pool) findVideoRendition(meta *domain.Metadata, name string) *domain.Vi
 	return nil
 }
 
+// muxedAudio returns the audio rendition muxed into a video rendition name
+// built by domain.MuxedRendition, or nil for a plain name.
+func (p *Pool) muxedAudio(meta *domain.Metadata, renditionKey string) (*domain.AudioRendition, error) {
+	name, _ := domain.SplitRendition(renditionKey)
+	_, audioName := domain.SplitMuxed(name)
+	if audioName == "" {
+		return nil, nil
+	}
+	audio := p.findAudioRendition(meta, audioName)
+	if audio == nil {
+		return nil, fmt.Errorf("audio rendition %s not found", audioName)
+	}
+	return audio, nil
+}
+
 func (p *Pool) findAudioRendition(meta *domain.Metadata, name string) *domain.AudioRendition {
+	name, _ = domain.SplitRendition(name)
 	if len(meta.Audios) == 0 {
 		return nil
 	}
 
-	renditions := rendition.GenerateAudio(meta.Audios[0])
+	renditions := rendition.GenerateAudio(meta.Audios[0], p.opts.Ladder)
 	for _, r := range renditions {
 		if r.Name == name {
 			return &r
@@ -283,10 +657,78 @@ func (p *Pool) publishError(ctx context.Context, job domain.Job, err error) {
 			Error: err.Error(),
 		}
 
+		p.recordFailure(ctx, info, status.Error)
+		p.coordinator.NotifySegment(ctx, info, status)
+	}
+}
+
+// publishMissing notifies an error for every segment in the job that the worker
+// never uploaded, so waiters fail fast instead of running into SegmentTimeout
+// when ffmpeg exits early (e.g. on a truncated source).
+func (p *Pool) publishMissing(ctx context.Context, job domain.Job, segments []domain.Segment, w *Worker) {
+	if ctx.Err() != nil {
+		return
+	}
+
+	reason := "ffmpeg exited before producing segment"
+	if err := w.Err(); err != nil {
+		reason = fmt.Sprintf("%s: %v", reason, err)
+	}
+
+	for _, seg := range segments {
+		if w.Uploaded(seg.Index) {
+			continue
+		}
+		info := domain.SegmentData{
+			SourceURL: job.SourceURL,
+			Index:     seg.Index,
+			Rendition: job.Rendition,
+			IsVideo:   p.streamType == domain.StreamVideo,
+		}
+		status := domain.SegmentStatus{
+			State: domain.SegmentStateError,
+			Error: reason,
+		}
+
+		p.recordFailure(ctx, info, reason)
 		p.coordinator.NotifySegment(ctx, info, status)
 	}
 }
 
+// recordFailure stores a failure record for a segment, counting one more
+// attempt, so playlists can mark it as a gap and the Controller can stop
+// retrying it. The record is deleted when the segment is next written, so
+// only consecutive failures count.
+//
+// It is best effort, and skipped when storage does not implement
+// SegmentFailureStore: waiters are told through the Coordinator either way.
+// Updates are serialised within the pool, but replicas sharing a Storage can
+// still race and lose an attempt, which only delays MaxSegmentRetries.
+func (p *Pool) recordFailure(ctx context.Context, info domain.SegmentData, reason string) {
+	failures, ok := p.storage.(domain.SegmentFailureStore)
+	if !ok {
+		return
+	}
+
+	p.failureMu.Lock()
+	defer p.failureMu.Unlock()
+
+	var failure domain.SegmentFailure
+	if exists, err := failures.SegmentFailureExists(ctx, info); err == nil && exists {
+		if data, err := failures.ReadSegmentFailure(ctx, info); err == nil {
+			json.Unmarshal(data, &failure)
+		}
+	}
+	failure.Attempts++
+	failure.Error = reason
+
+	data, err := json.Marshal(failure)
+	if err != nil {
+		return
+	}
+	failures.WriteSegmentFailure(ctx, info, data)
+}
+
 func findNearestKeyframe(keyframes []float64, target float64) float64 {
 	if len(keyframes) == 0 {
 		return 0
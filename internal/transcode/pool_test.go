@@ -1,10 +1,24 @@
 package transcode
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/eleven-am/goshl/internal/domain"
+	"github.com/eleven-am/goshl/internal/ffmpeg"
+	"github.com/eleven-am/goshl/internal/hwaccel"
 )
 
 type stubCoordinator struct {
@@ -35,8 +49,8 @@ func (s *stubCoordinator) Close() {}
 
 func TestExtractSegmentsRespectsRangeAndDuration(t *testing.T) {
 	p := &Pool{}
-	keyframes := []float64{0, 2, 4, 9, 15}
-	segments := p.extractSegments(keyframes, 16, 1, 2)
+	meta := &domain.Metadata{Keyframes: []float64{0, 2, 4, 9, 15}, Duration: 16}
+	segments := p.extractSegments(meta, 6, 1, 2)
 
 	if len(segments) != 2 {
 		t.Fatalf("expected 2 segments, got %d", len(segments))
@@ -49,6 +63,27 @@ func TestExtractSegmentsRespectsRangeAndDuration(t *testing.T) {
 	}
 }
 
+func TestTargetDurationFollowsRenditionOverride(t *testing.T) {
+	p := &Pool{opts: Options{TargetDuration: 4}}
+	meta := &domain.Metadata{Keyframes: []float64{0, 2, 4, 6, 8}, Duration: 10}
+
+	if got := p.targetDuration("720p"); got != 4 {
+		t.Fatalf("expected pool default target 4, got %v", got)
+	}
+	target := p.targetDuration(domain.TargetRendition("720p", 2))
+	if target != 2 {
+		t.Fatalf("expected overridden target 2, got %v", target)
+	}
+
+	segments := p.extractSegments(meta, target, 3, 3)
+	if len(segments) != 1 || segments[0].Start != 6 || segments[0].End != 8 {
+		t.Fatalf("unexpected segments for 2s target: %#v", segments)
+	}
+	if p.findVideoRendition(&domain.Metadata{Video: domain.VideoStream{Width: 1920, Height: 1080}}, domain.TargetRendition("720p", 2)) == nil {
+		t.Fatalf("expected override rendition to resolve to 720p")
+	}
+}
+
 func TestFindNearestKeyframePrefersPreviousWhenVeryClose(t *testing.T) {
 	keyframes := []float64{5, 10, 15}
 	got := findNearestKeyframe(keyframes, 10.005)
@@ -78,7 +113,8 @@ func TestFindVideoAndAudioRenditions(t *testing.T) {
 
 func TestPublishErrorSendsRange(t *testing.T) {
 	coord := &stubCoordinator{}
-	p := &Pool{coordinator: coord, streamType: domain.StreamVideo}
+	storage := &memoryStorage{}
+	p := &Pool{coordinator: coord, storage: storage, streamType: domain.StreamVideo}
 	job := domain.Job{Rendition: "1080p", StartIndex: 2, EndIndex: 4}
 
 	p.publishError(context.Background(), job, assertErr("boom"))
@@ -86,6 +122,75 @@ func TestPublishErrorSendsRange(t *testing.T) {
 	if len(coord.publishes) != 3 {
 		t.Fatalf("expected publish per segment, got %d", len(coord.publishes))
 	}
+	if len(storage.failures) != 3 {
+		t.Fatalf("expected a failure record per segment, got %d", len(storage.failures))
+	}
+	for _, status := range coord.publishes {
+		if status.State != domain.SegmentStateError || status.Error == "" {
+			t.Fatalf("status missing error: %#v", status)
+		}
+	}
+}
+
+func TestRecordFailureCountsAttempts(t *testing.T) {
+	storage := &memoryStorage{}
+	p := &Pool{storage: storage}
+	info := domain.SegmentData{SourceURL: "file:///source", Index: 3, Rendition: "720p", IsVideo: true}
+
+	p.recordFailure(context.Background(), info, "first")
+	p.recordFailure(context.Background(), info, "second")
+
+	var failure domain.SegmentFailure
+	if err := json.Unmarshal(storage.failureData[3], &failure); err != nil {
+		t.Fatalf("decode failure: %v", err)
+	}
+	if failure.Attempts != 2 || failure.Error != "second" {
+		t.Fatalf("expected 2 attempts with the latest error, got %#v", failure)
+	}
+}
+
+func TestRecordFailureKeepsConcurrentAttempts(t *testing.T) {
+	storage := &memoryStorage{}
+	p := &Pool{storage: storage}
+	info := domain.SegmentData{SourceURL: "file:///source", Index: 3, Rendition: "720p", IsVideo: true}
+
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.recordFailure(context.Background(), info, "overlap")
+		}()
+	}
+	wg.Wait()
+
+	var failure domain.SegmentFailure
+	if err := json.Unmarshal(storage.failureData[3], &failure); err != nil {
+		t.Fatalf("decode failure: %v", err)
+	}
+	if failure.Attempts != 8 {
+		t.Fatalf("expected every overlapping failure counted, got %d", failure.Attempts)
+	}
+}
+
+func TestPublishMissingNotifiesOnlyUnwrittenSegments(t *testing.T) {
+	coord := &stubCoordinator{}
+	storage := &memoryStorage{}
+	p := &Pool{coordinator: coord, storage: storage, streamType: domain.StreamAudio}
+	job := domain.Job{Rendition: "aac_stereo", StartIndex: 0, EndIndex: 2}
+	segments := []domain.Segment{{Index: 0}, {Index: 1}, {Index: 2}}
+
+	w := NewWorker(nil, nil, "file:///source", "aac_stereo", false, "", 0)
+	w.uploaded[0] = true
+
+	p.publishMissing(context.Background(), job, segments, w)
+
+	if len(coord.publishes) != 2 {
+		t.Fatalf("expected error for 2 missing segments, got %d", len(coord.publishes))
+	}
+	if len(storage.failures) != 2 || storage.failures[0].Index != 1 || storage.failures[1].Index != 2 {
+		t.Fatalf("expected failure records for segments 1 and 2, got %#v", storage.failures)
+	}
 	for _, status := range coord.publishes {
 		if status.State != domain.SegmentStateError || status.Error == "" {
 			t.Fatalf("status missing error: %#v", status)
@@ -93,6 +198,639 @@ func TestPublishErrorSendsRange(t *testing.T) {
 	}
 }
 
+func TestWaitForWorkerBlocksUntilDoneAndKillsOnCancel(t *testing.T) {
+	p := &Pool{}
+
+	w := NewWorker(nil, nil, "", "", false, "", 0)
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		w.finish()
+	}()
+	p.waitForWorker(context.Background(), w)
+	select {
+	case <-w.Done():
+	default:
+		t.Fatalf("waitForWorker returned before the worker finished")
+	}
+
+	killed := false
+	w = NewWorker(nil, nil, "", "", false, "", 0)
+	w.cancel = func() {
+		killed = true
+		w.finish()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	p.waitForWorker(ctx, w)
+	if !killed {
+		t.Fatalf("expected worker to be killed on context cancellation")
+	}
+}
+
+func TestProcessJobKillsHungFFmpegAfterJobTimeout(t *testing.T) {
+	tmp := t.TempDir()
+	script := filepath.Join(tmp, "ffmpeg")
+	if err := os.WriteFile(script, []byte("#!/bin/sh\nexec sleep 10\n"), 0755); err != nil {
+		t.Fatalf("write script: %v", err)
+	}
+
+	origPath := os.Getenv("PATH")
+	t.Cleanup(func() { _ = os.Setenv("PATH", origPath) })
+	_ = os.Setenv("PATH", tmp+string(os.PathListSeparator)+origPath)
+
+	meta, _ := json.Marshal(domain.Metadata{
+		Duration:  12,
+		Keyframes: []float64{0, 6},
+		Audios:    []domain.AudioStream{{Codec: "aac", Channels: 2}},
+	})
+	storage := &memoryStorage{meta: meta}
+	coord := &stubCoordinator{}
+	completed := make(chan domain.Job, 1)
+	p := NewPool(coord, 1, domain.StreamAudio, storage, ffmpeg.NewCommandBuilder(hwaccel.NewConfig(domain.AccelNone)), storage, Options{
+		JobTimeout:    100 * time.Millisecond,
+		OnJobComplete: func(job domain.Job) { completed <- job },
+	})
+
+	start := time.Now()
+	p.processJob(context.Background(), domain.Job{SourceURL: "file:///source", Rendition: "aac_stereo", StartIndex: 0, EndIndex: 1})
+
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("hung ffmpeg was not killed by job timeout (took %v)", elapsed)
+	}
+	if len(coord.publishes) != 2 {
+		t.Fatalf("expected both segments to be failed, got %d publishes", len(coord.publishes))
+	}
+	for _, status := range coord.publishes {
+		if status.State != domain.SegmentStateError {
+			t.Fatalf("expected error status, got %#v", status)
+		}
+	}
+
+	select {
+	case job := <-completed:
+		if job.Rendition != "aac_stereo" {
+			t.Fatalf("unexpected completed job: %#v", job)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("OnJobComplete hook was not invoked")
+	}
+}
+
+func TestProcessJobRetriesFailedHardwareEncodeInSoftware(t *testing.T) {
+	tmp := t.TempDir()
+	calls := filepath.Join(tmp, "calls")
+	script := `#!/bin/sh
+echo "$*" >> ` + calls + `
+case "$*" in *h264_nvenc*) echo "OpenEncodeSessionEx failed: out of memory" >&2; exit 1;; esac
+for out; do :; done
+dir=$(dirname "$out")
+for i in 0 1; do
+  f=$(printf "segment-%05d.ts" $i)
+  echo data > "$dir/$f"
+  echo "$f"
+done
+`
+	if err := os.WriteFile(filepath.Join(tmp, "ffmpeg"), []byte(script), 0755); err != nil {
+		t.Fatalf("write script: %v", err)
+	}
+	t.Setenv("PATH", tmp+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	meta, _ := json.Marshal(domain.Metadata{
+		Duration:  12,
+		Keyframes: []float64{0, 6},
+		Video:     domain.VideoStream{Codec: "h264", Width: 1920, Height: 1080},
+	})
+	storage := &memoryStorage{meta: meta}
+	coord := &stubCoordinator{}
+	var logs bytes.Buffer
+	p := NewPool(coord, 1, domain.StreamVideo, storage, ffmpeg.NewCommandBuilder(hwaccel.NewConfig(domain.AccelCUDA)), storage, Options{Logger: slog.New(slog.NewTextHandler(&logs, nil))})
+
+	p.processJob(context.Background(), domain.Job{SourceURL: "file:///source", Rendition: "720p", StartIndex: 0, EndIndex: 1})
+	if !strings.Contains(logs.String(), "retrying in software") || !strings.Contains(logs.String(), "rendition=720p") {
+		t.Fatalf("expected the retry logged, got %q", logs.String())
+	}
+
+	data, err := os.ReadFile(calls)
+	if err != nil {
+		t.Fatalf("read calls: %v", err)
+	}
+	runs := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(runs) != 2 || !strings.Contains(runs[0], "h264_nvenc") || !strings.Contains(runs[1], "libx264") {
+		t.Fatalf("expected a hardware run followed by a software retry, got %q", runs)
+	}
+	if len(storage.writes) != 2 {
+		t.Fatalf("expected both segments from the software run, got %d", len(storage.writes))
+	}
+	for _, status := range coord.publishes {
+		if status.State == domain.SegmentStateError {
+			t.Fatalf("no segment should fail after the retry: %#v", coord.publishes)
+		}
+	}
+}
+
+func TestSoftwareRetryKeepsSegmentsTheHardwareRunStored(t *testing.T) {
+	tmp := t.TempDir()
+	script := `#!/bin/sh
+for out; do :; done
+dir=$(dirname "$out")
+last=1
+case "$*" in *h264_nvenc*) last=0;; esac
+for i in $(seq 0 $last); do
+  f=$(printf "segment-%05d.ts" $i)
+  echo data > "$dir/$f"
+  echo "$f"
+done
+case "$*" in *h264_nvenc*) exit 1;; esac
+`
+	if err := os.WriteFile(filepath.Join(tmp, "ffmpeg"), []byte(script), 0755); err != nil {
+		t.Fatalf("write script: %v", err)
+	}
+	t.Setenv("PATH", tmp+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	meta, _ := json.Marshal(domain.Metadata{
+		Duration:  12,
+		Keyframes: []float64{0, 6},
+		Video:     domain.VideoStream{Codec: "h264", Width: 1920, Height: 1080},
+	})
+	storage := &memoryStorage{meta: meta}
+	coord := &stubCoordinator{}
+	p := NewPool(coord, 1, domain.StreamVideo, storage, ffmpeg.NewCommandBuilder(hwaccel.NewConfig(domain.AccelCUDA)), storage, Options{})
+
+	p.processJob(context.Background(), domain.Job{SourceURL: "file:///source", Rendition: "720p", StartIndex: 0, EndIndex: 1})
+
+	if len(storage.writes) != 2 || storage.writes[0].Index != 0 || storage.writes[1].Index != 1 {
+		t.Fatalf("expected segment 0 from the hardware run and only segment 1 from the retry, got %#v", storage.writes)
+	}
+	for _, status := range coord.publishes {
+		if status.State == domain.SegmentStateError {
+			t.Fatalf("no segment should fail after the retry: %#v", coord.publishes)
+		}
+	}
+}
+
+type failingWrites struct {
+	*memoryStorage
+}
+
+func (f failingWrites) WriteSegment(ctx context.Context, info domain.SegmentData, data []byte) error {
+	return assertErr("storage unavailable")
+}
+
+func TestStorageErrorsDoNotRetryInSoftware(t *testing.T) {
+	tmp := t.TempDir()
+	calls := filepath.Join(tmp, "calls")
+	script := `#!/bin/sh
+echo "$*" >> ` + calls + `
+for out; do :; done
+f=$(printf "segment-%05d.ts" 0)
+echo data > "$(dirname "$out")/$f"
+echo "$f"
+`
+	if err := os.WriteFile(filepath.Join(tmp, "ffmpeg"), []byte(script), 0755); err != nil {
+		t.Fatalf("write script: %v", err)
+	}
+	t.Setenv("PATH", tmp+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	meta, _ := json.Marshal(domain.Metadata{
+		Duration:  6,
+		Keyframes: []float64{0},
+		Video:     domain.VideoStream{Codec: "h264", Width: 1920, Height: 1080},
+	})
+	storage := &memoryStorage{meta: meta}
+	p := NewPool(&stubCoordinator{}, 1, domain.StreamVideo, storage, ffmpeg.NewCommandBuilder(hwaccel.NewConfig(domain.AccelCUDA)), failingWrites{storage}, Options{})
+
+	p.processJob(context.Background(), domain.Job{SourceURL: "file:///source", Rendition: "720p", StartIndex: 0, EndIndex: 0})
+
+	data, err := os.ReadFile(calls)
+	if err != nil {
+		t.Fatalf("read calls: %v", err)
+	}
+	if runs := strings.Split(strings.TrimSpace(string(data)), "\n"); len(runs) != 1 {
+		t.Fatalf("a storage error must not trigger a software retry, got %q", runs)
+	}
+}
+
+func TestProcessJobReportsEncodeSpeed(t *testing.T) {
+	tmp := t.TempDir()
+	script := `#!/bin/sh
+echo "frame=24" >&2
+echo "speed=N/A" >&2
+echo "progress=continue" >&2
+echo "[aac @ 0x1] Queue input is backward in time" >&2
+echo "speed=0.75x" >&2
+echo "progress=end" >&2
+for out; do :; done
+f=$(printf "segment-%05d.ts" 0)
+echo data > "$(dirname "$out")/$f"
+echo "$f"
+`
+	if err := os.WriteFile(filepath.Join(tmp, "ffmpeg"), []byte(script), 0755); err != nil {
+		t.Fatalf("write script: %v", err)
+	}
+	t.Setenv("PATH", tmp+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	meta, _ := json.Marshal(domain.Metadata{
+		Duration:  6,
+		Keyframes: []float64{0},
+		Audios:    []domain.AudioStream{{Codec: "aac", Channels: 2}},
+	})
+	storage := &memoryStorage{meta: meta}
+	stats := make(chan domain.JobStats, 1)
+	var logs bytes.Buffer
+	p := NewPool(&stubCoordinator{}, 1, domain.StreamAudio, storage, ffmpeg.NewCommandBuilder(hwaccel.NewConfig(domain.AccelNone)), storage, Options{
+		OnJobStats: func(s domain.JobStats) { stats <- s },
+		Logger:     slog.New(slog.NewTextHandler(&logs, nil)),
+	})
+
+	p.processJob(context.Background(), domain.Job{SourceURL: "file:///source", Rendition: "aac_stereo", StartIndex: 0, EndIndex: 0})
+
+	select {
+	case s := <-stats:
+		if s.Speed != 0.75 || s.Elapsed <= 0 || s.Job.Rendition != "aac_stereo" {
+			t.Fatalf("unexpected stats: %#v", s)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("OnJobStats was not called")
+	}
+	if !strings.Contains(logs.String(), "slower than realtime") || !strings.Contains(logs.String(), "speed=0.75") {
+		t.Fatalf("expected the slow job logged, got %q", logs.String())
+	}
+}
+
+type progressCoordinator struct {
+	stubCoordinator
+	progress []domain.JobProgress
+}
+
+func (s *progressCoordinator) NotifyProgress(ctx context.Context, progress domain.JobProgress) error {
+	s.progress = append(s.progress, progress)
+	return nil
+}
+
+func TestProcessJobPublishesProgress(t *testing.T) {
+	tmp := t.TempDir()
+	script := `#!/bin/sh
+printf "frame=0\nout_time_us=9000000\nspeed=2x\nprogress=continue\n" >&2
+printf "frame=0\nout_time_us=12000000\nspeed=2x\nprogress=end\n" >&2
+for out; do :; done
+f=$(printf "segment-%05d.ts" 1)
+echo data > "$(dirname "$out")/$f"
+echo "$f"
+`
+	if err := os.WriteFile(filepath.Join(tmp, "ffmpeg"), []byte(script), 0755); err != nil {
+		t.Fatalf("write script: %v", err)
+	}
+	t.Setenv("PATH", tmp+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	meta, _ := json.Marshal(domain.Metadata{
+		Duration:  12,
+		Keyframes: []float64{0, 6},
+		Audios:    []domain.AudioStream{{Codec: "aac", Channels: 2}},
+	})
+	storage := &memoryStorage{meta: meta}
+	coord := &progressCoordinator{}
+	p := NewPool(coord, 1, domain.StreamAudio, storage, ffmpeg.NewCommandBuilder(hwaccel.NewConfig(domain.AccelNone)), storage, Options{})
+
+	p.processJob(context.Background(), domain.Job{SourceURL: "file:///source", Rendition: "aac_stereo", StartIndex: 1, EndIndex: 1})
+
+	if len(coord.progress) != 2 {
+		t.Fatalf("expected one notification per progress block, got %#v", coord.progress)
+	}
+	if got := coord.progress[0]; got.Fraction != 0.5 || got.Position != 9 || got.Speed != 2 || got.Job.StartIndex != 1 {
+		t.Fatalf("expected halfway through the 6-12s range, got %#v", got)
+	}
+	if got := coord.progress[1]; got.Fraction != 1 {
+		t.Fatalf("expected the final block at the end of the range, got %#v", got)
+	}
+}
+
+// queueCoordinator delivers the jobs sent on jobs to a started pool and
+// reports each acknowledged job ID on acked.
+type queueCoordinator struct {
+	stubCoordinator
+	jobs  chan domain.Job
+	acked chan string
+}
+
+func (q *queueCoordinator) Subscribe(ctx context.Context, streamType domain.StreamType) (<-chan domain.Job, error) {
+	return q.jobs, nil
+}
+func (q *queueCoordinator) Ack(ctx context.Context, jobID string) error {
+	q.acked <- jobID
+	return nil
+}
+func (q *queueCoordinator) NotifySegment(ctx context.Context, info domain.SegmentData, status domain.SegmentStatus) error {
+	return nil
+}
+
+// installSessionFFmpeg puts an ffmpeg on PATH whose NVENC runs each hold a
+// single session until a line is written to release, recording any overlap
+// in the overlaps file.
+func installSessionFFmpeg(t *testing.T) (release, overlaps string) {
+	t.Helper()
+	tmp := t.TempDir()
+	lock := filepath.Join(tmp, "session")
+	overlaps = filepath.Join(tmp, "overlaps")
+	release = filepath.Join(tmp, "release")
+	if err := syscall.Mkfifo(release, 0600); err != nil {
+		t.Fatalf("mkfifo: %v", err)
+	}
+	script := `#!/bin/sh
+case "$*" in *h264_nvenc*)
+  mkdir ` + lock + ` 2>/dev/null || echo overlap >> ` + overlaps + `
+  read x < ` + release + `
+  rmdir ` + lock + `;;
+esac
+for out; do :; done
+f=$(printf "segment-%05d.ts" 0)
+echo data > "$(dirname "$out")/$f"
+echo "$f"
+`
+	if err := os.WriteFile(filepath.Join(tmp, "ffmpeg"), []byte(script), 0755); err != nil {
+		t.Fatalf("write script: %v", err)
+	}
+	t.Setenv("PATH", tmp+string(os.PathListSeparator)+os.Getenv("PATH"))
+	return release, overlaps
+}
+
+func TestHardwareJobsWaitingForASessionDoNotHoldWorkers(t *testing.T) {
+	release, overlaps := installSessionFFmpeg(t)
+
+	meta, _ := json.Marshal(domain.Metadata{
+		Duration:  12,
+		Keyframes: []float64{0, 6},
+		Video:     domain.VideoStream{Codec: "h264", Width: 1920, Height: 1080},
+	})
+	storage := &memoryStorage{meta: meta}
+	coord := &queueCoordinator{jobs: make(chan domain.Job, 3), acked: make(chan string, 3)}
+	p := NewPool(coord, 2, domain.StreamVideo, storage, ffmpeg.NewCommandBuilder(hwaccel.NewConfig(domain.AccelCUDA)), storage, Options{HardwareSessions: 1})
+	if err := p.Start(context.Background()); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	defer p.Stop()
+
+	coord.jobs <- domain.Job{ID: "720p", SourceURL: "file:///source", Rendition: "720p"}
+	coord.jobs <- domain.Job{ID: "480p", SourceURL: "file:///source", Rendition: "480p"}
+	coord.jobs <- domain.Job{ID: "1080p", SourceURL: "file:///source", Rendition: "1080p"}
+
+	acked := func() string {
+		select {
+		case id := <-coord.acked:
+			return id
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for a job")
+			return ""
+		}
+	}
+	if id := acked(); id != "1080p" {
+		t.Fatalf("expected the direct-stream job to finish while hardware jobs wait, got %s", id)
+	}
+	for range 2 {
+		if err := os.WriteFile(release, []byte("go\n"), 0600); err != nil {
+			t.Fatalf("release hardware job: %v", err)
+		}
+		acked()
+	}
+
+	if _, err := os.Stat(overlaps); err == nil {
+		t.Fatal("hardware jobs ran concurrently despite a single session")
+	}
+}
+
+func TestHardwareJobsBeyondTheQueueStayInTheCoordinator(t *testing.T) {
+	release, _ := installSessionFFmpeg(t)
+
+	meta, _ := json.Marshal(domain.Metadata{
+		Duration:  12,
+		Keyframes: []float64{0, 6},
+		Video:     domain.VideoStream{Codec: "h264", Width: 1920, Height: 1080},
+	})
+	storage := &memoryStorage{meta: meta}
+	coord := &queueCoordinator{jobs: make(chan domain.Job, 4), acked: make(chan string, 4)}
+	p := NewPool(coord, 1, domain.StreamVideo, storage, ffmpeg.NewCommandBuilder(hwaccel.NewConfig(domain.AccelCUDA)), storage, Options{HardwareSessions: 1})
+	if err := p.Start(context.Background()); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	defer p.Stop()
+
+	// One hardware job runs and one queues for the session; the worker
+	// then waits to hand over the third, leaving the direct-stream job in
+	// the Coordinator until the first hardware job finishes.
+	coord.jobs <- domain.Job{ID: "720p", SourceURL: "file:///source", Rendition: "720p"}
+	coord.jobs <- domain.Job{ID: "480p", SourceURL: "file:///source", Rendition: "480p"}
+	coord.jobs <- domain.Job{ID: "360p", SourceURL: "file:///source", Rendition: "360p"}
+	coord.jobs <- domain.Job{ID: "1080p", SourceURL: "file:///source", Rendition: "1080p"}
+
+	acked := func() string {
+		select {
+		case id := <-coord.acked:
+			return id
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for a job")
+			return ""
+		}
+	}
+	if err := os.WriteFile(release, []byte("go\n"), 0600); err != nil {
+		t.Fatalf("release hardware job: %v", err)
+	}
+	if id := acked(); id != "720p" {
+		t.Fatalf("expected the running hardware job to finish first, got %s", id)
+	}
+	if id := acked(); id != "1080p" {
+		t.Fatalf("expected the direct-stream job once the queue had room, got %s", id)
+	}
+	for _, want := range []string{"480p", "360p"} {
+		if err := os.WriteFile(release, []byte("go\n"), 0600); err != nil {
+			t.Fatalf("release hardware job: %v", err)
+		}
+		if id := acked(); id != want {
+			t.Fatalf("expected %s, got %s", want, id)
+		}
+	}
+}
+
 type assertErr string
 
 func (e assertErr) Error() string { return string(e) }
+
+// segmentingFFmpeg emits one segment per -segment_times cut plus one, numbered
+// from -segment_start_number, each holding its own index.
+const segmentingFFmpeg = `#!/bin/sh
+start=0
+times=""
+while [ $# -gt 1 ]; do
+  case "$1" in
+    -segment_start_number) start=$2;;
+    -segment_times) times=$2;;
+  esac
+  shift
+done
+dir=$(dirname "$1")
+last=$((start + $(echo "$times" | tr ',' '\n' | grep -c .)))
+i=$start
+while [ $i -le $last ]; do
+  f=$(printf "segment-%05d.ts" $i)
+  echo $i > "$dir/$f"
+  echo "$f"
+  i=$((i + 1))
+done
+`
+
+func TestDirectStreamJobsStayContinuousAcrossBoundaries(t *testing.T) {
+	tmp := t.TempDir()
+	if err := os.WriteFile(filepath.Join(tmp, "ffmpeg"), []byte(segmentingFFmpeg), 0755); err != nil {
+		t.Fatalf("write script: %v", err)
+	}
+	t.Setenv("PATH", tmp+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	var keyframes []float64
+	for kf := 0.0; kf < 40; kf += 2 {
+		keyframes = append(keyframes, kf)
+	}
+	meta := &domain.Metadata{Duration: 40, Keyframes: keyframes, Video: domain.VideoStream{Codec: "h264", Width: 1920, Height: 1080}}
+	metaBytes, _ := json.Marshal(meta)
+	jobs := []domain.Job{
+		{SourceURL: "file:///source", Rendition: "1080p", StartIndex: 0, EndIndex: 2},
+		{SourceURL: "file:///source", Rendition: "1080p", StartIndex: 3, EndIndex: 6},
+	}
+
+	for _, tc := range []struct{ overlap, ahead int }{{0, 1}, {2, 2}, {-1, 0}} {
+		storage := &memoryStorage{meta: metaBytes}
+		p := NewPool(&stubCoordinator{}, 1, domain.StreamVideo, storage, ffmpeg.NewCommandBuilder(hwaccel.NewConfig(domain.AccelNone)), storage, Options{OverlapSegments: tc.overlap})
+		segments := p.extractSegments(meta, defaultTargetDuration, 0, 6)
+
+		first, err := p.Command(context.Background(), jobs[0], "/out")
+		if err != nil {
+			t.Fatalf("command: %v", err)
+		}
+		second, err := p.Command(context.Background(), jobs[1], "/out")
+		if err != nil {
+			t.Fatalf("command: %v", err)
+		}
+		if end := argValue(first, "-to"); end != fmt.Sprintf("%.6f", segments[3].Start-0.001) {
+			t.Fatalf("overlap %d: first job must stop just short of segment 3, got -to %s", tc.overlap, end)
+		}
+		if start := argValue(second, "-ss"); start != fmt.Sprintf("%.6f", segments[3-tc.ahead].Start) {
+			t.Fatalf("overlap %d: expected second job to start %d segments early, got -ss %s", tc.overlap, tc.ahead, start)
+		}
+		if n := argValue(second, "-segment_start_number"); n != strconv.Itoa(3-tc.ahead) {
+			t.Fatalf("overlap %d: expected numbering from %d, got %s", tc.overlap, 3-tc.ahead, n)
+		}
+
+		for _, job := range jobs {
+			p.processJob(context.Background(), job)
+		}
+		seen := make(map[int]int)
+		for i, w := range storage.writes {
+			seen[w.Index]++
+			if string(storage.data[i]) != strconv.Itoa(w.Index)+"\n" {
+				t.Fatalf("overlap %d: segment %d stored with data %q", tc.overlap, w.Index, storage.data[i])
+			}
+		}
+		for i := 0; i <= 6; i++ {
+			if seen[i] != 1 {
+				t.Fatalf("overlap %d: expected segment %d stored once, got %d (%v)", tc.overlap, i, seen[i], seen)
+			}
+		}
+	}
+}
+
+func TestFastStartOnlyAffectsTheFirstJob(t *testing.T) {
+	var keyframes []float64
+	for kf := 0.0; kf < 40; kf += 2 {
+		keyframes = append(keyframes, kf)
+	}
+	meta := &domain.Metadata{Duration: 40, Keyframes: keyframes, Video: domain.VideoStream{Codec: "h264", Width: 1920, Height: 1080}}
+	metaBytes, _ := json.Marshal(meta)
+	storage := &memoryStorage{meta: metaBytes}
+	p := NewPool(&stubCoordinator{}, 1, domain.StreamVideo, storage, ffmpeg.NewCommandBuilder(hwaccel.NewConfig(domain.AccelNone)), storage, Options{FastStart: true, TwoPass: true})
+
+	for _, tc := range []struct {
+		job  domain.Job
+		fast bool
+	}{
+		{domain.Job{SourceURL: "file:///source", Rendition: "720p", StartIndex: 0, EndIndex: 2}, true},
+		{domain.Job{SourceURL: "file:///source", Rendition: "720p", StartIndex: 3, EndIndex: 5}, false},
+	} {
+		args, err := p.Command(context.Background(), tc.job, "/out")
+		if err != nil {
+			t.Fatalf("command: %v", err)
+		}
+		joined := strings.Join(args, " ")
+		if fast := strings.Contains(joined, "-tune zerolatency"); fast != tc.fast {
+			t.Fatalf("job from %d: expected fast start %v, got %s", tc.job.StartIndex, tc.fast, joined)
+		}
+		if twoPass := strings.Contains(joined, "-pass 2"); twoPass == tc.fast {
+			t.Fatalf("job from %d: expected two-pass %v, got %s", tc.job.StartIndex, !tc.fast, joined)
+		}
+	}
+}
+
+func argValue(args []string, flag string) string {
+	for i := 0; i < len(args)-1; i++ {
+		if args[i] == flag {
+			return args[i+1]
+		}
+	}
+	return ""
+}
+
+func TestJobsTileTheSourceWithoutOverlap(t *testing.T) {
+	// Irregular keyframes at 23.976 fps, as probed to the microsecond.
+	var keyframes []float64
+	for frame := 0; frame < 1440; frame += 48 + frame%5*12 {
+		keyframes = append(keyframes, math.Round(float64(frame)*1001/24000*1e6)/1e6)
+	}
+	meta := &domain.Metadata{Duration: 60.06, Keyframes: keyframes, Video: domain.VideoStream{Codec: "h264", Width: 1920, Height: 1080, FrameRate: 23.976}}
+	metaBytes, _ := json.Marshal(meta)
+	p := NewPool(&stubCoordinator{}, 1, domain.StreamVideo, &memoryStorage{meta: metaBytes}, ffmpeg.NewCommandBuilder(hwaccel.NewConfig(domain.AccelNone)), nil, Options{})
+	segments := p.extractSegments(meta, defaultTargetDuration, 0, math.MaxInt)
+	const frame = 1001.0 / 24000
+
+	for _, rendition := range []string{"1080p", "720p"} {
+		var total, covered float64
+		for start := 0; start < len(segments); start += 3 {
+			job := domain.Job{SourceURL: "file:///source", Rendition: rendition, StartIndex: start, EndIndex: min(start+2, len(segments)-1)}
+			args, err := p.Command(context.Background(), job, "/out")
+			if err != nil {
+				t.Fatalf("%s: command: %v", rendition, err)
+			}
+
+			offset, _ := strconv.ParseFloat(argValue(args, "-ss"), 64)
+			if rendition == "1080p" {
+				// Stream copies count their cuts from the keyframe the seek lands on.
+				offset = findNearestKeyframe(meta.Keyframes, offset)
+			}
+			to, _ := strconv.ParseFloat(argValue(args, "-to"), 64)
+			first, _ := strconv.Atoi(argValue(args, "-segment_start_number"))
+			cuts := []float64{0}
+			for _, c := range strings.Split(argValue(args, "-segment_times"), ",") {
+				v, _ := strconv.ParseFloat(c, 64)
+				cuts = append(cuts, v)
+			}
+
+			// Segment first+i spans cuts[i] to cuts[i+1] after the seek.
+			for i := 0; i+1 < len(cuts); i++ {
+				index := first + i
+				if index < job.StartIndex || index > job.EndIndex {
+					continue
+				}
+				begin, end := offset+cuts[i], offset+cuts[i+1]
+				if math.Abs(begin-covered) > 1e-6 || math.Abs(end-segments[index].End) > 1e-6 {
+					t.Fatalf("%s: segment %d spans %.6f-%.6f, want %.6f-%.6f", rendition, index, begin, end, covered, segments[index].End)
+				}
+				total += end - begin
+				covered = end
+			}
+
+			jobEnd := segments[job.EndIndex].End
+			if offset+cuts[len(cuts)-1]-jobEnd > 1e-6 || to >= jobEnd || to <= jobEnd-frame/2 {
+				t.Fatalf("%s: job %d-%d must cut at %.6f and stop within half a frame before it, got cut %.6f and -to %.6f",
+					rendition, job.StartIndex, job.EndIndex, jobEnd, offset+cuts[len(cuts)-1], to)
+			}
+		}
+		if math.Abs(total-meta.Duration) > 1e-5 {
+			t.Fatalf("%s: kept segments add up to %.6fs of a %.2fs source", rendition, total, meta.Duration)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package transcode
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// maxProgressLine bounds how much of an unterminated stderr line is buffered.
+const maxProgressLine = 64 << 10
+
+// Progress is one block of ffmpeg -progress output.
+type Progress struct {
+	// Frame is the number of video frames encoded so far; zero for audio.
+	Frame int64
+
+	// OutTime is the output position in seconds. Commands keep source
+	// timestamps (-copyts), so it is a position in the source.
+	OutTime float64
+
+	// Speed is the encode speed relative to realtime, zero until known.
+	Speed float64
+
+	// End is set on the final block, written when ffmpeg exits.
+	End bool
+}
+
+// progressWriter receives ffmpeg's stderr and parses the key=value blocks
+// written by -progress, each terminated by a "progress" line. Other output,
+// such as warnings, is ignored.
+type progressWriter struct {
+	mu       sync.Mutex
+	buf      []byte
+	current  Progress
+	onUpdate func(Progress)
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	var blocks []Progress
+	p.buf = append(p.buf, b...)
+	for {
+		i := bytes.IndexByte(p.buf, '\n')
+		if i < 0 {
+			break
+		}
+		if p.parseLine(string(p.buf[:i])) {
+			blocks = append(blocks, p.current)
+		}
+		p.buf = p.buf[i+1:]
+	}
+	if len(p.buf) > maxProgressLine {
+		p.buf = p.buf[:0]
+	}
+	onUpdate := p.onUpdate
+	p.mu.Unlock()
+
+	if onUpdate != nil {
+		for _, block := range blocks {
+			onUpdate(block)
+		}
+	}
+	return len(b), nil
+}
+
+// parseLine applies one line to the current block and reports whether it
+// completed the block.
+func (p *progressWriter) parseLine(line string) bool {
+	key, value, ok := strings.Cut(strings.TrimSpace(line), "=")
+	if !ok {
+		return false
+	}
+	value = strings.TrimSpace(value)
+	switch key {
+	case "frame":
+		if frame, err := strconv.ParseInt(value, 10, 64); err == nil {
+			p.current.Frame = frame
+		}
+	case "out_time_us", "out_time_ms":
+		// out_time_ms is also in microseconds; older builds only write it.
+		if us, err := strconv.ParseInt(value, 10, 64); err == nil && us >= 0 {
+			p.current.OutTime = float64(us) / 1e6
+		}
+	case "speed":
+		if speed, ok := parseSpeed(value); ok {
+			p.current.Speed = speed
+		}
+	case "progress":
+		p.current.End = value == "end"
+		return true
+	}
+	return false
+}
+
+// Speed returns the latest encode speed relative to realtime, or zero if
+// ffmpeg has not reported one.
+func (p *progressWriter) Speed() float64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.current.Speed
+}
+
+// parseSpeed parses ffmpeg's realtime factor, such as "1.25x". ffmpeg
+// reports "N/A" until it has encoded anything.
+func parseSpeed(s string) (float64, bool) {
+	s = strings.TrimSuffix(strings.TrimSpace(s), "x")
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil || v <= 0 {
+		return 0, false
+	}
+	return v, true
+}
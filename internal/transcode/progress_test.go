@@ -0,0 +1,47 @@
+package transcode
+
+import "testing"
+
+func TestProgressWriterKeepsLatestSpeedAcrossWrites(t *testing.T) {
+	var p progressWriter
+	if p.Speed() != 0 {
+		t.Fatalf("expected no speed before progress, got %v", p.Speed())
+	}
+
+	p.Write([]byte("frame=10\nspeed=N/A\nprogress=continue\n"))
+	if p.Speed() != 0 {
+		t.Fatalf("N/A must not set a speed, got %v", p.Speed())
+	}
+
+	p.Write([]byte("[h264 @ 0x1] non-existing PPS 0 referenced\nspe"))
+	p.Write([]byte("ed=   1.5x\nprogress=continue\n"))
+	if p.Speed() != 1.5 {
+		t.Fatalf("expected speed split across writes to parse, got %v", p.Speed())
+	}
+
+	p.Write([]byte("speed=0.8x\r\n"))
+	if p.Speed() != 0.8 {
+		t.Fatalf("expected latest speed, got %v", p.Speed())
+	}
+}
+
+func TestProgressWriterReportsEachBlock(t *testing.T) {
+	var blocks []Progress
+	p := progressWriter{onUpdate: func(pr Progress) { blocks = append(blocks, pr) }}
+
+	p.Write([]byte("frame=48\nout_time_us=2002000\nout_time=00:00:02.002000\nspeed=1.2x\nprogress=continue\nframe=96\n"))
+	p.Write([]byte("out_time_ms=4004000\nspeed=1.1x\nprogress=end\n"))
+
+	want := []Progress{
+		{Frame: 48, OutTime: 2.002, Speed: 1.2},
+		{Frame: 96, OutTime: 4.004, Speed: 1.1, End: true},
+	}
+	if len(blocks) != len(want) {
+		t.Fatalf("expected %d blocks, got %#v", len(want), blocks)
+	}
+	for i := range want {
+		if blocks[i] != want[i] {
+			t.Fatalf("block %d: want %#v, got %#v", i, want[i], blocks[i])
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package transcode
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+	"sync"
+
+	"github.com/eleven-am/goshl/internal/domain"
+	"github.com/eleven-am/goshl/internal/source"
+)
+
+// streamReader exposes a running ffmpeg's stdout. Reaching EOF reports the
+// process exit status; Close stops the process if it is still running.
+type streamReader struct {
+	stdout io.ReadCloser
+	cmd    *exec.Cmd
+	cancel context.CancelFunc
+	stderr bytes.Buffer
+	input  io.Closer
+
+	once sync.Once
+	err  error
+}
+
+// RunStream starts ffmpeg with args, which read from sourceURL, and returns
+// its stdout. A "pipe:" source is opened with open. The caller must Close the
+// reader; doing so before EOF kills ffmpeg.
+func RunStream(ctx context.Context, args []string, open domain.SourceOpener, sourceURL string) (io.ReadCloser, error) {
+	ctx, cancel := context.WithCancel(ctx)
+
+	s := &streamReader{cancel: cancel}
+	s.cmd = exec.CommandContext(ctx, "ffmpeg", args...)
+	s.cmd.Stderr = &s.stderr
+
+	input, err := source.Attach(ctx, s.cmd, open, sourceURL)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	s.input = input
+
+	stdout, err := s.cmd.StdoutPipe()
+	if err != nil {
+		cancel()
+		input.Close()
+		return nil, err
+	}
+	s.stdout = stdout
+
+	if err := s.cmd.Start(); err != nil {
+		cancel()
+		input.Close()
+		return nil, fmt.Errorf("start ffmpeg: %w", err)
+	}
+
+	return s, nil
+}
+
+func (s *streamReader) Read(p []byte) (int, error) {
+	n, err := s.stdout.Read(p)
+	if err == io.EOF {
+		if werr := s.wait(); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+func (s *streamReader) Close() error {
+	s.cancel()
+	s.wait()
+	return nil
+}
+
+func (s *streamReader) wait() error {
+	s.once.Do(func() {
+		err := s.cmd.Wait()
+		s.input.Close()
+		if err != nil {
+			s.err = fmt.Errorf("ffmpeg: %w: %s", err, strings.TrimSpace(s.stderr.String()))
+		}
+	})
+	return s.err
+}
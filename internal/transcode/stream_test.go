@@ -0,0 +1,84 @@
+package transcode
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/eleven-am/goshl/internal/domain"
+	"github.com/eleven-am/goshl/internal/ffmpeg"
+	"github.com/eleven-am/goshl/internal/hwaccel"
+)
+
+func installStreamFFmpeg(t *testing.T, body string) {
+	t.Helper()
+	tmp := t.TempDir()
+	if err := os.WriteFile(filepath.Join(tmp, "ffmpeg"), []byte("#!/bin/sh\n"+body), 0755); err != nil {
+		t.Fatalf("write script: %v", err)
+	}
+	t.Setenv("PATH", tmp+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+func TestPoolStreamPipesFFmpegStdout(t *testing.T) {
+	installStreamFFmpeg(t, "echo \"$@\"\n")
+
+	meta, _ := json.Marshal(domain.Metadata{
+		Duration: 12,
+		Video:    domain.VideoStream{Codec: "h264", Width: 1280, Height: 720},
+	})
+	storage := &memoryStorage{meta: meta}
+	p := NewPool(&stubCoordinator{}, 1, domain.StreamVideo, storage, ffmpeg.NewCommandBuilder(hwaccel.NewConfig(domain.AccelNone)), storage, Options{})
+
+	rc, err := p.Stream(context.Background(), "file:///source", "480p", 2, 0)
+	if err != nil {
+		t.Fatalf("stream: %v", err)
+	}
+	defer rc.Close()
+
+	out, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatalf("read stream: %v", err)
+	}
+	args := string(out)
+	if !strings.Contains(args, "-ss 2.000000") || !strings.Contains(args, "-to 12.000000") {
+		t.Fatalf("expected start and source-duration end, got %q", args)
+	}
+	if !strings.Contains(args, "-f mpegts pipe:1") {
+		t.Fatalf("expected piped mpegts output, got %q", args)
+	}
+
+	if _, err := p.Stream(context.Background(), "file:///source", "1080p", 0, 0); err == nil {
+		t.Fatalf("expected error for unknown rendition")
+	}
+}
+
+func TestRunStreamReportsFailureAndKillsOnClose(t *testing.T) {
+	installStreamFFmpeg(t, "echo boom >&2\nexit 1\n")
+
+	rc, err := RunStream(context.Background(), nil, nil, "")
+	if err != nil {
+		t.Fatalf("run stream: %v", err)
+	}
+	if _, err := io.ReadAll(rc); err == nil || !strings.Contains(err.Error(), "boom") {
+		t.Fatalf("expected ffmpeg failure with stderr, got %v", err)
+	}
+	rc.Close()
+
+	installStreamFFmpeg(t, "exec sleep 10\n")
+	rc, err = RunStream(context.Background(), nil, nil, "")
+	if err != nil {
+		t.Fatalf("run stream: %v", err)
+	}
+	start := time.Now()
+	if err := rc.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Fatalf("Close did not stop ffmpeg")
+	}
+}
@@ -2,18 +2,28 @@ package transcode
 
 import (
 	"bufio"
+	"bytes"
 	"context"
+	"encoding/binary"
 	"fmt"
+	"io"
+	"math"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/eleven-am/goshl/internal/domain"
+	"github.com/eleven-am/goshl/internal/source"
 )
 
+// sizeCheckInterval is how often a worker with a segment size limit checks
+// the segments ffmpeg is still writing.
+const sizeCheckInterval = 500 * time.Millisecond
+
 type WorkerState int
 
 const (
@@ -25,33 +35,121 @@ const (
 
 type Worker struct {
 	args      []string
+	firstPass []string
 	storage   domain.Storage
+	inits     domain.InitSegmentStore
 	sourceURL string
 	rendition string
 	isVideo   bool
 	tmpDir    string
-	skipFirst bool
-
-	mu     sync.RWMutex
-	state  WorkerState
-	err    error
-	cmd    *exec.Cmd
-	cancel context.CancelFunc
+	uploaders int
+	maxSize   int64
+	open      domain.SourceOpener
+
+	// firstIndex is the first segment index stored; lower ones are overlap.
+	// lastIndex is the last; higher ones hold what ffmpeg wrote past the
+	// job's end boundary.
+	firstIndex int
+	lastIndex  int
+
+	initMu    sync.Mutex
+	wroteInit bool
+
+	progress progressWriter
+
+	mu       sync.RWMutex
+	state    WorkerState
+	err      error
+	cmd      *exec.Cmd
+	input    io.Closer
+	cancel   context.CancelFunc
+	uploaded map[int]bool
+
+	done     chan struct{}
+	doneOnce sync.Once
 }
 
-func NewWorker(args []string, storage domain.Storage, sourceURL string, rendition string, isVideo bool, tmpDir string, skipFirst bool) *Worker {
+// NewWorker returns a worker running ffmpeg with args. Segments numbered
+// below firstIndex are overlap ahead of the job's range and are discarded
+// rather than stored.
+func NewWorker(args []string, storage domain.Storage, sourceURL string, rendition string, isVideo bool, tmpDir string, firstIndex int) *Worker {
 	return &Worker{
-		args:      args,
-		storage:   storage,
-		sourceURL: sourceURL,
-		rendition: rendition,
-		isVideo:   isVideo,
-		tmpDir:    tmpDir,
-		skipFirst: skipFirst,
-		state:     WorkerStateIdle,
+		args:       args,
+		storage:    storage,
+		sourceURL:  sourceURL,
+		rendition:  rendition,
+		isVideo:    isVideo,
+		tmpDir:     tmpDir,
+		firstIndex: firstIndex,
+		lastIndex:  math.MaxInt,
+		uploaders:  1,
+		state:      WorkerStateIdle,
+		uploaded:   make(map[int]bool),
+		done:       make(chan struct{}),
+	}
+}
+
+// SetFirstPass makes the worker run args to completion before its main
+// command, as the first pass of a two-pass encode. It must be called before
+// Start.
+func (w *Worker) SetFirstPass(args []string) {
+	w.firstPass = args
+}
+
+// SetInitStore sets where the init segment of a fragmented MP4 rendition is
+// written. Without one, a job producing fMP4 segments fails. It must be
+// called before Start.
+func (w *Worker) SetInitStore(inits domain.InitSegmentStore) {
+	w.inits = inits
+}
+
+// SetStored marks segments an earlier run of the same job already wrote to
+// storage. The worker discards them rather than write them again, and
+// reports them as uploaded. It must be called before Start.
+func (w *Worker) SetStored(indexes []int) {
+	for _, idx := range indexes {
+		w.uploaded[idx] = true
 	}
 }
 
+// SetLastIndex makes the worker discard segments numbered above i, which
+// hold output past the job's end boundary rather than store them. It must
+// be called before Start.
+func (w *Worker) SetLastIndex(i int) {
+	w.lastIndex = i
+}
+
+// SetUploadConcurrency sets how many finished segments may be written to
+// storage at once while ffmpeg keeps encoding. Values below 1 mean 1. It
+// must be called before Start.
+func (w *Worker) SetUploadConcurrency(n int) {
+	if n < 1 {
+		n = 1
+	}
+	w.uploaders = n
+}
+
+// SetMaxSegmentSize makes the worker fail, rather than store, a segment larger
+// than n bytes, which usually means runaway rate control. ffmpeg is stopped
+// as soon as a segment it is still writing passes the limit. Zero means no
+// limit. It must be called before Start.
+func (w *Worker) SetMaxSegmentSize(n int64) {
+	w.maxSize = n
+}
+
+// SetSourceOpener sets how the worker reads a "pipe:" source. Each ffmpeg
+// run opens the source afresh. It must be called before Start.
+func (w *Worker) SetSourceOpener(open domain.SourceOpener) {
+	w.open = open
+}
+
+// SetProgressFunc sets a function called with each block of ffmpeg's
+// -progress output. It runs on the goroutine reading ffmpeg's stderr, so a
+// slow fn delays those reads. It must be called before Start.
+func (w *Worker) SetProgressFunc(fn func(Progress)) {
+	w.progress.onUpdate = fn
+}
+
 func (w *Worker) Start(ctx context.Context) error {
 	w.mu.Lock()
 	if w.state != WorkerStateIdle {
@@ -63,37 +161,142 @@ func (w *Worker) Start(ctx context.Context) error {
 
 	ctx, w.cancel = context.WithCancel(ctx)
 
-	w.cmd = exec.CommandContext(ctx, "ffmpeg", w.args...)
-	stdout, err := w.cmd.StdoutPipe()
+	if len(w.firstPass) > 0 {
+		go w.runPasses(ctx)
+		return nil
+	}
+
+	stdout, err := w.startCommand(ctx)
 	if err != nil {
 		w.setError(err)
+		w.finish()
 		return err
 	}
 
-	if err := w.cmd.Start(); err != nil {
+	go w.run(ctx, stdout)
+
+	return nil
+}
+
+// runPasses runs the first pass and then the main command, failing the
+// worker if the first pass does not complete.
+func (w *Worker) runPasses(ctx context.Context) {
+	if err := w.runFirstPass(ctx); err != nil {
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		w.setError(fmt.Errorf("first pass: %w", err))
+		w.finish()
+		return
+	}
+
+	stdout, err := w.startCommand(ctx)
+	if err != nil {
 		w.setError(err)
+		w.finish()
+		return
+	}
+
+	w.run(ctx, stdout)
+}
+
+func (w *Worker) runFirstPass(ctx context.Context) error {
+	cmd := exec.CommandContext(ctx, "ffmpeg", w.firstPass...)
+	input, err := source.Attach(ctx, cmd, w.open, w.sourceURL)
+	if err != nil {
 		return err
 	}
+	defer input.Close()
+	return cmd.Run()
+}
 
-	go w.run(ctx, stdout)
+func (w *Worker) startCommand(ctx context.Context) (interface{}, error) {
+	w.cmd = exec.CommandContext(ctx, "ffmpeg", w.args...)
+	input, err := source.Attach(ctx, w.cmd, w.open, w.sourceURL)
+	if err != nil {
+		return nil, err
+	}
+	w.input = input
+	w.cmd.Stderr = &w.progress
 
-	return nil
+	stdout, err := w.cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := w.cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	return stdout, nil
 }
 
 func (w *Worker) run(ctx context.Context, stdout interface{}) {
+	defer w.finish()
+
 	reader, ok := stdout.(interface{ Read([]byte) (int, error) })
 	if !ok {
 		w.setError(fmt.Errorf("invalid stdout type"))
 		return
 	}
 
+	uploadCtx, cancelUploads := context.WithCancel(ctx)
+	defer cancelUploads()
+
+	uploads := make(chan string)
+	var wg sync.WaitGroup
+	var uploadErr error
+	var errOnce sync.Once
+	fail := func(err error) {
+		errOnce.Do(func() {
+			uploadErr = err
+			cancelUploads()
+		})
+	}
+	for i := 0; i < w.uploaders; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for filename := range uploads {
+				if err := w.uploadSegment(uploadCtx, filename); err != nil {
+					fail(err)
+				}
+			}
+		}()
+	}
+	watchCtx, stopWatching := context.WithCancel(uploadCtx)
+	watched := make(chan struct{})
+	go func() {
+		defer close(watched)
+		if w.maxSize <= 0 {
+			return
+		}
+		if err := w.watchSegmentSizes(watchCtx); err != nil {
+			fail(err)
+			// Killing the process ends its output, so the loop below
+			// drains and reports err.
+			w.cmd.Process.Kill()
+		}
+	}()
+
+	// drain stops feeding the uploaders, waits for in-flight uploads and
+	// stops the size watch, returning the first error from either.
+	drain := func() error {
+		close(uploads)
+		wg.Wait()
+		stopWatching()
+		<-watched
+		return uploadErr
+	}
+
 	scanner := bufio.NewScanner(reader)
-	skipFirst := w.skipFirst
 
 	for scanner.Scan() {
 		select {
 		case <-ctx.Done():
+			drain()
 			w.cmd.Wait()
+			w.setError(ctx.Err())
 			return
 		default:
 		}
@@ -103,19 +306,27 @@ func (w *Worker) run(ctx context.Context, stdout interface{}) {
 			continue
 		}
 
-		if skipFirst {
-			skipFirst = false
+		if idx, err := parseSegmentIndex(filename); err == nil && (idx < w.firstIndex || idx > w.lastIndex || w.Uploaded(idx)) {
 			os.Remove(filepath.Join(w.tmpDir, filename))
 			continue
 		}
 
-		if err := w.uploadSegment(ctx, filename); err != nil {
-			w.setError(err)
-			w.cmd.Wait()
-			return
+		select {
+		case uploads <- filename:
+		case <-uploadCtx.Done():
+		}
+		if uploadCtx.Err() != nil {
+			break
 		}
 	}
 
+	if err := drain(); err != nil {
+		w.setError(err)
+		w.Kill()
+		w.cmd.Wait()
+		return
+	}
+
 	cmdErr := w.cmd.Wait()
 
 	w.mu.Lock()
@@ -130,37 +341,199 @@ func (w *Worker) run(ctx context.Context, stdout interface{}) {
 	w.state = WorkerStateDone
 }
 
+// uploadSegment writes one finished segment to storage. It returns the
+// context's error without writing once the job has been cancelled, since a
+// slow storage write can otherwise outlive the job by a long way.
 func (w *Worker) uploadSegment(ctx context.Context, filename string) error {
 	idx, err := parseSegmentIndex(filename)
 	if err != nil {
 		return nil
 	}
 
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
 	filePath := filepath.Join(w.tmpDir, filename)
 
+	if w.maxSize > 0 {
+		size, err := segmentMediaSize(filePath)
+		if err != nil {
+			return fmt.Errorf("stat segment file %s: %w", filename, err)
+		}
+		if size > w.maxSize {
+			return fmt.Errorf("segment %d is %d bytes, over the %d byte limit", idx, size, w.maxSize)
+		}
+	}
+
 	data, err := os.ReadFile(filePath)
 	if err != nil {
 		return fmt.Errorf("read segment file %s: %w", filename, err)
 	}
 
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if filepath.Ext(filename) == domain.ContainerFMP4.Extension() {
+		var init []byte
+		init, data = splitInitSegment(data)
+		if init != nil {
+			if err := w.writeInit(ctx, init); err != nil {
+				return err
+			}
+		}
+	}
+
 	info := domain.SegmentData{
 		SourceURL: w.sourceURL,
 		Index:     idx,
 		Rendition: w.rendition,
 		IsVideo:   w.isVideo,
+		Size:      int64(len(data)),
 	}
 
 	if err := w.storage.WriteSegment(ctx, info, data); err != nil {
 		return fmt.Errorf("write segment %d: %w", idx, err)
 	}
 
+	w.mu.Lock()
+	w.uploaded[idx] = true
+	w.mu.Unlock()
+
 	os.Remove(filePath)
 
 	return nil
 }
 
+// watchSegmentSizes checks the stored range's segments in the worker's
+// directory every sizeCheckInterval until ctx is done, returning an error
+// once one passes the size limit, so a runaway encode is stopped before it
+// finishes the segment.
+func (w *Worker) watchSegmentSizes(ctx context.Context) error {
+	ticker := time.NewTicker(sizeCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		entries, err := os.ReadDir(w.tmpDir)
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			idx, err := parseSegmentIndex(entry.Name())
+			if err != nil || idx < w.firstIndex || idx > w.lastIndex || w.Uploaded(idx) {
+				continue
+			}
+			size, err := segmentMediaSize(filepath.Join(w.tmpDir, entry.Name()))
+			if err != nil {
+				continue
+			}
+			if size > w.maxSize {
+				return fmt.Errorf("segment %d reached %d bytes while encoding, over the %d byte limit", idx, size, w.maxSize)
+			}
+		}
+	}
+}
+
+// segmentMediaSize returns the size of the segment file at path without
+// reading it, less the init section a fragmented MP4 segment may carry.
+func segmentMediaSize(path string) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	size := info.Size()
+	if filepath.Ext(path) == domain.ContainerFMP4.Extension() {
+		size -= initLength(f, size)
+	}
+	return size, nil
+}
+
+// writeInit stores the rendition's init segment the first time any of the
+// worker's uploads carries one.
+func (w *Worker) writeInit(ctx context.Context, init []byte) error {
+	w.initMu.Lock()
+	defer w.initMu.Unlock()
+
+	if w.wroteInit {
+		return nil
+	}
+	if w.inits == nil {
+		return fmt.Errorf("write init segment: storage does not implement InitSegmentStore")
+	}
+	streamType := domain.StreamAudio
+	if w.isVideo {
+		streamType = domain.StreamVideo
+	}
+	if err := w.inits.WriteInitSegment(ctx, w.sourceURL, w.rendition, streamType, init); err != nil {
+		return fmt.Errorf("write init segment: %w", err)
+	}
+	w.wroteInit = true
+	return nil
+}
+
+// splitInitSegment separates a self-initializing fragmented MP4 segment into
+// its initialization section (ftyp and moov) and its media section, which
+// starts at the first styp, sidx or moof box. Data without a moov before the
+// media is returned whole as media.
+func splitInitSegment(data []byte) (init, media []byte) {
+	n := initLength(bytes.NewReader(data), int64(len(data)))
+	if n == 0 {
+		return nil, data
+	}
+	return data[:n], data[n:]
+}
+
+// initLength returns the length of the initialization section at the start
+// of the size bytes in r, as split by splitInitSegment, reading only box
+// headers. It is zero when there is none.
+func initLength(r io.ReaderAt, size int64) int64 {
+	var sawMoov bool
+	var header [16]byte
+	offset := int64(0)
+	for offset+8 <= size {
+		if _, err := r.ReadAt(header[:8], offset); err != nil {
+			break
+		}
+		boxSize := uint64(binary.BigEndian.Uint32(header[:]))
+		switch string(header[4:8]) {
+		case "moov":
+			sawMoov = true
+		case "styp", "sidx", "moof":
+			if sawMoov {
+				return offset
+			}
+			return 0
+		}
+
+		if boxSize == 1 && offset+16 <= size {
+			if _, err := r.ReadAt(header[8:16], offset+8); err != nil {
+				break
+			}
+			boxSize = binary.BigEndian.Uint64(header[8:])
+		}
+		if boxSize < 8 || boxSize > uint64(size-offset) {
+			break
+		}
+		offset += int64(boxSize)
+	}
+	return 0
+}
+
 func parseSegmentIndex(filename string) (int, error) {
-	name := strings.TrimSuffix(filename, ".ts")
+	name := strings.TrimSuffix(filename, filepath.Ext(filename))
 	parts := strings.Split(name, "-")
 	if len(parts) < 2 {
 		return 0, fmt.Errorf("invalid segment filename: %s", filename)
@@ -184,12 +557,54 @@ func (w *Worker) State() WorkerState {
 	return w.state
 }
 
+// Done returns a channel that is closed once the worker reaches a terminal
+// state (WorkerStateDone or WorkerStateError).
+func (w *Worker) Done() <-chan struct{} {
+	return w.done
+}
+
+// Uploaded reports whether the segment with the given index was written to storage.
+func (w *Worker) Uploaded(index int) bool {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return w.uploaded[index]
+}
+
+// uploadedIndexes returns the indexes of every segment written to storage.
+func (w *Worker) uploadedIndexes() []int {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	indexes := make([]int, 0, len(w.uploaded))
+	for idx := range w.uploaded {
+		indexes = append(indexes, idx)
+	}
+	return indexes
+}
+
+// Speed returns ffmpeg's latest encode speed relative to realtime, as
+// reported through -progress. Once the worker is done it is the job's
+// overall speed. Zero means ffmpeg has not reported one.
+func (w *Worker) Speed() float64 {
+	return w.progress.Speed()
+}
+
 func (w *Worker) Err() error {
 	w.mu.RLock()
 	defer w.mu.RUnlock()
 	return w.err
 }
 
+// finish marks the worker as terminal, releasing anyone blocked on w.done.
+// Safe to call more than once.
+func (w *Worker) finish() {
+	w.doneOnce.Do(func() {
+		if w.input != nil {
+			w.input.Close()
+		}
+		close(w.done)
+	})
+}
+
 func (w *Worker) setError(err error) {
 	w.mu.Lock()
 	defer w.mu.Unlock()
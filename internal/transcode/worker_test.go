@@ -4,6 +4,10 @@ import (
 	"context"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -11,20 +15,43 @@ import (
 )
 
 type memoryStorage struct {
-	writes []domain.SegmentData
+	meta        []byte
+	writes      []domain.SegmentData
+	data        [][]byte
+	inits       [][]byte
+	failures    []domain.SegmentData
+	failureData map[int][]byte
+	onWrite     func()
+
+	mu sync.Mutex
 }
 
 func (m *memoryStorage) MetadataExists(ctx context.Context, sourceURL string) (bool, error) {
 	return false, nil
 }
 func (m *memoryStorage) GetMetadata(ctx context.Context, sourceURL string) ([]byte, error) {
-	return nil, nil
+	return m.meta, nil
 }
 func (m *memoryStorage) SetMetadata(ctx context.Context, sourceURL string, data []byte) error {
 	return nil
 }
+func (m *memoryStorage) WriteRawProbe(ctx context.Context, sourceURL string, data []byte) error {
+	return nil
+}
+func (m *memoryStorage) ReadRawProbe(ctx context.Context, sourceURL string) ([]byte, error) {
+	return nil, nil
+}
+func (m *memoryStorage) RawProbeExists(ctx context.Context, sourceURL string) (bool, error) {
+	return false, nil
+}
 func (m *memoryStorage) WriteSegment(ctx context.Context, info domain.SegmentData, data []byte) error {
+	m.mu.Lock()
 	m.writes = append(m.writes, info)
+	m.data = append(m.data, data)
+	m.mu.Unlock()
+	if m.onWrite != nil {
+		m.onWrite()
+	}
 	return nil
 }
 func (m *memoryStorage) ReadSegment(ctx context.Context, info domain.SegmentData) ([]byte, error) {
@@ -33,6 +60,31 @@ func (m *memoryStorage) ReadSegment(ctx context.Context, info domain.SegmentData
 func (m *memoryStorage) SegmentExists(ctx context.Context, info domain.SegmentData) (bool, error) {
 	return false, nil
 }
+func (m *memoryStorage) SegmentSize(ctx context.Context, info domain.SegmentData) (int64, error) {
+	return 0, nil
+}
+func (m *memoryStorage) WriteSegmentFailure(ctx context.Context, info domain.SegmentData, data []byte) error {
+	m.failures = append(m.failures, info)
+	if m.failureData == nil {
+		m.failureData = make(map[int][]byte)
+	}
+	m.failureData[info.Index] = data
+	return nil
+}
+func (m *memoryStorage) ReadSegmentFailure(ctx context.Context, info domain.SegmentData) ([]byte, error) {
+	return m.failureData[info.Index], nil
+}
+func (m *memoryStorage) SegmentFailureExists(ctx context.Context, info domain.SegmentData) (bool, error) {
+	_, ok := m.failureData[info.Index]
+	return ok, nil
+}
+func (m *memoryStorage) ReadSegmentFailures(ctx context.Context, sourceURL string, rendition string, streamType domain.StreamType) (map[int][]byte, error) {
+	return m.failureData, nil
+}
+func (m *memoryStorage) DeleteSegmentFailure(ctx context.Context, info domain.SegmentData) error {
+	delete(m.failureData, info.Index)
+	return nil
+}
 func (m *memoryStorage) WriteSprite(ctx context.Context, mediaID string, index int, data []byte) error {
 	return nil
 }
@@ -60,6 +112,58 @@ func (m *memoryStorage) ReadSubtitleVTT(ctx context.Context, mediaID string, lan
 func (m *memoryStorage) SubtitleVTTExists(ctx context.Context, mediaID string, lang string) (bool, error) {
 	return false, nil
 }
+func (m *memoryStorage) WriteIndex(ctx context.Context, sourceURL string, rendition string, streamType domain.StreamType, data []byte) error {
+	return nil
+}
+func (m *memoryStorage) ReadIndex(ctx context.Context, sourceURL string, rendition string, streamType domain.StreamType) ([]byte, error) {
+	return nil, nil
+}
+func (m *memoryStorage) IndexExists(ctx context.Context, sourceURL string, rendition string, streamType domain.StreamType) (bool, error) {
+	return false, nil
+}
+func (m *memoryStorage) ReadKeyframes(ctx context.Context, sourceURL string) ([]byte, error) {
+	return nil, nil
+}
+func (m *memoryStorage) KeyframesExists(ctx context.Context, sourceURL string) (bool, error) {
+	return false, nil
+}
+func (m *memoryStorage) WriteThumbnail(ctx context.Context, info domain.ThumbnailData, data []byte) error {
+	return nil
+}
+func (m *memoryStorage) ReadThumbnail(ctx context.Context, info domain.ThumbnailData) ([]byte, error) {
+	return nil, nil
+}
+func (m *memoryStorage) ThumbnailExists(ctx context.Context, info domain.ThumbnailData) (bool, error) {
+	return false, nil
+}
+func (m *memoryStorage) WritePoster(ctx context.Context, sourceURL string, data []byte) error {
+	return nil
+}
+func (m *memoryStorage) ReadPoster(ctx context.Context, sourceURL string) ([]byte, error) {
+	return nil, nil
+}
+func (m *memoryStorage) PosterExists(ctx context.Context, sourceURL string) (bool, error) {
+	return false, nil
+}
+func (m *memoryStorage) WriteSubtitleASS(ctx context.Context, sourceURL string, lang string, data []byte) error {
+	return nil
+}
+func (m *memoryStorage) ReadSubtitleASS(ctx context.Context, sourceURL string, lang string) ([]byte, error) {
+	return nil, nil
+}
+func (m *memoryStorage) SubtitleASSExists(ctx context.Context, sourceURL string, lang string) (bool, error) {
+	return false, nil
+}
+func (m *memoryStorage) WriteInitSegment(ctx context.Context, sourceURL string, rendition string, streamType domain.StreamType, data []byte) error {
+	m.inits = append(m.inits, data)
+	return nil
+}
+func (m *memoryStorage) ReadInitSegment(ctx context.Context, sourceURL string, rendition string, streamType domain.StreamType) ([]byte, error) {
+	return nil, nil
+}
+func (m *memoryStorage) InitSegmentExists(ctx context.Context, sourceURL string, rendition string, streamType domain.StreamType) (bool, error) {
+	return false, nil
+}
 
 func TestWorkerUploadsSegmentsAndSkipsFirstWhenConfigured(t *testing.T) {
 	tmp := t.TempDir()
@@ -82,7 +186,7 @@ func TestWorkerUploadsSegmentsAndSkipsFirstWhenConfigured(t *testing.T) {
 	_ = os.Setenv("PATH", tmp+string(os.PathListSeparator)+origPath)
 
 	storage := &memoryStorage{}
-	w := NewWorker([]string{"--emit", files[0], files[1]}, storage, "file:///source", "1080p", true, tmp, true)
+	w := NewWorker([]string{"--emit", files[0], files[1]}, storage, "file:///source", "1080p", true, tmp, 2)
 
 	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
 	defer cancel()
@@ -91,16 +195,10 @@ func TestWorkerUploadsSegmentsAndSkipsFirstWhenConfigured(t *testing.T) {
 		t.Fatalf("start failed: %v", err)
 	}
 
-	// wait for completion bounded by context deadline
-	for {
-		state := w.State()
-		if state == WorkerStateDone || state == WorkerStateError {
-			break
-		}
-		if ctx.Err() != nil {
-			t.Fatalf("worker did not finish before context deadline, state %v err %v", state, w.Err())
-		}
-		time.Sleep(10 * time.Millisecond)
+	select {
+	case <-w.Done():
+	case <-ctx.Done():
+		t.Fatalf("worker did not finish before context deadline, state %v err %v", w.State(), w.Err())
 	}
 
 	if w.State() != WorkerStateDone {
@@ -113,6 +211,9 @@ func TestWorkerUploadsSegmentsAndSkipsFirstWhenConfigured(t *testing.T) {
 	if storage.writes[0].Index != 2 || storage.writes[0].SourceURL != "file:///source" {
 		t.Fatalf("unexpected written segment info: %#v", storage.writes[0])
 	}
+	if storage.writes[0].Size != int64(len("data")) {
+		t.Fatalf("expected segment size to be recorded, got %d", storage.writes[0].Size)
+	}
 }
 
 const fakeFFmpegScript = `#!/bin/sh
@@ -123,6 +224,271 @@ if [ "$1" = "--emit" ]; then
   done
   exit 0
 fi
+if [ "$1" = "--grow" ]; then
+  head -c "$3" /dev/zero > "$2"
+  exec sleep 30
+fi
+if [ "$1" = "--pass1" ]; then
+  echo stats > "$2"
+  exit 0
+fi
+if [ "$1" = "--require" ]; then
+  [ -f "$2" ] || { echo "missing $2" >&2; exit 1; }
+  log="$2"
+  shift 2
+  exec "$0" "$@"
+fi
 echo "unexpected args: $@" >&2
 exit 1
 `
+
+func TestWorkerUploadsSegmentsInParallel(t *testing.T) {
+	tmp := t.TempDir()
+	if err := os.WriteFile(filepath.Join(tmp, "ffmpeg"), []byte(fakeFFmpegScript), 0755); err != nil {
+		t.Fatalf("write script: %v", err)
+	}
+	var files []string
+	for i := 0; i < 6; i++ {
+		name := "segment-0000" + strconv.Itoa(i) + ".ts"
+		if err := os.WriteFile(filepath.Join(tmp, name), []byte("data"), 0644); err != nil {
+			t.Fatalf("prime file: %v", err)
+		}
+		files = append(files, name)
+	}
+	t.Setenv("PATH", tmp+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	var inflight, peak atomic.Int32
+	storage := &memoryStorage{}
+	storage.onWrite = func() {
+		n := inflight.Add(1)
+		for {
+			p := peak.Load()
+			if n <= p || peak.CompareAndSwap(p, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		inflight.Add(-1)
+	}
+
+	w := NewWorker(append([]string{"--emit"}, files...), storage, "file:///source", "720p", true, tmp, 0)
+	w.SetUploadConcurrency(3)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := w.Start(ctx); err != nil {
+		t.Fatalf("start failed: %v", err)
+	}
+	<-w.Done()
+
+	if w.State() != WorkerStateDone {
+		t.Fatalf("worker did not finish, state %v err %v", w.State(), w.Err())
+	}
+	if len(storage.writes) != len(files) {
+		t.Fatalf("expected all %d segments written, got %d", len(files), len(storage.writes))
+	}
+	for i := range files {
+		if !w.Uploaded(i) {
+			t.Fatalf("segment %d not reported as uploaded", i)
+		}
+	}
+	if peak.Load() < 2 {
+		t.Fatalf("expected overlapping uploads, peak concurrency %d", peak.Load())
+	}
+}
+
+func TestWorkerFailsOversizedSegment(t *testing.T) {
+	tmp := t.TempDir()
+	if err := os.WriteFile(filepath.Join(tmp, "ffmpeg"), []byte(fakeFFmpegScript), 0755); err != nil {
+		t.Fatalf("write script: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(tmp, "segment-00000.ts"), []byte("data"), 0644); err != nil {
+		t.Fatalf("prime file: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(tmp, "segment-00001.ts"), make([]byte, 64), 0644); err != nil {
+		t.Fatalf("prime file: %v", err)
+	}
+	t.Setenv("PATH", tmp+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	storage := &memoryStorage{}
+	w := NewWorker([]string{"--emit", "segment-00000.ts", "segment-00001.ts"}, storage, "file:///source", "720p", true, tmp, 0)
+	w.SetMaxSegmentSize(16)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := w.Start(ctx); err != nil {
+		t.Fatalf("start failed: %v", err)
+	}
+	<-w.Done()
+
+	if w.State() != WorkerStateError || w.Err() == nil || !strings.Contains(w.Err().Error(), "segment 1 is 64 bytes, over the 16 byte limit") {
+		t.Fatalf("expected size limit error, state %v err %v", w.State(), w.Err())
+	}
+	if len(storage.writes) != 1 || storage.writes[0].Index != 0 {
+		t.Fatalf("expected only the small segment stored, got %#v", storage.writes)
+	}
+}
+
+func TestWorkerStopsFFmpegOnceASegmentBeingWrittenIsOversized(t *testing.T) {
+	tmp := t.TempDir()
+	if err := os.WriteFile(filepath.Join(tmp, "ffmpeg"), []byte(fakeFFmpegScript), 0755); err != nil {
+		t.Fatalf("write script: %v", err)
+	}
+	t.Setenv("PATH", tmp+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	storage := &memoryStorage{}
+	w := NewWorker([]string{"--grow", filepath.Join(tmp, "segment-00000.ts"), "64"}, storage, "file:///source", "720p", true, tmp, 0)
+	w.SetMaxSegmentSize(16)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := w.Start(ctx); err != nil {
+		t.Fatalf("start failed: %v", err)
+	}
+	select {
+	case <-w.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("ffmpeg was not stopped while writing an oversized segment")
+	}
+
+	if w.Err() == nil || !strings.Contains(w.Err().Error(), "segment 0 reached 64 bytes while encoding, over the 16 byte limit") {
+		t.Fatalf("expected size limit error, state %v err %v", w.State(), w.Err())
+	}
+	if len(storage.writes) != 0 {
+		t.Fatalf("expected nothing stored, got %#v", storage.writes)
+	}
+}
+
+func TestWorkerRunsFirstPassBeforeMainCommand(t *testing.T) {
+	tmp := t.TempDir()
+	if err := os.WriteFile(filepath.Join(tmp, "ffmpeg"), []byte(fakeFFmpegScript), 0755); err != nil {
+		t.Fatalf("write script: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(tmp, "segment-00000.ts"), []byte("data"), 0644); err != nil {
+		t.Fatalf("prime file: %v", err)
+	}
+	t.Setenv("PATH", tmp+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	passlog := filepath.Join(tmp, "passlog")
+	storage := &memoryStorage{}
+	w := NewWorker([]string{"--require", passlog, "--emit", "segment-00000.ts"}, storage, "file:///source", "720p", true, tmp, 0)
+	w.SetFirstPass([]string{"--pass1", passlog})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := w.Start(ctx); err != nil {
+		t.Fatalf("start failed: %v", err)
+	}
+	<-w.Done()
+
+	if w.State() != WorkerStateDone || len(storage.writes) != 1 {
+		t.Fatalf("expected second pass to run after the first, state %v err %v writes %d", w.State(), w.Err(), len(storage.writes))
+	}
+
+	failing := NewWorker([]string{"--emit", "segment-00000.ts"}, &memoryStorage{}, "file:///source", "720p", true, tmp, 0)
+	failing.SetFirstPass([]string{"--bogus"})
+	if err := failing.Start(ctx); err != nil {
+		t.Fatalf("start failed: %v", err)
+	}
+	<-failing.Done()
+	if failing.Err() == nil || !strings.Contains(failing.Err().Error(), "first pass") {
+		t.Fatalf("expected first pass failure, got %v", failing.Err())
+	}
+}
+
+func TestWorkerStopsUploadingOnceKilled(t *testing.T) {
+	tmp := t.TempDir()
+	if err := os.WriteFile(filepath.Join(tmp, "ffmpeg"), []byte(fakeFFmpegScript), 0755); err != nil {
+		t.Fatalf("write script: %v", err)
+	}
+	files := []string{"segment-00000.ts", "segment-00001.ts", "segment-00002.ts"}
+	for _, name := range files {
+		if err := os.WriteFile(filepath.Join(tmp, name), []byte("data"), 0644); err != nil {
+			t.Fatalf("prime file: %v", err)
+		}
+	}
+	t.Setenv("PATH", tmp+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	storage := &memoryStorage{}
+	w := NewWorker(append([]string{"--emit"}, files...), storage, "file:///source", "720p", true, tmp, 0)
+	storage.onWrite = w.Kill
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := w.Start(ctx); err != nil {
+		t.Fatalf("start failed: %v", err)
+	}
+	<-w.Done()
+
+	if len(storage.writes) != 1 {
+		t.Fatalf("expected uploads to stop after the kill, got %d writes", len(storage.writes))
+	}
+
+	cancelled, stop := context.WithCancel(context.Background())
+	stop()
+	if err := w.uploadSegment(cancelled, "segment-00002.ts"); err != context.Canceled {
+		t.Fatalf("expected context.Canceled before writing, got %v", err)
+	}
+	if len(storage.writes) != 1 {
+		t.Fatalf("cancelled upload must not reach storage")
+	}
+}
+
+func mp4Box(boxType string, payload string) string {
+	size := 8 + len(payload)
+	return string([]byte{byte(size >> 24), byte(size >> 16), byte(size >> 8), byte(size)}) + boxType + payload
+}
+
+func TestSplitInitSegment(t *testing.T) {
+	init := mp4Box("ftyp", "iso5") + mp4Box("moov", "trak")
+	media := mp4Box("moof", "traf") + mp4Box("mdat", "data")
+
+	gotInit, gotMedia := splitInitSegment([]byte(init + media))
+	if string(gotInit) != init || string(gotMedia) != media {
+		t.Fatalf("unexpected split: init %q media %q", gotInit, gotMedia)
+	}
+
+	gotInit, gotMedia = splitInitSegment([]byte(media))
+	if gotInit != nil || string(gotMedia) != media {
+		t.Fatalf("media-only segment must be returned whole, got init %q", gotInit)
+	}
+
+	gotInit, gotMedia = splitInitSegment([]byte("not mp4"))
+	if gotInit != nil || string(gotMedia) != "not mp4" {
+		t.Fatalf("unparseable data must be returned whole")
+	}
+}
+
+func TestWorkerSplitsInitFromFragmentedSegments(t *testing.T) {
+	tmp := t.TempDir()
+	if err := os.WriteFile(filepath.Join(tmp, "ffmpeg"), []byte(fakeFFmpegScript), 0755); err != nil {
+		t.Fatalf("write script: %v", err)
+	}
+	init := mp4Box("ftyp", "iso5") + mp4Box("moov", "trak")
+	files := []string{"segment-00000.m4s", "segment-00001.m4s"}
+	for i, name := range files {
+		media := mp4Box("moof", "traf") + mp4Box("mdat", strconv.Itoa(i))
+		if err := os.WriteFile(filepath.Join(tmp, name), []byte(init+media), 0644); err != nil {
+			t.Fatalf("prime file: %v", err)
+		}
+	}
+	t.Setenv("PATH", tmp+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	storage := &memoryStorage{}
+	w := NewWorker(append([]string{"--emit"}, files...), storage, "file:///source", "720p", true, tmp, 0)
+	w.SetInitStore(storage)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := w.Start(ctx); err != nil {
+		t.Fatalf("start failed: %v", err)
+	}
+	<-w.Done()
+
+	if len(storage.inits) != 1 || string(storage.inits[0]) != init {
+		t.Fatalf("expected one init segment upload, got %q", storage.inits)
+	}
+	if len(storage.data) != 2 || strings.HasPrefix(string(storage.data[1]), init) || storage.writes[1].Index != 1 {
+		t.Fatalf("expected media-only segments, got %q", storage.data)
+	}
+}
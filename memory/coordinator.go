@@ -0,0 +1,232 @@
+// Package memory provides an in-process Coordinator for single-instance
+// deployments and tests.
+package memory
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/eleven-am/goshl/internal/domain"
+)
+
+// DefaultReadyRetention is how long a Coordinator remembers that a segment
+// became ready, for waiters that subscribe just after the notification.
+const DefaultReadyRetention = time.Minute
+
+// DefaultQueueSize is the job buffer per stream type used when NewCoordinator
+// is given a non-positive size.
+const DefaultQueueSize = 1024
+
+// ErrClosed is returned by Enqueue once the Coordinator is closed.
+var ErrClosed = errors.New("memory: coordinator closed")
+
+var (
+	_ domain.Coordinator  = (*Coordinator)(nil)
+	_ domain.QueueDepther = (*Coordinator)(nil)
+)
+
+type segmentKey struct {
+	sourceURL string
+	rendition string
+	isVideo   bool
+	index     int
+}
+
+func keyOf(info domain.SegmentData) segmentKey {
+	return segmentKey{
+		sourceURL: info.SourceURL,
+		rendition: info.Rendition,
+		isVideo:   info.IsVideo,
+		index:     info.Index,
+	}
+}
+
+// Coordinator is an in-memory domain.Coordinator. Jobs are queued on a
+// buffered channel per stream type, shared by every subscriber of that type.
+//
+// NotifySegment delivers to every current waiter of the segment, however
+// many there are. A segment announced ready is remembered for
+// ReadyRetention, so a WaitSegment that arrives just after the notification
+// (for example between a storage miss and the subscription) still receives
+// it. Errors are delivered only to current waiters: a later wait usually
+// precedes a retry and must see that retry's outcome.
+type Coordinator struct {
+	// ReadyRetention is how long ready notifications are replayed to late
+	// waiters. Zero means DefaultReadyRetention. Set it before first use.
+	ReadyRetention time.Duration
+
+	mu      sync.Mutex
+	queues  map[domain.StreamType]chan domain.Job
+	waiters map[segmentKey]map[chan domain.SegmentStatus]func() bool
+	ready   map[segmentKey]time.Time
+	swept   time.Time
+	size    int
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewCoordinator returns a Coordinator whose job queues hold queueSize jobs
+// per stream type before Enqueue blocks. A non-positive size means
+// DefaultQueueSize.
+func NewCoordinator(queueSize int) *Coordinator {
+	if queueSize <= 0 {
+		queueSize = DefaultQueueSize
+	}
+	return &Coordinator{
+		queues:  make(map[domain.StreamType]chan domain.Job),
+		waiters: make(map[segmentKey]map[chan domain.SegmentStatus]func() bool),
+		ready:   make(map[segmentKey]time.Time),
+		size:    queueSize,
+		done:    make(chan struct{}),
+	}
+}
+
+func (c *Coordinator) queue(streamType domain.StreamType) chan domain.Job {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	q, ok := c.queues[streamType]
+	if !ok {
+		q = make(chan domain.Job, c.size)
+		c.queues[streamType] = q
+	}
+	return q
+}
+
+// Enqueue queues job for its stream type, blocking while the queue is full.
+func (c *Coordinator) Enqueue(ctx context.Context, job domain.Job) error {
+	select {
+	case <-c.done:
+		return ErrClosed
+	default:
+	}
+
+	select {
+	case c.queue(job.StreamType) <- job:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-c.done:
+		return ErrClosed
+	}
+}
+
+// Subscribe returns the job queue of streamType. The channel is never
+// closed; subscribers stop when their context ends.
+func (c *Coordinator) Subscribe(ctx context.Context, streamType domain.StreamType) (<-chan domain.Job, error) {
+	return c.queue(streamType), nil
+}
+
+// Ack is a no-op: jobs leave the queue when they are received.
+func (c *Coordinator) Ack(ctx context.Context, jobID string) error {
+	return nil
+}
+
+// QueueDepth reports how many jobs of streamType are waiting for a worker.
+func (c *Coordinator) QueueDepth(ctx context.Context, streamType domain.StreamType) (int, error) {
+	return len(c.queue(streamType)), nil
+}
+
+// NotifySegment delivers status to every current waiter of the segment.
+func (c *Coordinator) NotifySegment(ctx context.Context, info domain.SegmentData, status domain.SegmentStatus) error {
+	key := keyOf(info)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	if status.State == domain.SegmentStateReady {
+		c.ready[key] = now
+	} else {
+		delete(c.ready, key)
+	}
+	c.sweep(now)
+
+	for ch, stop := range c.waiters[key] {
+		// Each waiter channel has room for exactly one status and is
+		// removed as it is filled, so this never blocks.
+		ch <- status
+		stop()
+	}
+	delete(c.waiters, key)
+	return nil
+}
+
+// WaitSegment returns a channel that receives the segment's next status, or
+// its ready status at once if it was announced within ReadyRetention. The
+// wait is dropped when ctx ends.
+func (c *Coordinator) WaitSegment(ctx context.Context, info domain.SegmentData) (<-chan domain.SegmentStatus, error) {
+	key := keyOf(info)
+	ch := make(chan domain.SegmentStatus, 1)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if at, ok := c.ready[key]; ok && time.Since(at) < c.retention() {
+		ch <- domain.SegmentStatus{State: domain.SegmentStateReady}
+		return ch, nil
+	}
+
+	waiters, ok := c.waiters[key]
+	if !ok {
+		waiters = make(map[chan domain.SegmentStatus]func() bool)
+		c.waiters[key] = waiters
+	}
+	waiters[ch] = context.AfterFunc(ctx, func() { c.dropWaiter(key, ch) })
+	return ch, nil
+}
+
+func (c *Coordinator) dropWaiter(key segmentKey, ch chan domain.SegmentStatus) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	waiters := c.waiters[key]
+	delete(waiters, ch)
+	if len(waiters) == 0 {
+		delete(c.waiters, key)
+	}
+}
+
+// Waiters returns how many WaitSegment calls are currently registered across
+// all segments.
+func (c *Coordinator) Waiters() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	n := 0
+	for _, waiters := range c.waiters {
+		n += len(waiters)
+	}
+	return n
+}
+
+// sweep forgets expired ready notifications, at most once per retention
+// period. The caller holds c.mu.
+func (c *Coordinator) sweep(now time.Time) {
+	retention := c.retention()
+	if now.Sub(c.swept) < retention {
+		return
+	}
+	c.swept = now
+	for key, at := range c.ready {
+		if now.Sub(at) >= retention {
+			delete(c.ready, key)
+		}
+	}
+}
+
+func (c *Coordinator) retention() time.Duration {
+	if c.ReadyRetention > 0 {
+		return c.ReadyRetention
+	}
+	return DefaultReadyRetention
+}
+
+// Close makes pending and later Enqueue calls fail with ErrClosed. It is safe
+// to call more than once.
+func (c *Coordinator) Close() {
+	c.closeOnce.Do(func() { close(c.done) })
+}
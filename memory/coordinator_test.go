@@ -0,0 +1,143 @@
+package memory
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/eleven-am/goshl/internal/domain"
+)
+
+var seg = domain.SegmentData{SourceURL: "file:///media", Rendition: "720p", IsVideo: true, Index: 3}
+
+func TestNotifySegmentReachesEveryWaiter(t *testing.T) {
+	c := NewCoordinator(0)
+	ctx := context.Background()
+
+	const waiters = 100
+	var ready sync.WaitGroup
+	var got sync.WaitGroup
+	var mu sync.Mutex
+	received := 0
+	for i := 0; i < waiters; i++ {
+		ready.Add(1)
+		got.Add(1)
+		go func() {
+			defer got.Done()
+			ch, err := c.WaitSegment(ctx, seg)
+			ready.Done()
+			if err != nil {
+				t.Errorf("wait err: %v", err)
+				return
+			}
+			select {
+			case status := <-ch:
+				if status.State == domain.SegmentStateReady {
+					mu.Lock()
+					received++
+					mu.Unlock()
+				}
+			case <-time.After(time.Second):
+			}
+		}()
+	}
+	ready.Wait()
+
+	if err := c.NotifySegment(ctx, seg, domain.SegmentStatus{State: domain.SegmentStateReady}); err != nil {
+		t.Fatalf("notify err: %v", err)
+	}
+	got.Wait()
+
+	if received != waiters {
+		t.Fatalf("expected all %d waiters to see the notification, got %d", waiters, received)
+	}
+	if n := c.Waiters(); n != 0 {
+		t.Fatalf("expected notified waiters to be released, got %d", n)
+	}
+}
+
+func TestLateWaiterSeesReadyButNotError(t *testing.T) {
+	c := NewCoordinator(0)
+	ctx := context.Background()
+
+	c.NotifySegment(ctx, seg, domain.SegmentStatus{State: domain.SegmentStateReady})
+	ch, _ := c.WaitSegment(ctx, seg)
+	select {
+	case status := <-ch:
+		if status.State != domain.SegmentStateReady {
+			t.Fatalf("expected ready, got %#v", status)
+		}
+	default:
+		t.Fatal("late waiter must see the ready notification")
+	}
+
+	other := seg
+	other.Index = 4
+	c.NotifySegment(ctx, other, domain.SegmentStatus{State: domain.SegmentStateError, Error: "boom"})
+	ch, _ = c.WaitSegment(ctx, other)
+	select {
+	case status := <-ch:
+		t.Fatalf("an old error must not be replayed to a retry, got %#v", status)
+	default:
+	}
+}
+
+func TestReadyRetentionExpires(t *testing.T) {
+	c := NewCoordinator(0)
+	c.ReadyRetention = time.Millisecond
+	ctx := context.Background()
+
+	c.NotifySegment(ctx, seg, domain.SegmentStatus{State: domain.SegmentStateReady})
+	time.Sleep(5 * time.Millisecond)
+
+	ch, _ := c.WaitSegment(ctx, seg)
+	select {
+	case status := <-ch:
+		t.Fatalf("expired notification replayed: %#v", status)
+	default:
+	}
+}
+
+func TestWaitSegmentDroppedWhenContextEnds(t *testing.T) {
+	c := NewCoordinator(0)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	c.WaitSegment(ctx, seg)
+	if n := c.Waiters(); n != 1 {
+		t.Fatalf("expected one waiter, got %d", n)
+	}
+	cancel()
+
+	deadline := time.Now().Add(time.Second)
+	for c.Waiters() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("cancelled waiter was not released")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestEnqueueSubscribeAndClose(t *testing.T) {
+	c := NewCoordinator(1)
+	ctx := context.Background()
+
+	jobs, _ := c.Subscribe(ctx, domain.StreamAudio)
+	if err := c.Enqueue(ctx, domain.Job{ID: "a", StreamType: domain.StreamAudio}); err != nil {
+		t.Fatalf("enqueue err: %v", err)
+	}
+	if depth, _ := c.QueueDepth(ctx, domain.StreamAudio); depth != 1 {
+		t.Fatalf("expected depth 1, got %d", depth)
+	}
+	if job := <-jobs; job.ID != "a" {
+		t.Fatalf("unexpected job %#v", job)
+	}
+
+	c.Enqueue(ctx, domain.Job{ID: "b", StreamType: domain.StreamAudio})
+	c.Close()
+	c.Close()
+	if err := c.Enqueue(ctx, domain.Job{ID: "c", StreamType: domain.StreamAudio}); !errors.Is(err, ErrClosed) {
+		t.Fatalf("expected ErrClosed on a full queue after Close, got %v", err)
+	}
+}